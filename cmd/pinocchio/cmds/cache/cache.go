@@ -0,0 +1,133 @@
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/spf13/cobra"
+	"github.com/wesen/geppetto/pkg/cache"
+	"github.com/wesen/glazed/pkg/cli"
+	"os"
+	"time"
+)
+
+var CacheCmd = &cobra.Command{
+	Use:   "cache",
+	Short: "Inspect and prune the cache of completions (see --cache)",
+}
+
+func loadStore(cmd *cobra.Command) *cache.Store {
+	directory, _ := cmd.Flags().GetString("directory")
+	if directory == "" {
+		var err error
+		directory, err = cache.DefaultDirectory()
+		cobra.CheckErr(err)
+	}
+	return cache.NewStore(directory)
+}
+
+// cachedRequest is the part of a cached completion request shown by ls.
+type cachedRequest struct {
+	Backend  string `json:"backend"`
+	Engine   string `json:"engine"`
+	Prompt   string `json:"prompt"`
+	Settings struct {
+		Temperature *float32 `json:"temperature"`
+	} `json:"settings"`
+}
+
+var ListCmd = &cobra.Command{
+	Use:   "ls",
+	Short: "List the cached completions, newest first",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		entries, err := loadStore(cmd).List()
+		cobra.CheckErr(err)
+
+		gp, of, err := cli.SetupProcessor(cmd)
+		cobra.CheckErr(err)
+
+		for _, entry := range entries {
+			request := &cachedRequest{}
+			b, err := json.Marshal(entry.Request)
+			cobra.CheckErr(err)
+			// entries cached by other versions are still listed
+			_ = json.Unmarshal(b, request)
+
+			key := entry.Key
+			if len(key) > 12 {
+				key = key[:12]
+			}
+			row := map[string]interface{}{
+				"key":         key,
+				"created":     entry.Created.Local().Format("2006-01-02 15:04:05"),
+				"age":         time.Since(entry.Created).Round(time.Second).String(),
+				"backend":     request.Backend,
+				"engine":      request.Engine,
+				"temperature": "",
+				"prompt":      request.Prompt,
+				"bytes":       len(entry.Value),
+			}
+			if request.Settings.Temperature != nil {
+				row["temperature"] = *request.Settings.Temperature
+			}
+			err = gp.ProcessInputObject(row)
+			cobra.CheckErr(err)
+		}
+
+		s, err := of.Output()
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "Error rendering output: %s\n", err)
+			os.Exit(1)
+		}
+		fmt.Print(s)
+	},
+}
+
+var ShowCmd = &cobra.Command{
+	Use:   "show <key>",
+	Short: "Show the request and the cached response of a completion, by key or key prefix",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		entry, err := loadStore(cmd).Load(args[0])
+		cobra.CheckErr(err)
+
+		b, err := json.MarshalIndent(entry, "", "  ")
+		cobra.CheckErr(err)
+		fmt.Println(string(b))
+	},
+}
+
+var PruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "Remove the cached completions older than --older-than, or all of them with --all",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		olderThan, _ := cmd.Flags().GetDuration("older-than")
+		all, _ := cmd.Flags().GetBool("all")
+		if olderThan == 0 && !all {
+			cobra.CheckErr(fmt.Errorf("either --older-than or --all is required"))
+		}
+		if all {
+			olderThan = 0
+		}
+
+		removed, err := loadStore(cmd).Prune(olderThan)
+		cobra.CheckErr(err)
+		fmt.Printf("Removed %d cached completions\n", removed)
+	},
+}
+
+func init() {
+	CacheCmd.PersistentFlags().String("directory", "", "Directory of the cache (default: $XDG_CACHE_HOME/pinocchio/completions)")
+
+	defaults := cli.NewFlagsDefaults()
+	defaults.FieldsFilter.Fields = "key,created,age,backend,engine,temperature,bytes,prompt"
+	cli.AddFlags(ListCmd, defaults)
+	CacheCmd.AddCommand(ListCmd)
+
+	CacheCmd.AddCommand(ShowCmd)
+
+	PruneCmd.Flags().Duration("older-than", 0, "Remove the completions cached longer ago than this, for example 168h")
+	PruneCmd.Flags().Bool("all", false, "Remove all the cached completions")
+	CacheCmd.AddCommand(PruneCmd)
+}
@@ -0,0 +1,78 @@
+package chunk
+
+import (
+	"context"
+	"fmt"
+	"github.com/spf13/cobra"
+	"github.com/wesen/geppetto/pkg/chunking"
+	"github.com/wesen/geppetto/pkg/steps"
+	"github.com/wesen/glazed/pkg/cli"
+	"os"
+)
+
+var ChunkCmd = &cobra.Command{
+	Use:   "chunk <files...>",
+	Short: "Split documents into chunks, output as rows",
+	Long: "Split documents into chunks, by markdown heading, paragraph, token count or code function,\n" +
+		"and output a row per chunk. The JSON output can be used as the multi_input of a command\n" +
+		"to run a prompt per chunk.",
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		settings, err := chunking.NewSettingsFromCobra(cmd)
+		cobra.CheckErr(err)
+
+		gp, of, err := cli.SetupProcessor(cmd)
+		cobra.CheckErr(err)
+
+		ctx := context.Background()
+		for _, file := range args {
+			path := file
+			if file == "-" {
+				path = "/dev/stdin"
+			}
+			b, err := os.ReadFile(path)
+			cobra.CheckErr(err)
+
+			chunker, err := chunking.NewChunker(settings, file)
+			cobra.CheckErr(err)
+			s := steps.NewChunkStep(chunker)
+			go func() {
+				_ = s.Run(ctx, string(b))
+			}()
+			result := <-s.GetOutput()
+			chunks, err := result.Value()
+			cobra.CheckErr(err)
+
+			for _, chunk := range chunks {
+				row := map[string]interface{}{
+					"source": file,
+					"chunk":  chunk.Index,
+					"title":  chunk.Title,
+					"start":  chunk.Start,
+					"end":    chunk.End,
+					"tokens": chunk.Tokens,
+					"text":   chunk.Text,
+				}
+				err = gp.ProcessInputObject(row)
+				cobra.CheckErr(err)
+			}
+		}
+
+		s, err := of.Output()
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "Error rendering output: %s\n", err)
+			os.Exit(1)
+		}
+		fmt.Print(s)
+	},
+}
+
+func init() {
+	chunking.AddFlags(ChunkCmd, &chunking.Settings{
+		Strategy: chunking.StrategyParagraph,
+	})
+
+	defaults := cli.NewFlagsDefaults()
+	defaults.FieldsFilter.Fields = "source,chunk,title,start,end,tokens,text"
+	cli.AddFlags(ChunkCmd, defaults)
+}
@@ -0,0 +1,222 @@
+package embeddings
+
+import (
+	"context"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"github.com/wesen/geppetto/pkg/chunking"
+	geppetto_embeddings "github.com/wesen/geppetto/pkg/embeddings"
+	"github.com/wesen/geppetto/pkg/steps/openai"
+	geppetto_usage "github.com/wesen/geppetto/pkg/usage"
+	"github.com/wesen/glazed/pkg/cli"
+	"os"
+	"strings"
+)
+
+var EmbeddingsCmd = &cobra.Command{
+	Use:   "embeddings",
+	Short: "Index documents as embeddings and search them semantically",
+}
+
+func openIndex(cmd *cobra.Command) *geppetto_embeddings.Index {
+	directory, _ := cmd.Flags().GetString("directory")
+	if directory == "" {
+		name, _ := cmd.Flags().GetString("index")
+		var err error
+		directory, err = geppetto_embeddings.DefaultDirectory(name)
+		cobra.CheckErr(err)
+	}
+	index, err := geppetto_embeddings.Open(directory)
+	cobra.CheckErr(err)
+	return index
+}
+
+// newEmbedder creates an embedder for model from the client flags.
+func newEmbedder(cmd *cobra.Command, model string) *geppetto_embeddings.Embedder {
+	clientSettings, err := openai.NewClientSettingsFromCobra(cmd)
+	cobra.CheckErr(err)
+	clientSettings.UsageTracker = geppetto_usage.NewTracker()
+
+	backend, err := clientSettings.CreateBackend()
+	cobra.CheckErr(err)
+
+	batchSize, _ := cmd.Flags().GetInt("batch-size")
+	user, _ := cmd.Flags().GetString("user")
+	return &geppetto_embeddings.Embedder{
+		Backend:      backend,
+		Model:        model,
+		BatchSize:    batchSize,
+		User:         user,
+		UsageTracker: clientSettings.UsageTracker,
+	}
+}
+
+func logUsage(cmd *cobra.Command, tracker *geppetto_usage.Tracker) {
+	printUsage, _ := cmd.Flags().GetBool("print-usage")
+	for _, total := range tracker.Totals() {
+		evt := log.Debug()
+		if printUsage {
+			evt = log.Info()
+		}
+		evt.
+			Str("model", total.Model).
+			Int("requests", total.Requests).
+			Int("prompt-tokens", total.PromptTokens).
+			Float64("cost", total.Cost).
+			Msg("Usage")
+	}
+}
+
+var IndexCmd = &cobra.Command{
+	Use:   "index <files...>",
+	Short: "Chunk files, embed the chunks and store them in the index",
+	Long: "Chunk files, embed the chunks and store them in the index.\n" +
+		"Files already indexed are embedded again only if their content changed.",
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		index := openIndex(cmd)
+
+		model, _ := cmd.Flags().GetString("model")
+		if index.Metadata.Model != "" && index.Metadata.Model != model {
+			if cmd.Flags().Changed("model") {
+				cobra.CheckErr(fmt.Errorf("the index %s uses the model %s, not %s",
+					index.Directory, index.Metadata.Model, model))
+			}
+			model = index.Metadata.Model
+		}
+		chunkSettings, err := chunking.NewSettingsFromCobra(cmd)
+		cobra.CheckErr(err)
+		if chunkSettings.Model == "" {
+			chunkSettings.Model = model
+		}
+
+		chunks := []*geppetto_embeddings.Chunk{}
+		skipped, removed := 0, 0
+		for _, file := range args {
+			b, err := os.ReadFile(file)
+			cobra.CheckErr(err)
+			content := string(b)
+
+			hash := geppetto_embeddings.HashSource(content)
+			if indexedHash, ok := index.SourceHash(file); ok {
+				if indexedHash == hash {
+					log.Debug().Str("file", file).Msg("file unchanged, skipping")
+					skipped++
+					continue
+				}
+				removed += index.RemoveSource(file)
+			}
+
+			chunker, err := chunking.NewChunker(chunkSettings, file)
+			cobra.CheckErr(err)
+			fileChunks, err := chunker.Chunk(content)
+			cobra.CheckErr(err)
+			for _, chunk := range fileChunks {
+				chunks = append(chunks, &geppetto_embeddings.Chunk{
+					Source:     file,
+					Index:      chunk.Index,
+					Title:      chunk.Title,
+					Start:      chunk.Start,
+					End:        chunk.End,
+					Text:       chunk.Text,
+					SourceHash: hash,
+				})
+			}
+		}
+
+		embedder := newEmbedder(cmd, model)
+		texts := make([]string, len(chunks))
+		for i, chunk := range chunks {
+			texts[i] = chunk.Text
+		}
+		vectors, err := embedder.Embed(context.Background(), texts)
+		cobra.CheckErr(err)
+
+		err = index.Add(model, chunks, vectors)
+		cobra.CheckErr(err)
+		err = index.Save()
+		cobra.CheckErr(err)
+
+		logUsage(cmd, embedder.UsageTracker)
+		fmt.Printf("Indexed %d chunks from %d files (%d unchanged files skipped, %d stale chunks removed), %d chunks in %s\n",
+			len(chunks), len(args)-skipped, skipped, removed, len(index.Chunks), index.Directory)
+	},
+}
+
+var SearchCmd = &cobra.Command{
+	Use:   "search <query>",
+	Short: "Search the index for the chunks most similar to the query",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		index := openIndex(cmd)
+		if len(index.Chunks) == 0 {
+			cobra.CheckErr(fmt.Errorf("the index %s is empty, add files with embeddings index", index.Directory))
+		}
+
+		embedder := newEmbedder(cmd, index.Metadata.Model)
+		vectors, err := embedder.Embed(context.Background(), []string{args[0]})
+		cobra.CheckErr(err)
+		logUsage(cmd, embedder.UsageTracker)
+
+		topK, _ := cmd.Flags().GetInt("top-k")
+		results, err := index.Search(vectors[0], topK)
+		cobra.CheckErr(err)
+
+		gp, of, err := cli.SetupProcessor(cmd)
+		cobra.CheckErr(err)
+
+		for i, result := range results {
+			row := map[string]interface{}{
+				"rank":   i + 1,
+				"score":  result.Score,
+				"source": result.Chunk.Source,
+				"chunk":  result.Chunk.Index,
+				"title":  result.Chunk.Title,
+				"start":  result.Chunk.Start,
+				"end":    result.Chunk.End,
+				"text":   strings.ReplaceAll(result.Chunk.Text, "\n", "\\n"),
+			}
+			err = gp.ProcessInputObject(row)
+			cobra.CheckErr(err)
+		}
+
+		s, err := of.Output()
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "Error rendering output: %s\n", err)
+			os.Exit(1)
+		}
+		fmt.Print(s)
+	},
+}
+
+func init() {
+	EmbeddingsCmd.PersistentFlags().String("index", "default", "Name of the index, stored in $XDG_DATA_HOME/pinocchio/embeddings")
+	EmbeddingsCmd.PersistentFlags().String("directory", "", "Directory of the index (overrides --index)")
+	EmbeddingsCmd.PersistentFlags().Int("batch-size", geppetto_embeddings.DefaultBatchSize, "Maximum number of texts per embeddings request")
+	EmbeddingsCmd.PersistentFlags().Bool("print-usage", false, "print usage")
+
+	EmbeddingsCmd.PersistentFlags().Int("timeout", 60, "timeout in seconds")
+	EmbeddingsCmd.PersistentFlags().String("organization", "", "organization to use")
+	EmbeddingsCmd.PersistentFlags().String("user-agent", "Geppetto", "user agent to use")
+	EmbeddingsCmd.PersistentFlags().String("base-url", "https://api.openai.com/v1", "base url to use")
+	EmbeddingsCmd.PersistentFlags().String("default-engine", "", "default engine to use")
+	EmbeddingsCmd.PersistentFlags().String("user", "", "user (hash) to use")
+	EmbeddingsCmd.PersistentFlags().Int("max-retries", 0, "retry failed requests (rate limits, server errors) up to this many times")
+	EmbeddingsCmd.PersistentFlags().Int("requests-per-minute", 0, "maximum number of requests per minute (0 for no limit)")
+	EmbeddingsCmd.PersistentFlags().Int("tokens-per-minute", 0, "maximum number of tokens per minute (0 for no limit)")
+	EmbeddingsCmd.PersistentFlags().Int("max-in-flight", 0, "maximum number of concurrent requests (0 for no limit)")
+
+	IndexCmd.Flags().String("model", geppetto_embeddings.DefaultModel, "Embeddings model (the model of the index if it isn't empty)")
+	chunking.AddFlags(IndexCmd, &chunking.Settings{
+		Strategy:  chunking.StrategyParagraph,
+		MaxTokens: chunking.DefaultTokens,
+	})
+	EmbeddingsCmd.AddCommand(IndexCmd)
+
+	SearchCmd.Flags().Int("top-k", 5, "Number of chunks returned")
+	defaults := cli.NewFlagsDefaults()
+	defaults.FieldsFilter.Fields = "rank,score,source,chunk,title,start,end,text"
+	cli.AddFlags(SearchCmd, defaults)
+	EmbeddingsCmd.AddCommand(SearchCmd)
+}
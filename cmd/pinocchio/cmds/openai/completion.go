@@ -4,12 +4,18 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"github.com/PullRequestInc/go-gpt3"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
+	"github.com/wesen/geppetto/pkg/backends"
 	"github.com/wesen/geppetto/pkg/steps/openai"
+	geppetto_usage "github.com/wesen/geppetto/pkg/usage"
 	"github.com/wesen/glazed/pkg/cli"
+	"github.com/wesen/glazed/pkg/middlewares"
+	"github.com/wesen/glazed/pkg/types"
+	"math"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
 )
 
@@ -18,7 +24,10 @@ var completionStepFactory *openai.CompletionStepFactory
 var CompletionCmd = &cobra.Command{
 	Use:   "completion",
 	Short: "send a prompt to the completion API",
-	Args:  cobra.MinimumNArgs(1),
+	Long: "Send the content of each file as a prompt to the completion API.\n" +
+		"Each prompt is sent as a separate request, through the rate limits and retries\n" +
+		"of the client, instead of batching all the prompts in a single request.",
+	Args: cobra.MinimumNArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
 		prompts := []string{}
 
@@ -43,7 +52,8 @@ var CompletionCmd = &cobra.Command{
 		err = completionStepFactory.UpdateFromCobra(cmd)
 		cobra.CheckErr(err)
 
-		client, err := clientSettings.CreateClient()
+		// the backend retries failed requests and sends the completions with the HTTP API
+		backend, err := clientSettings.CreateBackend()
 		cobra.CheckErr(err)
 
 		ctx := context.Background()
@@ -51,29 +61,39 @@ var CompletionCmd = &cobra.Command{
 		if settings.Engine == nil {
 			cobra.CheckErr(fmt.Errorf("engine is required"))
 		}
-		resp, err := client.CompletionWithEngine(ctx, *settings.Engine,
-			gpt3.CompletionRequest{
-				Prompt:           prompts,
-				MaxTokens:        settings.MaxResponseTokens,
-				Temperature:      settings.Temperature,
-				TopP:             settings.TopP,
-				N:                settings.N,
-				LogProbs:         settings.LogProbs,
-				Echo:             false,
-				Stop:             settings.Stop,
-				PresencePenalty:  0,
-				FrequencyPenalty: 0,
-				Stream:           false,
-			},
-		)
-		cobra.CheckErr(err)
+		logProbsOutput, _ := cmd.Flags().GetBool("logprobs-output")
+		if logProbsOutput && settings.LogProbs == nil {
+			// 0 returns the logprobs of the sampled tokens, without alternatives
+			logProbs := 0
+			settings.LogProbs = &logProbs
+		}
+		responses := []*backends.CompletionResponse{}
+		usage := backends.Usage{}
+		// one request per prompt, since backends.CompletionRequest has a single prompt
+		for _, prompt := range prompts {
+			request, err := openai.NewCompletionRequest(settings, *settings.Engine, prompt)
+			cobra.CheckErr(err)
+			resp, err := backend.Complete(ctx, request)
+			cobra.CheckErr(err)
+			responses = append(responses, resp)
+			usage.PromptTokens += resp.Usage.PromptTokens
+			usage.CompletionTokens += resp.Usage.CompletionTokens
+			usage.TotalTokens += resp.Usage.TotalTokens
+		}
 
 		printUsage, _ := cmd.Flags().GetBool("print-usage")
-		usage := resp.Usage
 		evt := log.Debug()
 		if printUsage {
 			evt = log.Info()
 		}
+		cost, ok := geppetto_usage.Usage{
+			Model:            *settings.Engine,
+			PromptTokens:     usage.PromptTokens,
+			CompletionTokens: usage.CompletionTokens,
+		}.Cost()
+		if ok {
+			evt = evt.Float64("cost", cost)
+		}
 		evt.
 			Int("prompt-tokens", usage.PromptTokens).
 			Int("completion-tokens", usage.CompletionTokens).
@@ -82,57 +102,73 @@ var CompletionCmd = &cobra.Command{
 
 		gp, of, err := cli.SetupProcessor(cmd)
 		cobra.CheckErr(err)
+		if !cmd.Flags().Changed("fields") {
+			columns := []types.FieldName{"prompt", "index", "rank", "mean_logprob", "min_logprob", "perplexity", "tokens", "text", "finish_reason", "engine"}
+			if logProbsOutput {
+				columns = []types.FieldName{"prompt", "choice", "position", "token", "logprob", "probability", "top_logprobs"}
+			}
+			of.AddTableMiddleware(middlewares.NewReorderColumnOrderMiddleware(columns))
+		}
 
 		printRawResponse, _ := cmd.Flags().GetBool("print-raw-response")
 
 		if printRawResponse {
-			// serialize resp to json
-			rawResponse, err := json.MarshalIndent(resp, "", "  ")
-			cobra.CheckErr(err)
-
-			// deserialize to map[string]interface{}
-			var rawResponseMap map[string]interface{}
-			err = json.Unmarshal(rawResponse, &rawResponseMap)
-			cobra.CheckErr(err)
-
-			err = gp.ProcessInputObject(rawResponseMap)
-			cobra.CheckErr(err)
-
-		} else {
-			for i, choice := range resp.Choices {
-				logProbs := map[string]interface{}{}
-
-				logProbJson, err := json.MarshalIndent(choice.LogProbs, "", "  ")
+			for _, resp := range responses {
+				// serialize resp to json
+				rawResponse, err := json.MarshalIndent(resp, "", "  ")
 				cobra.CheckErr(err)
 
 				// deserialize to map[string]interface{}
-				var logProbMap map[string]interface{}
-				err = json.Unmarshal(logProbJson, &logProbMap)
+				var rawResponseMap map[string]interface{}
+				err = json.Unmarshal(rawResponse, &rawResponseMap)
 				cobra.CheckErr(err)
 
-				idx := i / len(resp.Choices)
-				prompt := ""
-				if len(prompts) > idx {
-					prompt = prompts[idx]
+				err = gp.ProcessInputObject(rawResponseMap)
+				cobra.CheckErr(err)
+			}
+
+		} else if logProbsOutput {
+			for idx, resp := range responses {
+				for _, choice := range resp.Choices {
+					for _, row := range logProbRows(choice) {
+						row["prompt"] = idx
+						err = gp.ProcessInputObject(row)
+						cobra.CheckErr(err)
+					}
 				}
+			}
 
-				// escape newline in response
-				text := strings.Trim(choice.Text, " \t\n")
-				text = strings.ReplaceAll(text, "\n", "\\n")
-				prompt = strings.Trim(prompt, " \t\n")
-				prompt = strings.ReplaceAll(prompt, "\n", "\\n")
-				// trim whitespace
-
-				row := map[string]interface{}{
-					"index":         choice.Index,
-					"text":          text,
-					"logprobs":      logProbs,
-					"prompt":        prompt,
-					"finish_reason": choice.FinishReason,
-					"engine":        *settings.Engine,
+		} else {
+			for idx, resp := range responses {
+				ranks := rankChoices(resp.Choices)
+				for _, choice := range resp.Choices {
+					prompt := prompts[idx]
+
+					// escape newline in response
+					text := strings.Trim(choice.Text, " \t\n")
+					text = strings.ReplaceAll(text, "\n", "\\n")
+					prompt = strings.Trim(prompt, " \t\n")
+					prompt = strings.ReplaceAll(prompt, "\n", "\\n")
+					// trim whitespace
+
+					row := map[string]interface{}{
+						"index":         choice.Index,
+						"text":          text,
+						"prompt":        prompt,
+						"finish_reason": choice.FinishReason,
+						"engine":        *settings.Engine,
+					}
+					if choice.LogProbs != nil {
+						metrics := choice.LogProbs.Metrics()
+						row["tokens"] = metrics.Tokens
+						row["mean_logprob"] = metrics.MeanLogProb
+						row["min_logprob"] = metrics.MinLogProb
+						row["perplexity"] = metrics.Perplexity
+						row["rank"] = ranks[choice.Index]
+					}
+					err = gp.ProcessInputObject(row)
+					cobra.CheckErr(err)
 				}
-				err = gp.ProcessInputObject(row)
-				cobra.CheckErr(err)
 			}
 		}
 
@@ -145,3 +181,54 @@ var CompletionCmd = &cobra.Command{
 		cobra.CheckErr(err)
 	},
 }
+
+// logProbRows returns a row per token of the choice, with its logprob and the most likely alternatives.
+func logProbRows(choice backends.CompletionChoice) []map[string]interface{} {
+	ret := []map[string]interface{}{}
+	if choice.LogProbs == nil {
+		return ret
+	}
+	logProbs := choice.LogProbs
+	for i, token := range logProbs.Tokens {
+		row := map[string]interface{}{
+			"choice":   choice.Index,
+			"position": i,
+			"token":    strings.ReplaceAll(token, "\n", "\\n"),
+		}
+		if i < len(logProbs.TokenLogProbs) && logProbs.TokenLogProbs[i] != nil {
+			row["logprob"] = *logProbs.TokenLogProbs[i]
+			row["probability"] = math.Exp(float64(*logProbs.TokenLogProbs[i]))
+		}
+		if i < len(logProbs.TextOffset) {
+			row["text_offset"] = logProbs.TextOffset[i]
+		}
+		alternatives := []string{}
+		for _, alternative := range logProbs.TopAlternatives(i) {
+			alternatives = append(alternatives,
+				fmt.Sprintf("%s=%.3f", strconv.Quote(alternative.Token), alternative.LogProb))
+		}
+		row["top_logprobs"] = strings.Join(alternatives, " ")
+		ret = append(ret, row)
+	}
+	return ret
+}
+
+// rankChoices ranks the choices returned with logprobs by their mean logprob, the most confident
+// choice has rank 1. It returns the rank of each choice index.
+func rankChoices(choices []backends.CompletionChoice) map[int]int {
+	ranked := []backends.CompletionChoice{}
+	for _, choice := range choices {
+		if choice.LogProbs != nil {
+			ranked = append(ranked, choice)
+		}
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return ranked[i].LogProbs.Metrics().MeanLogProb > ranked[j].LogProbs.Metrics().MeanLogProb
+	})
+
+	ret := map[int]int{}
+	for i, choice := range ranked {
+		ret[choice.Index] = i + 1
+	}
+	return ret
+}
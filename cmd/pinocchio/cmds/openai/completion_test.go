@@ -0,0 +1,168 @@
+package openai
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/wesen/geppetto/pkg/backends"
+	"testing"
+)
+
+func float32Ptr(f float32) *float32 {
+	return &f
+}
+
+func TestLogProbRows(t *testing.T) {
+	tests := []struct {
+		name     string
+		choice   backends.CompletionChoice
+		expected []map[string]interface{}
+	}{
+		{
+			name:     "no logprobs",
+			choice:   backends.CompletionChoice{Index: 0, Text: "yes"},
+			expected: []map[string]interface{}{},
+		},
+		{
+			name: "tokens with alternatives",
+			choice: backends.CompletionChoice{
+				Index: 1,
+				Text:  " yes\n",
+				LogProbs: &backends.LogProbs{
+					Tokens:        []string{" yes", "\n"},
+					TokenLogProbs: []*float32{float32Ptr(0), float32Ptr(-1)},
+					TopLogProbs: []map[string]float32{
+						{" yes": 0, " no": -2},
+						{"\n": -1},
+					},
+					TextOffset: []int{0, 4},
+				},
+			},
+			expected: []map[string]interface{}{
+				{
+					"choice":       1,
+					"position":     0,
+					"token":        " yes",
+					"logprob":      float32(0),
+					"probability":  1.0,
+					"text_offset":  0,
+					"top_logprobs": `" yes"=0.000 " no"=-2.000`,
+				},
+				{
+					"choice":       1,
+					"position":     1,
+					"token":        `\n`,
+					"logprob":      float32(-1),
+					"probability":  0.36787944117144233,
+					"text_offset":  4,
+					"top_logprobs": `"\n"=-1.000`,
+				},
+			},
+		},
+		{
+			name: "echo without logprob for the first token",
+			choice: backends.CompletionChoice{
+				Index: 0,
+				Text:  "Say yes",
+				LogProbs: &backends.LogProbs{
+					Tokens:        []string{"Say", " yes"},
+					TokenLogProbs: []*float32{nil, float32Ptr(0)},
+					TopLogProbs:   []map[string]float32{nil, {" yes": 0}},
+					TextOffset:    []int{0, 3},
+				},
+			},
+			expected: []map[string]interface{}{
+				{
+					"choice":       0,
+					"position":     0,
+					"token":        "Say",
+					"text_offset":  0,
+					"top_logprobs": "",
+				},
+				{
+					"choice":       0,
+					"position":     1,
+					"token":        " yes",
+					"logprob":      float32(0),
+					"probability":  1.0,
+					"text_offset":  3,
+					"top_logprobs": `" yes"=0.000`,
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, logProbRows(tt.choice))
+		})
+	}
+}
+
+func TestRankChoices(t *testing.T) {
+	withLogProbs := func(index int, logProbs ...*float32) backends.CompletionChoice {
+		return backends.CompletionChoice{
+			Index:    index,
+			LogProbs: &backends.LogProbs{TokenLogProbs: logProbs},
+		}
+	}
+
+	tests := []struct {
+		name     string
+		choices  []backends.CompletionChoice
+		expected map[int]int
+	}{
+		{
+			name:     "no choices",
+			choices:  []backends.CompletionChoice{},
+			expected: map[int]int{},
+		},
+		{
+			name: "no logprobs",
+			choices: []backends.CompletionChoice{
+				{Index: 0, Text: "yes"},
+				{Index: 1, Text: "no"},
+			},
+			expected: map[int]int{},
+		},
+		{
+			name: "ranked by mean logprob",
+			choices: []backends.CompletionChoice{
+				withLogProbs(0, float32Ptr(-2), float32Ptr(-2)),
+				withLogProbs(1, float32Ptr(-0.5), float32Ptr(-0.5)),
+				withLogProbs(2, float32Ptr(-1), float32Ptr(-1)),
+			},
+			expected: map[int]int{1: 1, 2: 2, 0: 3},
+		},
+		{
+			name: "choices without logprobs are not ranked",
+			choices: []backends.CompletionChoice{
+				{Index: 0, Text: "yes"},
+				withLogProbs(1, float32Ptr(-1)),
+				withLogProbs(2, float32Ptr(-0.1)),
+			},
+			expected: map[int]int{2: 1, 1: 2},
+		},
+		{
+			name: "echo without logprob for the first token",
+			choices: []backends.CompletionChoice{
+				// the null logprob is not counted as a certain token
+				withLogProbs(0, nil, float32Ptr(-1)),
+				withLogProbs(1, float32Ptr(-0.5), float32Ptr(-0.9)),
+			},
+			expected: map[int]int{1: 1, 0: 2},
+		},
+		{
+			name: "ties keep the order of the choices",
+			choices: []backends.CompletionChoice{
+				withLogProbs(0, float32Ptr(-1)),
+				withLogProbs(1, float32Ptr(-1)),
+			},
+			expected: map[int]int{0: 1, 1: 2},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, rankChoices(tt.choices))
+		})
+	}
+}
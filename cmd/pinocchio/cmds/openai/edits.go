@@ -0,0 +1,116 @@
+package openai
+
+import (
+	"context"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"github.com/wesen/geppetto/pkg/helpers"
+	"github.com/wesen/geppetto/pkg/steps/openai"
+	geppetto_usage "github.com/wesen/geppetto/pkg/usage"
+	"github.com/wesen/glazed/pkg/cli"
+	"os"
+)
+
+var editStepFactory *openai.EditStepFactory
+
+var EditsCmd = &cobra.Command{
+	Use:   "edits <file>",
+	Short: "Apply an instruction to a file (or - for stdin) with the edits API",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		file := args[0]
+		path := file
+		if path == "-" {
+			path = "/dev/stdin"
+		}
+		f, err := os.ReadFile(path)
+		cobra.CheckErr(err)
+
+		instruction, _ := cmd.Flags().GetString("instruction")
+		if instruction == "" {
+			cobra.CheckErr(fmt.Errorf("--instruction is required"))
+		}
+
+		clientSettings, err := openai.NewClientSettingsFromCobra(cmd)
+		cobra.CheckErr(err)
+		tracker := geppetto_usage.NewTracker()
+		clientSettings.UsageTracker = tracker
+		editStepFactory.ClientSettings = clientSettings
+
+		err = editStepFactory.UpdateFromCobra(cmd)
+		cobra.CheckErr(err)
+
+		ctx := context.Background()
+		s, err := editStepFactory.NewStep()
+		cobra.CheckErr(err)
+		input := openai.EditInput{
+			Input:       string(f),
+			Instruction: instruction,
+		}
+		go func() {
+			_ = s.Run(ctx, input)
+		}()
+		choices, err := (<-s.GetOutput()).Value()
+		cobra.CheckErr(err)
+
+		printUsage, _ := cmd.Flags().GetBool("print-usage")
+		for _, total := range tracker.Totals() {
+			evt := log.Debug()
+			if printUsage {
+				evt = log.Info()
+			}
+			evt.
+				Str("model", total.Model).
+				Int("prompt-tokens", total.PromptTokens).
+				Int("completion-tokens", total.CompletionTokens).
+				Int("total-tokens", total.TotalTokens()).
+				Float64("cost", total.Cost).
+				Msg("Usage")
+		}
+
+		if cmd.Flags().Changed("output") {
+			gp, of, err := cli.SetupProcessor(cmd)
+			cobra.CheckErr(err)
+
+			engine := ""
+			if editStepFactory.StepSettings.Engine != nil {
+				engine = *editStepFactory.StepSettings.Engine
+			}
+			for _, choice := range choices {
+				row := map[string]interface{}{
+					"index":       choice.Index,
+					"file":        file,
+					"instruction": instruction,
+					"text":        choice.Text,
+					"engine":      engine,
+				}
+				err = gp.ProcessInputObject(row)
+				cobra.CheckErr(err)
+			}
+
+			s, err := of.Output()
+			if err != nil {
+				_, _ = fmt.Fprintf(os.Stderr, "Error rendering output: %s\n", err)
+				os.Exit(1)
+			}
+			fmt.Print(s)
+			return
+		}
+
+		showDiff, _ := cmd.Flags().GetBool("diff")
+		separator, _ := cmd.Flags().GetString("choices-separator")
+		for i, choice := range choices {
+			if i > 0 {
+				fmt.Print(separator)
+			}
+			if !showDiff {
+				fmt.Print(choice.Text)
+				continue
+			}
+			diff, err := helpers.UnifiedDiff(file, string(f), choice.Text)
+			cobra.CheckErr(err)
+			fmt.Print(diff)
+		}
+	},
+}
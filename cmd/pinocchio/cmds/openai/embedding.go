@@ -4,9 +4,9 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"github.com/PullRequestInc/go-gpt3"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
+	"github.com/wesen/geppetto/pkg/backends"
 	"github.com/wesen/geppetto/pkg/steps/openai"
 	"github.com/wesen/glazed/pkg/cli"
 	"os"
@@ -42,13 +42,13 @@ var EmbeddingsCmd = &cobra.Command{
 		err = completionStepFactory.UpdateFromCobra(cmd)
 		cobra.CheckErr(err)
 
-		client, err := clientSettings.CreateClient()
+		backend, err := clientSettings.CreateBackend()
 		cobra.CheckErr(err)
 
 		engine, _ := cmd.Flags().GetString("engine")
 
 		ctx := context.Background()
-		resp, err := client.Embeddings(ctx, gpt3.EmbeddingsRequest{
+		resp, err := backend.Embed(ctx, &backends.EmbeddingsRequest{
 			Input: prompts,
 			Model: engine,
 			User:  user,
@@ -87,7 +87,7 @@ var EmbeddingsCmd = &cobra.Command{
 		} else {
 			for _, embedding := range resp.Data {
 				row := map[string]interface{}{
-					"object":    embedding.Object,
+					"object":    "embedding",
 					"embedding": embedding.Embedding,
 					"index":     embedding.Index,
 				}
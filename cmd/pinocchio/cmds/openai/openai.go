@@ -10,6 +10,7 @@ import (
 	"github.com/mb0/glob"
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
+	geppetto_models "github.com/wesen/geppetto/pkg/models"
 	"github.com/wesen/geppetto/pkg/steps/openai"
 	"github.com/wesen/glazed/pkg/cli"
 	"github.com/wesen/glazed/pkg/help"
@@ -23,14 +24,6 @@ var OpenaiCmd = &cobra.Command{
 	Short: "OpenAI commands",
 }
 
-var EditsCmd = &cobra.Command{
-	Use:   "edits",
-	Short: "Compute edits for a file",
-	Run: func(cmd *cobra.Command, args []string) {
-
-	},
-}
-
 var ListEnginesCmd = &cobra.Command{
 	Use:   "list-engines",
 	Short: "list engines",
@@ -38,11 +31,11 @@ var ListEnginesCmd = &cobra.Command{
 		clientSettings, err := openai.NewClientSettingsFromCobra(cmd)
 		cobra.CheckErr(err)
 
-		client, err := clientSettings.CreateClient()
+		backend, err := clientSettings.CreateBackend()
 		cobra.CheckErr(err)
 
 		ctx := context.Background()
-		resp, err := client.Engines(ctx)
+		models, err := backend.ListModels(ctx)
 		cobra.CheckErr(err)
 
 		gp, of, err := cli.SetupProcessor(cmd)
@@ -52,7 +45,7 @@ var ListEnginesCmd = &cobra.Command{
 		ownerGlob, _ := cmd.Flags().GetString("owner")
 		ready, _ := cmd.Flags().GetBool("ready")
 
-		for _, engine := range resp.Data {
+		for _, engine := range models {
 			if idGlob != "" {
 				// check if idGlob  matches id
 				matching, err := glob.Match(idGlob, engine.ID)
@@ -136,40 +129,12 @@ var EngineInfoCmd = &cobra.Command{
 	},
 }
 
-// embed the models.json file
-
-//go:embed help/models.json
-var modelsJson string
-
 //go:embed help/help-family-template.md
 var helpFamilyTemplate string
 
 //go:embed help/help-completion-template.md
 var helpCompletionTemplate string
 
-type Completion struct {
-	Name                   string `json:"name"`
-	Family                 string `json:"family"`
-	Description            string `json:"description"`
-	MaxTokens              int    `json:"max_tokens"`
-	TrainingDataCutoffDate string `json:"training_data_cutoff_date"`
-}
-
-type Family struct {
-	Name             string   `json:"name"`
-	Description      string   `json:"description"`
-	PricePer1kTokens float64  `json:"price_per_1k_tokens"`
-	GoodAt           []string `json:"good_at"`
-	KeyPoints        []string `json:"key_points"`
-	Subtitle         string   `json:"subtitle"`
-	Short            string   `json:"short"`
-}
-
-type ModelsJSON struct {
-	Completion []Completion `json:"completion"`
-	Families   []Family     `json:"families"`
-}
-
 type SimpleModelsJSON struct {
 	Completion []map[string]interface{} `json:"completion"`
 	Families   []map[string]interface{} `json:"families"`
@@ -180,7 +145,7 @@ var FamiliesCmd = &cobra.Command{
 	Short: "list families",
 	Run: func(cmd *cobra.Command, args []string) {
 		models := SimpleModelsJSON{}
-		err := json.Unmarshal([]byte(modelsJson), &models)
+		err := json.Unmarshal([]byte(geppetto_models.ModelsJSONString), &models)
 		cobra.CheckErr(err)
 
 		gp, of, err := cli.SetupProcessor(cmd)
@@ -207,7 +172,7 @@ var ModelsCmd = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 
 		models := SimpleModelsJSON{}
-		err := json.Unmarshal([]byte(modelsJson), &models)
+		err := json.Unmarshal([]byte(geppetto_models.ModelsJSONString), &models)
 		cobra.CheckErr(err)
 
 		gp, of, err := cli.SetupProcessor(cmd)
@@ -229,8 +194,7 @@ var ModelsCmd = &cobra.Command{
 }
 
 func LoadModelsHelpFiles() ([]*help.Section, error) {
-	models := ModelsJSON{}
-	err := json.Unmarshal([]byte(modelsJson), &models)
+	models, err := geppetto_models.Load()
 	if err != nil {
 		return nil, err
 	}
@@ -247,9 +211,10 @@ func LoadModelsHelpFiles() ([]*help.Section, error) {
 		return nil, err
 	}
 
-	families := map[string]*Family{}
+	families := map[string]*geppetto_models.Family{}
 
-	for _, family := range models.Families {
+	for _, family_ := range models.Families {
+		family := family_
 		families[family.Name] = &family
 
 		buf := &bytes.Buffer{}
@@ -335,6 +300,13 @@ func init() {
 	OpenaiCmd.PersistentFlags().String("base-url", "https://api.openai.com/v1", "base url to use")
 	OpenaiCmd.PersistentFlags().String("default-engine", "", "default engine to use")
 	OpenaiCmd.PersistentFlags().String("user", "", "user (hash) to use")
+	OpenaiCmd.PersistentFlags().Int("max-retries", 0, "retry failed requests (rate limits, server errors) up to this many times")
+	OpenaiCmd.PersistentFlags().Int("requests-per-minute", 0, "maximum number of requests per minute (0 for no limit)")
+	OpenaiCmd.PersistentFlags().Int("tokens-per-minute", 0, "maximum number of tokens per minute (0 for no limit)")
+	OpenaiCmd.PersistentFlags().Int("max-in-flight", 0, "maximum number of concurrent requests (0 for no limit)")
+	OpenaiCmd.PersistentFlags().String("cache", "", "cache mode of the completions: off, read-write, read-only, refresh (default from the client settings, or off)")
+	OpenaiCmd.PersistentFlags().Duration("cache-ttl", 0, "how long cached completions are used, for example 24h (0 to never expire)")
+	OpenaiCmd.PersistentFlags().Bool("cache-non-zero-temperature", false, "also cache the completions sampled with a non-zero temperature")
 
 	ListEnginesCmd.Flags().String("id", "", "glob pattern to match engine id")
 	ListEnginesCmd.Flags().String("owner", "", "glob pattern to match engine owner")
@@ -356,6 +328,7 @@ func init() {
 
 	CompletionCmd.Flags().Bool("print-usage", false, "print usage")
 	CompletionCmd.Flags().Bool("print-raw-response", false, "print raw response as object")
+	CompletionCmd.Flags().Bool("logprobs-output", false, "output a row per token of each choice, with its logprob and the --logprobs most likely alternatives")
 	cli.AddFlags(CompletionCmd, cli.NewFlagsDefaults())
 	OpenaiCmd.AddCommand(CompletionCmd)
 
@@ -368,6 +341,17 @@ func init() {
 	EmbeddingsCmd.Flags().String("engine", gpt3.TextDavinci002Engine, "engine to use")
 	OpenaiCmd.AddCommand(EmbeddingsCmd)
 
+	editStepFactory = openai.NewEditStepFactory(
+		openai.NewEditStepSettings(),
+		openai.NewClientSettings(),
+	)
+	err = editStepFactory.AddFlags(EditsCmd, "", &openai.EditStepFactoryFlagsDefaults{})
+	cobra.CheckErr(err)
+	EditsCmd.Flags().String("instruction", "", "Instruction telling the model how to edit the file (required)")
+	EditsCmd.Flags().Bool("diff", false, "Print a unified diff against the input instead of the edited text")
+	EditsCmd.Flags().String("choices-separator", "\n---\n", "Separator printed between choices when --n is greater than 1")
+	EditsCmd.Flags().Bool("print-usage", false, "print usage")
+	cli.AddFlags(EditsCmd, cli.NewFlagsDefaults())
 	OpenaiCmd.AddCommand(EditsCmd)
 
 	cli.AddFlags(FamiliesCmd, cli.NewFlagsDefaults())
@@ -0,0 +1,81 @@
+package runs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/wesen/geppetto/pkg/recorder"
+	"github.com/wesen/geppetto/pkg/replay"
+	"github.com/wesen/geppetto/pkg/steps/openai"
+	"github.com/wesen/geppetto/pkg/usage"
+	"os"
+)
+
+var ReplayCmd = &cobra.Command{
+	Use:   "replay <id>",
+	Short: "Replay a recorded run",
+	Long: "Replay a recorded run with its recorded inputs and settings.\n" +
+		"The completions started before --from-step reuse their recorded output, unless their\n" +
+		"input changed because of a previous step. The replay is recorded as a new run.",
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		store := loadStore(cmd)
+		run, err := store.Load(args[0])
+		cobra.CheckErr(err)
+
+		fromStep, _ := cmd.Flags().GetInt("from-step")
+		noRecord, _ := cmd.Flags().GetBool("no-record")
+
+		clientSettings := openai.NewClientSettings()
+		if apiKey := viper.GetString("openai-api-key"); apiKey != "" {
+			clientSettings.APIKey = &apiKey
+		}
+		tracker := usage.NewTracker()
+		clientSettings.UsageTracker = tracker
+
+		settings := replay.Settings{
+			FromStep:       fromStep,
+			ClientSettings: clientSettings,
+		}
+		if cmd.Flags().Changed("engine") {
+			engine, _ := cmd.Flags().GetString("engine")
+			settings.Engine = &engine
+		}
+		if cmd.Flags().Changed("temperature") {
+			temperature, _ := cmd.Flags().GetFloat32("temperature")
+			settings.Temperature = &temperature
+		}
+
+		r, err := replay.NewReplayer(run, settings)
+		cobra.CheckErr(err)
+
+		ctx := context.Background()
+		var rec *recorder.Recorder
+		if !noRecord {
+			rec, err = store.CreateReplay(run, fromStep)
+			cobra.CheckErr(err)
+			ctx = recorder.WithRecorder(ctx, rec)
+		}
+
+		output, err := r.Replay(ctx)
+		if rec != nil {
+			finishErr := rec.Finish(err, tracker)
+			if finishErr != nil {
+				log.Warn().Err(finishErr).Str("run", rec.RunID()).Msg("could not record the end of the replay")
+			}
+			_, _ = fmt.Fprintf(os.Stderr, "Recorded the replay as run %s\n", rec.RunID())
+		}
+		cobra.CheckErr(err)
+
+		if s, ok := output.(string); ok {
+			fmt.Println(s)
+			return
+		}
+		b, err := json.MarshalIndent(output, "", "  ")
+		cobra.CheckErr(err)
+		fmt.Println(string(b))
+	},
+}
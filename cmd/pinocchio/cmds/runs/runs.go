@@ -0,0 +1,280 @@
+package runs
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/spf13/cobra"
+	"github.com/wesen/geppetto/pkg/recorder"
+	"github.com/wesen/glazed/pkg/cli"
+	"github.com/wesen/glazed/pkg/formatters"
+	"gopkg.in/yaml.v3"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+var RunsCmd = &cobra.Command{
+	Use:   "runs",
+	Short: "List, inspect and replay the recorded runs of commands",
+}
+
+func loadStore(cmd *cobra.Command) *recorder.Store {
+	directory, _ := cmd.Flags().GetString("directory")
+	if directory == "" {
+		var err error
+		directory, err = recorder.DefaultDirectory()
+		cobra.CheckErr(err)
+	}
+	return recorder.NewStore(directory)
+}
+
+func printOutput(of formatters.OutputFormatter) {
+	s, err := of.Output()
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "Error rendering output: %s\n", err)
+		os.Exit(1)
+	}
+	fmt.Print(s)
+}
+
+var ListCmd = &cobra.Command{
+	Use:   "ls",
+	Short: "List the recorded runs, newest first",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		runs, err := loadStore(cmd).List()
+		cobra.CheckErr(err)
+
+		gp, of, err := cli.SetupProcessor(cmd)
+		cobra.CheckErr(err)
+
+		for _, run := range runs {
+			row := map[string]interface{}{
+				"id":                run.ID,
+				"command":           run.Command,
+				"date":              run.Start.Local().Format("2006-01-02 15:04:05"),
+				"duration_ms":       run.DurationMs,
+				"status":            run.Status,
+				"steps":             len(run.Steps),
+				"prompt_tokens":     run.PromptTokens,
+				"completion_tokens": run.CompletionTokens,
+				"total_tokens":      run.PromptTokens + run.CompletionTokens,
+				"cost":              run.Cost,
+				"replay_of":         run.ReplayOf,
+			}
+			err = gp.ProcessInputObject(row)
+			cobra.CheckErr(err)
+		}
+
+		printOutput(of)
+	},
+}
+
+var ShowCmd = &cobra.Command{
+	Use:   "show <id>",
+	Short: "Show the steps of a recorded run",
+	Long: "Show the steps of a recorded run as a tree, with their input, output and metrics.\n" +
+		"The step IDs can be passed to runs replay --from-step. When --output is set,\n" +
+		"the steps are output as rows instead.",
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		run, err := loadStore(cmd).Load(args[0])
+		cobra.CheckErr(err)
+
+		if !cmd.Flags().Changed("output") {
+			printRun(run)
+			return
+		}
+
+		gp, of, err := cli.SetupProcessor(cmd)
+		cobra.CheckErr(err)
+
+		for _, step := range run.Steps {
+			row := map[string]interface{}{
+				"id":          step.ID,
+				"parent_id":   step.ParentID,
+				"type":        step.Type,
+				"name":        step.Name,
+				"duration_ms": step.DurationMs,
+				"error":       step.Error,
+				"input":       formatValue(step.Input),
+				"output":      formatValue(step.Output),
+			}
+			for key, value := range step.Metrics {
+				row[key] = value
+			}
+			err = gp.ProcessInputObject(row)
+			cobra.CheckErr(err)
+		}
+
+		printOutput(of)
+	},
+}
+
+var PruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "Remove old recorded runs",
+	Long: "Remove the runs started more than --older-than ago (for example 720h for 30 days),\n" +
+		"always keeping the --keep most recent runs. Without --older-than, all the runs but\n" +
+		"the --keep most recent ones are removed.",
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		olderThan, _ := cmd.Flags().GetDuration("older-than")
+		keep, _ := cmd.Flags().GetInt("keep")
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+		if !cmd.Flags().Changed("older-than") && !cmd.Flags().Changed("keep") {
+			cobra.CheckErr(fmt.Errorf("at least one of --older-than and --keep is required"))
+		}
+
+		removed, err := loadStore(cmd).Prune(olderThan, keep, dryRun)
+		for _, id := range removed {
+			if dryRun {
+				fmt.Printf("would remove %s\n", id)
+			} else {
+				fmt.Printf("removed %s\n", id)
+			}
+		}
+		cobra.CheckErr(err)
+	},
+}
+
+// formatValue formats a recorded input or output as text: strings are kept as is,
+// other values are formatted as JSON.
+func formatValue(v interface{}) string {
+	switch v_ := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v_
+	default:
+		b, err := json.Marshal(v_)
+		if err != nil {
+			return fmt.Sprintf("%v", v_)
+		}
+		return string(b)
+	}
+}
+
+// formatBlock formats a recorded value as an indented block of text, strings are kept as is
+// and other values are formatted as YAML.
+func formatBlock(v interface{}, indent string) string {
+	s, ok := v.(string)
+	if !ok {
+		b, err := yaml.Marshal(v)
+		if err != nil {
+			s = fmt.Sprintf("%v", v)
+		} else {
+			s = string(b)
+		}
+	}
+	s = strings.TrimRight(s, "\n")
+	return indent + strings.ReplaceAll(s, "\n", "\n"+indent)
+}
+
+func printRun(run *recorder.Run) {
+	fmt.Printf("Run:      %s\n", run.ID)
+	fmt.Printf("Command:  %s\n", run.Command)
+	if run.ReplayOf != "" {
+		fmt.Printf("Replay:   of %s from step %d\n", run.ReplayOf, run.FromStep)
+	}
+	fmt.Printf("Date:     %s (%s)\n",
+		run.Start.Local().Format("2006-01-02 15:04:05"),
+		time.Duration(run.DurationMs)*time.Millisecond)
+	fmt.Printf("Status:   %s\n", run.Status)
+	if run.Error != "" {
+		fmt.Printf("Error:    %s\n", run.Error)
+	}
+	fmt.Printf("Tokens:   %d prompt, %d completion, $%.4f\n", run.PromptTokens, run.CompletionTokens, run.Cost)
+
+	if len(run.Parameters) > 0 {
+		fmt.Println("Parameters:")
+		keys := make([]string, 0, len(run.Parameters))
+		for key := range run.Parameters {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Printf("  %s: %s\n", key, formatValue(run.Parameters[key]))
+		}
+	}
+
+	fmt.Println()
+	printSteps(run, 0, "")
+}
+
+// printSteps prints the children of the step parentID, and their children, indented by depth.
+// The input of containers is left out, it is the input of their first child.
+func printSteps(run *recorder.Run, parentID int, indent string) {
+	for _, step := range run.Children(parentID) {
+		name := step.Type
+		if step.Name != "" {
+			name += " " + step.Name
+		}
+		fmt.Printf("%s[%d] %s (%s)\n", indent, step.ID, name, time.Duration(step.DurationMs)*time.Millisecond)
+
+		details := indent + "    "
+		children := run.Children(step.ID)
+		if len(children) == 0 {
+			if template, ok := step.Metadata["template"]; ok {
+				fmt.Printf("%stemplate:\n%s\n", details, formatBlock(template, details+"  "))
+			} else if step.Input != nil {
+				fmt.Printf("%sinput:\n%s\n", details, formatBlock(step.Input, details+"  "))
+			}
+		}
+		if step.Output != nil {
+			fmt.Printf("%soutput:\n%s\n", details, formatBlock(step.Output, details+"  "))
+		}
+		if engine, ok := step.Metadata["engine"]; ok {
+			fmt.Printf("%sengine: %v\n", details, engine)
+		}
+		if cached, _ := step.Metadata["cached"].(bool); cached {
+			fmt.Printf("%scached response %v\n", details, step.Metadata["cache_key"])
+		}
+		if reused, ok := step.Metadata["reused_step"]; ok {
+			fmt.Printf("%sreused output of step %v\n", details, reused)
+		}
+		if len(step.Metrics) > 0 {
+			keys := make([]string, 0, len(step.Metrics))
+			for key := range step.Metrics {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			metrics := []string{}
+			for _, key := range keys {
+				metrics = append(metrics, fmt.Sprintf("%s=%v", key, step.Metrics[key]))
+			}
+			fmt.Printf("%smetrics: %s\n", details, strings.Join(metrics, " "))
+		}
+		if step.Error != "" {
+			fmt.Printf("%serror: %s\n", details, step.Error)
+		}
+
+		printSteps(run, step.ID, indent+"  ")
+	}
+}
+
+func init() {
+	RunsCmd.PersistentFlags().String("directory", "", "Directory of the recorded runs (default: $XDG_DATA_HOME/pinocchio/runs)")
+
+	defaults := cli.NewFlagsDefaults()
+	defaults.FieldsFilter.Fields = "id,date,command,status,duration_ms,steps,prompt_tokens,completion_tokens,total_tokens,cost,replay_of"
+	cli.AddFlags(ListCmd, defaults)
+	RunsCmd.AddCommand(ListCmd)
+
+	defaults = cli.NewFlagsDefaults()
+	defaults.FieldsFilter.Fields = "id,parent_id,type,name,duration_ms,prompt_tokens,completion_tokens,cost,error,input,output"
+	cli.AddFlags(ShowCmd, defaults)
+	RunsCmd.AddCommand(ShowCmd)
+
+	PruneCmd.Flags().Duration("older-than", 0, "Remove the runs started longer ago than this duration")
+	PruneCmd.Flags().Int("keep", 0, "Number of most recent runs always kept")
+	PruneCmd.Flags().Bool("dry-run", false, "Only list the runs that would be removed")
+	RunsCmd.AddCommand(PruneCmd)
+
+	ReplayCmd.Flags().Int("from-step", 0, "ID of the first completion to send again, the outputs of the previous ones are reused (see runs show)")
+	ReplayCmd.Flags().String("engine", "", "Engine to use instead of the recorded one")
+	ReplayCmd.Flags().Float32("temperature", 0, "Temperature to use instead of the recorded one")
+	ReplayCmd.Flags().Bool("no-record", false, "Don't record the replay as a new run")
+	RunsCmd.AddCommand(ReplayCmd)
+}
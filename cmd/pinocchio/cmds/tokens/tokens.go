@@ -0,0 +1,77 @@
+package tokens
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"github.com/wesen/geppetto/pkg/models"
+	"github.com/wesen/geppetto/pkg/tokenizer"
+	"github.com/wesen/glazed/pkg/cli"
+	"io"
+	"os"
+)
+
+var TokensCmd = &cobra.Command{
+	Use:   "tokens",
+	Short: "Tokenizer commands",
+}
+
+var CountCmd = &cobra.Command{
+	Use:   "count",
+	Short: "Count the tokens of a series of files (- for stdin)",
+	Run: func(cmd *cobra.Command, args []string) {
+		model, _ := cmd.Flags().GetString("model")
+		encoding, _ := cmd.Flags().GetString("encoding")
+		if encoding == "" {
+			encoding = tokenizer.EncodingForModel(model)
+		}
+		t := tokenizer.ForEncoding(encoding)
+
+		if len(args) == 0 {
+			args = []string{"-"}
+		}
+
+		gp, of, err := cli.SetupProcessor(cmd)
+		cobra.CheckErr(err)
+
+		contextWindow, hasContextWindow := models.ContextWindow(model)
+
+		for _, file := range args {
+			var s []byte
+			if file == "-" {
+				s, err = io.ReadAll(os.Stdin)
+			} else {
+				s, err = os.ReadFile(file)
+			}
+			cobra.CheckErr(err)
+
+			count := t.Count(string(s))
+			row := map[string]interface{}{
+				"file":      file,
+				"tokens":    count,
+				"encoding":  t.Name(),
+				"model":     model,
+				"bytes":     len(s),
+				"remaining": "",
+			}
+			if hasContextWindow {
+				row["remaining"] = contextWindow - count
+			}
+			err = gp.ProcessInputObject(row)
+			cobra.CheckErr(err)
+		}
+
+		s, err := of.Output()
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "Error rendering output: %s\n", err)
+			os.Exit(1)
+		}
+		fmt.Print(s)
+	},
+}
+
+func init() {
+	CountCmd.Flags().String("model", "text-davinci-003", "Model whose tokenizer and context window to use")
+	CountCmd.Flags().String("encoding", "", "Encoding to use instead of the one of the model (r50k_base, p50k_base, cl100k_base)")
+	cli.AddFlags(CountCmd, cli.NewFlagsDefaults())
+	TokensCmd.AddCommand(CountCmd)
+}
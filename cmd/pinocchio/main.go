@@ -7,13 +7,19 @@ import (
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"github.com/wesen/geppetto/cmd/pinocchio/cmds/cache"
+	"github.com/wesen/geppetto/cmd/pinocchio/cmds/chunk"
+	"github.com/wesen/geppetto/cmd/pinocchio/cmds/embeddings"
 	"github.com/wesen/geppetto/cmd/pinocchio/cmds/openai"
 	"github.com/wesen/geppetto/cmd/pinocchio/cmds/openai/ui"
+	"github.com/wesen/geppetto/cmd/pinocchio/cmds/runs"
+	"github.com/wesen/geppetto/cmd/pinocchio/cmds/tokens"
 	geppetto_cmds "github.com/wesen/geppetto/pkg/cmds"
 	glazed_cmds "github.com/wesen/glazed/pkg/cmds"
 	"github.com/wesen/glazed/pkg/help"
 	"gopkg.in/natefinch/lumberjack.v2"
 	"io"
+	"io/fs"
 	"os"
 	"strings"
 )
@@ -94,9 +100,15 @@ func loadRepositoryCommands(helpSystem *help.HelpSystem) ([]*geppetto_cmds.Geppe
 			if err != nil {
 				return nil, nil, err
 			}
+			repositoryCommands := make([]*geppetto_cmds.GeppettoCommand, 0, len(commands_))
 			for _, command := range commands_ {
-				commands = append(commands, command.(*geppetto_cmds.GeppettoCommand))
+				repositoryCommands = append(repositoryCommands, command.(*geppetto_cmds.GeppettoCommand))
 			}
+			err = geppetto_cmds.LoadCommandTemplates(os.DirFS(repository), repository, repositoryCommands)
+			if err != nil {
+				return nil, nil, err
+			}
+			commands = append(commands, repositoryCommands...)
 			aliases = append(aliases, aliases_...)
 
 			_, err = os.Stat(docDir)
@@ -171,6 +183,15 @@ func initCommands(
 		commands = append(commands, command.(*geppetto_cmds.GeppettoCommand))
 	}
 
+	prompts, err := fs.Sub(promptsFS, "prompts")
+	if err != nil {
+		return nil, nil, err
+	}
+	err = geppetto_cmds.LoadCommandTemplates(prompts, "prompts", commands)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	err = helpSystem.LoadSectionsFromEmbedFS(promptsFS, "prompts/doc")
 	if err != nil {
 		return nil, nil, err
@@ -309,4 +330,14 @@ func init() {
 	rootCmd.AddCommand(openai.OpenaiCmd)
 
 	rootCmd.AddCommand(ui.UiCmd)
+
+	rootCmd.AddCommand(tokens.TokensCmd)
+
+	rootCmd.AddCommand(runs.RunsCmd)
+
+	rootCmd.AddCommand(cache.CacheCmd)
+
+	rootCmd.AddCommand(embeddings.EmbeddingsCmd)
+
+	rootCmd.AddCommand(chunk.ChunkCmd)
 }
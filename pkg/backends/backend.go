@@ -0,0 +1,188 @@
+package backends
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Backend is the interface to a LLM provider. Steps talk to a Backend instead of a
+// specific client library, so that the same command can be run against OpenAI or
+// a self-hosted model.
+type Backend interface {
+	// Complete sends a completion request and waits for the full response.
+	Complete(ctx context.Context, request *CompletionRequest) (*CompletionResponse, error)
+	// CompleteStream sends a completion request and calls onData for each chunk of the response.
+	CompleteStream(ctx context.Context, request *CompletionRequest, onData func(*CompletionResponse)) error
+	// Chat sends the messages of a chat completion request and waits for the full response.
+	Chat(ctx context.Context, request *ChatRequest) (*ChatResponse, error)
+	// ChatStream sends a chat completion request and calls onData for each chunk of the response.
+	ChatStream(ctx context.Context, request *ChatRequest, onData func(*ChatResponse)) error
+	// Embed computes the embeddings of the inputs of the request.
+	Embed(ctx context.Context, request *EmbeddingsRequest) (*EmbeddingsResponse, error)
+	// Edit applies the instruction of the request to its input.
+	Edit(ctx context.Context, request *EditRequest) (*EditResponse, error)
+	// ListModels returns the models served by the backend.
+	ListModels(ctx context.Context) ([]*Model, error)
+}
+
+type CompletionRequest struct {
+	Model  string
+	Prompt string
+
+	MaxTokens   *int
+	Temperature *float32
+	TopP        *float32
+	// How many choices to create for the prompt
+	N *int
+	// Include the probabilities of the most likely tokens
+	LogProbs *int
+	Stop     []string
+
+	// Suffix is the text that comes after the completion, to insert text instead of appending it
+	Suffix           string
+	PresencePenalty  *float32
+	FrequencyPenalty *float32
+	// BestOf generates BestOf completions server-side and returns the N best ones
+	BestOf *int
+	// LogitBias maps token ids to a bias from -100 (ban) to 100 (exclusive selection)
+	LogitBias map[int]float32
+	// Echo returns the prompt in addition to the completion
+	Echo bool
+	// User identifies the end-user to the API, to monitor abuse
+	User string
+}
+
+// Completions returns how many completions the request generates, which is BestOf
+// if it is larger than N.
+func (r *CompletionRequest) Completions() int {
+	ret := 1
+	if r.N != nil && *r.N > 0 {
+		ret = *r.N
+	}
+	if r.BestOf != nil && *r.BestOf > ret {
+		ret = *r.BestOf
+	}
+	return ret
+}
+
+type LogProbs struct {
+	Tokens []string
+	// TokenLogProbs is nil for the tokens without a logprob, like the first token of an echoed prompt
+	TokenLogProbs []*float32
+	TopLogProbs   []map[string]float32
+	TextOffset    []int
+}
+
+type CompletionChoice struct {
+	Index        int
+	Text         string
+	FinishReason string
+	// LogProbs is only set when the request asked for logprobs
+	LogProbs *LogProbs
+}
+
+type Usage struct {
+	PromptTokens     int
+	CompletionTokens int
+	TotalTokens      int
+}
+
+type CompletionResponse struct {
+	ID      string
+	Model   string
+	Choices []CompletionChoice
+	Usage   Usage
+}
+
+type ChatMessage struct {
+	Role    string
+	Content string
+}
+
+type ChatRequest struct {
+	Model    string
+	Messages []ChatMessage
+
+	MaxTokens   *int
+	Temperature *float32
+	TopP        *float32
+	// How many answers to create for the messages
+	N    *int
+	Stop []string
+	// User identifies the end-user to the API, to monitor abuse
+	User string
+}
+
+type ChatChoice struct {
+	Index int
+	// Message is the answer, or the part of the answer received in a chunk when streaming
+	Message      ChatMessage
+	FinishReason string
+}
+
+type ChatResponse struct {
+	ID      string
+	Model   string
+	Choices []ChatChoice
+	Usage   Usage
+}
+
+type EmbeddingsRequest struct {
+	Model string
+	Input []string
+	User  string
+}
+
+type Embedding struct {
+	Index     int
+	Embedding []float64
+}
+
+type EmbeddingsResponse struct {
+	Model string
+	Data  []Embedding
+	Usage Usage
+}
+
+type EditRequest struct {
+	Model       string
+	Input       string
+	Instruction string
+
+	Temperature *float32
+	TopP        *float32
+	// How many edits to create for the input
+	N *int
+}
+
+type EditChoice struct {
+	Index int
+	Text  string
+}
+
+type EditResponse struct {
+	Model   string
+	Choices []EditChoice
+	Usage   Usage
+}
+
+type Model struct {
+	ID     string
+	Object string
+	Owner  string
+	Ready  bool
+}
+
+// APIError is returned by the backends when the provider answers with an error status.
+type APIError struct {
+	StatusCode int
+	Type       string
+	Message    string
+	// RetryAfter is the delay requested by the Retry-After header, if any
+	RetryAfter time.Duration
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("[%d:%s] %s", e.StatusCode, e.Type, e.Message)
+}
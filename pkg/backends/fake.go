@@ -0,0 +1,523 @@
+package backends
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"math"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FakeResponse is a scripted answer of the FakeBackend.
+type FakeResponse struct {
+	Text string
+	// Error is returned instead of a completion if set
+	Error *APIError
+}
+
+type fakeRegexpResponse struct {
+	regexp   *regexp.Regexp
+	response *FakeResponse
+}
+
+// FakeBackend is a deterministic Backend answering with scripted responses, used to test
+// commands and pipelines without network access.
+//
+// Responses are looked up in order by:
+//   - the sha256 hash of the prompt (see PromptHash)
+//   - the first matching regexp
+//   - the next response of the sequence
+//   - the default response
+//
+// If none of these match, an error is returned.
+type FakeBackend struct {
+	// Models is returned by ListModels
+	Models []string
+	// Default is returned when no other response matches
+	Default *FakeResponse
+	// EmbeddingDimensions is the size of the vectors returned by Embed
+	EmbeddingDimensions int
+
+	mu       sync.Mutex
+	hashes   map[string]*FakeResponse
+	regexps  []fakeRegexpResponse
+	sequence []*FakeResponse
+	requests []CompletionRequest
+	// embeddingsRequests are recorded separately, since they have several inputs
+	embeddingsRequests []EmbeddingsRequest
+}
+
+func NewFakeBackend() *FakeBackend {
+	return &FakeBackend{
+		Models:              []string{"fake-model"},
+		EmbeddingDimensions: 16,
+		hashes:              map[string]*FakeResponse{},
+	}
+}
+
+// PromptHash returns the key used to look up the response to a prompt.
+func PromptHash(prompt string) string {
+	h := sha256.Sum256([]byte(prompt))
+	return hex.EncodeToString(h[:])
+}
+
+// AddPromptResponse registers the response to the exact prompt.
+func (f *FakeBackend) AddPromptResponse(prompt string, response *FakeResponse) {
+	f.AddHashResponse(PromptHash(prompt), response)
+}
+
+// AddHashResponse registers the response to the prompt with the given PromptHash.
+func (f *FakeBackend) AddHashResponse(hash string, response *FakeResponse) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.hashes[hash] = response
+}
+
+// AddRegexpResponse registers the response to the prompts matching expr.
+func (f *FakeBackend) AddRegexpResponse(expr string, response *FakeResponse) error {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.regexps = append(f.regexps, fakeRegexpResponse{regexp: re, response: response})
+	return nil
+}
+
+// AddSequenceResponses appends responses that are returned one after the other
+// for prompts that don't match a hash or a regexp.
+func (f *FakeBackend) AddSequenceResponses(responses ...*FakeResponse) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sequence = append(f.sequence, responses...)
+}
+
+// Requests returns the completion requests received so far.
+func (f *FakeBackend) Requests() []CompletionRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ret := make([]CompletionRequest, len(f.requests))
+	copy(ret, f.requests)
+	return ret
+}
+
+// EmbeddingsRequests returns the embeddings requests received so far.
+func (f *FakeBackend) EmbeddingsRequests() []EmbeddingsRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ret := make([]EmbeddingsRequest, len(f.embeddingsRequests))
+	copy(ret, f.embeddingsRequests)
+	return ret
+}
+
+// Lookup returns the response for prompt, or an error if there is none.
+func (f *FakeBackend) Lookup(prompt string) (*FakeResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if response, ok := f.hashes[PromptHash(prompt)]; ok {
+		return response, nil
+	}
+	for _, r := range f.regexps {
+		if r.regexp.MatchString(prompt) {
+			return r.response, nil
+		}
+	}
+	if len(f.sequence) > 0 {
+		response := f.sequence[0]
+		f.sequence = f.sequence[1:]
+		return response, nil
+	}
+	if f.Default != nil {
+		return f.Default, nil
+	}
+
+	return nil, fmt.Errorf("no fake response for prompt %q (hash %s)", prompt, PromptHash(prompt))
+}
+
+func (f *FakeBackend) respond(request *CompletionRequest) (string, error) {
+	f.mu.Lock()
+	f.requests = append(f.requests, *request)
+	f.mu.Unlock()
+
+	response, err := f.Lookup(request.Prompt)
+	if err != nil {
+		return "", err
+	}
+	if response.Error != nil {
+		return "", response.Error
+	}
+	return response.Text, nil
+}
+
+// splitFakeChunks splits text into words, keeping the whitespace in front of each word,
+// which is roughly what a streaming API returns.
+func splitFakeChunks(text string) []string {
+	var ret []string
+	start := 0
+	for i := 1; i < len(text); i++ {
+		if text[i] == ' ' || text[i] == '\n' {
+			if text[i-1] != ' ' && text[i-1] != '\n' {
+				ret = append(ret, text[start:i])
+				start = i
+			}
+		}
+	}
+	if start < len(text) {
+		ret = append(ret, text[start:])
+	}
+	return ret
+}
+
+func fakeLogProbs(chunks []string) *LogProbs {
+	ret := &LogProbs{}
+	offset := 0
+	for _, chunk := range chunks {
+		ret.Tokens = append(ret.Tokens, chunk)
+		ret.TokenLogProbs = append(ret.TokenLogProbs, new(float32))
+		ret.TopLogProbs = append(ret.TopLogProbs, map[string]float32{chunk: 0})
+		ret.TextOffset = append(ret.TextOffset, offset)
+		offset += len(chunk)
+	}
+	return ret
+}
+
+func fakeUsage(prompt string, completion string, n int) Usage {
+	promptTokens := len(strings.Fields(prompt))
+	completionTokens := len(splitFakeChunks(completion)) * n
+	return Usage{
+		PromptTokens:     promptTokens,
+		CompletionTokens: completionTokens,
+		TotalTokens:      promptTokens + completionTokens,
+	}
+}
+
+func requestN(request *CompletionRequest) int {
+	if request.N != nil && *request.N > 0 {
+		return *request.N
+	}
+	return 1
+}
+
+func (f *FakeBackend) Complete(ctx context.Context, request *CompletionRequest) (*CompletionResponse, error) {
+	text, err := f.respond(request)
+	if err != nil {
+		return nil, err
+	}
+
+	n := requestN(request)
+	ret := &CompletionResponse{
+		ID:    "fake-" + PromptHash(request.Prompt)[:8],
+		Model: request.Model,
+		Usage: fakeUsage(request.Prompt, text, n),
+	}
+	for i := 0; i < n; i++ {
+		choice := CompletionChoice{
+			Index:        i,
+			Text:         text,
+			FinishReason: "stop",
+		}
+		if request.LogProbs != nil {
+			choice.LogProbs = fakeLogProbs(splitFakeChunks(text))
+		}
+		ret.Choices = append(ret.Choices, choice)
+	}
+	return ret, nil
+}
+
+// CompleteStream sends the response word by word, interleaving the N choices.
+func (f *FakeBackend) CompleteStream(
+	ctx context.Context,
+	request *CompletionRequest,
+	onData func(*CompletionResponse),
+) error {
+	text, err := f.respond(request)
+	if err != nil {
+		return err
+	}
+
+	id := "fake-" + PromptHash(request.Prompt)[:8]
+	n := requestN(request)
+	chunks := splitFakeChunks(text)
+	for _, chunk := range chunks {
+		for i := 0; i < n; i++ {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			choice := CompletionChoice{Index: i, Text: chunk}
+			if request.LogProbs != nil {
+				choice.LogProbs = fakeLogProbs([]string{chunk})
+			}
+			onData(&CompletionResponse{
+				ID:      id,
+				Model:   request.Model,
+				Choices: []CompletionChoice{choice},
+			})
+		}
+	}
+	for i := 0; i < n; i++ {
+		onData(&CompletionResponse{
+			ID:      id,
+			Model:   request.Model,
+			Choices: []CompletionChoice{{Index: i, FinishReason: "stop"}},
+		})
+	}
+
+	return nil
+}
+
+// FakeChatPrompt is the prompt the chat messages are looked up with in the FakeBackend,
+// one "role: content" line per message.
+func FakeChatPrompt(messages []ChatMessage) string {
+	lines := make([]string, 0, len(messages))
+	for _, message := range messages {
+		lines = append(lines, message.Role+": "+message.Content)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func fakeChatCompletionRequest(request *ChatRequest) *CompletionRequest {
+	return &CompletionRequest{
+		Model:       request.Model,
+		Prompt:      FakeChatPrompt(request.Messages),
+		MaxTokens:   request.MaxTokens,
+		Temperature: request.Temperature,
+		TopP:        request.TopP,
+		N:           request.N,
+		Stop:        request.Stop,
+		User:        request.User,
+	}
+}
+
+func toFakeChatResponse(resp *CompletionResponse) *ChatResponse {
+	ret := &ChatResponse{
+		ID:    resp.ID,
+		Model: resp.Model,
+		Usage: resp.Usage,
+	}
+	for _, choice := range resp.Choices {
+		ret.Choices = append(ret.Choices, ChatChoice{
+			Index:        choice.Index,
+			Message:      ChatMessage{Role: "assistant", Content: choice.Text},
+			FinishReason: choice.FinishReason,
+		})
+	}
+	return ret
+}
+
+// Chat answers N times with the response to the FakeChatPrompt of the messages.
+func (f *FakeBackend) Chat(ctx context.Context, request *ChatRequest) (*ChatResponse, error) {
+	resp, err := f.Complete(ctx, fakeChatCompletionRequest(request))
+	if err != nil {
+		return nil, err
+	}
+	return toFakeChatResponse(resp), nil
+}
+
+// ChatStream sends the response to the FakeChatPrompt of the messages word by word, like CompleteStream.
+func (f *FakeBackend) ChatStream(
+	ctx context.Context,
+	request *ChatRequest,
+	onData func(*ChatResponse),
+) error {
+	return f.CompleteStream(ctx, fakeChatCompletionRequest(request), func(resp *CompletionResponse) {
+		onData(toFakeChatResponse(resp))
+	})
+}
+
+// FakeEmbedPrompt is the prompt the embeddings requests are looked up with in the FakeBackend.
+func FakeEmbedPrompt(input string) string {
+	return "embed: " + input
+}
+
+// Embed returns a deterministic unit vector derived from the hash of each input.
+//
+// The response to the FakeEmbedPrompt of the first input is looked up like for completions, so that
+// errors can be scripted. The error of the response is returned if it has one, its text is ignored.
+// Requests without a response are answered with the vectors as well.
+func (f *FakeBackend) Embed(ctx context.Context, request *EmbeddingsRequest) (*EmbeddingsResponse, error) {
+	f.mu.Lock()
+	f.embeddingsRequests = append(f.embeddingsRequests, *request)
+	f.mu.Unlock()
+
+	if len(request.Input) > 0 {
+		response, err := f.Lookup(FakeEmbedPrompt(request.Input[0]))
+		if err == nil && response.Error != nil {
+			return nil, response.Error
+		}
+	}
+
+	dimensions := f.EmbeddingDimensions
+	if dimensions <= 0 {
+		dimensions = 16
+	}
+
+	ret := &EmbeddingsResponse{
+		Model: request.Model,
+	}
+	for i, input := range request.Input {
+		h := sha256.Sum256([]byte(input))
+		vector := make([]float64, dimensions)
+		norm := 0.0
+		for j := range vector {
+			vector[j] = float64(h[j%len(h)])/127.5 - 1.0
+			norm += vector[j] * vector[j]
+		}
+		norm = math.Sqrt(norm)
+		if norm > 0 {
+			for j := range vector {
+				vector[j] /= norm
+			}
+		}
+		ret.Data = append(ret.Data, Embedding{Index: i, Embedding: vector})
+		ret.Usage.PromptTokens += len(strings.Fields(input))
+	}
+	ret.Usage.TotalTokens = ret.Usage.PromptTokens
+
+	return ret, nil
+}
+
+// FakeEditPrompt is the prompt the edit requests are looked up with in the FakeBackend.
+func FakeEditPrompt(instruction string, input string) string {
+	return "instruction: " + instruction + "\ninput: " + input
+}
+
+// Edit answers N times with the response to the FakeEditPrompt of the request.
+func (f *FakeBackend) Edit(ctx context.Context, request *EditRequest) (*EditResponse, error) {
+	completionRequest := &CompletionRequest{
+		Model:       request.Model,
+		Prompt:      FakeEditPrompt(request.Instruction, request.Input),
+		Temperature: request.Temperature,
+		TopP:        request.TopP,
+		N:           request.N,
+	}
+	text, err := f.respond(completionRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	n := requestN(completionRequest)
+	ret := &EditResponse{
+		Model: request.Model,
+		Usage: fakeUsage(completionRequest.Prompt, text, n),
+	}
+	for i := 0; i < n; i++ {
+		ret.Choices = append(ret.Choices, EditChoice{Index: i, Text: text})
+	}
+	return ret, nil
+}
+
+func (f *FakeBackend) ListModels(ctx context.Context) ([]*Model, error) {
+	ret := make([]*Model, 0, len(f.Models))
+	for _, model := range f.Models {
+		ret = append(ret, &Model{
+			ID:     model,
+			Object: "model",
+			Owner:  "geppetto",
+			Ready:  true,
+		})
+	}
+	return ret, nil
+}
+
+type fakeErrorFile struct {
+	StatusCode int    `yaml:"status_code"`
+	Type       string `yaml:"type"`
+	Message    string `yaml:"message"`
+	// RetryAfter is sent as Retry-After header by the FakeOpenAIServer, in seconds
+	RetryAfter int `yaml:"retry_after,omitempty"`
+}
+
+type fakeResponseFile struct {
+	Prompt       *string        `yaml:"prompt,omitempty"`
+	PromptHash   string         `yaml:"prompt_hash,omitempty"`
+	PromptRegexp string         `yaml:"prompt_regexp,omitempty"`
+	Text         string         `yaml:"text,omitempty"`
+	Error        *fakeErrorFile `yaml:"error,omitempty"`
+}
+
+func (r *fakeResponseFile) toFakeResponse() *FakeResponse {
+	ret := &FakeResponse{Text: r.Text}
+	if r.Error != nil {
+		ret.Error = &APIError{
+			StatusCode: r.Error.StatusCode,
+			Type:       r.Error.Type,
+			Message:    r.Error.Message,
+			RetryAfter: time.Duration(r.Error.RetryAfter) * time.Second,
+		}
+	}
+	return ret
+}
+
+type fakeBackendFile struct {
+	Models    []string            `yaml:"models,omitempty"`
+	Default   *fakeResponseFile   `yaml:"default,omitempty"`
+	Responses []*fakeResponseFile `yaml:"responses"`
+}
+
+// NewFakeBackendFromYAML loads the scripted responses from a YAML file in the format:
+//
+//	models:
+//	  - fake-model
+//	default:
+//	  text: I don't know
+//	responses:
+//	  # matched by the hash of the exact prompt
+//	  - prompt: "What is 2+2?"
+//	    text: "4"
+//	  - prompt_hash: 5d4f...
+//	    text: "5"
+//	  - prompt_regexp: "^Summarize"
+//	    text: A summary.
+//	  # embeddings requests are matched by "embed: " and their first input
+//	  - prompt_regexp: "^embed: "
+//	    error:
+//	      status_code: 500
+//	      type: server_error
+//	      message: The server had an error
+//	  # responses without a matcher are returned in sequence
+//	  - text: First answer
+//	  - error:
+//	      status_code: 429
+//	      type: rate_limit_exceeded
+//	      message: Rate limit reached
+//	      retry_after: 1
+func NewFakeBackendFromYAML(r io.Reader) (*FakeBackend, error) {
+	var file fakeBackendFile
+	if err := yaml.NewDecoder(r).Decode(&file); err != nil {
+		return nil, err
+	}
+
+	ret := NewFakeBackend()
+	if len(file.Models) > 0 {
+		ret.Models = file.Models
+	}
+	if file.Default != nil {
+		ret.Default = file.Default.toFakeResponse()
+	}
+
+	for _, response := range file.Responses {
+		switch {
+		case response.Prompt != nil:
+			ret.AddPromptResponse(*response.Prompt, response.toFakeResponse())
+		case response.PromptHash != "":
+			ret.AddHashResponse(response.PromptHash, response.toFakeResponse())
+		case response.PromptRegexp != "":
+			err := ret.AddRegexpResponse(response.PromptRegexp, response.toFakeResponse())
+			if err != nil {
+				return nil, err
+			}
+		default:
+			ret.AddSequenceResponses(response.toFakeResponse())
+		}
+	}
+
+	return ret, nil
+}
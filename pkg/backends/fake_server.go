@@ -0,0 +1,406 @@
+package backends
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FakeOpenAIServer is a httptest server implementing the parts of the OpenAI REST API
+// used by geppetto, answering from a FakeBackend. Point ClientSettings.BaseURL to
+// its URL to run commands without network access.
+//
+// Both the go-gpt3 routes (/engines/<model>/completions) and the OpenAI-compatible
+// routes (/completions, /chat/completions) are served, with and without streaming.
+// A FakeResponse with an Error is returned as an OpenAI error with its status code.
+type FakeOpenAIServer struct {
+	*httptest.Server
+	Backend *FakeBackend
+}
+
+func NewFakeOpenAIServer(backend *FakeBackend) *FakeOpenAIServer {
+	s := &FakeOpenAIServer{
+		Backend: backend,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/models", s.handleModels)
+	mux.HandleFunc("/engines", s.handleModels)
+	mux.HandleFunc("/engines/", s.handleEngineCompletions)
+	mux.HandleFunc("/completions", func(w http.ResponseWriter, r *http.Request) {
+		s.handleCompletions(w, r, "")
+	})
+	mux.HandleFunc("/chat/completions", s.handleChatCompletions)
+	mux.HandleFunc("/embeddings", s.handleEmbeddings)
+	mux.HandleFunc("/edits", s.handleEdits)
+
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+type fakeCompletionRequest struct {
+	Model       string          `json:"model"`
+	Prompt      json.RawMessage `json:"prompt"`
+	MaxTokens   *int            `json:"max_tokens,omitempty"`
+	Temperature *float32        `json:"temperature,omitempty"`
+	TopP        *float32        `json:"top_p,omitempty"`
+	N           *int            `json:"n,omitempty"`
+	LogProbs    *int            `json:"logprobs,omitempty"`
+	Stop        []string        `json:"stop,omitempty"`
+	Stream      bool            `json:"stream,omitempty"`
+
+	Suffix           string          `json:"suffix,omitempty"`
+	PresencePenalty  *float32        `json:"presence_penalty,omitempty"`
+	FrequencyPenalty *float32        `json:"frequency_penalty,omitempty"`
+	BestOf           *int            `json:"best_of,omitempty"`
+	LogitBias        map[int]float32 `json:"logit_bias,omitempty"`
+	Echo             bool            `json:"echo,omitempty"`
+	User             string          `json:"user,omitempty"`
+}
+
+// prompt decodes the prompt, which go-gpt3 sends as a list of strings.
+func (r *fakeCompletionRequest) prompt() (string, error) {
+	var prompt string
+	if err := json.Unmarshal(r.Prompt, &prompt); err == nil {
+		return prompt, nil
+	}
+	var prompts []string
+	if err := json.Unmarshal(r.Prompt, &prompts); err != nil {
+		return "", fmt.Errorf("invalid prompt: %w", err)
+	}
+	return strings.Join(prompts, ""), nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	errorType := "server_error"
+	if apiError, ok := err.(*APIError); ok {
+		status = apiError.StatusCode
+		errorType = apiError.Type
+		if apiError.RetryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(apiError.RetryAfter/time.Second)))
+		}
+		err = fmt.Errorf("%s", apiError.Message)
+	}
+	writeJSON(w, status, map[string]interface{}{
+		"error": map[string]interface{}{
+			"message": err.Error(),
+			"type":    errorType,
+		},
+	})
+}
+
+// streamWriter writes server-sent events, flushing after each of them.
+type streamWriter struct {
+	w       http.ResponseWriter
+	started bool
+}
+
+func (s *streamWriter) send(v interface{}) {
+	if !s.started {
+		s.w.Header().Set("Content-Type", "text/event-stream")
+		s.w.WriteHeader(http.StatusOK)
+		s.started = true
+	}
+	data, _ := json.Marshal(v)
+	_, _ = fmt.Fprintf(s.w, "data: %s\n\n", data)
+	if f, ok := s.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (s *streamWriter) done() {
+	_, _ = fmt.Fprint(s.w, "data: [DONE]\n\n")
+	if f, ok := s.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (s *FakeOpenAIServer) handleModels(w http.ResponseWriter, r *http.Request) {
+	models, _ := s.Backend.ListModels(r.Context())
+	data := make([]map[string]interface{}, 0, len(models))
+	for _, model := range models {
+		data = append(data, map[string]interface{}{
+			"id":       model.ID,
+			"object":   model.Object,
+			"owner":    model.Owner,
+			"owned_by": model.Owner,
+			"ready":    model.Ready,
+		})
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"object": "list",
+		"data":   data,
+	})
+}
+
+func (s *FakeOpenAIServer) handleEngineCompletions(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/engines/")
+	model := strings.TrimSuffix(path, "/completions")
+	if model == path || r.Method != http.MethodPost {
+		writeError(w, &APIError{StatusCode: http.StatusNotFound, Type: "invalid_request_error", Message: "not found"})
+		return
+	}
+	s.handleCompletions(w, r, model)
+}
+
+func toJSONChoice(choice CompletionChoice) map[string]interface{} {
+	ret := map[string]interface{}{
+		"index":         choice.Index,
+		"text":          choice.Text,
+		"finish_reason": nil,
+		"logprobs":      nil,
+	}
+	if choice.FinishReason != "" {
+		ret["finish_reason"] = choice.FinishReason
+	}
+	if choice.LogProbs != nil {
+		ret["logprobs"] = map[string]interface{}{
+			"tokens":         choice.LogProbs.Tokens,
+			"token_logprobs": choice.LogProbs.TokenLogProbs,
+			"top_logprobs":   choice.LogProbs.TopLogProbs,
+			"text_offset":    choice.LogProbs.TextOffset,
+		}
+	}
+	return ret
+}
+
+func toJSONUsage(usage Usage) map[string]interface{} {
+	return map[string]interface{}{
+		"prompt_tokens":     usage.PromptTokens,
+		"completion_tokens": usage.CompletionTokens,
+		"total_tokens":      usage.TotalTokens,
+	}
+}
+
+func toJSONCompletionResponse(resp *CompletionResponse) map[string]interface{} {
+	choices := make([]map[string]interface{}, 0, len(resp.Choices))
+	for _, choice := range resp.Choices {
+		choices = append(choices, toJSONChoice(choice))
+	}
+	return map[string]interface{}{
+		"id":      resp.ID,
+		"object":  "text_completion",
+		"created": time.Now().Unix(),
+		"model":   resp.Model,
+		"choices": choices,
+		"usage":   toJSONUsage(resp.Usage),
+	}
+}
+
+func (s *FakeOpenAIServer) handleCompletions(w http.ResponseWriter, r *http.Request, model string) {
+	var body fakeCompletionRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, &APIError{StatusCode: http.StatusBadRequest, Type: "invalid_request_error", Message: err.Error()})
+		return
+	}
+	prompt, err := body.prompt()
+	if err != nil {
+		writeError(w, &APIError{StatusCode: http.StatusBadRequest, Type: "invalid_request_error", Message: err.Error()})
+		return
+	}
+	if model == "" {
+		model = body.Model
+	}
+
+	request := &CompletionRequest{
+		Model:       model,
+		Prompt:      prompt,
+		MaxTokens:   body.MaxTokens,
+		Temperature: body.Temperature,
+		TopP:        body.TopP,
+		N:           body.N,
+		LogProbs:    body.LogProbs,
+		Stop:        body.Stop,
+
+		Suffix:           body.Suffix,
+		PresencePenalty:  body.PresencePenalty,
+		FrequencyPenalty: body.FrequencyPenalty,
+		BestOf:           body.BestOf,
+		LogitBias:        body.LogitBias,
+		Echo:             body.Echo,
+		User:             body.User,
+	}
+
+	if !body.Stream {
+		resp, err := s.Backend.Complete(r.Context(), request)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, toJSONCompletionResponse(resp))
+		return
+	}
+
+	sw := &streamWriter{w: w}
+	err = s.Backend.CompleteStream(r.Context(), request, func(resp *CompletionResponse) {
+		sw.send(toJSONCompletionResponse(resp))
+	})
+	if err != nil && !sw.started {
+		writeError(w, err)
+		return
+	}
+	sw.done()
+}
+
+func (s *FakeOpenAIServer) handleChatCompletions(w http.ResponseWriter, r *http.Request) {
+	var body httpChatRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, &APIError{StatusCode: http.StatusBadRequest, Type: "invalid_request_error", Message: err.Error()})
+		return
+	}
+
+	request := &ChatRequest{
+		Model:       body.Model,
+		Messages:    make([]ChatMessage, 0, len(body.Messages)),
+		MaxTokens:   body.MaxTokens,
+		Temperature: body.Temperature,
+		TopP:        body.TopP,
+		N:           body.N,
+		Stop:        body.Stop,
+		User:        body.User,
+	}
+	for _, message := range body.Messages {
+		request.Messages = append(request.Messages, ChatMessage(message))
+	}
+
+	toJSON := func(resp *ChatResponse, stream bool) map[string]interface{} {
+		choices := make([]map[string]interface{}, 0, len(resp.Choices))
+		for _, choice := range resp.Choices {
+			message := map[string]interface{}{
+				"role":    choice.Message.Role,
+				"content": choice.Message.Content,
+			}
+			c := map[string]interface{}{
+				"index":         choice.Index,
+				"finish_reason": nil,
+			}
+			if choice.FinishReason != "" {
+				c["finish_reason"] = choice.FinishReason
+			}
+			if stream {
+				c["delta"] = message
+			} else {
+				c["message"] = message
+			}
+			choices = append(choices, c)
+		}
+		return map[string]interface{}{
+			"id":      resp.ID,
+			"object":  "chat.completion",
+			"created": time.Now().Unix(),
+			"model":   resp.Model,
+			"choices": choices,
+			"usage":   toJSONUsage(resp.Usage),
+		}
+	}
+
+	if !body.Stream {
+		resp, err := s.Backend.Chat(r.Context(), request)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, toJSON(resp, false))
+		return
+	}
+
+	sw := &streamWriter{w: w}
+	err := s.Backend.ChatStream(r.Context(), request, func(resp *ChatResponse) {
+		sw.send(toJSON(resp, true))
+	})
+	if err != nil && !sw.started {
+		writeError(w, err)
+		return
+	}
+	sw.done()
+}
+
+func (s *FakeOpenAIServer) handleEmbeddings(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Model string   `json:"model"`
+		Input []string `json:"input"`
+		User  string   `json:"user"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, &APIError{StatusCode: http.StatusBadRequest, Type: "invalid_request_error", Message: err.Error()})
+		return
+	}
+
+	resp, err := s.Backend.Embed(r.Context(), &EmbeddingsRequest{
+		Model: body.Model,
+		Input: body.Input,
+		User:  body.User,
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	data := make([]map[string]interface{}, 0, len(resp.Data))
+	for _, embedding := range resp.Data {
+		data = append(data, map[string]interface{}{
+			"object":    "embedding",
+			"index":     embedding.Index,
+			"embedding": embedding.Embedding,
+		})
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"object": "list",
+		"model":  resp.Model,
+		"data":   data,
+		"usage":  toJSONUsage(resp.Usage),
+	})
+}
+
+func (s *FakeOpenAIServer) handleEdits(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Model       string   `json:"model"`
+		Input       string   `json:"input"`
+		Instruction string   `json:"instruction"`
+		Temperature *float32 `json:"temperature,omitempty"`
+		TopP        *float32 `json:"top_p,omitempty"`
+		N           *int     `json:"n,omitempty"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, &APIError{StatusCode: http.StatusBadRequest, Type: "invalid_request_error", Message: err.Error()})
+		return
+	}
+
+	resp, err := s.Backend.Edit(r.Context(), &EditRequest{
+		Model:       body.Model,
+		Input:       body.Input,
+		Instruction: body.Instruction,
+		Temperature: body.Temperature,
+		TopP:        body.TopP,
+		N:           body.N,
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	choices := make([]map[string]interface{}, 0, len(resp.Choices))
+	for _, choice := range resp.Choices {
+		choices = append(choices, map[string]interface{}{
+			"index": choice.Index,
+			"text":  choice.Text,
+		})
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"object":  "edit",
+		"created": time.Now().Unix(),
+		"choices": choices,
+		"usage":   toJSONUsage(resp.Usage),
+	})
+}
@@ -0,0 +1,256 @@
+package backends
+
+import (
+	"context"
+	"github.com/PullRequestInc/go-gpt3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+)
+
+const fakeBackendYAML = `
+models:
+  - fake-davinci
+default:
+  text: default answer
+responses:
+  - prompt: What is 2+2?
+    text: "4"
+  - prompt_regexp: "^Summarize"
+    text: A summary.
+  - text: first
+  - text: second
+  - error:
+      status_code: 429
+      type: rate_limit_exceeded
+      message: Rate limit reached
+`
+
+func TestFakeBackendLookup(t *testing.T) {
+	backend, err := NewFakeBackendFromYAML(strings.NewReader(fakeBackendYAML))
+	require.Nil(t, err)
+
+	expected := []struct {
+		prompt string
+		text   string
+	}{
+		{"What is 2+2?", "4"},
+		{"Summarize this article", "A summary."},
+		{"foo", "first"},
+		{"What is 2+2?", "4"},
+		{"bar", "second"},
+	}
+	for _, e := range expected {
+		resp, err := backend.Complete(context.Background(), &CompletionRequest{Prompt: e.prompt})
+		require.Nil(t, err)
+		require.Len(t, resp.Choices, 1)
+		assert.Equal(t, e.text, resp.Choices[0].Text)
+	}
+
+	_, err = backend.Complete(context.Background(), &CompletionRequest{Prompt: "baz"})
+	apiError, ok := err.(*APIError)
+	require.True(t, ok)
+	assert.Equal(t, 429, apiError.StatusCode)
+
+	resp, err := backend.Complete(context.Background(), &CompletionRequest{Prompt: "baz"})
+	require.Nil(t, err)
+	assert.Equal(t, "default answer", resp.Choices[0].Text)
+
+	assert.Len(t, backend.Requests(), 7)
+}
+
+func TestFakeBackendEmbedErrors(t *testing.T) {
+	backend, err := NewFakeBackendFromYAML(strings.NewReader(`
+responses:
+  - prompt_regexp: "^embed: broken"
+    error:
+      status_code: 500
+      type: server_error
+      message: The server had an error
+`))
+	require.Nil(t, err)
+	ctx := context.Background()
+
+	_, err = backend.Embed(ctx, &EmbeddingsRequest{Model: "fake-embeddings", Input: []string{"broken input", "foo"}})
+	apiError, ok := err.(*APIError)
+	require.True(t, ok)
+	assert.Equal(t, 500, apiError.StatusCode)
+
+	// inputs without a response are embedded
+	resp, err := backend.Embed(ctx, &EmbeddingsRequest{Model: "fake-embeddings", Input: []string{"foo"}})
+	require.Nil(t, err)
+	require.Len(t, resp.Data, 1)
+	assert.Len(t, resp.Data[0].Embedding, backend.EmbeddingDimensions)
+
+	requests := backend.EmbeddingsRequests()
+	require.Len(t, requests, 2)
+	assert.Equal(t, []string{"broken input", "foo"}, requests[0].Input)
+	assert.Empty(t, backend.Requests())
+}
+
+func TestFakeBackendNoResponse(t *testing.T) {
+	backend := NewFakeBackend()
+	_, err := backend.Complete(context.Background(), &CompletionRequest{Prompt: "foo"})
+	assert.Error(t, err)
+}
+
+func TestFakeBackendStream(t *testing.T) {
+	backend := NewFakeBackend()
+	backend.AddPromptResponse("foo", &FakeResponse{Text: "Hello world,\nhow are you"})
+
+	n := 2
+	texts := map[int]string{}
+	finished := map[int]bool{}
+	err := backend.CompleteStream(context.Background(), &CompletionRequest{Prompt: "foo", N: &n},
+		func(resp *CompletionResponse) {
+			for _, choice := range resp.Choices {
+				texts[choice.Index] += choice.Text
+				if choice.FinishReason != "" {
+					finished[choice.Index] = true
+				}
+			}
+		})
+	require.Nil(t, err)
+	assert.Equal(t, map[int]string{0: "Hello world,\nhow are you", 1: "Hello world,\nhow are you"}, texts)
+	assert.Equal(t, map[int]bool{0: true, 1: true}, finished)
+}
+
+func newFakeServer(t *testing.T) *FakeOpenAIServer {
+	backend := NewFakeBackend()
+	backend.AddPromptResponse("foo", &FakeResponse{Text: "bar baz"})
+	backend.AddPromptResponse("user: hello", &FakeResponse{Text: "Hi there"})
+	backend.AddPromptResponse(FakeEditPrompt("Fix the typo", "helo"), &FakeResponse{Text: "hello"})
+	backend.AddPromptResponse("error", &FakeResponse{Error: &APIError{
+		StatusCode: 503,
+		Type:       "server_error",
+		Message:    "overloaded",
+	}})
+
+	server := NewFakeOpenAIServer(backend)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestFakeServerOpenAIBackend(t *testing.T) {
+	server := newFakeServer(t)
+	backend, err := NewOpenAIBackend(
+		gpt3.NewClient("test", gpt3.WithBaseURL(server.URL)),
+		NewHTTPBackend(HTTPBackendSettings{BaseURL: server.URL}))
+	require.Nil(t, err)
+	ctx := context.Background()
+
+	resp, err := backend.Complete(ctx, &CompletionRequest{Model: "fake-model", Prompt: "foo"})
+	require.Nil(t, err)
+	assert.Equal(t, "bar baz", resp.Choices[0].Text)
+	assert.Equal(t, "fake-model", server.Backend.Requests()[0].Model)
+
+	text := ""
+	err = backend.CompleteStream(ctx, &CompletionRequest{Model: "fake-model", Prompt: "foo"},
+		func(resp *CompletionResponse) {
+			text += resp.Choices[0].Text
+		})
+	require.Nil(t, err)
+	assert.Equal(t, "bar baz", text)
+
+	_, err = backend.Complete(ctx, &CompletionRequest{Model: "fake-model", Prompt: "error"})
+	apiError, ok := err.(*APIError)
+	require.True(t, ok)
+	assert.Equal(t, 503, apiError.StatusCode)
+	assert.Equal(t, "overloaded", apiError.Message)
+
+	models, err := backend.ListModels(ctx)
+	require.Nil(t, err)
+	require.Len(t, models, 1)
+	assert.Equal(t, "fake-model", models[0].ID)
+
+	n := 2
+	edit, err := backend.Edit(ctx, &EditRequest{Model: "fake-model", Input: "helo", Instruction: "Fix the typo", N: &n})
+	require.Nil(t, err)
+	require.Len(t, edit.Choices, 2)
+	assert.Equal(t, "hello", edit.Choices[1].Text)
+	assert.Greater(t, edit.Usage.TotalTokens, 0)
+}
+
+func TestOpenAIBackendCompletions(t *testing.T) {
+	server := newFakeServer(t)
+	client := gpt3.NewClient("test", gpt3.WithBaseURL(server.URL))
+	backend, err := NewOpenAIBackend(client, NewHTTPBackend(HTTPBackendSettings{BaseURL: server.URL}))
+	require.Nil(t, err)
+	_, err = NewOpenAIBackend(client, nil)
+	assert.Error(t, err)
+
+	// the parameters go-gpt3 doesn't support are sent, since completions go through the HTTPBackend
+	penalty := float32(0.5)
+	bestOf := 3
+	resp, err := backend.Complete(context.Background(), &CompletionRequest{
+		Model:           "fake-model",
+		Prompt:          "foo",
+		Suffix:          "end",
+		PresencePenalty: &penalty,
+		BestOf:          &bestOf,
+		LogitBias:       map[int]float32{50256: -100},
+		Echo:            true,
+		User:            "user-1",
+	})
+	require.Nil(t, err)
+	assert.Equal(t, "bar baz", resp.Choices[0].Text)
+
+	requests := server.Backend.Requests()
+	require.Len(t, requests, 1)
+	assert.Equal(t, "end", requests[0].Suffix)
+	assert.Equal(t, &penalty, requests[0].PresencePenalty)
+	assert.Equal(t, &bestOf, requests[0].BestOf)
+	assert.Equal(t, map[int]float32{50256: -100}, requests[0].LogitBias)
+	assert.True(t, requests[0].Echo)
+	assert.Equal(t, "user-1", requests[0].User)
+}
+
+func TestFakeServerHTTPBackend(t *testing.T) {
+	server := newFakeServer(t)
+	backend := NewHTTPBackend(HTTPBackendSettings{BaseURL: server.URL})
+	ctx := context.Background()
+
+	resp, err := backend.Complete(ctx, &CompletionRequest{Model: "fake-model", Prompt: "foo"})
+	require.Nil(t, err)
+	assert.Equal(t, "bar baz", resp.Choices[0].Text)
+
+	text := ""
+	err = backend.CompleteStream(ctx, &CompletionRequest{Model: "fake-model", Prompt: "foo"},
+		func(resp *CompletionResponse) {
+			text += resp.Choices[0].Text
+		})
+	require.Nil(t, err)
+	assert.Equal(t, "bar baz", text)
+
+	err = backend.CompleteStream(ctx, &CompletionRequest{Model: "fake-model", Prompt: "error"},
+		func(resp *CompletionResponse) {})
+	apiError, ok := err.(*APIError)
+	require.True(t, ok)
+	assert.Equal(t, 503, apiError.StatusCode)
+
+	chatRequest := &ChatRequest{Model: "fake-model", Messages: []ChatMessage{{Role: "user", Content: "hello"}}}
+	chat, err := backend.Chat(ctx, chatRequest)
+	require.Nil(t, err)
+	require.Len(t, chat.Choices, 1)
+	assert.Equal(t, ChatMessage{Role: "assistant", Content: "Hi there"}, chat.Choices[0].Message)
+	assert.Equal(t, "stop", chat.Choices[0].FinishReason)
+
+	text = ""
+	err = backend.ChatStream(ctx, chatRequest, func(resp *ChatResponse) {
+		text += resp.Choices[0].Message.Content
+	})
+	require.Nil(t, err)
+	assert.Equal(t, "Hi there", text)
+
+	embeddings, err := backend.Embed(ctx, &EmbeddingsRequest{Model: "fake-model", Input: []string{"foo", "bar"}})
+	require.Nil(t, err)
+	require.Len(t, embeddings.Data, 2)
+	assert.Len(t, embeddings.Data[0].Embedding, 16)
+	assert.NotEqual(t, embeddings.Data[0].Embedding, embeddings.Data[1].Embedding)
+
+	edit, err := backend.Edit(ctx, &EditRequest{Model: "fake-model", Input: "helo", Instruction: "Fix the typo"})
+	require.Nil(t, err)
+	require.Len(t, edit.Choices, 1)
+	assert.Equal(t, "hello", edit.Choices[0].Text)
+}
@@ -0,0 +1,517 @@
+package backends
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const DefaultOpenAIBaseURL = "https://api.openai.com/v1"
+
+type HTTPBackendSettings struct {
+	// BaseURL is the URL of the API, for example http://localhost:8080/v1 for a llama.cpp server.
+	BaseURL string
+	// APIKey is sent as bearer token if set. Most self-hosted servers don't need one.
+	APIKey       string
+	Organization string
+	UserAgent    string
+	Timeout      time.Duration
+	HTTPClient   *http.Client
+}
+
+// HTTPBackend talks to any server implementing the OpenAI REST API
+// (OpenAI itself, llama.cpp server, vLLM, ...).
+//
+// Contrary to the go-gpt3 client, it uses the /completions endpoint with the model
+// passed in the request body, which is what most OpenAI-compatible servers implement.
+type HTTPBackend struct {
+	settings   HTTPBackendSettings
+	httpClient *http.Client
+}
+
+func NewHTTPBackend(settings HTTPBackendSettings) *HTTPBackend {
+	if settings.BaseURL == "" {
+		settings.BaseURL = DefaultOpenAIBaseURL
+	}
+	httpClient := settings.HTTPClient
+	if httpClient == nil {
+		timeout := settings.Timeout
+		if timeout == 0 {
+			timeout = 60 * time.Second
+		}
+		httpClient = &http.Client{Timeout: timeout}
+	}
+
+	return &HTTPBackend{
+		settings:   settings,
+		httpClient: httpClient,
+	}
+}
+
+type httpCompletionRequest struct {
+	Model       string   `json:"model"`
+	Prompt      string   `json:"prompt"`
+	MaxTokens   *int     `json:"max_tokens,omitempty"`
+	Temperature *float32 `json:"temperature,omitempty"`
+	TopP        *float32 `json:"top_p,omitempty"`
+	N           *int     `json:"n,omitempty"`
+	LogProbs    *int     `json:"logprobs,omitempty"`
+	Stop        []string `json:"stop,omitempty"`
+	Stream      bool     `json:"stream,omitempty"`
+
+	Suffix           string          `json:"suffix,omitempty"`
+	PresencePenalty  *float32        `json:"presence_penalty,omitempty"`
+	FrequencyPenalty *float32        `json:"frequency_penalty,omitempty"`
+	BestOf           *int            `json:"best_of,omitempty"`
+	LogitBias        map[int]float32 `json:"logit_bias,omitempty"`
+	Echo             bool            `json:"echo,omitempty"`
+	User             string          `json:"user,omitempty"`
+}
+
+type httpLogProbs struct {
+	Tokens        []string             `json:"tokens"`
+	TokenLogProbs []*float32           `json:"token_logprobs"`
+	TopLogProbs   []map[string]float32 `json:"top_logprobs"`
+	TextOffset    []int                `json:"text_offset"`
+}
+
+type httpUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+type httpCompletionResponse struct {
+	ID      string `json:"id"`
+	Model   string `json:"model"`
+	Choices []struct {
+		Index        int           `json:"index"`
+		Text         string        `json:"text"`
+		FinishReason string        `json:"finish_reason"`
+		LogProbs     *httpLogProbs `json:"logprobs"`
+	} `json:"choices"`
+	Usage httpUsage `json:"usage"`
+}
+
+func (h *HTTPBackend) toHTTPRequest(request *CompletionRequest, stream bool) *httpCompletionRequest {
+	return &httpCompletionRequest{
+		Model:       request.Model,
+		Prompt:      request.Prompt,
+		MaxTokens:   request.MaxTokens,
+		Temperature: request.Temperature,
+		TopP:        request.TopP,
+		N:           request.N,
+		LogProbs:    request.LogProbs,
+		Stop:        request.Stop,
+		Stream:      stream,
+
+		Suffix:           request.Suffix,
+		PresencePenalty:  request.PresencePenalty,
+		FrequencyPenalty: request.FrequencyPenalty,
+		BestOf:           request.BestOf,
+		LogitBias:        request.LogitBias,
+		Echo:             request.Echo,
+		User:             request.User,
+	}
+}
+
+func (r *httpCompletionResponse) toCompletionResponse() *CompletionResponse {
+	ret := &CompletionResponse{
+		ID:    r.ID,
+		Model: r.Model,
+		Usage: Usage(r.Usage),
+	}
+	for _, choice := range r.Choices {
+		c := CompletionChoice{
+			Index:        choice.Index,
+			Text:         choice.Text,
+			FinishReason: choice.FinishReason,
+		}
+		if choice.LogProbs != nil && len(choice.LogProbs.Tokens) > 0 {
+			c.LogProbs = &LogProbs{
+				Tokens:        choice.LogProbs.Tokens,
+				TokenLogProbs: choice.LogProbs.TokenLogProbs,
+				TopLogProbs:   choice.LogProbs.TopLogProbs,
+				TextOffset:    choice.LogProbs.TextOffset,
+			}
+		}
+		ret.Choices = append(ret.Choices, c)
+	}
+	return ret
+}
+
+func (h *HTTPBackend) Complete(ctx context.Context, request *CompletionRequest) (*CompletionResponse, error) {
+	resp := &httpCompletionResponse{}
+	err := h.PostJSON(ctx, "/completions", h.toHTTPRequest(request, false), resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp.toCompletionResponse(), nil
+}
+
+func (h *HTTPBackend) CompleteStream(
+	ctx context.Context,
+	request *CompletionRequest,
+	onData func(*CompletionResponse),
+) error {
+	return h.PostStream(ctx, "/completions", h.toHTTPRequest(request, true), func(data []byte) error {
+		resp := &httpCompletionResponse{}
+		if err := json.Unmarshal(data, resp); err != nil {
+			return fmt.Errorf("invalid json stream data: %v", err)
+		}
+		onData(resp.toCompletionResponse())
+		return nil
+	})
+}
+
+type httpChatMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type httpChatRequest struct {
+	Model       string            `json:"model"`
+	Messages    []httpChatMessage `json:"messages"`
+	MaxTokens   *int              `json:"max_tokens,omitempty"`
+	Temperature *float32          `json:"temperature,omitempty"`
+	TopP        *float32          `json:"top_p,omitempty"`
+	N           *int              `json:"n,omitempty"`
+	Stop        []string          `json:"stop,omitempty"`
+	Stream      bool              `json:"stream,omitempty"`
+	User        string            `json:"user,omitempty"`
+}
+
+type httpChatResponse struct {
+	ID      string `json:"id"`
+	Model   string `json:"model"`
+	Choices []struct {
+		Index int `json:"index"`
+		// Message is set for non-streaming responses
+		Message httpChatMessage `json:"message"`
+		// Delta is set for the chunks of a streaming response
+		Delta        httpChatMessage `json:"delta"`
+		FinishReason string          `json:"finish_reason"`
+	} `json:"choices"`
+	Usage httpUsage `json:"usage"`
+}
+
+func (h *HTTPBackend) toHTTPChatRequest(request *ChatRequest, stream bool) *httpChatRequest {
+	ret := &httpChatRequest{
+		Model:       request.Model,
+		Messages:    make([]httpChatMessage, 0, len(request.Messages)),
+		MaxTokens:   request.MaxTokens,
+		Temperature: request.Temperature,
+		TopP:        request.TopP,
+		N:           request.N,
+		Stop:        request.Stop,
+		Stream:      stream,
+		User:        request.User,
+	}
+	for _, message := range request.Messages {
+		ret.Messages = append(ret.Messages, httpChatMessage(message))
+	}
+	return ret
+}
+
+func (r *httpChatResponse) toChatResponse(stream bool) *ChatResponse {
+	ret := &ChatResponse{
+		ID:    r.ID,
+		Model: r.Model,
+		Usage: Usage(r.Usage),
+	}
+	for _, choice := range r.Choices {
+		message := choice.Message
+		if stream {
+			message = choice.Delta
+		}
+		ret.Choices = append(ret.Choices, ChatChoice{
+			Index:        choice.Index,
+			Message:      ChatMessage(message),
+			FinishReason: choice.FinishReason,
+		})
+	}
+	return ret
+}
+
+func (h *HTTPBackend) Chat(ctx context.Context, request *ChatRequest) (*ChatResponse, error) {
+	resp := &httpChatResponse{}
+	err := h.PostJSON(ctx, "/chat/completions", h.toHTTPChatRequest(request, false), resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp.toChatResponse(false), nil
+}
+
+func (h *HTTPBackend) ChatStream(
+	ctx context.Context,
+	request *ChatRequest,
+	onData func(*ChatResponse),
+) error {
+	return h.PostStream(ctx, "/chat/completions", h.toHTTPChatRequest(request, true), func(data []byte) error {
+		resp := &httpChatResponse{}
+		if err := json.Unmarshal(data, resp); err != nil {
+			return fmt.Errorf("invalid json stream data: %v", err)
+		}
+		onData(resp.toChatResponse(true))
+		return nil
+	})
+}
+
+func (h *HTTPBackend) Embed(ctx context.Context, request *EmbeddingsRequest) (*EmbeddingsResponse, error) {
+	payload := map[string]interface{}{
+		"model": request.Model,
+		"input": request.Input,
+	}
+	if request.User != "" {
+		payload["user"] = request.User
+	}
+
+	resp := &struct {
+		Model string `json:"model"`
+		Data  []struct {
+			Index     int       `json:"index"`
+			Embedding []float64 `json:"embedding"`
+		} `json:"data"`
+		Usage httpUsage `json:"usage"`
+	}{}
+	err := h.PostJSON(ctx, "/embeddings", payload, resp)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := &EmbeddingsResponse{
+		Model: resp.Model,
+		Usage: Usage(resp.Usage),
+	}
+	for _, data := range resp.Data {
+		ret.Data = append(ret.Data, Embedding{
+			Index:     data.Index,
+			Embedding: data.Embedding,
+		})
+	}
+	return ret, nil
+}
+
+func (h *HTTPBackend) Edit(ctx context.Context, request *EditRequest) (*EditResponse, error) {
+	payload := map[string]interface{}{
+		"model":       request.Model,
+		"input":       request.Input,
+		"instruction": request.Instruction,
+	}
+	if request.Temperature != nil {
+		payload["temperature"] = *request.Temperature
+	}
+	if request.TopP != nil {
+		payload["top_p"] = *request.TopP
+	}
+	if request.N != nil {
+		payload["n"] = *request.N
+	}
+
+	resp := &struct {
+		Choices []struct {
+			Index int    `json:"index"`
+			Text  string `json:"text"`
+		} `json:"choices"`
+		Usage httpUsage `json:"usage"`
+	}{}
+	err := h.PostJSON(ctx, "/edits", payload, resp)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := &EditResponse{
+		Model: request.Model,
+		Usage: Usage(resp.Usage),
+	}
+	for _, choice := range resp.Choices {
+		ret.Choices = append(ret.Choices, EditChoice{
+			Index: choice.Index,
+			Text:  choice.Text,
+		})
+	}
+	return ret, nil
+}
+
+func (h *HTTPBackend) ListModels(ctx context.Context) ([]*Model, error) {
+	resp := &struct {
+		Data []struct {
+			ID      string `json:"id"`
+			Object  string `json:"object"`
+			OwnedBy string `json:"owned_by"`
+		} `json:"data"`
+	}{}
+
+	req, err := h.newRequest(ctx, "GET", "/models", nil)
+	if err != nil {
+		return nil, err
+	}
+	err = h.do(req, resp)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]*Model, 0, len(resp.Data))
+	for _, model := range resp.Data {
+		ret = append(ret, &Model{
+			ID:     model.ID,
+			Object: model.Object,
+			Owner:  model.OwnedBy,
+			Ready:  true,
+		})
+	}
+	return ret, nil
+}
+
+func (h *HTTPBackend) newRequest(ctx context.Context, method string, path string, payload interface{}) (*http.Request, error) {
+	var body io.Reader
+	if payload != nil {
+		b, err := json.Marshal(payload)
+		if err != nil {
+			return nil, fmt.Errorf("failed encoding json: %w", err)
+		}
+		body = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, h.settings.BaseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if h.settings.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+h.settings.APIKey)
+	}
+	if h.settings.Organization != "" {
+		req.Header.Set("OpenAI-Organization", h.settings.Organization)
+	}
+	if h.settings.UserAgent != "" {
+		req.Header.Set("User-Agent", h.settings.UserAgent)
+	}
+
+	return req, nil
+}
+
+// send sends the request, and converts non 2xx responses to an *APIError.
+func (h *HTTPBackend) send(req *http.Request) (*http.Response, error) {
+	resp, err := h.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from body: %w", err)
+	}
+
+	apiError := &APIError{
+		StatusCode: resp.StatusCode,
+		Type:       "Unexpected",
+		Message:    string(data),
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+	}
+	var result struct {
+		Error struct {
+			Message string `json:"message"`
+			Type    string `json:"type"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(data, &result); err == nil && result.Error.Message != "" {
+		apiError.Type = result.Error.Type
+		apiError.Message = result.Error.Message
+	}
+	return nil, apiError
+}
+
+// parseRetryAfter parses the Retry-After header, which is either a number of seconds or a date.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+func (h *HTTPBackend) do(req *http.Request, out interface{}) error {
+	resp, err := h.send(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("invalid json response: %w", err)
+	}
+	return nil
+}
+
+// PostJSON sends payload as JSON to path, and decodes the JSON response into out.
+func (h *HTTPBackend) PostJSON(ctx context.Context, path string, payload interface{}, out interface{}) error {
+	req, err := h.newRequest(ctx, "POST", path, payload)
+	if err != nil {
+		return err
+	}
+	return h.do(req, out)
+}
+
+var dataPrefix = []byte("data: ")
+var doneSequence = []byte("[DONE]")
+
+// PostStream sends payload as JSON to path, and calls onData with the payload of each
+// server-sent event until the stream is terminated by [DONE].
+func (h *HTTPBackend) PostStream(ctx context.Context, path string, payload interface{}, onData func([]byte) error) error {
+	req, err := h.newRequest(ctx, "POST", path, payload)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+
+	resp, err := h.send(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	reader := bufio.NewReader(resp.Body)
+	for {
+		line, readErr := reader.ReadBytes('\n')
+		if readErr != nil && readErr != io.EOF {
+			return readErr
+		}
+
+		line = bytes.TrimSpace(line)
+		if bytes.HasPrefix(line, dataPrefix) {
+			line = bytes.TrimPrefix(line, dataPrefix)
+			if bytes.HasPrefix(line, doneSequence) {
+				return nil
+			}
+			if err := onData(line); err != nil {
+				return err
+			}
+		}
+
+		if readErr == io.EOF {
+			return nil
+		}
+	}
+}
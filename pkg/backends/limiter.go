@@ -0,0 +1,317 @@
+package backends
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// LimiterSettings configures a Limiter. A value of 0 disables the corresponding limit.
+type LimiterSettings struct {
+	RequestsPerMinute int `yaml:"requests_per_minute,omitempty"`
+	TokensPerMinute   int `yaml:"tokens_per_minute,omitempty"`
+	MaxInFlight       int `yaml:"max_in_flight,omitempty"`
+}
+
+// tokenBucket refills capacity units per minute, and lets the level go negative when
+// more units are used than were reserved.
+type tokenBucket struct {
+	mu         sync.Mutex
+	capacity   float64
+	available  float64
+	lastRefill time.Time
+}
+
+func newTokenBucket(perMinute int) *tokenBucket {
+	return &tokenBucket{
+		capacity:   float64(perMinute),
+		available:  float64(perMinute),
+		lastRefill: time.Now(),
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	elapsed := now.Sub(b.lastRefill)
+	b.lastRefill = now
+	b.available += elapsed.Minutes() * b.capacity
+	if b.available > b.capacity {
+		b.available = b.capacity
+	}
+}
+
+// take removes n units, waiting until they are available. Requests bigger than the
+// capacity wait for a full bucket.
+func (b *tokenBucket) take(ctx context.Context, n int) error {
+	needed := float64(n)
+	if needed > b.capacity {
+		needed = b.capacity
+	}
+
+	for {
+		b.mu.Lock()
+		now := time.Now()
+		b.refill(now)
+		if b.available >= needed {
+			b.available -= float64(n)
+			b.mu.Unlock()
+			return nil
+		}
+		wait := time.Duration((needed - b.available) / b.capacity * float64(time.Minute))
+		b.mu.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// adjust corrects the level after the actual usage of a request is known.
+func (b *tokenBucket) adjust(n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.available -= float64(n)
+	if b.available > b.capacity {
+		b.available = b.capacity
+	}
+}
+
+// Limiter limits the requests sent to a provider, so that parallel steps don't exhaust
+// the quota of the organization. A single Limiter is meant to be shared by all the steps
+// created from the same settings.
+//
+// The methods of a nil *Limiter don't limit anything.
+type Limiter struct {
+	settings LimiterSettings
+	requests *tokenBucket
+	tokens   *tokenBucket
+	inFlight chan struct{}
+}
+
+func NewLimiter(settings LimiterSettings) *Limiter {
+	ret := &Limiter{
+		settings: settings,
+	}
+	if settings.RequestsPerMinute > 0 {
+		ret.requests = newTokenBucket(settings.RequestsPerMinute)
+	}
+	if settings.TokensPerMinute > 0 {
+		ret.tokens = newTokenBucket(settings.TokensPerMinute)
+	}
+	if settings.MaxInFlight > 0 {
+		ret.inFlight = make(chan struct{}, settings.MaxInFlight)
+	}
+	return ret
+}
+
+func (l *Limiter) Settings() LimiterSettings {
+	if l == nil {
+		return LimiterSettings{}
+	}
+	return l.settings
+}
+
+// Acquire blocks until a request using the estimated number of tokens can be sent,
+// or ctx is cancelled. The returned function must be called once the request is done.
+func (l *Limiter) Acquire(ctx context.Context, tokens int) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+
+	if l.inFlight != nil {
+		select {
+		case l.inFlight <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	release := func() {
+		if l.inFlight != nil {
+			<-l.inFlight
+		}
+	}
+
+	if l.requests != nil {
+		if err := l.requests.take(ctx, 1); err != nil {
+			release()
+			return nil, err
+		}
+	}
+	if l.tokens != nil {
+		if err := l.tokens.take(ctx, tokens); err != nil {
+			// the request is not sent, give its slot back
+			if l.requests != nil {
+				l.requests.adjust(-1)
+			}
+			release()
+			return nil, err
+		}
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(release)
+	}, nil
+}
+
+// RecordUsage corrects the token budget once the actual number of tokens used by a request
+// with the given estimate is known.
+func (l *Limiter) RecordUsage(estimated int, actual int) {
+	if l == nil || l.tokens == nil || actual <= 0 {
+		return
+	}
+	l.tokens.adjust(actual - estimated)
+}
+
+// EstimateTokens returns a rough estimate of the number of tokens used by a request,
+// counting 4 characters per token for the prompt and the maximum length of each completion.
+func EstimateTokens(prompt string, maxTokens *int, n *int) int {
+	ret := (len(prompt) + 3) / 4
+	completions := 1
+	if n != nil && *n > 0 {
+		completions = *n
+	}
+	if maxTokens != nil {
+		ret += *maxTokens * completions
+	}
+	return ret
+}
+
+// LimitedBackend sends the requests of a Backend through a Limiter.
+type LimitedBackend struct {
+	backend Backend
+	limiter *Limiter
+}
+
+func NewLimitedBackend(backend Backend, limiter *Limiter) *LimitedBackend {
+	return &LimitedBackend{
+		backend: backend,
+		limiter: limiter,
+	}
+}
+
+// estimateCompletionTokens estimates the tokens of a completion request, including the suffix
+// and all the completions generated for best_of.
+func estimateCompletionTokens(request *CompletionRequest) int {
+	n := request.Completions()
+	return EstimateTokens(request.Prompt+request.Suffix, request.MaxTokens, &n)
+}
+
+func (l *LimitedBackend) Complete(ctx context.Context, request *CompletionRequest) (*CompletionResponse, error) {
+	estimate := estimateCompletionTokens(request)
+	release, err := l.limiter.Acquire(ctx, estimate)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	resp, err := l.backend.Complete(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	l.limiter.RecordUsage(estimate, resp.Usage.TotalTokens)
+	return resp, nil
+}
+
+func (l *LimitedBackend) CompleteStream(
+	ctx context.Context,
+	request *CompletionRequest,
+	onData func(*CompletionResponse),
+) error {
+	release, err := l.limiter.Acquire(ctx, estimateCompletionTokens(request))
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	return l.backend.CompleteStream(ctx, request, onData)
+}
+
+// estimateChatTokens estimates the tokens of a chat request from the content of its messages.
+func estimateChatTokens(request *ChatRequest) int {
+	prompt := ""
+	for _, message := range request.Messages {
+		prompt += message.Content
+	}
+	return EstimateTokens(prompt, request.MaxTokens, request.N)
+}
+
+func (l *LimitedBackend) Chat(ctx context.Context, request *ChatRequest) (*ChatResponse, error) {
+	estimate := estimateChatTokens(request)
+	release, err := l.limiter.Acquire(ctx, estimate)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	resp, err := l.backend.Chat(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	l.limiter.RecordUsage(estimate, resp.Usage.TotalTokens)
+	return resp, nil
+}
+
+func (l *LimitedBackend) ChatStream(
+	ctx context.Context,
+	request *ChatRequest,
+	onData func(*ChatResponse),
+) error {
+	release, err := l.limiter.Acquire(ctx, estimateChatTokens(request))
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	return l.backend.ChatStream(ctx, request, onData)
+}
+
+func (l *LimitedBackend) Embed(ctx context.Context, request *EmbeddingsRequest) (*EmbeddingsResponse, error) {
+	estimate := 0
+	for _, input := range request.Input {
+		estimate += EstimateTokens(input, nil, nil)
+	}
+	release, err := l.limiter.Acquire(ctx, estimate)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	resp, err := l.backend.Embed(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	l.limiter.RecordUsage(estimate, resp.Usage.TotalTokens)
+	return resp, nil
+}
+
+func (l *LimitedBackend) Edit(ctx context.Context, request *EditRequest) (*EditResponse, error) {
+	// each edit is about as long as the input
+	editTokens := EstimateTokens(request.Input, nil, nil)
+	estimate := EstimateTokens(request.Instruction+request.Input, &editTokens, request.N)
+	release, err := l.limiter.Acquire(ctx, estimate)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	resp, err := l.backend.Edit(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	l.limiter.RecordUsage(estimate, resp.Usage.TotalTokens)
+	return resp, nil
+}
+
+func (l *LimitedBackend) ListModels(ctx context.Context) ([]*Model, error) {
+	release, err := l.limiter.Acquire(ctx, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	return l.backend.ListModels(ctx)
+}
@@ -0,0 +1,130 @@
+package backends
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLimiterMaxInFlight(t *testing.T) {
+	limiter := NewLimiter(LimiterSettings{MaxInFlight: 2})
+
+	var inFlight, maxInFlight int32
+	wg := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release, err := limiter.Acquire(context.Background(), 0)
+			require.Nil(t, err)
+			defer release()
+
+			n := atomic.AddInt32(&inFlight, 1)
+			for {
+				m := atomic.LoadInt32(&maxInFlight)
+				if n <= m || atomic.CompareAndSwapInt32(&maxInFlight, m, n) {
+					break
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+			atomic.AddInt32(&inFlight, -1)
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(2), maxInFlight)
+}
+
+func TestLimiterRequestsPerMinuteBlocks(t *testing.T) {
+	limiter := NewLimiter(LimiterSettings{RequestsPerMinute: 2})
+
+	for i := 0; i < 2; i++ {
+		release, err := limiter.Acquire(context.Background(), 0)
+		require.Nil(t, err)
+		release()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := limiter.Acquire(ctx, 0)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestLimiterTokensPerMinute(t *testing.T) {
+	limiter := NewLimiter(LimiterSettings{TokensPerMinute: 100})
+
+	release, err := limiter.Acquire(context.Background(), 60)
+	require.Nil(t, err)
+	release()
+	// the request used more tokens than estimated
+	limiter.RecordUsage(60, 100)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = limiter.Acquire(ctx, 10)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestLimiterCancelledRequestKeepsRequestBudget(t *testing.T) {
+	limiter := NewLimiter(LimiterSettings{RequestsPerMinute: 2, TokensPerMinute: 100})
+
+	release, err := limiter.Acquire(context.Background(), 100)
+	require.Nil(t, err)
+	release()
+
+	// cancelled while waiting for tokens, the request is never sent
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+		_, err = limiter.Acquire(ctx, 50)
+		cancel()
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	release, err = limiter.Acquire(ctx, 0)
+	require.Nil(t, err)
+	release()
+}
+
+func TestNilLimiter(t *testing.T) {
+	var limiter *Limiter
+	release, err := limiter.Acquire(context.Background(), 1000)
+	require.Nil(t, err)
+	release()
+	limiter.RecordUsage(10, 20)
+}
+
+func TestLimitedBackend(t *testing.T) {
+	fake := NewFakeBackend()
+	fake.Default = &FakeResponse{Text: "ok"}
+	backend := NewLimitedBackend(fake, NewLimiter(LimiterSettings{RequestsPerMinute: 1}))
+
+	_, err := backend.Complete(context.Background(), &CompletionRequest{Prompt: "foo"})
+	require.Nil(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = backend.Complete(ctx, &CompletionRequest{Prompt: "foo"})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Len(t, fake.Requests(), 1)
+}
+
+func TestEstimateCompletionTokens(t *testing.T) {
+	maxTokens := 10
+	n := 2
+	bestOf := 5
+	request := &CompletionRequest{Prompt: "12345678", MaxTokens: &maxTokens, N: &n}
+	assert.Equal(t, 2+20, estimateCompletionTokens(request))
+
+	// best_of completions are generated (and billed) even if only n are returned
+	request.BestOf = &bestOf
+	assert.Equal(t, 2+50, estimateCompletionTokens(request))
+
+	request.Suffix = "abcd"
+	assert.Equal(t, 3+50, estimateCompletionTokens(request))
+}
@@ -0,0 +1,65 @@
+package backends
+
+import (
+	"math"
+	"sort"
+)
+
+// TokenLogProb is a token and the log probability of the model sampling it.
+type TokenLogProb struct {
+	Token   string
+	LogProb float32
+}
+
+// TopAlternatives returns the most likely tokens at position i of the completion,
+// most likely first. It is empty if the request didn't ask for logprobs alternatives.
+func (l *LogProbs) TopAlternatives(i int) []TokenLogProb {
+	if i >= len(l.TopLogProbs) {
+		return nil
+	}
+	ret := make([]TokenLogProb, 0, len(l.TopLogProbs[i]))
+	for token, logProb := range l.TopLogProbs[i] {
+		ret = append(ret, TokenLogProb{Token: token, LogProb: logProb})
+	}
+	sort.Slice(ret, func(a, b int) bool {
+		if ret[a].LogProb != ret[b].LogProb {
+			return ret[a].LogProb > ret[b].LogProb
+		}
+		return ret[a].Token < ret[b].Token
+	})
+	return ret
+}
+
+// LogProbMetrics summarizes the confidence of the model in a completion,
+// to compare the choices of a request.
+type LogProbMetrics struct {
+	Tokens int
+	// MeanLogProb is the average log probability of the tokens, higher is more confident
+	MeanLogProb float64
+	// MinLogProb is the log probability of the least likely token
+	MinLogProb float64
+	// Perplexity is exp(-MeanLogProb), 1 if the model was certain of every token
+	Perplexity float64
+}
+
+// Metrics computes the confidence metrics of the tokens of the completion.
+// The tokens without a logprob are left out.
+func (l *LogProbs) Metrics() LogProbMetrics {
+	ret := LogProbMetrics{}
+	sum := 0.0
+	ret.MinLogProb = math.Inf(1)
+	for _, logProb := range l.TokenLogProbs {
+		if logProb == nil {
+			continue
+		}
+		ret.Tokens++
+		sum += float64(*logProb)
+		ret.MinLogProb = math.Min(ret.MinLogProb, float64(*logProb))
+	}
+	if ret.Tokens == 0 {
+		return LogProbMetrics{}
+	}
+	ret.MeanLogProb = sum / float64(ret.Tokens)
+	ret.Perplexity = math.Exp(-ret.MeanLogProb)
+	return ret
+}
@@ -0,0 +1,67 @@
+package backends
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"math"
+	"testing"
+)
+
+func TestLogProbsMetrics(t *testing.T) {
+	logProbs := &LogProbs{
+		Tokens:        []string{" yes", "."},
+		TokenLogProbs: []*float32{float32Ptr(-0.5), float32Ptr(-1.5)},
+		TopLogProbs: []map[string]float32{
+			{" yes": -0.5, " no": -1, " maybe": -1},
+			{".": -1.5},
+		},
+		TextOffset: []int{0, 4},
+	}
+
+	metrics := logProbs.Metrics()
+	assert.Equal(t, 2, metrics.Tokens)
+	assert.InDelta(t, -1.0, metrics.MeanLogProb, 1e-6)
+	assert.InDelta(t, -1.5, metrics.MinLogProb, 1e-6)
+	assert.InDelta(t, math.E, metrics.Perplexity, 1e-6)
+
+	assert.Equal(t, []TokenLogProb{
+		{Token: " yes", LogProb: -0.5},
+		{Token: " maybe", LogProb: -1},
+		{Token: " no", LogProb: -1},
+	}, logProbs.TopAlternatives(0))
+	assert.Empty(t, logProbs.TopAlternatives(2))
+
+	assert.Equal(t, LogProbMetrics{}, (&LogProbs{}).Metrics())
+
+	// the first token of an echoed prompt has no logprob
+	echo := &LogProbs{
+		Tokens:        []string{"Say", " yes"},
+		TokenLogProbs: []*float32{nil, float32Ptr(-0.5)},
+	}
+	metrics = echo.Metrics()
+	assert.Equal(t, 1, metrics.Tokens)
+	assert.InDelta(t, -0.5, metrics.MeanLogProb, 1e-6)
+	assert.InDelta(t, -0.5, metrics.MinLogProb, 1e-6)
+}
+
+func TestDecodeEchoLogProbs(t *testing.T) {
+	resp := &httpCompletionResponse{}
+	err := json.Unmarshal([]byte(`{"choices": [{"index": 0, "text": "Say yes", "logprobs": {
+		"tokens": ["Say", " yes"],
+		"token_logprobs": [null, -0.5],
+		"top_logprobs": [null, {" yes": -0.5}],
+		"text_offset": [0, 3]
+	}}]}`), resp)
+	require.Nil(t, err)
+
+	logProbs := resp.toCompletionResponse().Choices[0].LogProbs
+	require.NotNil(t, logProbs)
+	assert.Nil(t, logProbs.TokenLogProbs[0])
+	assert.Equal(t, float32(-0.5), *logProbs.TokenLogProbs[1])
+	assert.Empty(t, logProbs.TopAlternatives(0))
+}
+
+func float32Ptr(f float32) *float32 {
+	return &f
+}
@@ -0,0 +1,186 @@
+package backends
+
+import (
+	"context"
+	"github.com/PullRequestInc/go-gpt3"
+	"github.com/pkg/errors"
+	"net/http"
+	"time"
+)
+
+// OpenAIBackend talks to the OpenAI API using the go-gpt3 client.
+//
+// go-gpt3 doesn't support all the parameters of completions (suffix, best_of, logit_bias, user),
+// nor the chat completions, so these are sent by the completions backend, usually an HTTPBackend
+// talking to the same API.
+type OpenAIBackend struct {
+	client      gpt3.Client
+	completions Backend
+}
+
+func NewOpenAIBackend(client gpt3.Client, completions Backend) (*OpenAIBackend, error) {
+	if completions == nil {
+		return nil, errors.New("the OpenAI backend needs a backend to send the completions")
+	}
+	return &OpenAIBackend{
+		client:      client,
+		completions: completions,
+	}, nil
+}
+
+type retryAfterKey struct{}
+
+// withRetryAfter returns a context in which the RetryAfterTransport stores the Retry-After
+// header of an error response, since the errors of go-gpt3 don't include the headers.
+func withRetryAfter(ctx context.Context) (context.Context, *time.Duration) {
+	retryAfter := new(time.Duration)
+	return context.WithValue(ctx, retryAfterKey{}, retryAfter), retryAfter
+}
+
+// RetryAfterTransport records the Retry-After header of error responses, so that the
+// OpenAIBackend can honour it. The http.Client passed to go-gpt3 has to use it.
+type RetryAfterTransport struct {
+	Base http.RoundTripper
+}
+
+func (t *RetryAfterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	resp, err := base.RoundTrip(req)
+	if err != nil || resp.StatusCode < 400 {
+		return resp, err
+	}
+	if retryAfter, ok := req.Context().Value(retryAfterKey{}).(*time.Duration); ok {
+		*retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
+	}
+	return resp, nil
+}
+
+// NewOpenAIHTTPClient returns the http.Client to pass to go-gpt3: a copy of httpClient, or a
+// client with timeout if httpClient is nil, using a RetryAfterTransport.
+func NewOpenAIHTTPClient(httpClient *http.Client, timeout time.Duration) *http.Client {
+	ret := &http.Client{Timeout: timeout}
+	if httpClient != nil {
+		c := *httpClient
+		ret = &c
+	}
+	ret.Transport = &RetryAfterTransport{Base: ret.Transport}
+	return ret
+}
+
+func (o *OpenAIBackend) Complete(ctx context.Context, request *CompletionRequest) (*CompletionResponse, error) {
+	return o.completions.Complete(ctx, request)
+}
+
+func (o *OpenAIBackend) CompleteStream(
+	ctx context.Context,
+	request *CompletionRequest,
+	onData func(*CompletionResponse),
+) error {
+	return o.completions.CompleteStream(ctx, request, onData)
+}
+
+func (o *OpenAIBackend) Chat(ctx context.Context, request *ChatRequest) (*ChatResponse, error) {
+	return o.completions.Chat(ctx, request)
+}
+
+func (o *OpenAIBackend) ChatStream(
+	ctx context.Context,
+	request *ChatRequest,
+	onData func(*ChatResponse),
+) error {
+	return o.completions.ChatStream(ctx, request, onData)
+}
+
+func (o *OpenAIBackend) Embed(ctx context.Context, request *EmbeddingsRequest) (*EmbeddingsResponse, error) {
+	ctx, retryAfter := withRetryAfter(ctx)
+	resp, err := o.client.Embeddings(ctx, gpt3.EmbeddingsRequest{
+		Input: request.Input,
+		Model: request.Model,
+		User:  request.User,
+	})
+	if err != nil {
+		return nil, convertGPT3Error(err, *retryAfter)
+	}
+
+	ret := &EmbeddingsResponse{
+		Model: request.Model,
+		Usage: Usage{
+			PromptTokens: resp.Usage.PromptTokens,
+			TotalTokens:  resp.Usage.TotalTokens,
+		},
+	}
+	for _, data := range resp.Data {
+		ret.Data = append(ret.Data, Embedding{
+			Index:     data.Index,
+			Embedding: data.Embedding,
+		})
+	}
+	return ret, nil
+}
+
+func (o *OpenAIBackend) Edit(ctx context.Context, request *EditRequest) (*EditResponse, error) {
+	ctx, retryAfter := withRetryAfter(ctx)
+	resp, err := o.client.Edits(ctx, gpt3.EditsRequest{
+		Model:       request.Model,
+		Input:       request.Input,
+		Instruction: request.Instruction,
+		Temperature: request.Temperature,
+		TopP:        request.TopP,
+		N:           request.N,
+	})
+	if err != nil {
+		return nil, convertGPT3Error(err, *retryAfter)
+	}
+
+	ret := &EditResponse{
+		Model: request.Model,
+		Usage: Usage(resp.Usage),
+	}
+	for _, choice := range resp.Choices {
+		ret.Choices = append(ret.Choices, EditChoice{
+			Index: choice.Index,
+			Text:  choice.Text,
+		})
+	}
+	return ret, nil
+}
+
+func (o *OpenAIBackend) ListModels(ctx context.Context) ([]*Model, error) {
+	ctx, retryAfter := withRetryAfter(ctx)
+	resp, err := o.client.Engines(ctx)
+	if err != nil {
+		return nil, convertGPT3Error(err, *retryAfter)
+	}
+
+	ret := make([]*Model, 0, len(resp.Data))
+	for _, engine := range resp.Data {
+		ret = append(ret, &Model{
+			ID:     engine.ID,
+			Object: engine.Object,
+			Owner:  engine.Owner,
+			Ready:  engine.Ready,
+		})
+	}
+	return ret, nil
+}
+
+// convertGPT3Error converts the errors returned by the API to *APIError, with the delay
+// requested by the Retry-After header recorded by the RetryAfterTransport.
+func convertGPT3Error(err error, retryAfter time.Duration) error {
+	if err == nil {
+		return nil
+	}
+	var apiError gpt3.APIError
+	if errors.As(err, &apiError) {
+		return &APIError{
+			StatusCode: apiError.StatusCode,
+			Type:       apiError.Type,
+			Message:    apiError.Message,
+			RetryAfter: retryAfter,
+		}
+	}
+	return err
+}
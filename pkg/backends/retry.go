@@ -0,0 +1,269 @@
+package backends
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+	"io"
+	"math/rand"
+	"net"
+	"time"
+)
+
+// RetrySettings configures how failed requests are retried.
+//
+// The delay before the n-th retry is BackoffBase * 2^n, capped at BackoffCap, and reduced
+// by a random fraction of up to Jitter. If the server sent a Retry-After header and
+// RespectRetryAfter is set, its value is used instead when it is longer.
+type RetrySettings struct {
+	MaxRetries  int           `yaml:"max_retries"`
+	BackoffBase time.Duration `yaml:"backoff_base"`
+	BackoffCap  time.Duration `yaml:"backoff_cap"`
+	// Jitter is the fraction (between 0 and 1) of the delay that is randomized
+	Jitter               float64 `yaml:"jitter"`
+	RetryableStatusCodes []int   `yaml:"retryable_status_codes"`
+	RespectRetryAfter    bool    `yaml:"respect_retry_after"`
+}
+
+func NewRetrySettings() *RetrySettings {
+	return &RetrySettings{
+		MaxRetries:           3,
+		BackoffBase:          time.Second,
+		BackoffCap:           30 * time.Second,
+		Jitter:               0.2,
+		RetryableStatusCodes: []int{408, 409, 429, 500, 502, 503, 504},
+		RespectRetryAfter:    true,
+	}
+}
+
+func (r *RetrySettings) Clone() *RetrySettings {
+	ret := *r
+	ret.RetryableStatusCodes = append([]int{}, r.RetryableStatusCodes...)
+	return &ret
+}
+
+// UnmarshalYAML fills in the defaults for the fields that are not in the YAML.
+func (r *RetrySettings) UnmarshalYAML(value *yaml.Node) error {
+	type Alias RetrySettings
+	aux := (*Alias)(NewRetrySettings())
+	if err := value.Decode(aux); err != nil {
+		return err
+	}
+	*r = RetrySettings(*aux)
+	return nil
+}
+
+// IsRetryable returns true for API errors with one of the RetryableStatusCodes, and for network errors.
+func (r *RetrySettings) IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var apiError *APIError
+	if errors.As(err, &apiError) {
+		for _, code := range r.RetryableStatusCodes {
+			if apiError.StatusCode == code {
+				return true
+			}
+		}
+		return false
+	}
+
+	var netError net.Error
+	if errors.As(err, &netError) {
+		return true
+	}
+	return errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// Delay returns how long to wait before the retry with the given number (starting at 0).
+func (r *RetrySettings) Delay(retry int, err error) time.Duration {
+	delay := r.BackoffBase
+	for i := 0; i < retry && (r.BackoffCap <= 0 || delay < r.BackoffCap); i++ {
+		delay *= 2
+	}
+	if r.BackoffCap > 0 && delay > r.BackoffCap {
+		delay = r.BackoffCap
+	}
+	if r.Jitter > 0 {
+		delay -= time.Duration(rand.Float64() * r.Jitter * float64(delay))
+	}
+
+	var apiError *APIError
+	if r.RespectRetryAfter && errors.As(err, &apiError) && apiError.RetryAfter > delay {
+		delay = apiError.RetryAfter
+	}
+
+	return delay
+}
+
+// ShouldRetry returns the delay to wait before retrying after the given number of retries,
+// or false if err should not be retried.
+func (r *RetrySettings) ShouldRetry(retry int, err error) (time.Duration, bool) {
+	if retry >= r.MaxRetries || !r.IsRetryable(err) {
+		return 0, false
+	}
+	return r.Delay(retry, err), true
+}
+
+// Retry calls f until it succeeds, returns an error that is not retryable, or
+// MaxRetries is exhausted. A nil RetrySettings calls f once.
+func Retry(ctx context.Context, settings *RetrySettings, operation string, f func() error) error {
+	for retry := 0; ; retry++ {
+		if settings != nil {
+			log.Debug().Str("operation", operation).Int("attempt", retry+1).Msg("sending request")
+		}
+		err := f()
+		if err == nil || settings == nil {
+			return err
+		}
+
+		delay, ok := settings.ShouldRetry(retry, err)
+		if !ok {
+			return err
+		}
+
+		log.Warn().
+			Str("operation", operation).
+			Int("attempt", retry+1).
+			Int("max_retries", settings.MaxRetries).
+			Dur("delay", delay).
+			Err(err).
+			Msg("request failed, retrying")
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// RetryStream is Retry for streaming requests: f calls received when it gets data, after which
+// errors are not retried anymore.
+func RetryStream(ctx context.Context, settings *RetrySettings, operation string, f func(received func()) error) error {
+	hasReceived := false
+	received := func() {
+		hasReceived = true
+	}
+	err := Retry(ctx, settings, operation, func() error {
+		err := f(received)
+		if err != nil && hasReceived {
+			return &nonRetryableError{err}
+		}
+		return err
+	})
+
+	var nonRetryable *nonRetryableError
+	if errors.As(err, &nonRetryable) {
+		return nonRetryable.err
+	}
+	return err
+}
+
+// RetryBackend retries the requests of a Backend according to its RetrySettings.
+type RetryBackend struct {
+	backend  Backend
+	settings *RetrySettings
+}
+
+func NewRetryBackend(backend Backend, settings *RetrySettings) *RetryBackend {
+	return &RetryBackend{
+		backend:  backend,
+		settings: settings,
+	}
+}
+
+func (r *RetryBackend) Complete(ctx context.Context, request *CompletionRequest) (*CompletionResponse, error) {
+	var ret *CompletionResponse
+	err := Retry(ctx, r.settings, "complete", func() error {
+		var err error
+		ret, err = r.backend.Complete(ctx, request)
+		return err
+	})
+	return ret, err
+}
+
+// CompleteStream only retries if the request failed before any data was received,
+// since the chunks already passed to onData can't be taken back.
+func (r *RetryBackend) CompleteStream(
+	ctx context.Context,
+	request *CompletionRequest,
+	onData func(*CompletionResponse),
+) error {
+	return RetryStream(ctx, r.settings, "complete-stream", func(received func()) error {
+		return r.backend.CompleteStream(ctx, request, func(resp *CompletionResponse) {
+			received()
+			onData(resp)
+		})
+	})
+}
+
+func (r *RetryBackend) Chat(ctx context.Context, request *ChatRequest) (*ChatResponse, error) {
+	var ret *ChatResponse
+	err := Retry(ctx, r.settings, "chat", func() error {
+		var err error
+		ret, err = r.backend.Chat(ctx, request)
+		return err
+	})
+	return ret, err
+}
+
+// ChatStream only retries if the request failed before any data was received, like CompleteStream.
+func (r *RetryBackend) ChatStream(
+	ctx context.Context,
+	request *ChatRequest,
+	onData func(*ChatResponse),
+) error {
+	return RetryStream(ctx, r.settings, "chat-stream", func(received func()) error {
+		return r.backend.ChatStream(ctx, request, func(resp *ChatResponse) {
+			received()
+			onData(resp)
+		})
+	})
+}
+
+func (r *RetryBackend) Embed(ctx context.Context, request *EmbeddingsRequest) (*EmbeddingsResponse, error) {
+	var ret *EmbeddingsResponse
+	err := Retry(ctx, r.settings, "embed", func() error {
+		var err error
+		ret, err = r.backend.Embed(ctx, request)
+		return err
+	})
+	return ret, err
+}
+
+func (r *RetryBackend) Edit(ctx context.Context, request *EditRequest) (*EditResponse, error) {
+	var ret *EditResponse
+	err := Retry(ctx, r.settings, "edit", func() error {
+		var err error
+		ret, err = r.backend.Edit(ctx, request)
+		return err
+	})
+	return ret, err
+}
+
+func (r *RetryBackend) ListModels(ctx context.Context) ([]*Model, error) {
+	var ret []*Model
+	err := Retry(ctx, r.settings, "list-models", func() error {
+		var err error
+		ret, err = r.backend.ListModels(ctx)
+		return err
+	})
+	return ret, err
+}
+
+// nonRetryableError hides the wrapped error from IsRetryable.
+type nonRetryableError struct {
+	err error
+}
+
+func (n *nonRetryableError) Error() string {
+	return n.err.Error()
+}
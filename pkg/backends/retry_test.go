@@ -0,0 +1,147 @@
+package backends
+
+import (
+	"context"
+	"github.com/PullRequestInc/go-gpt3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+	"testing"
+	"time"
+)
+
+func newTestRetrySettings() *RetrySettings {
+	settings := NewRetrySettings()
+	settings.BackoffBase = time.Millisecond
+	settings.BackoffCap = 5 * time.Millisecond
+	return settings
+}
+
+func TestRetryBackendRetriesRateLimits(t *testing.T) {
+	fake := NewFakeBackend()
+	rateLimit := &FakeResponse{Error: &APIError{StatusCode: 429, Type: "rate_limit_exceeded", Message: "slow down"}}
+	fake.AddSequenceResponses(rateLimit, rateLimit, &FakeResponse{Text: "ok"})
+	server := NewFakeOpenAIServer(fake)
+	defer server.Close()
+
+	backend := NewRetryBackend(NewHTTPBackend(HTTPBackendSettings{BaseURL: server.URL}), newTestRetrySettings())
+	resp, err := backend.Complete(context.Background(), &CompletionRequest{Prompt: "foo"})
+	require.Nil(t, err)
+	assert.Equal(t, "ok", resp.Choices[0].Text)
+	assert.Len(t, fake.Requests(), 3)
+}
+
+func TestRetryBackendRetriesEmbeddings(t *testing.T) {
+	fake := NewFakeBackend()
+	fake.AddSequenceResponses(&FakeResponse{Error: &APIError{StatusCode: 429, Type: "rate_limit_exceeded", Message: "slow down"}})
+	server := NewFakeOpenAIServer(fake)
+	defer server.Close()
+
+	backend := NewRetryBackend(NewHTTPBackend(HTTPBackendSettings{BaseURL: server.URL}), newTestRetrySettings())
+	resp, err := backend.Embed(context.Background(), &EmbeddingsRequest{Model: "fake-embeddings", Input: []string{"foo"}})
+	require.Nil(t, err)
+	assert.Len(t, resp.Data, 1)
+	assert.Len(t, fake.EmbeddingsRequests(), 2)
+}
+
+func TestRetryBackendRetriesChat(t *testing.T) {
+	fake := NewFakeBackend()
+	fake.AddSequenceResponses(&FakeResponse{Error: &APIError{StatusCode: 429, Type: "rate_limit_exceeded", Message: "slow down"}})
+	fake.Default = &FakeResponse{Text: "Hi there"}
+	server := NewFakeOpenAIServer(fake)
+	defer server.Close()
+
+	backend := NewRetryBackend(NewHTTPBackend(HTTPBackendSettings{BaseURL: server.URL}), newTestRetrySettings())
+	request := &ChatRequest{Model: "fake-model", Messages: []ChatMessage{{Role: "user", Content: "hi"}}}
+	resp, err := backend.Chat(context.Background(), request)
+	require.Nil(t, err)
+	assert.Equal(t, "Hi there", resp.Choices[0].Message.Content)
+	assert.Len(t, fake.Requests(), 2)
+
+	fake.AddSequenceResponses(&FakeResponse{Error: &APIError{StatusCode: 429, Type: "rate_limit_exceeded", Message: "slow down"}})
+	text := ""
+	err = backend.ChatStream(context.Background(), request, func(resp *ChatResponse) {
+		text += resp.Choices[0].Message.Content
+	})
+	require.Nil(t, err)
+	assert.Equal(t, "Hi there", text)
+	assert.Len(t, fake.Requests(), 4)
+}
+
+func TestRetryBackendGivesUp(t *testing.T) {
+	fake := NewFakeBackend()
+	fake.Default = &FakeResponse{Error: &APIError{StatusCode: 503, Type: "server_error", Message: "overloaded"}}
+
+	settings := newTestRetrySettings()
+	settings.MaxRetries = 2
+	backend := NewRetryBackend(fake, settings)
+	_, err := backend.Complete(context.Background(), &CompletionRequest{Prompt: "foo"})
+	apiError, ok := err.(*APIError)
+	require.True(t, ok)
+	assert.Equal(t, 503, apiError.StatusCode)
+	assert.Len(t, fake.Requests(), 3)
+}
+
+func TestRetryBackendDoesNotRetryClientErrors(t *testing.T) {
+	fake := NewFakeBackend()
+	fake.Default = &FakeResponse{Error: &APIError{StatusCode: 400, Type: "invalid_request_error", Message: "bad"}}
+
+	backend := NewRetryBackend(fake, newTestRetrySettings())
+	err := backend.CompleteStream(context.Background(), &CompletionRequest{Prompt: "foo"}, func(*CompletionResponse) {})
+	assert.Error(t, err)
+	assert.Len(t, fake.Requests(), 1)
+}
+
+func TestRetryDelay(t *testing.T) {
+	settings := NewRetrySettings()
+	settings.Jitter = 0
+	assert.Equal(t, time.Second, settings.Delay(0, nil))
+	assert.Equal(t, 4*time.Second, settings.Delay(2, nil))
+	assert.Equal(t, 30*time.Second, settings.Delay(10, nil))
+
+	err := &APIError{StatusCode: 429, RetryAfter: 10 * time.Second}
+	assert.Equal(t, 10*time.Second, settings.Delay(0, err))
+	settings.RespectRetryAfter = false
+	assert.Equal(t, time.Second, settings.Delay(0, err))
+}
+
+func TestRetryAfterHeader(t *testing.T) {
+	fake := NewFakeBackend()
+	fake.Default = &FakeResponse{Error: &APIError{StatusCode: 429, Type: "rate_limit_exceeded", Message: "slow down", RetryAfter: 2 * time.Second}}
+	server := NewFakeOpenAIServer(fake)
+	defer server.Close()
+
+	_, err := NewHTTPBackend(HTTPBackendSettings{BaseURL: server.URL}).
+		Complete(context.Background(), &CompletionRequest{Prompt: "foo"})
+	apiError, ok := err.(*APIError)
+	require.True(t, ok)
+	assert.Equal(t, 2*time.Second, apiError.RetryAfter)
+
+	// go-gpt3 doesn't return the headers, they are recorded by the transport of its client
+	client := gpt3.NewClient("test",
+		gpt3.WithBaseURL(server.URL),
+		gpt3.WithHTTPClient(NewOpenAIHTTPClient(nil, 10*time.Second)))
+	backend, err := NewOpenAIBackend(client, NewHTTPBackend(HTTPBackendSettings{BaseURL: server.URL}))
+	require.Nil(t, err)
+
+	ctx := context.Background()
+	_, completeErr := backend.Complete(ctx, &CompletionRequest{Model: "fake-model", Prompt: "foo"})
+	_, embedErr := backend.Embed(ctx, &EmbeddingsRequest{Model: "fake-embeddings", Input: []string{"foo"}})
+	_, editErr := backend.Edit(ctx, &EditRequest{Model: "fake-model", Input: "foo", Instruction: "bar"})
+	for _, err := range []error{completeErr, embedErr, editErr} {
+		apiError, ok = err.(*APIError)
+		require.True(t, ok, err)
+		assert.Equal(t, 429, apiError.StatusCode)
+		assert.Equal(t, 2*time.Second, apiError.RetryAfter)
+	}
+}
+
+func TestRetrySettingsYAMLDefaults(t *testing.T) {
+	settings := &RetrySettings{}
+	err := yaml.Unmarshal([]byte("max_retries: 5\nbackoff_base: 500ms\n"), settings)
+	require.Nil(t, err)
+	assert.Equal(t, 5, settings.MaxRetries)
+	assert.Equal(t, 500*time.Millisecond, settings.BackoffBase)
+	assert.Equal(t, 30*time.Second, settings.BackoffCap)
+	assert.Contains(t, settings.RetryableStatusCodes, 429)
+}
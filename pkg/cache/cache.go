@@ -0,0 +1,268 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Mode selects how the cache is used.
+type Mode string
+
+const (
+	// ModeOff doesn't use the cache
+	ModeOff Mode = "off"
+	// ModeReadWrite returns the cached responses, and caches the new ones
+	ModeReadWrite Mode = "read-write"
+	// ModeReadOnly returns the cached responses, but doesn't cache the new ones
+	ModeReadOnly Mode = "read-only"
+	// ModeRefresh ignores the cached responses, and caches the new ones
+	ModeRefresh Mode = "refresh"
+)
+
+func ParseMode(s string) (Mode, error) {
+	switch Mode(s) {
+	case ModeOff, ModeReadWrite, ModeReadOnly, ModeRefresh:
+		return Mode(s), nil
+	case "":
+		return ModeOff, nil
+	default:
+		return "", fmt.Errorf("unknown cache mode %s (off, read-write, read-only, refresh)", s)
+	}
+}
+
+func (m *Mode) UnmarshalYAML(value *yaml.Node) error {
+	var s string
+	if err := value.Decode(&s); err != nil {
+		return err
+	}
+	mode, err := ParseMode(s)
+	if err != nil {
+		return err
+	}
+	*m = mode
+	return nil
+}
+
+type Settings struct {
+	Mode Mode `yaml:"mode,omitempty"`
+	// TTL is how long the cached responses are used, for example 24h. They don't expire if 0.
+	TTL time.Duration `yaml:"ttl,omitempty"`
+	// NonZeroTemperature enables caching the responses sampled with a non-zero temperature,
+	// which are expected to be different each time
+	NonZeroTemperature bool `yaml:"non_zero_temperature,omitempty"`
+	// Directory defaults to DefaultDirectory()
+	Directory string `yaml:"directory,omitempty"`
+}
+
+func (s *Settings) Clone() *Settings {
+	ret := *s
+	return &ret
+}
+
+// CanRead returns true if the cached responses are returned.
+func (s *Settings) CanRead() bool {
+	return s.Mode == ModeReadWrite || s.Mode == ModeReadOnly
+}
+
+// CanWrite returns true if the new responses are cached.
+func (s *Settings) CanWrite() bool {
+	return s.Mode == ModeReadWrite || s.Mode == ModeRefresh
+}
+
+// NewStore returns the store of the directory of the settings.
+func (s *Settings) NewStore() (*Store, error) {
+	directory := s.Directory
+	if directory == "" {
+		var err error
+		directory, err = DefaultDirectory()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return NewStore(directory), nil
+}
+
+// DefaultDirectory returns pinocchio/completions in the user cache directory,
+// which is $XDG_CACHE_HOME or ~/.cache on Linux.
+func DefaultDirectory() (string, error) {
+	cacheHome, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(cacheHome, "pinocchio", "completions"), nil
+}
+
+// Key returns the SHA-256 hash of the JSON serialization of v.
+func Key(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:]), nil
+}
+
+// Entry is a cached response, along with the request it answers so that the cache can be inspected.
+type Entry struct {
+	Key     string          `json:"key"`
+	Created time.Time       `json:"created"`
+	Request interface{}     `json:"request"`
+	Value   json.RawMessage `json:"value"`
+}
+
+// Expired returns true if the entry is older than ttl. Entries don't expire if ttl is 0.
+func (e *Entry) Expired(ttl time.Duration) bool {
+	return ttl > 0 && time.Since(e.Created) > ttl
+}
+
+// Store keeps each entry in a JSON file named after its key in Directory.
+type Store struct {
+	Directory string
+}
+
+func NewStore(directory string) *Store {
+	return &Store{Directory: directory}
+}
+
+func (s *Store) path(key string) string {
+	return filepath.Join(s.Directory, key+".json")
+}
+
+// Get returns the entry with key, or nil if there is none or it expired.
+func (s *Store) Get(key string, ttl time.Duration) (*Entry, error) {
+	entry, err := loadEntry(s.path(key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if entry.Expired(ttl) {
+		return nil, nil
+	}
+	return entry, nil
+}
+
+// Put caches value under key, replacing the previous entry.
+func (s *Store) Put(key string, request interface{}, value interface{}) error {
+	v, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(&Entry{
+		Key:     key,
+		Created: time.Now(),
+		Request: request,
+		Value:   v,
+	})
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(s.Directory, 0755)
+	if err != nil {
+		return err
+	}
+	// write to a temporary file first, so that concurrent readers never see a partial entry
+	f, err := os.CreateTemp(s.Directory, key+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), s.path(key))
+}
+
+func loadEntry(path string) (*Entry, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	entry := &Entry{}
+	err = json.Unmarshal(b, entry)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse cache entry %s: %w", path, err)
+	}
+	return entry, nil
+}
+
+// Load returns the entry whose key starts with prefix, expired or not.
+func (s *Store) Load(prefix string) (*Entry, error) {
+	paths, err := filepath.Glob(filepath.Join(s.Directory, prefix+"*.json"))
+	if err != nil {
+		return nil, err
+	}
+	switch len(paths) {
+	case 0:
+		return nil, fmt.Errorf("no cache entry %s", prefix)
+	case 1:
+		return loadEntry(paths[0])
+	default:
+		return nil, fmt.Errorf("cache key %s is ambiguous (%d entries)", prefix, len(paths))
+	}
+}
+
+// List returns all the entries, expired or not, newest first.
+func (s *Store) List() ([]*Entry, error) {
+	files, err := os.ReadDir(s.Directory)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	ret := []*Entry{}
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		entry, err := loadEntry(filepath.Join(s.Directory, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, entry)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Created.After(ret[j].Created)
+	})
+	return ret, nil
+}
+
+// Prune removes the entries older than maxAge, or all the entries if maxAge is 0,
+// and returns the number of entries removed.
+func (s *Store) Prune(maxAge time.Duration) (int, error) {
+	entries, err := s.List()
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, entry := range entries {
+		if maxAge > 0 && !entry.Expired(maxAge) {
+			continue
+		}
+		err = os.Remove(s.path(entry.Key))
+		if err != nil && !os.IsNotExist(err) {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
@@ -0,0 +1,60 @@
+package cache
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+	"testing"
+	"time"
+)
+
+func TestStore(t *testing.T) {
+	store := NewStore(t.TempDir())
+
+	entry, err := store.Get("missing", 0)
+	require.Nil(t, err)
+	assert.Nil(t, entry)
+
+	key, err := Key(map[string]interface{}{"prompt": "Say hello"})
+	require.Nil(t, err)
+	require.Nil(t, store.Put(key, map[string]interface{}{"prompt": "Say hello"}, []string{"Hello"}))
+
+	entry, err = store.Get(key, time.Hour)
+	require.Nil(t, err)
+	require.NotNil(t, entry)
+	assert.JSONEq(t, `["Hello"]`, string(entry.Value))
+
+	entry, err = store.Load(key[:8])
+	require.Nil(t, err)
+	assert.Equal(t, key, entry.Key)
+
+	// expired entries are not returned, but are still listed
+	time.Sleep(10 * time.Millisecond)
+	entry, err = store.Get(key, time.Millisecond)
+	require.Nil(t, err)
+	assert.Nil(t, entry)
+	entries, err := store.List()
+	require.Nil(t, err)
+	assert.Len(t, entries, 1)
+
+	removed, err := store.Prune(time.Hour)
+	require.Nil(t, err)
+	assert.Equal(t, 0, removed)
+	removed, err = store.Prune(time.Millisecond)
+	require.Nil(t, err)
+	assert.Equal(t, 1, removed)
+	entries, err = store.List()
+	require.Nil(t, err)
+	assert.Len(t, entries, 0)
+}
+
+func TestSettingsYAML(t *testing.T) {
+	settings := &Settings{}
+	require.Nil(t, yaml.Unmarshal([]byte("mode: read-only\nttl: 24h\n"), settings))
+	assert.Equal(t, ModeReadOnly, settings.Mode)
+	assert.Equal(t, 24*time.Hour, settings.TTL)
+	assert.True(t, settings.CanRead())
+	assert.False(t, settings.CanWrite())
+
+	assert.Error(t, yaml.Unmarshal([]byte("mode: sometimes\n"), settings))
+}
@@ -0,0 +1,242 @@
+package chunking
+
+import (
+	"fmt"
+	"github.com/wesen/geppetto/pkg/tokenizer"
+	"path/filepath"
+	"strings"
+)
+
+// Chunk is a part of a document, small enough to be sent to a model on its own.
+type Chunk struct {
+	Index int `json:"index"`
+	// Title is the heading of the section (heading strategy) or the name of the function
+	// (code strategy) the chunk belongs to
+	Title string `json:"title,omitempty"`
+	// Start and End are the byte offsets of the chunk in the document
+	Start  int    `json:"start"`
+	End    int    `json:"end"`
+	Text   string `json:"text"`
+	Tokens int    `json:"tokens"`
+}
+
+// Chunker splits a document into chunks.
+type Chunker interface {
+	Chunk(content string) ([]*Chunk, error)
+}
+
+const (
+	StrategyHeading   = "heading"
+	StrategyParagraph = "paragraph"
+	StrategyTokens    = "tokens"
+	StrategyCode      = "code"
+)
+
+const (
+	DefaultHeadingLevel = 2
+	DefaultTokens       = 512
+)
+
+// Settings selects a chunking strategy and its parameters, for example in the step of a YAML command.
+type Settings struct {
+	// Strategy is one of heading, paragraph, tokens or code
+	Strategy string `yaml:"strategy"`
+	// Level is the deepest markdown heading level starting a new chunk (heading)
+	Level int `yaml:"level,omitempty"`
+	// MaxTokens is the size of the chunks (tokens), the size up to which paragraphs are merged
+	// (paragraph), and otherwise the size above which chunks are split further. 0 uses the default
+	// of the strategy: 512 tokens for tokens, no limit for the others.
+	MaxTokens int `yaml:"max_tokens,omitempty"`
+	// Overlap is the number of tokens repeated at the start of the next chunk (tokens)
+	Overlap int `yaml:"overlap,omitempty"`
+	// Language is the programming language of the document (code), by default from its extension
+	Language string `yaml:"language,omitempty"`
+	// Model selects the tokenizer used to count tokens
+	Model string `yaml:"model,omitempty"`
+}
+
+func (s *Settings) Clone() *Settings {
+	ret := *s
+	return &ret
+}
+
+// Validate checks the settings, except for the language which can depend on the chunked file.
+func (s *Settings) Validate() error {
+	switch s.Strategy {
+	case StrategyHeading, StrategyParagraph, StrategyTokens, StrategyCode:
+	default:
+		return fmt.Errorf("unknown chunking strategy %s, expected heading, paragraph, tokens or code", s.Strategy)
+	}
+	if s.Level < 0 || s.Level > 6 {
+		return fmt.Errorf("invalid heading level %d", s.Level)
+	}
+	if s.MaxTokens < 0 || s.Overlap < 0 {
+		return fmt.Errorf("max_tokens and overlap can't be negative")
+	}
+	if s.Strategy == StrategyTokens {
+		maxTokens := s.MaxTokens
+		if maxTokens == 0 {
+			maxTokens = DefaultTokens
+		}
+		if s.Overlap >= maxTokens {
+			return fmt.Errorf("overlap (%d) has to be smaller than max_tokens (%d)", s.Overlap, maxTokens)
+		}
+	}
+	if s.Strategy == StrategyCode && s.Language != "" {
+		if _, ok := languagePatterns[s.Language]; !ok {
+			return fmt.Errorf("unsupported language %s, expected one of %s", s.Language, strings.Join(Languages(), ", "))
+		}
+	}
+	return nil
+}
+
+// NewChunker creates the chunker of the settings. path is the path of the chunked document,
+// used to detect the language of code, and can be empty.
+func NewChunker(settings *Settings, path string) (Chunker, error) {
+	if err := settings.Validate(); err != nil {
+		return nil, err
+	}
+	tok := tokenizer.ForModel(settings.Model)
+
+	switch settings.Strategy {
+	case StrategyHeading:
+		level := settings.Level
+		if level == 0 {
+			level = DefaultHeadingLevel
+		}
+		return &HeadingChunker{Level: level, MaxTokens: settings.MaxTokens, Tokenizer: tok}, nil
+
+	case StrategyParagraph:
+		return &ParagraphChunker{MaxTokens: settings.MaxTokens, Tokenizer: tok}, nil
+
+	case StrategyTokens:
+		size := settings.MaxTokens
+		if size == 0 {
+			size = DefaultTokens
+		}
+		return &TokenChunker{Size: size, Overlap: settings.Overlap, Tokenizer: tok}, nil
+
+	default:
+		language := settings.Language
+		if language == "" {
+			language = LanguageFromPath(path)
+		}
+		if language == "" {
+			return nil, fmt.Errorf("could not detect the language of %s, expected one of %s",
+				path, strings.Join(Languages(), ", "))
+		}
+		return &CodeChunker{Language: language, MaxTokens: settings.MaxTokens, Tokenizer: tok}, nil
+	}
+}
+
+// LanguageFromPath returns the language of a source file from its extension, or an empty string.
+func LanguageFromPath(path string) string {
+	return languageExtensions[strings.ToLower(filepath.Ext(path))]
+}
+
+// span is a part of the document, before it is trimmed and split into chunks.
+type span struct {
+	start int
+	end   int
+	title string
+}
+
+const whitespace = " \t\r\n"
+
+// newChunks trims the whitespace around the spans, drops the empty ones, splits the ones
+// longer than maxTokens if it isn't 0, and numbers the resulting chunks.
+func newChunks(content string, spans []span, tok tokenizer.Tokenizer, maxTokens int) []*Chunk {
+	ret := []*Chunk{}
+	for _, s := range spans {
+		s = trimSpan(content, s)
+		if s.start == s.end {
+			continue
+		}
+
+		parts := []span{s}
+		if maxTokens > 0 && tok.Count(content[s.start:s.end]) > maxTokens {
+			parts = splitTokens(content, s, tok, maxTokens, 0)
+		}
+		for _, part := range parts {
+			part = trimSpan(content, part)
+			if part.start == part.end {
+				continue
+			}
+			text := content[part.start:part.end]
+			ret = append(ret, &Chunk{
+				Index:  len(ret),
+				Title:  part.title,
+				Start:  part.start,
+				End:    part.end,
+				Text:   text,
+				Tokens: tok.Count(text),
+			})
+		}
+	}
+	return ret
+}
+
+func trimSpan(content string, s span) span {
+	for s.start < s.end && strings.IndexByte(whitespace, content[s.start]) >= 0 {
+		s.start++
+	}
+	for s.end > s.start && strings.IndexByte(whitespace, content[s.end-1]) >= 0 {
+		s.end--
+	}
+	return s
+}
+
+// splitTokens splits s into spans of at most size tokens, each starting with the last overlap
+// tokens of the previous one. A single word longer than size is kept whole.
+func splitTokens(content string, s span, tok tokenizer.Tokenizer, size int, overlap int) []span {
+	ret := []span{}
+	start := s.start
+	for {
+		for start < s.end && strings.IndexByte(whitespace, content[start]) >= 0 {
+			start++
+		}
+		if start >= s.end {
+			break
+		}
+		window := tok.TrimEnd(content[start:s.end], size)
+		if window == "" {
+			window = content[start:s.end]
+			if i := strings.IndexAny(window[1:], whitespace); i >= 0 {
+				window = window[:i+1]
+			}
+		}
+		end := start + len(window)
+		ret = append(ret, span{start: start, end: end, title: s.title})
+		if end >= s.end {
+			break
+		}
+
+		next := end
+		if overlap > 0 {
+			o := tok.TrimStart(window, overlap)
+			if strings.HasSuffix(window, o) {
+				next = end - len(o)
+			}
+		}
+		if next <= start {
+			next = end
+		}
+		start = next
+	}
+	return ret
+}
+
+// TokenChunker splits a document into chunks of Size tokens, overlapping by Overlap tokens.
+type TokenChunker struct {
+	Size      int
+	Overlap   int
+	Tokenizer tokenizer.Tokenizer
+}
+
+func (t *TokenChunker) Chunk(content string) ([]*Chunk, error) {
+	if t.Size <= 0 || t.Overlap >= t.Size {
+		return nil, fmt.Errorf("invalid chunk size %d with overlap %d", t.Size, t.Overlap)
+	}
+	spans := splitTokens(content, span{start: 0, end: len(content)}, t.Tokenizer, t.Size, t.Overlap)
+	return newChunks(content, spans, t.Tokenizer, 0), nil
+}
@@ -0,0 +1,137 @@
+package chunking
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wesen/geppetto/pkg/tokenizer"
+	"testing"
+)
+
+var approximate = tokenizer.NewApproximateTokenizer(tokenizer.EncodingCL100kBase)
+
+func chunkTexts(t *testing.T, content string, chunks []*Chunk) []string {
+	ret := []string{}
+	for i, chunk := range chunks {
+		assert.Equal(t, i, chunk.Index)
+		assert.Equal(t, content[chunk.Start:chunk.End], chunk.Text)
+		assert.Equal(t, approximate.Count(chunk.Text), chunk.Tokens)
+		ret = append(ret, chunk.Text)
+	}
+	return ret
+}
+
+func TestHeadingChunker(t *testing.T) {
+	content := "Intro text.\n\n# Title\n\nSome text.\n\n## Section 1 ##\n\nFirst section.\n\n" +
+		"```\n## not a heading\n```\n\n### Subsection\n\nDeeper.\n\n## Section 2\nSecond section.\n"
+
+	chunks, err := (&HeadingChunker{Level: 2, Tokenizer: approximate}).Chunk(content)
+	require.Nil(t, err)
+	assert.Equal(t, []string{
+		"Intro text.",
+		"# Title\n\nSome text.",
+		"## Section 1 ##\n\nFirst section.\n\n```\n## not a heading\n```\n\n### Subsection\n\nDeeper.",
+		"## Section 2\nSecond section.",
+	}, chunkTexts(t, content, chunks))
+	assert.Equal(t, []string{"", "Title", "Section 1", "Section 2"},
+		[]string{chunks[0].Title, chunks[1].Title, chunks[2].Title, chunks[3].Title})
+
+	chunks, err = (&HeadingChunker{Level: 3, Tokenizer: approximate}).Chunk(content)
+	require.Nil(t, err)
+	require.Len(t, chunks, 5)
+	assert.Equal(t, "Subsection", chunks[3].Title)
+
+	// long sections are split, and keep their title
+	chunks, err = (&HeadingChunker{Level: 1, MaxTokens: 8, Tokenizer: approximate}).Chunk("# Title\n\none two three four five six seven\n")
+	require.Nil(t, err)
+	require.Len(t, chunks, 2)
+	for _, chunk := range chunks {
+		assert.Equal(t, "Title", chunk.Title)
+		assert.LessOrEqual(t, chunk.Tokens, 8)
+	}
+}
+
+func TestParagraphChunker(t *testing.T) {
+	content := "# Title\n\nfirst paragraph\n\n\nsecond paragraph\n  \n" +
+		"a long paragraph that has to be split into several chunks\n"
+
+	chunks, err := (&ParagraphChunker{Tokenizer: approximate}).Chunk(content)
+	require.Nil(t, err)
+	assert.Equal(t, []string{
+		"# Title",
+		"first paragraph",
+		"second paragraph",
+		"a long paragraph that has to be split into several chunks",
+	}, chunkTexts(t, content, chunks))
+
+	chunks, err = (&ParagraphChunker{MaxTokens: 6, Tokenizer: approximate}).Chunk(content)
+	require.Nil(t, err)
+	assert.Equal(t, []string{
+		"# Title",
+		"first paragraph",
+		"second paragraph",
+		"a long paragraph",
+		"that has to be split",
+		"into several chunks",
+	}, chunkTexts(t, content, chunks))
+
+	// paragraphs are merged as long as they fit
+	chunks, err = (&ParagraphChunker{MaxTokens: 10, Tokenizer: approximate}).Chunk(content)
+	require.Nil(t, err)
+	assert.Equal(t, "# Title\n\nfirst paragraph", chunks[0].Text)
+
+	chunks, err = (&ParagraphChunker{MaxTokens: 10, Tokenizer: approximate}).Chunk("\n\n  \n")
+	require.Nil(t, err)
+	assert.Empty(t, chunks)
+}
+
+func TestTokenChunker(t *testing.T) {
+	content := "one two three four five six seven eight nine ten"
+
+	chunks, err := (&TokenChunker{Size: 8, Overlap: 3, Tokenizer: approximate}).Chunk(content)
+	require.Nil(t, err)
+	assert.Equal(t, []string{
+		"one two three four five",
+		"five six seven eight nine",
+		"nine ten",
+	}, chunkTexts(t, content, chunks))
+
+	chunks, err = (&TokenChunker{Size: 8, Tokenizer: approximate}).Chunk(content)
+	require.Nil(t, err)
+	assert.Equal(t, []string{
+		"one two three four five",
+		"six seven eight nine ten",
+	}, chunkTexts(t, content, chunks))
+
+	// words longer than the chunk size are kept whole
+	chunks, err = (&TokenChunker{Size: 1, Tokenizer: approximate}).Chunk("a verylongword b")
+	require.Nil(t, err)
+	assert.Equal(t, []string{"a", "verylongword", "b"}, chunkTexts(t, "a verylongword b", chunks))
+
+	_, err = (&TokenChunker{Size: 8, Overlap: 8, Tokenizer: approximate}).Chunk(content)
+	assert.NotNil(t, err)
+}
+
+func TestNewChunker(t *testing.T) {
+	chunker, err := NewChunker(&Settings{Strategy: StrategyHeading}, "")
+	require.Nil(t, err)
+	assert.Equal(t, DefaultHeadingLevel, chunker.(*HeadingChunker).Level)
+
+	chunker, err = NewChunker(&Settings{Strategy: StrategyTokens, Overlap: 10}, "")
+	require.Nil(t, err)
+	assert.Equal(t, DefaultTokens, chunker.(*TokenChunker).Size)
+
+	chunker, err = NewChunker(&Settings{Strategy: StrategyCode}, "main.py")
+	require.Nil(t, err)
+	assert.Equal(t, LanguagePython, chunker.(*CodeChunker).Language)
+
+	for _, settings := range []*Settings{
+		{Strategy: "sentence"},
+		{Strategy: StrategyHeading, Level: 7},
+		{Strategy: StrategyTokens, MaxTokens: 10, Overlap: 10},
+		{Strategy: StrategyCode, Language: "cobol"},
+		{Strategy: StrategyCode},
+	} {
+		_, err = NewChunker(settings, "README")
+		assert.NotNil(t, err, "%+v", settings)
+	}
+}
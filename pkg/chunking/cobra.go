@@ -0,0 +1,53 @@
+package chunking
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"strings"
+)
+
+// AddFlags adds the flags selecting the chunking strategy to cmd, with the values of defaults.
+func AddFlags(cmd *cobra.Command, defaults *Settings) {
+	cmd.Flags().String("strategy", defaults.Strategy, "Chunking strategy: heading, paragraph, tokens or code")
+	cmd.Flags().Int("level", defaults.Level,
+		fmt.Sprintf("Deepest markdown heading level starting a chunk (heading, default %d)", DefaultHeadingLevel))
+	cmd.Flags().Int("max-tokens", defaults.MaxTokens,
+		fmt.Sprintf("Size of the chunks (tokens, default %d), size up to which paragraphs are merged (paragraph), "+
+			"size above which sections and functions are split (heading, code). 0 for the default", DefaultTokens))
+	cmd.Flags().Int("overlap", defaults.Overlap, "Number of tokens repeated at the start of the next chunk (tokens)")
+	cmd.Flags().String("language", defaults.Language,
+		fmt.Sprintf("Programming language (code, default from the file extension): %s", strings.Join(Languages(), ", ")))
+	cmd.Flags().String("tokenizer-model", defaults.Model, "Model whose tokenizer counts the tokens")
+}
+
+// NewSettingsFromCobra returns the chunking settings of the flags added by AddFlags.
+func NewSettingsFromCobra(cmd *cobra.Command) (*Settings, error) {
+	ret := &Settings{}
+	var err error
+	ret.Strategy, err = cmd.Flags().GetString("strategy")
+	if err != nil {
+		return nil, err
+	}
+	ret.Level, err = cmd.Flags().GetInt("level")
+	if err != nil {
+		return nil, err
+	}
+	ret.MaxTokens, err = cmd.Flags().GetInt("max-tokens")
+	if err != nil {
+		return nil, err
+	}
+	ret.Overlap, err = cmd.Flags().GetInt("overlap")
+	if err != nil {
+		return nil, err
+	}
+	ret.Language, err = cmd.Flags().GetString("language")
+	if err != nil {
+		return nil, err
+	}
+	ret.Model, err = cmd.Flags().GetString("tokenizer-model")
+	if err != nil {
+		return nil, err
+	}
+
+	return ret, ret.Validate()
+}
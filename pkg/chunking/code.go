@@ -0,0 +1,193 @@
+package chunking
+
+import (
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"github.com/wesen/geppetto/pkg/tokenizer"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	LanguageGo         = "go"
+	LanguagePython     = "python"
+	LanguageJavascript = "javascript"
+	LanguageTypescript = "typescript"
+	LanguageRust       = "rust"
+	LanguageRuby       = "ruby"
+)
+
+var languageExtensions = map[string]string{
+	".go":  LanguageGo,
+	".py":  LanguagePython,
+	".js":  LanguageJavascript,
+	".mjs": LanguageJavascript,
+	".jsx": LanguageJavascript,
+	".ts":  LanguageTypescript,
+	".tsx": LanguageTypescript,
+	".rs":  LanguageRust,
+	".rb":  LanguageRuby,
+}
+
+var javascriptPattern = `^(?:export\s+)?(?:default\s+)?(?:async\s+)?(?:function\*?|(?:abstract\s+)?class)\s+(\w+)` +
+	`|^(?:export\s+)?(?:const|let|var)\s+(\w+)\s*=\s*(?:async\s+)?(?:function|\([^)]*\)\s*=>|\w+\s*=>)`
+
+// languagePatterns match the first line of the top-level definitions of a language,
+// the first non-empty group being the name of the definition.
+var languagePatterns = map[string]*regexp.Regexp{
+	LanguageGo:         regexp.MustCompile(`^func\s+(?:\([^)]*\)\s*)?(\w+)`),
+	LanguagePython:     regexp.MustCompile(`^(?:async\s+)?(?:def|class)\s+(\w+)`),
+	LanguageJavascript: regexp.MustCompile(javascriptPattern),
+	LanguageTypescript: regexp.MustCompile(javascriptPattern),
+	LanguageRust:       regexp.MustCompile(`^(?:pub(?:\([^)]*\))?\s+)?(?:async\s+)?(?:unsafe\s+)?(?:fn|struct|enum|trait|mod)\s+(\w+)|^(impl\b.*?)\s*\{?\s*$`),
+	LanguageRuby:       regexp.MustCompile(`^(?:def|class|module)\s+([\w.:]+)`),
+}
+
+// commentRegexp matches the comment and decorator lines attached to the definition that follows them.
+var commentRegexp = regexp.MustCompile(`^\s*(?://|#|/\*|\*|@|///)`)
+
+// Languages returns the languages supported by the code strategy.
+func Languages() []string {
+	ret := []string{}
+	for language := range languagePatterns {
+		ret = append(ret, language)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// CodeChunker splits source code at the boundaries of its top-level functions (and classes,
+// depending on the language), with their doc comments. Go files are parsed, each function
+// being a chunk and the declarations between functions being chunks without title.
+// Other languages are split at the lines starting a definition, without indentation.
+type CodeChunker struct {
+	Language string
+	// MaxTokens splits the functions longer than this, if not 0
+	MaxTokens int
+	Tokenizer tokenizer.Tokenizer
+}
+
+func (c *CodeChunker) Chunk(content string) ([]*Chunk, error) {
+	if c.Language == LanguageGo {
+		spans, err := goSpans(content)
+		if err == nil {
+			return newChunks(content, spans, c.Tokenizer, c.MaxTokens), nil
+		}
+		// snippets that don't parse are still split at the func lines
+		log.Debug().Err(err).Msg("could not parse go code, splitting at func lines")
+	}
+
+	pattern, ok := languagePatterns[c.Language]
+	if !ok {
+		return nil, fmt.Errorf("unsupported language %s, expected one of %s", c.Language, strings.Join(Languages(), ", "))
+	}
+	return newChunks(content, definitionSpans(content, pattern), c.Tokenizer, c.MaxTokens), nil
+}
+
+// goSpans returns a span per function of a go file, and a span for the declarations between functions.
+func goSpans(content string) ([]span, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "", content, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := []span{}
+	previous := 0
+	for _, decl := range f.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok {
+			continue
+		}
+		start := fset.Position(fn.Pos()).Offset
+		if fn.Doc != nil {
+			start = fset.Position(fn.Doc.Pos()).Offset
+		}
+		end := fset.Position(fn.End()).Offset
+
+		ret = append(ret, span{start: previous, end: start})
+		ret = append(ret, span{start: start, end: end, title: goFuncName(fn)})
+		previous = end
+	}
+	ret = append(ret, span{start: previous, end: len(content)})
+
+	return ret, nil
+}
+
+// goFuncName returns the name of a function, prefixed with its receiver type for methods.
+func goFuncName(fn *ast.FuncDecl) string {
+	if fn.Recv == nil || len(fn.Recv.List) == 0 {
+		return fn.Name.Name
+	}
+	recv := fn.Recv.List[0].Type
+	prefix := ""
+	if star, ok := recv.(*ast.StarExpr); ok {
+		prefix = "*"
+		recv = star.X
+	}
+	// drop the type parameters of generic receivers
+	switch r := recv.(type) {
+	case *ast.IndexExpr:
+		recv = r.X
+	case *ast.IndexListExpr:
+		recv = r.X
+	}
+	if ident, ok := recv.(*ast.Ident); ok {
+		return fmt.Sprintf("(%s%s).%s", prefix, ident.Name, fn.Name.Name)
+	}
+	return fn.Name.Name
+}
+
+// definitionSpans splits content at the lines matching pattern, moving each split up
+// over the comments and decorators directly above the definition.
+func definitionSpans(content string, pattern *regexp.Regexp) []span {
+	type line struct {
+		start int
+		text  string
+	}
+	lines := []line{}
+	offset := 0
+	for _, text := range strings.SplitAfter(content, "\n") {
+		lines = append(lines, line{start: offset, text: strings.TrimRight(text, "\r\n")})
+		offset += len(text)
+	}
+
+	ret := []span{}
+	current := span{start: 0}
+	for i, l := range lines {
+		m := pattern.FindStringSubmatch(l.text)
+		if m == nil {
+			continue
+		}
+		title := ""
+		for _, group := range m[1:] {
+			if group != "" {
+				title = group
+				break
+			}
+		}
+
+		first := i
+		for first > 0 && lines[first-1].start >= current.start &&
+			strings.TrimSpace(lines[first-1].text) != "" && commentRegexp.MatchString(lines[first-1].text) {
+			first--
+		}
+		start := lines[first].start
+		if start <= current.start {
+			// the current span only contains the comments of this definition
+			current.title = title
+			continue
+		}
+		current.end = start
+		ret = append(ret, current)
+		current = span{start: start, title: title}
+	}
+	current.end = len(content)
+	ret = append(ret, current)
+
+	return ret
+}
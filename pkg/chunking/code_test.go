@@ -0,0 +1,89 @@
+package chunking
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func chunkTitles(chunks []*Chunk) []string {
+	ret := []string{}
+	for _, chunk := range chunks {
+		ret = append(ret, chunk.Title)
+	}
+	return ret
+}
+
+func TestCodeChunkerGo(t *testing.T) {
+	content := `package main
+
+import "fmt"
+
+// Hello says hello
+func Hello(name string) {
+	fmt.Println("hello", name)
+}
+
+type Greeter[T any] struct{}
+
+func (g *Greeter[T]) Greet() {
+	Hello("world")
+}
+
+func main() {
+	(&Greeter[int]{}).Greet()
+}
+`
+	chunks, err := (&CodeChunker{Language: LanguageGo, Tokenizer: approximate}).Chunk(content)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"", "Hello", "", "(*Greeter).Greet", "main"}, chunkTitles(chunks))
+	texts := chunkTexts(t, content, chunks)
+	assert.Equal(t, "package main\n\nimport \"fmt\"", texts[0])
+	assert.Equal(t, "// Hello says hello\nfunc Hello(name string) {\n\tfmt.Println(\"hello\", name)\n}", texts[1])
+	assert.Equal(t, "type Greeter[T any] struct{}", texts[2])
+
+	// snippets are split at the func lines
+	snippet := "func a() {\n}\n\n// b does b\nfunc b() {\n"
+	chunks, err = (&CodeChunker{Language: LanguageGo, Tokenizer: approximate}).Chunk(snippet)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"a", "b"}, chunkTitles(chunks))
+	assert.Equal(t, "// b does b\nfunc b() {", chunks[1].Text)
+}
+
+func TestCodeChunkerPython(t *testing.T) {
+	content := `import os
+
+# a constant
+X = 1
+
+@decorator
+def first():
+    def inner():
+        pass
+
+class Second:
+    def method(self):
+        pass
+
+async def third():
+    pass
+`
+	chunks, err := (&CodeChunker{Language: LanguagePython, Tokenizer: approximate}).Chunk(content)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"", "first", "Second", "third"}, chunkTitles(chunks))
+	texts := chunkTexts(t, content, chunks)
+	assert.Equal(t, "import os\n\n# a constant\nX = 1", texts[0])
+	assert.Equal(t, "@decorator\ndef first():\n    def inner():\n        pass", texts[1])
+}
+
+func TestCodeChunkerJavascript(t *testing.T) {
+	content := `export function a() {}
+const b = async (x) => x
+/** c is a class */
+export default class C {}
+`
+	chunks, err := (&CodeChunker{Language: LanguageJavascript, Tokenizer: approximate}).Chunk(content)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"a", "b", "C"}, chunkTitles(chunks))
+	assert.Equal(t, "/** c is a class */\nexport default class C {}", chunks[2].Text)
+}
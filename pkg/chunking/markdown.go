@@ -0,0 +1,104 @@
+package chunking
+
+import (
+	"github.com/wesen/geppetto/pkg/tokenizer"
+	"regexp"
+	"strings"
+)
+
+var headingRegexp = regexp.MustCompile(`^ {0,3}(#{1,6})[ \t]+(.*?)(?:[ \t]+#+)?[ \t]*$`)
+var fenceRegexp = regexp.MustCompile("^ {0,3}(```|~~~)")
+
+// HeadingChunker splits a markdown document into sections, starting a new chunk at each
+// ATX heading (# Title) of Level or above. Headings inside fenced code blocks are ignored.
+// The text before the first heading is a chunk without title.
+type HeadingChunker struct {
+	Level int
+	// MaxTokens splits the sections longer than this, if not 0
+	MaxTokens int
+	Tokenizer tokenizer.Tokenizer
+}
+
+func (h *HeadingChunker) Chunk(content string) ([]*Chunk, error) {
+	spans := []span{}
+	current := span{start: 0}
+	fence := ""
+
+	offset := 0
+	for _, line := range strings.SplitAfter(content, "\n") {
+		lineStart := offset
+		offset += len(line)
+		line = strings.TrimRight(line, "\r\n")
+
+		if m := fenceRegexp.FindStringSubmatch(line); m != nil {
+			if fence == "" {
+				fence = m[1]
+			} else if fence == m[1] {
+				fence = ""
+			}
+			continue
+		}
+		if fence != "" {
+			continue
+		}
+
+		m := headingRegexp.FindStringSubmatch(line)
+		if m == nil || len(m[1]) > h.Level {
+			continue
+		}
+		current.end = lineStart
+		spans = append(spans, current)
+		current = span{start: lineStart, title: m[2]}
+	}
+	current.end = len(content)
+	spans = append(spans, current)
+
+	return newChunks(content, spans, h.Tokenizer, h.MaxTokens), nil
+}
+
+var paragraphSeparator = regexp.MustCompile(`\n[ \t]*\r?\n`)
+
+// ParagraphChunker splits a document at blank lines. If MaxTokens is not 0, consecutive
+// paragraphs are merged into a chunk as long as they fit, and longer paragraphs are split.
+type ParagraphChunker struct {
+	MaxTokens int
+	Tokenizer tokenizer.Tokenizer
+}
+
+func (p *ParagraphChunker) Chunk(content string) ([]*Chunk, error) {
+	paragraphs := []span{}
+	start := 0
+	for _, separator := range paragraphSeparator.FindAllStringIndex(content, -1) {
+		paragraphs = append(paragraphs, span{start: start, end: separator[0]})
+		start = separator[1]
+	}
+	paragraphs = append(paragraphs, span{start: start, end: len(content)})
+
+	if p.MaxTokens == 0 {
+		return newChunks(content, paragraphs, p.Tokenizer, 0), nil
+	}
+
+	spans := []span{}
+	current, tokens := span{start: -1}, 0
+	for _, paragraph := range paragraphs {
+		text := strings.Trim(content[paragraph.start:paragraph.end], whitespace)
+		if text == "" {
+			continue
+		}
+		count := p.Tokenizer.Count(text)
+		if current.start >= 0 && tokens+count > p.MaxTokens {
+			spans = append(spans, current)
+			current, tokens = span{start: -1}, 0
+		}
+		if current.start < 0 {
+			current.start = paragraph.start
+		}
+		current.end = paragraph.end
+		tokens += count
+	}
+	if current.start >= 0 {
+		spans = append(spans, current)
+	}
+
+	return newChunks(content, spans, p.Tokenizer, p.MaxTokens), nil
+}
@@ -6,13 +6,19 @@ import (
 	"fmt"
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
+	"github.com/wesen/geppetto/pkg/backends"
+	"github.com/wesen/geppetto/pkg/recorder"
 	"github.com/wesen/geppetto/pkg/steps"
 	"github.com/wesen/geppetto/pkg/steps/openai"
+	"github.com/wesen/geppetto/pkg/usage"
+	"github.com/wesen/glazed/pkg/cli"
 	glazedcmds "github.com/wesen/glazed/pkg/cmds"
+	"github.com/wesen/glazed/pkg/formatters"
 	"github.com/wesen/glazed/pkg/helpers"
 	"golang.org/x/sync/errgroup"
 	"gopkg.in/yaml.v3"
 	"io"
+	"os"
 	"strings"
 	"text/template"
 )
@@ -28,12 +34,68 @@ type GeppettoCommandDescription struct {
 	Step *steps.StepDescription `yaml:"step,omitempty"`
 
 	Prompt string `yaml:"prompt"`
+	// PromptFile is the path of a file containing the prompt, relative to the command file
+	PromptFile string `yaml:"prompt_file,omitempty"`
+
+	// SystemPrompt and Messages are used instead of Prompt to declare a chat command.
+	// Both the system prompt and the message contents are templates.
+	SystemPrompt string                `yaml:"system,omitempty"`
+	Messages     []*openai.ChatMessage `yaml:"messages,omitempty"`
+
+	// Steps and Chain are used instead of Prompt to declare a command running multiple steps.
+	Steps map[string]*steps.ChainStepDescription `yaml:"steps,omitempty"`
+	Chain *steps.ChainDescription                `yaml:"chain,omitempty"`
+
+	// Output parses (and validates) the response of completion and chat commands,
+	// which then outputs structured data through glazed.
+	Output *steps.OutputDescription `yaml:"output,omitempty"`
+
+	// Edit is used instead of Prompt to declare a command editing a text with the edits API.
+	Edit *EditDescription `yaml:"edit,omitempty"`
 }
 
 type GeppettoCommand struct {
-	description *glazedcmds.CommandDescription
-	Factories   map[string]interface{} `yaml:"__factories,omitempty"`
-	Prompt      string
+	description  *glazedcmds.CommandDescription
+	Factories    map[string]interface{} `yaml:"__factories,omitempty"`
+	Prompt       string
+	PromptFile   string
+	SystemPrompt string
+	Messages     []*openai.ChatMessage
+	Steps        map[string]*steps.ChainStepDescription
+	Chain        *steps.ChainDescription
+	Step         *steps.StepDescription
+	Output       *steps.OutputDescription
+	Edit         *EditDescription
+	// outputProcessor is created from Output by the loader
+	outputProcessor *steps.OutputProcessor
+	// templates contains the partials loaded by LoadTemplates
+	templates *template.Template
+	// glazedFlags is true if the glazed output flags could be added to the cobra command
+	glazedFlags bool
+	// fileParameters are the types of the file parameters, which glazed parses as paths
+	fileParameters map[string]glazedcmds.ParameterType
+}
+
+// IsChat returns true if the command declares a system prompt or a list of messages
+// instead of a single prompt.
+func (g *GeppettoCommand) IsChat() bool {
+	return g.SystemPrompt != "" || len(g.Messages) > 0
+}
+
+// IsMulti returns true if the prompt is run once per element of a list parameter.
+func (g *GeppettoCommand) IsMulti() bool {
+	return g.Step != nil && g.Step.Type == steps.StepTypeMulti
+}
+
+// hasGlazedOutput returns true if the command always outputs rows through glazed.
+// The other commands output rows when --output is passed.
+func (g *GeppettoCommand) hasGlazedOutput() bool {
+	return g.IsMulti() || g.Output != nil
+}
+
+// IsChain returns true if the command declares a chain of steps instead of a single prompt.
+func (g *GeppettoCommand) IsChain() bool {
+	return g.Chain != nil
 }
 
 func (g *GeppettoCommand) RunFromCobra(cmd *cobra.Command, args []string) error {
@@ -46,6 +108,26 @@ func (g *GeppettoCommand) RunFromCobra(cmd *cobra.Command, args []string) error
 	parameters["print-prompt"] = printPrompt
 	printDyno, _ := cmd.Flags().GetBool("print-dyno")
 	parameters["print-dyno"] = printDyno
+	choicesSeparator, _ := cmd.Flags().GetString("choices-separator")
+	parameters["choices-separator"] = choicesSeparator
+	printUsage, _ := cmd.Flags().GetBool("print-usage")
+	parameters["print-usage"] = printUsage
+	noRecord, _ := cmd.Flags().GetBool("no-record")
+	parameters["record"] = !noRecord
+	if g.IsMulti() {
+		concurrency, _ := cmd.Flags().GetInt("concurrency")
+		parameters["concurrency"] = concurrency
+	}
+	if len(g.fileParameters) > 0 {
+		maxFileSize, _ := cmd.Flags().GetInt("max-file-size")
+		parameters["max-file-size"] = maxFileSize
+	}
+	if g.IsEdit() {
+		inPlace, _ := cmd.Flags().GetBool("in-place")
+		parameters["in-place"] = inPlace
+		diff, _ := cmd.Flags().GetBool("diff")
+		parameters["diff"] = diff
+	}
 
 	for _, f := range g.Factories {
 		factory, ok := f.(steps.GenericStepFactory)
@@ -58,49 +140,119 @@ func (g *GeppettoCommand) RunFromCobra(cmd *cobra.Command, args []string) error
 		}
 	}
 
-	return g.Run(parameters)
+	var gp *cli.GlazeProcessor
+	var of formatters.OutputFormatter
+	if g.glazedFlags && (g.hasGlazedOutput() || cmd.Flags().Changed("output")) {
+		gp, of, err = cli.SetupProcessor(cmd)
+		if err != nil {
+			return err
+		}
+	}
+
+	return g.run(parameters, gp, of)
 }
 
 //go:embed templates/dyno.tmpl.html
 var dynoTemplate string
 
-func (g *GeppettoCommand) Run(parameters map[string]interface{}) error {
-	openaiCompletionStepFactory_, ok := g.Factories["openai-completion-step"]
-	if !ok {
-		return errors.Errorf("No openai-completion-step factory defined")
+// setUsageTracker makes all the steps created by the factories of the command record their usage in tracker.
+func (g *GeppettoCommand) setUsageTracker(tracker *usage.Tracker) {
+	for _, f := range g.Factories {
+		switch factory := f.(type) {
+		case *openai.CompletionStepFactory:
+			if factory.ClientSettings != nil {
+				factory.ClientSettings.UsageTracker = tracker
+			}
+		case *openai.ChatCompletionStepFactory:
+			if factory.ClientSettings != nil {
+				factory.ClientSettings.UsageTracker = tracker
+			}
+		case *openai.EditStepFactory:
+			if factory.ClientSettings != nil {
+				factory.ClientSettings.UsageTracker = tracker
+			}
+		}
 	}
-	openaiCompletionStepFactory, ok := openaiCompletionStepFactory_.(steps.StepFactory[string, string])
-	if !ok {
-		return errors.Errorf("openai-completion-step factory is not a StepFactory[string, string]")
+}
+
+func (g *GeppettoCommand) Run(parameters map[string]interface{}) error {
+	return g.run(parameters, nil, nil)
+}
+
+// run runs the command. If the glaze processor is not nil, the results are output as rows,
+// otherwise they are printed as plain text.
+func (g *GeppettoCommand) run(
+	parameters map[string]interface{},
+	gp *cli.GlazeProcessor,
+	of formatters.OutputFormatter,
+) error {
+	if g.PromptFile != "" {
+		return errors.Errorf("prompt_file %s was not loaded", g.PromptFile)
 	}
 
-	// TODO(manuel, 2023-01-28) here we would overload the factory settings with stuff passed on the CLI
-	// (say, temperature or model). This would probably be part of the API for the factory, in general the
-	// factory is the central abstraction of the entire system
-	s, err := openaiCompletionStepFactory.NewStep()
+	err := g.loadFileParameters(parameters)
 	if err != nil {
 		return err
 	}
 
+	tracker := usage.NewTracker()
+	g.setUsageTracker(tracker)
+
 	ctx := context.Background()
+	rec := g.startRecording(parameters)
+	if rec != nil {
+		ctx = recorder.WithRecorder(ctx, rec)
+	}
+
+	if g.IsMulti() {
+		err = g.runMulti(ctx, parameters, gp, of)
+	} else if g.IsChain() {
+		err = g.runChain(ctx, parameters, gp, of)
+	} else if g.IsEdit() {
+		err = g.runEdit(ctx, parameters, gp, of)
+	} else if g.IsChat() {
+		err = g.runChat(ctx, parameters, gp, of)
+	} else {
+		err = g.runCompletion(ctx, parameters, gp, of)
+	}
+	if rec != nil {
+		finishRecording(rec, err, tracker)
+	}
 
-	// TODO(manuel, 2023-02-04) All this could be handle by some prompt renderer kind of thing
-	promptTemplate, err := template.New("prompt").Parse(g.Prompt)
+	printUsage, _ := parameters["print-usage"].(bool)
+	usageErr := reportUsage(os.Stderr, tracker, printUsage)
 	if err != nil {
 		return err
 	}
+	return usageErr
+}
+
+func (g *GeppettoCommand) runCompletion(
+	ctx context.Context,
+	parameters map[string]interface{},
+	gp *cli.GlazeProcessor,
+	of formatters.OutputFormatter,
+) error {
+
+	openaiCompletionStepFactory_, ok := g.Factories["completion-step"]
+	if !ok {
+		return errors.Errorf("No completion-step factory defined")
+	}
+	openaiCompletionStepFactory, ok := openaiCompletionStepFactory_.(steps.StepFactory[string, string])
+	if !ok {
+		return errors.Errorf("completion-step factory is not a StepFactory[string, string]")
+	}
 
 	// TODO(manuel, 2023-02-04) This is where multisteps would work differently, since
 	// the prompt would be rendered at execution time
-	var promptBuffer strings.Builder
-	err = promptTemplate.Execute(&promptBuffer, parameters)
+	prompt, err := g.recordTemplate(ctx, "prompt", g.Prompt, parameters)
 	if err != nil {
 		return err
 	}
 
 	printPrompt, ok := parameters["print-prompt"]
 	if ok && printPrompt.(bool) {
-		fmt.Println(promptBuffer.String())
+		fmt.Println(prompt)
 		return nil
 	}
 
@@ -108,12 +260,12 @@ func (g *GeppettoCommand) Run(parameters map[string]interface{}) error {
 	if ok && printDyno.(bool) {
 		openaiCompletionStepFactory__, ok := openaiCompletionStepFactory_.(*openai.CompletionStepFactory)
 		if !ok {
-			return errors.Errorf("openai-completion-step factory is not a CompletionStepFactory")
+			return errors.Errorf("completion-step factory is not a CompletionStepFactory")
 		}
 		settings := openaiCompletionStepFactory__.StepSettings
 
 		dyno, err := helpers.RenderTemplateString(dynoTemplate, map[string]interface{}{
-			"initialPrompt":   promptBuffer.String(),
+			"initialPrompt":   prompt,
 			"initialResponse": "",
 			"maxTokens":       settings.MaxResponseTokens,
 			"temperature":     settings.Temperature,
@@ -126,15 +278,56 @@ func (g *GeppettoCommand) Run(parameters map[string]interface{}) error {
 		return nil
 	}
 
+	if g.outputProcessor != nil {
+		factory, err := g.newNonStreamingCompletionFactory()
+		if err != nil {
+			return err
+		}
+		s := steps.NewOutputStep[string](factory, g.outputProcessor, g.Output.MaxRetries, steps.RepromptCompletion)
+		return runOutputStep[string](ctx, s, prompt, gp, of)
+	}
+
+	if gp != nil {
+		factory, ok := openaiCompletionStepFactory_.(*openai.CompletionStepFactory)
+		if !ok {
+			return errors.Errorf("completion-step factory is not a CompletionStepFactory")
+		}
+		return g.runCompletionRows(ctx, factory, parameters, prompt, gp, of)
+	}
+
+	completionStepFactory, ok := openaiCompletionStepFactory_.(*openai.CompletionStepFactory)
+	if ok && completionStepFactory.StepSettings.N != nil && *completionStepFactory.StepSettings.N > 1 {
+		separator, _ := parameters["choices-separator"].(string)
+		return runChoices(ctx, completionStepFactory, prompt, separator)
+	}
+
+	// TODO(manuel, 2023-01-28) here we would overload the factory settings with stuff passed on the CLI
+	// (say, temperature or model). This would probably be part of the API for the factory, in general the
+	// factory is the central abstraction of the entire system
+	s, err := openaiCompletionStepFactory.NewStep()
+	if err != nil {
+		return err
+	}
+
 	eg, ctx2 := errgroup.WithContext(ctx)
-	prompt := promptBuffer.String()
-	//fmt.Printf("Prompt:\n\n%s\n\n", prompt)
 
 	eg.Go(func() error {
 		return s.Run(ctx2, prompt)
 	})
 
 	eg.Go(func() error {
+		// when streaming, print the chunks as they come in, and skip printing the final result
+		streamed := false
+		if streamingStep, ok := s.(steps.StreamingStep[string, string, *backends.CompletionResponse]); ok {
+			for delta := range streamingStep.GetDeltaOutput() {
+				if len(delta.Choices) == 0 {
+					continue
+				}
+				streamed = true
+				fmt.Print(delta.Choices[0].Text)
+			}
+		}
+
 		select {
 		case <-ctx2.Done():
 			return ctx2.Err()
@@ -143,7 +336,9 @@ func (g *GeppettoCommand) Run(parameters map[string]interface{}) error {
 			if err != nil {
 				return err
 			}
-			fmt.Printf("%s", v)
+			if !streamed {
+				fmt.Printf("%s", v)
+			}
 		}
 
 		return err
@@ -151,6 +346,269 @@ func (g *GeppettoCommand) Run(parameters map[string]interface{}) error {
 	return eg.Wait()
 }
 
+// renderMessages renders the system prompt and the message templates into a list of chat messages.
+func (g *GeppettoCommand) renderMessages(
+	ctx context.Context,
+	parameters map[string]interface{},
+) ([]openai.ChatMessage, error) {
+	messages := []openai.ChatMessage{}
+
+	if g.SystemPrompt != "" {
+		systemPrompt, err := g.recordTemplate(ctx, "system", g.SystemPrompt, parameters)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, openai.ChatMessage{
+			Role:    openai.ChatMessageRoleSystem,
+			Content: systemPrompt,
+		})
+	}
+
+	for i, message := range g.Messages {
+		content, err := g.recordTemplate(ctx, fmt.Sprintf("message-%d", i), message.Content, parameters)
+		if err != nil {
+			return nil, err
+		}
+		role := message.Role
+		if role == "" {
+			role = openai.ChatMessageRoleUser
+		}
+		messages = append(messages, openai.ChatMessage{
+			Role:    role,
+			Content: content,
+		})
+	}
+
+	return messages, nil
+}
+
+func (g *GeppettoCommand) runChat(
+	ctx context.Context,
+	parameters map[string]interface{},
+	gp *cli.GlazeProcessor,
+	of formatters.OutputFormatter,
+) error {
+	factory_, ok := g.Factories["chat-completion-step"]
+	if !ok {
+		return errors.Errorf("No chat-completion-step factory defined")
+	}
+	factory, ok := factory_.(steps.StepFactory[[]openai.ChatMessage, string])
+	if !ok {
+		return errors.Errorf("chat-completion-step factory is not a StepFactory[[]ChatMessage, string]")
+	}
+
+	messages, err := g.renderMessages(ctx, parameters)
+	if err != nil {
+		return err
+	}
+
+	printPrompt, ok := parameters["print-prompt"]
+	if ok && printPrompt.(bool) {
+		for _, message := range messages {
+			fmt.Printf("%s: %s\n", message.Role, message.Content)
+		}
+		return nil
+	}
+
+	printDyno, ok := parameters["print-dyno"]
+	if ok && printDyno.(bool) {
+		return errors.Errorf("--print-dyno is not supported for chat commands")
+	}
+
+	chatFactory, isChatFactory := factory_.(*openai.ChatCompletionStepFactory)
+	if (g.outputProcessor != nil || gp != nil) && !isChatFactory {
+		return errors.Errorf("chat-completion-step factory is not a ChatCompletionStepFactory")
+	}
+
+	if g.outputProcessor != nil {
+		// the output is only printed once parsed, so there is nobody to consume the streamed chunks
+		nonStreamingFactory := steps.StepFactoryFunc[[]openai.ChatMessage, string](
+			func() (steps.Step[[]openai.ChatMessage, string], error) {
+				settings := chatFactory.NewStepSettings()
+				settings.Stream = false
+				return openai.NewChatCompletionStep(settings), nil
+			})
+		s := steps.NewOutputStep[[]openai.ChatMessage](nonStreamingFactory, g.outputProcessor, g.Output.MaxRetries, openai.RepromptChat)
+		return runOutputStep[[]openai.ChatMessage](ctx, s, messages, gp, of)
+	}
+
+	if gp != nil {
+		return g.runChatRows(ctx, chatFactory, parameters, messages, gp, of)
+	}
+
+	s, err := factory.NewStep()
+	if err != nil {
+		return err
+	}
+
+	eg, ctx2 := errgroup.WithContext(ctx)
+
+	eg.Go(func() error {
+		return s.Run(ctx2, messages)
+	})
+
+	// the chunks of multiple answers are interleaved, they are printed once complete
+	multipleAnswers := isChatFactory && chatFactory.StepSettings.N != nil && *chatFactory.StepSettings.N > 1
+
+	eg.Go(func() error {
+		streamed := false
+		if streamingStep, ok := s.(steps.StreamingStep[[]openai.ChatMessage, string, *backends.ChatResponse]); ok {
+			for delta := range streamingStep.GetDeltaOutput() {
+				if len(delta.Choices) == 0 || multipleAnswers {
+					continue
+				}
+				streamed = true
+				fmt.Print(delta.Choices[0].Message.Content)
+			}
+		}
+
+		select {
+		case <-ctx2.Done():
+			return ctx2.Err()
+		case result := <-s.GetOutput():
+			v, err := result.Value()
+			if err != nil {
+				return err
+			}
+			chatStep, ok := s.(*openai.ChatCompletionStep)
+			if multipleAnswers && ok {
+				separator, _ := parameters["choices-separator"].(string)
+				fmt.Print(strings.Join(chatStep.Choices(), separator))
+			} else if !streamed {
+				fmt.Printf("%s", v)
+			}
+		}
+
+		return nil
+	})
+
+	return eg.Wait()
+}
+
+// newNonStreamingCompletionFactory creates completion steps that don't stream, for the completions
+// whose output is not printed as is, since there is nobody to consume the streamed chunks.
+func (g *GeppettoCommand) newNonStreamingCompletionFactory() (steps.StepFactory[string, string], error) {
+	f, ok := g.Factories["completion-step"].(*openai.CompletionStepFactory)
+	if !ok {
+		return nil, errors.Errorf("No completion-step factory defined")
+	}
+	return steps.StepFactoryFunc[string, string](func() (steps.Step[string, string], error) {
+		settings := f.NewStepSettings()
+		settings.Stream = false
+		return openai.NewCompletionStep(settings), nil
+	}), nil
+}
+
+func (g *GeppettoCommand) runChain(
+	ctx context.Context,
+	parameters map[string]interface{},
+	gp *cli.GlazeProcessor,
+	of formatters.OutputFormatter,
+) error {
+	var completionFactory steps.StepFactory[string, string]
+	if _, ok := g.Factories["completion-step"]; ok {
+		var err error
+		completionFactory, err = g.newNonStreamingCompletionFactory()
+		if err != nil {
+			return err
+		}
+	}
+
+	s, err := steps.NewChainStep(g.Steps, g.Chain, completionFactory)
+	if err != nil {
+		return err
+	}
+	s.SetBaseTemplate(g.templates)
+
+	printPrompt, ok := parameters["print-prompt"]
+	if ok && printPrompt.(bool) {
+		prompts, err := s.RenderPrompts(parameters)
+		if err != nil {
+			return err
+		}
+		for _, prompt := range prompts {
+			fmt.Printf("--- %s ---\n%s\n", prompt.ID, prompt.Prompt)
+		}
+		return nil
+	}
+
+	printDyno, ok := parameters["print-dyno"]
+	if ok && printDyno.(bool) {
+		return errors.Errorf("--print-dyno is not supported for chain commands")
+	}
+
+	go func() {
+		_ = s.Run(ctx, parameters)
+	}()
+
+	result := <-s.GetOutput()
+	outputs, err := result.Value()
+	if err != nil {
+		return err
+	}
+
+	ids := s.Outputs()
+	if gp != nil {
+		return outputGlazedRows(g.chainRows(parameters, ids, outputs), gp, of)
+	}
+	if len(ids) == 1 {
+		fmt.Printf("%s", outputs[ids[0]])
+		return nil
+	}
+	for _, id := range ids {
+		fmt.Printf("--- %s ---\n%s\n", id, outputs[id])
+	}
+	return nil
+}
+
+// runChoices runs a completion that returns multiple choices, and prints them separated by separator.
+// Streamed chunks of the different choices are interleaved, so they are not printed as they arrive.
+func runChoices(
+	ctx context.Context,
+	factory *openai.CompletionStepFactory,
+	prompt string,
+	separator string,
+) error {
+	s, err := factory.NewChoicesStep()
+	if err != nil {
+		return err
+	}
+
+	eg, ctx2 := errgroup.WithContext(ctx)
+
+	eg.Go(func() error {
+		return s.Run(ctx2, prompt)
+	})
+
+	eg.Go(func() error {
+		if streamingStep, ok := s.(steps.StreamingStep[string, []backends.CompletionChoice, *backends.CompletionResponse]); ok {
+			// drain the interleaved chunks, we print the choices once they are complete
+			for range streamingStep.GetDeltaOutput() {
+			}
+		}
+
+		select {
+		case <-ctx2.Done():
+			return ctx2.Err()
+		case result := <-s.GetOutput():
+			choices, err := result.Value()
+			if err != nil {
+				return err
+			}
+			for i, choice := range choices {
+				if i > 0 {
+					fmt.Print(separator)
+				}
+				fmt.Printf("%s", choice.Text)
+			}
+		}
+
+		return nil
+	})
+
+	return eg.Wait()
+}
+
 func (g *GeppettoCommand) Description() *glazedcmds.CommandDescription {
 	return g.description
 }
@@ -162,6 +620,20 @@ func (g *GeppettoCommand) BuildCobraCommand() (*cobra.Command, error) {
 	}
 	cmd.Flags().Bool("print-prompt", false, "Print the prompt that will be executed.")
 	cmd.Flags().Bool("print-dyno", false, "Print a dyno HTML embed with the given prompt. Useful to create documentation examples.")
+	cmd.Flags().Bool("print-usage", false, "Print the tokens used and their cost, for this run and for today.")
+	cmd.Flags().Bool("no-record", false, "Don't record the run in ~/.local/share/pinocchio/runs")
+	cmd.Flags().String("choices-separator", "\n---\n", "Separator printed between choices when --openai-n is greater than 1.")
+	if g.IsMulti() {
+		cmd.Flags().Int("concurrency", 0, "Number of completions run at the same time (default from the command, or 4)")
+	}
+	if g.IsEdit() {
+		cmd.Flags().Bool("in-place", false, "Write the edited text back to the edited file")
+		cmd.Flags().Bool("diff", false, "Print a unified diff of the edit instead of the edited text")
+	}
+	g.glazedFlags = addGlazedFlags(cmd)
+	if len(g.fileParameters) > 0 {
+		cmd.Flags().Int("max-file-size", defaultMaxFileSize, "Maximum size in bytes of the files read by file parameters")
+	}
 
 	cmd.PersistentFlags().Int("timeout", 60, "timeout in seconds")
 	cmd.PersistentFlags().String("organization", "", "organization to use")
@@ -169,13 +641,23 @@ func (g *GeppettoCommand) BuildCobraCommand() (*cobra.Command, error) {
 	cmd.PersistentFlags().String("base-url", "https://api.openai.com/v1", "base url to use")
 	cmd.PersistentFlags().String("default-engine", "", "default engine to use")
 	cmd.PersistentFlags().String("user", "", "user (hash) to use")
+	cmd.PersistentFlags().Int("max-retries", 0, "retry failed requests (rate limits, server errors) up to this many times")
+	cmd.PersistentFlags().Int("requests-per-minute", 0, "maximum number of requests per minute (0 for no limit)")
+	cmd.PersistentFlags().Int("tokens-per-minute", 0, "maximum number of tokens per minute (0 for no limit)")
+	cmd.PersistentFlags().Int("max-in-flight", 0, "maximum number of concurrent requests (0 for no limit)")
+	cmd.PersistentFlags().String("cache", "", "cache mode of the completions: off, read-write, read-only, refresh (default from the client settings, or off)")
+	cmd.PersistentFlags().Duration("cache-ttl", 0, "how long cached completions are used, for example 24h (0 to never expire)")
+	cmd.PersistentFlags().Bool("cache-non-zero-temperature", false, "also cache the completions sampled with a non-zero temperature")
 	for _, f := range g.Factories {
-		factory, ok := f.(steps.GenericStepFactory)
-		if !ok {
-			continue
+		var err error
+		switch factory := f.(type) {
+		case *openai.CompletionStepFactory:
+			err = factory.AddFlags(cmd, "openai-", &openai.CompletionStepFactoryFlagsDefaults{})
+		case *openai.ChatCompletionStepFactory:
+			err = factory.AddFlags(cmd, "openai-", &openai.ChatCompletionStepFactoryFlagsDefaults{})
+		case *openai.EditStepFactory:
+			err = factory.AddFlags(cmd, "openai-", &openai.EditStepFactoryFlagsDefaults{})
 		}
-
-		err := factory.AddFlags(cmd, "openai-", &openai.CompletionStepFactoryFlagsDefaults{})
 		if err != nil {
 			return nil, err
 		}
@@ -206,18 +688,78 @@ func (g *GeppettoCommandLoader) LoadCommandFromYAML(s io.Reader) ([]glazedcmds.C
 	// maybe the easiest is just going to be to make them a separate file in the bundle format, really
 	// rewind to read the factories...
 	buf = strings.NewReader(string(yamlContent))
-	completionStepFactory, err := openai.NewCompletionStepFactoryFromYAML(buf)
+	factories := map[string]interface{}{}
 
-	if err != nil {
-		return nil, err
+	if scd.Prompt != "" && scd.PromptFile != "" {
+		return nil, errors.Errorf("command %s has both a prompt and a prompt_file", scd.Name)
 	}
 
-	factories := map[string]interface{}{}
-	if completionStepFactory != nil {
-		factories["openai-completion-step"] = completionStepFactory
+	if scd.Step != nil && scd.Step.Type == steps.StepTypeMulti {
+		err = validateMultiInput(scd)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid command %s", scd.Name)
+		}
 	}
+
+	if scd.Chain != nil {
+		err = validateChain(scd)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid chain in command %s", scd.Name)
+		}
+	}
+
+	var outputProcessor *steps.OutputProcessor
+	if scd.Output != nil {
+		if scd.Chain != nil || (scd.Step != nil && scd.Step.Type == steps.StepTypeMulti) {
+			return nil, errors.Errorf("command %s: output is only supported by completion and chat commands", scd.Name)
+		}
+		outputProcessor, err = steps.NewOutputProcessor(scd.Output)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid output in command %s", scd.Name)
+		}
+	}
+
+	if scd.Edit != nil {
+		err = validateEdit(scd)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid edit in command %s", scd.Name)
+		}
+		editStepFactory, err := openai.NewEditStepFactoryFromYAML(buf)
+		if err != nil {
+			return nil, err
+		}
+		factories["edit-step"] = editStepFactory
+	} else if scd.SystemPrompt != "" || len(scd.Messages) > 0 {
+		chatCompletionStepFactory, err := openai.NewChatCompletionStepFactoryFromYAML(buf)
+		if err != nil {
+			return nil, err
+		}
+		factories["chat-completion-step"] = chatCompletionStepFactory
+	} else {
+		completionStepFactory, err := openai.NewCompletionStepFactoryFromYAML(buf)
+		if err != nil {
+			return nil, err
+		}
+		if completionStepFactory != nil {
+			factories["completion-step"] = completionStepFactory
+		}
+	}
+
+	fileParameters := convertFileParameters(scd.Flags)
+	for name, type_ := range convertFileParameters(scd.Arguments) {
+		fileParameters[name] = type_
+	}
+
 	sq := &GeppettoCommand{
-		Prompt: scd.Prompt,
+		Prompt:       scd.Prompt,
+		PromptFile:   scd.PromptFile,
+		SystemPrompt: scd.SystemPrompt,
+		Messages:     scd.Messages,
+		Steps:        scd.Steps,
+		Chain:        scd.Chain,
+		Step:         scd.Step,
+		Output:       scd.Output,
+		Edit:         scd.Edit,
 		// separate copy because the glazed framework uses this to build the cobra command and mutates it
 		description: &glazedcmds.CommandDescription{
 			Name:      scd.Name,
@@ -226,12 +768,49 @@ func (g *GeppettoCommandLoader) LoadCommandFromYAML(s io.Reader) ([]glazedcmds.C
 			Flags:     scd.Flags,
 			Arguments: scd.Arguments,
 		},
-		Factories: factories,
+		Factories:       factories,
+		outputProcessor: outputProcessor,
+		fileParameters:  fileParameters,
 	}
 
 	return []glazedcmds.Command{sq}, nil
 }
 
+// validateChain checks that the chain of the command is valid, and that the
+// arguments and flags it references are declared by the command.
+func validateChain(scd *GeppettoCommandDescription) error {
+	_, err := steps.NewChainStep(scd.Steps, scd.Chain, nil)
+	if err != nil {
+		return err
+	}
+
+	arguments := map[string]bool{}
+	for _, argument := range scd.Arguments {
+		arguments[argument.Name] = true
+	}
+	flags := map[string]bool{}
+	for _, flag := range scd.Flags {
+		flags[flag.Name] = true
+	}
+
+	for _, entry := range scd.Chain.Pipe {
+		for _, s := range entry.Inputs {
+			ref, err := steps.ParseReference(s)
+			if err != nil {
+				return err
+			}
+			if ref.Type == steps.ReferenceArguments && !arguments[ref.Name] {
+				return errors.Errorf("unknown argument %s", ref.Name)
+			}
+			if ref.Type == steps.ReferenceFlags && !flags[ref.Name] {
+				return errors.Errorf("unknown flag %s", ref.Name)
+			}
+		}
+	}
+
+	return nil
+}
+
 func (g *GeppettoCommandLoader) LoadCommandAliasFromYAML(s io.Reader) ([]*glazedcmds.CommandAlias, error) {
 	var alias glazedcmds.CommandAlias
 	err := yaml.NewDecoder(s).Decode(&alias)
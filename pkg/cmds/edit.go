@@ -0,0 +1,198 @@
+package cmds
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/wesen/geppetto/pkg/helpers"
+	"github.com/wesen/geppetto/pkg/steps/openai"
+	"github.com/wesen/glazed/pkg/cli"
+	glazedcmds "github.com/wesen/glazed/pkg/cmds"
+	"github.com/wesen/glazed/pkg/formatters"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// EditDescription declares a command applying an instruction to a text with the edits API,
+// instead of sending a prompt to the completion API.
+type EditDescription struct {
+	// Instruction is a template of the instruction telling the model how to edit the text
+	Instruction string `yaml:"instruction"`
+	// File is the name of the file parameter whose content is edited.
+	// With --in-place, the edited text is written back to the file.
+	File string `yaml:"file,omitempty"`
+	// Input is a template of the text to edit, used instead of the content of File
+	Input string `yaml:"input,omitempty"`
+}
+
+// validateEdit checks that the edit of the command has an instruction and a text to edit,
+// and that its file is a file parameter of the command.
+func validateEdit(scd *GeppettoCommandDescription) error {
+	if scd.Prompt != "" || scd.PromptFile != "" || scd.SystemPrompt != "" || len(scd.Messages) > 0 ||
+		scd.Chain != nil || scd.Step != nil || scd.Output != nil {
+		return errors.New("edit can't be combined with a prompt, messages, a chain, a step or an output")
+	}
+	if scd.Edit.Instruction == "" {
+		return errors.New("edit has no instruction")
+	}
+	if scd.Edit.File == "" && scd.Edit.Input == "" {
+		return errors.New("edit needs a file or an input")
+	}
+	if scd.Edit.File == "" {
+		return nil
+	}
+
+	for _, p := range append(append([]*glazedcmds.Parameter{}, scd.Arguments...), scd.Flags...) {
+		if p.Name != scd.Edit.File {
+			continue
+		}
+		if p.Type != ParameterTypeFile {
+			return errors.Errorf("edit file %s is not a file parameter", p.Name)
+		}
+		return nil
+	}
+	return errors.Errorf("unknown edit file %s", scd.Edit.File)
+}
+
+// IsEdit returns true if the command applies an instruction with the edits API.
+func (g *GeppettoCommand) IsEdit() bool {
+	return g.Edit != nil
+}
+
+// renderEdit renders the instruction and the text to edit. The edited file is nil if the
+// text is rendered from the input template.
+func (g *GeppettoCommand) renderEdit(
+	ctx context.Context,
+	parameters map[string]interface{},
+) (openai.EditInput, *File, error) {
+	ret := openai.EditInput{}
+	var err error
+	ret.Instruction, err = g.recordTemplate(ctx, "instruction", g.Edit.Instruction, parameters)
+	if err != nil {
+		return ret, nil, err
+	}
+
+	if g.Edit.Input != "" {
+		ret.Input, err = g.recordTemplate(ctx, "input", g.Edit.Input, parameters)
+		return ret, nil, err
+	}
+
+	file, ok := parameters[g.Edit.File].(*File)
+	if !ok {
+		return ret, nil, errors.Errorf("edit file %s was not given", g.Edit.File)
+	}
+	ret.Input = file.Content
+	return ret, file, nil
+}
+
+func (g *GeppettoCommand) runEdit(
+	ctx context.Context,
+	parameters map[string]interface{},
+	gp *cli.GlazeProcessor,
+	of formatters.OutputFormatter,
+) error {
+	factory, ok := g.Factories["edit-step"].(*openai.EditStepFactory)
+	if !ok {
+		return errors.Errorf("No edit-step factory defined")
+	}
+
+	input, file, err := g.renderEdit(ctx, parameters)
+	if err != nil {
+		return err
+	}
+
+	printPrompt, _ := parameters["print-prompt"].(bool)
+	if printPrompt {
+		fmt.Printf("instruction: %s\n\n%s", input.Instruction, input.Input)
+		return nil
+	}
+	printDyno, _ := parameters["print-dyno"].(bool)
+	if printDyno {
+		return errors.Errorf("--print-dyno is not supported for edit commands")
+	}
+
+	inPlace, _ := parameters["in-place"].(bool)
+	if inPlace && (file == nil || file.Path == "-") {
+		return errors.Errorf("--in-place needs the edited text to be read from a file")
+	}
+
+	settings := factory.NewStepSettings()
+	s := openai.NewEditStep(settings)
+	start := time.Now()
+	go func() {
+		_ = s.Run(ctx, input)
+	}()
+	choices, err := (<-s.GetOutput()).Value()
+	latency := time.Since(start)
+	if err != nil {
+		return err
+	}
+
+	if inPlace {
+		if len(choices) > 1 {
+			return errors.Errorf("--in-place can't write %d edits to %s", len(choices), file.Path)
+		}
+		return writeInPlace(file.Path, choices[0].Text)
+	}
+
+	if gp != nil {
+		engine := engineName(settings.Engine, settings.ClientSettings)
+		rows := []map[string]interface{}{}
+		for _, choice := range choices {
+			row := g.parameterColumns(parameters)
+			row["index"] = choice.Index
+			row["instruction"] = input.Instruction
+			row["input"] = input.Input
+			row["response"] = choice.Text
+			row["engine"] = engine
+			row["latency_ms"] = latency.Milliseconds()
+			addUsageColumns(row, settings.ClientSettings.UsageTracker)
+			rows = append(rows, row)
+		}
+		return outputGlazedRows(rows, gp, of)
+	}
+
+	showDiff, _ := parameters["diff"].(bool)
+	separator, _ := parameters["choices-separator"].(string)
+	for i, choice := range choices {
+		if i > 0 {
+			fmt.Print(separator)
+		}
+		if !showDiff {
+			fmt.Print(choice.Text)
+			continue
+		}
+		path := "input"
+		if file != nil {
+			path = file.Path
+		}
+		diff, err := helpers.UnifiedDiff(path, input.Input, choice.Text)
+		if err != nil {
+			return err
+		}
+		fmt.Print(diff)
+	}
+	return nil
+}
+
+// writeInPlace replaces the content of the file at path, keeping its permissions. The content is
+// written to a temporary file first, so that the file is left untouched if writing fails.
+func writeInPlace(path string, content string) error {
+	// replace the target of a symlink, not the symlink itself
+	path, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	err = helpers.WriteFileAtomic(path, []byte(content), info.Mode().Perm())
+	if err != nil {
+		return errors.Wrapf(err, "could not write %s", path)
+	}
+	log.Info().Str("path", path).Msg("edited file in place")
+	return nil
+}
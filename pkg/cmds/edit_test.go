@@ -0,0 +1,127 @@
+package cmds
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wesen/geppetto/pkg/backends"
+	"github.com/wesen/geppetto/pkg/steps/openai"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadEdit(t *testing.T) {
+	loader := &GeppettoCommandLoader{}
+	commands, err := loader.LoadCommandFromYAML(strings.NewReader(`
+name: fix
+short: Fix the typos of a file
+arguments:
+  - name: source
+    type: file
+    required: true
+edit:
+  instruction: Fix the typos
+  file: source
+`))
+	require.Nil(t, err)
+	command := commands[0].(*GeppettoCommand)
+	assert.True(t, command.IsEdit())
+	assert.IsType(t, &openai.EditStepFactory{}, command.Factories["edit-step"])
+
+	invalid := []string{
+		// no instruction
+		"edit:\n  file: source\n",
+		// not a file parameter
+		"flags:\n  - name: text\n    type: string\nedit:\n  instruction: Fix\n  file: text\n",
+		// unknown file
+		"edit:\n  instruction: Fix\n  file: source\n",
+		// edits don't have a prompt
+		"prompt: hello\nedit:\n  instruction: Fix\n  input: hello\n",
+	}
+	for _, s := range invalid {
+		_, err = loader.LoadCommandFromYAML(strings.NewReader("name: fix\nshort: Fix\n" + s))
+		assert.Error(t, err, s)
+	}
+}
+
+func TestEditInPlace(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(home, ".config"))
+	t.Setenv("XDG_DATA_HOME", filepath.Join(home, ".local", "share"))
+
+	dir := writeTestFiles(t, map[string]string{"hello.txt": "helo\n"})
+	path := filepath.Join(dir, "hello.txt")
+
+	backend := backends.NewFakeBackend()
+	backend.AddPromptResponse(backends.FakeEditPrompt("Fix the typo", "helo\n"), &backends.FakeResponse{Text: "hello\n"})
+	server := backends.NewFakeOpenAIServer(backend)
+	defer server.Close()
+
+	loader := &GeppettoCommandLoader{}
+	commands, err := loader.LoadCommandFromYAML(strings.NewReader(`
+name: fix
+short: Fix the typos of a file
+arguments:
+  - name: source
+    type: file
+    required: true
+factories:
+  openai:
+    client:
+      api_key: test
+      base_url: ` + server.URL + `
+    edit:
+      engine: fake-edit-model
+edit:
+  instruction: Fix the typo
+  file: source
+`))
+	require.Nil(t, err)
+	command := commands[0].(*GeppettoCommand)
+
+	err = command.Run(map[string]interface{}{
+		"source":   path,
+		"in-place": true,
+	})
+	require.Nil(t, err)
+
+	b, err := os.ReadFile(path)
+	require.Nil(t, err)
+	assert.Equal(t, "hello\n", string(b))
+	require.Len(t, backend.Requests(), 1)
+	assert.Equal(t, "fake-edit-model", backend.Requests()[0].Model)
+
+	// stdin can't be edited in place
+	err = command.Run(map[string]interface{}{
+		"source":   "-",
+		"in-place": true,
+	})
+	assert.Error(t, err)
+}
+
+func TestWriteInPlace(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "hello.txt")
+	require.Nil(t, os.WriteFile(path, []byte("helo\n"), 0640))
+	link := filepath.Join(dir, "link.txt")
+	require.Nil(t, os.Symlink(path, link))
+
+	require.Nil(t, writeInPlace(link, "hello\n"))
+
+	b, err := os.ReadFile(path)
+	require.Nil(t, err)
+	assert.Equal(t, "hello\n", string(b))
+	info, err := os.Stat(path)
+	require.Nil(t, err)
+	assert.Equal(t, os.FileMode(0640), info.Mode().Perm())
+
+	// the symlink is kept, and no temporary file is left behind
+	info, err = os.Lstat(link)
+	require.Nil(t, err)
+	assert.Equal(t, os.ModeSymlink, info.Mode().Type())
+	entries, err := os.ReadDir(dir)
+	require.Nil(t, err)
+	assert.Len(t, entries, 2)
+}
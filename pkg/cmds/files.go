@@ -0,0 +1,223 @@
+package cmds
+
+import (
+	"bytes"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	glazedcmds "github.com/wesen/glazed/pkg/cmds"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Parameter types handled by geppetto commands on top of the glazed ones. They are passed to glazed
+// as string and string list parameters, and the paths are replaced by *File values before rendering
+// the prompt.
+const (
+	// ParameterTypeFile reads a single file, or stdin for -
+	ParameterTypeFile glazedcmds.ParameterType = "file"
+	// ParameterTypeFileList reads a list of files
+	ParameterTypeFileList glazedcmds.ParameterType = "fileList"
+	// ParameterTypeDirectory reads all the files below a directory, or matching a glob such as src/*.go.
+	// Hidden directories and binary files are skipped.
+	ParameterTypeDirectory glazedcmds.ParameterType = "directory"
+)
+
+const defaultMaxFileSize = 1024 * 1024
+
+// binaryDetectionLength is the number of bytes checked for NUL bytes, like git does.
+const binaryDetectionLength = 8000
+
+// File is the value of file parameters in templates. It renders as its content,
+// so that {{ .input_file }} inlines the file.
+type File struct {
+	Content string
+	// Path is the path as given on the command line, or - for stdin
+	Path string
+	// Basename and Extension (for example .go) are empty for stdin
+	Basename  string
+	Extension string
+	Size      int
+}
+
+func (f *File) String() string {
+	return f.Content
+}
+
+func isBinary(content []byte) bool {
+	if len(content) > binaryDetectionLength {
+		content = content[:binaryDetectionLength]
+	}
+	return bytes.IndexByte(content, 0) != -1
+}
+
+var errBinaryFile = errors.New("binary file")
+
+// readFile reads path (stdin for -), refusing files larger than maxSize bytes and binary files.
+func readFile(path string, maxSize int) (*File, error) {
+	var r io.Reader
+	ret := &File{Path: path}
+	if path == "-" {
+		r = os.Stdin
+	} else {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+		ret.Basename = filepath.Base(path)
+		ret.Extension = filepath.Ext(path)
+	}
+
+	// read one more byte than allowed to detect files that are too large
+	content, err := io.ReadAll(io.LimitReader(r, int64(maxSize)+1))
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not read %s", path)
+	}
+	if len(content) > maxSize {
+		return nil, errors.Errorf("%s is larger than the maximum file size of %d bytes", path, maxSize)
+	}
+	if isBinary(content) {
+		return nil, errors.Wrapf(errBinaryFile, "%s", path)
+	}
+
+	ret.Content = string(content)
+	ret.Size = len(content)
+	return ret, nil
+}
+
+// readDirectory reads the files below path, or the files matching path if it is a glob.
+// Matching directories are read recursively.
+func readDirectory(path string, maxSize int) ([]*File, error) {
+	roots := []string{path}
+	if strings.ContainsAny(path, "*?[") {
+		matches, err := filepath.Glob(path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid glob %s", path)
+		}
+		if len(matches) == 0 {
+			return nil, errors.Errorf("no files match %s", path)
+		}
+		roots = matches
+	}
+
+	paths := []string{}
+	for _, root := range roots {
+		err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				if p != root && strings.HasPrefix(d.Name(), ".") {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if d.Type().IsRegular() {
+				paths = append(paths, p)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.Strings(paths)
+
+	ret := []*File{}
+	for _, p := range paths {
+		f, err := readFile(p, maxSize)
+		if errors.Is(err, errBinaryFile) {
+			log.Debug().Str("path", p).Msg("skipping binary file")
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, f)
+	}
+	return ret, nil
+}
+
+// convertFileParameters replaces the file parameter types by the glazed types used to parse their paths,
+// and returns the original types of the converted parameters, indexed by name.
+func convertFileParameters(parameters []*glazedcmds.Parameter) map[string]glazedcmds.ParameterType {
+	ret := map[string]glazedcmds.ParameterType{}
+	for _, p := range parameters {
+		switch p.Type {
+		case ParameterTypeFile, ParameterTypeDirectory:
+			ret[p.Name] = p.Type
+			p.Type = glazedcmds.ParameterTypeString
+		case ParameterTypeFileList:
+			ret[p.Name] = p.Type
+			p.Type = glazedcmds.ParameterTypeStringList
+		}
+	}
+	return ret
+}
+
+// loadFileParameters replaces the paths passed to the file parameters of the command by their files.
+// Values that are not paths (for example already loaded files) are left as is.
+func (g *GeppettoCommand) loadFileParameters(parameters map[string]interface{}) error {
+	maxSize := defaultMaxFileSize
+	if m, ok := parameters["max-file-size"].(int); ok && m > 0 {
+		maxSize = m
+	}
+
+	for name, type_ := range g.fileParameters {
+		switch v := parameters[name].(type) {
+		case string:
+			if v == "" {
+				continue
+			}
+			var err error
+			if type_ == ParameterTypeDirectory {
+				parameters[name], err = readDirectory(v, maxSize)
+			} else {
+				parameters[name], err = readFile(v, maxSize)
+			}
+			if err != nil {
+				return errors.Wrapf(err, "could not read %s", name)
+			}
+
+		case []string, []interface{}:
+			paths, ok := toStringList(v)
+			if !ok {
+				return errors.Errorf("invalid paths for %s: %v", name, v)
+			}
+			files := []*File{}
+			for _, path := range paths {
+				f, err := readFile(path, maxSize)
+				if err != nil {
+					return errors.Wrapf(err, "could not read %s", name)
+				}
+				files = append(files, f)
+			}
+			parameters[name] = files
+		}
+	}
+	return nil
+}
+
+// toStringList converts a list of paths, for example a default value parsed from YAML.
+func toStringList(v interface{}) ([]string, bool) {
+	switch v_ := v.(type) {
+	case []string:
+		return v_, true
+	case []interface{}:
+		ret := []string{}
+		for _, s := range v_ {
+			s_, ok := s.(string)
+			if !ok {
+				return nil, false
+			}
+			ret = append(ret, s_)
+		}
+		return ret, true
+	}
+	return nil, false
+}
@@ -0,0 +1,109 @@
+package cmds
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	glazedcmds "github.com/wesen/glazed/pkg/cmds"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeTestFiles(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, content := range files {
+		p := filepath.Join(dir, name)
+		require.Nil(t, os.MkdirAll(filepath.Dir(p), 0755))
+		require.Nil(t, os.WriteFile(p, []byte(content), 0644))
+	}
+	return dir
+}
+
+func TestFileParameters(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{
+		"user.php":         "class User {}",
+		"src/a.go":         "package a",
+		"src/b/b.go":       "package b",
+		"src/notes.txt":    "notes",
+		"src/.git/HEAD":    "ref",
+		"src/binary.go":    "\x00\x01",
+		"other/order.php":  "class Order {}",
+		"other/ignore.txt": "ignore",
+	})
+
+	loader := &GeppettoCommandLoader{}
+	commands, err := loader.LoadCommandFromYAML(strings.NewReader(`
+name: files
+short: Files
+flags:
+  - name: sources
+    type: directory
+  - name: others
+    type: fileList
+arguments:
+  - name: input_file
+    type: file
+    required: true
+prompt: |
+  {{ .input_file.Basename }} {{ .input_file.Extension }}: {{ .input_file }}
+  {{ range .sources }}{{ .Path }}
+  {{ end }}{{ range .others }}{{ .Basename }}
+  {{ end }}
+`))
+	require.Nil(t, err)
+	command := commands[0].(*GeppettoCommand)
+
+	// glazed only sees string parameters
+	assert.Equal(t, glazedcmds.ParameterTypeString, command.Description().Flags[0].Type)
+	assert.Equal(t, glazedcmds.ParameterTypeStringList, command.Description().Flags[1].Type)
+	assert.Equal(t, glazedcmds.ParameterTypeString, command.Description().Arguments[0].Type)
+
+	parameters := map[string]interface{}{
+		"input_file": filepath.Join(dir, "user.php"),
+		"sources":    filepath.Join(dir, "src", "*.go"),
+		"others":     []string{filepath.Join(dir, "other", "order.php")},
+	}
+	require.Nil(t, command.loadFileParameters(parameters))
+
+	prompt, err := command.renderTemplate("prompt", command.Prompt, parameters)
+	require.Nil(t, err)
+	assert.Equal(t,
+		"user.php .php: class User {}\n"+
+			filepath.Join(dir, "src", "a.go")+"\n"+
+			"order.php\n\n",
+		prompt)
+
+	parameters = map[string]interface{}{"sources": filepath.Join(dir, "src")}
+	require.Nil(t, command.loadFileParameters(parameters))
+	paths := []string{}
+	for _, f := range parameters["sources"].([]*File) {
+		paths = append(paths, f.Path)
+	}
+	assert.Equal(t, []string{
+		filepath.Join(dir, "src", "a.go"),
+		filepath.Join(dir, "src", "b", "b.go"),
+		filepath.Join(dir, "src", "notes.txt"),
+	}, paths)
+}
+
+func TestReadFileLimits(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{
+		"small.txt":  "0123456789",
+		"binary.bin": "abc\x00def",
+	})
+
+	f, err := readFile(filepath.Join(dir, "small.txt"), 10)
+	require.Nil(t, err)
+	assert.Equal(t, "0123456789", f.Content)
+	assert.Equal(t, 10, f.Size)
+
+	_, err = readFile(filepath.Join(dir, "small.txt"), 9)
+	assert.Error(t, err)
+
+	_, err = readFile(filepath.Join(dir, "binary.bin"), 100)
+	assert.ErrorIs(t, err, errBinaryFile)
+
+	_, err = readDirectory(filepath.Join(dir, "*.md"), 100)
+	assert.Error(t, err)
+}
@@ -0,0 +1,280 @@
+package cmds
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/wesen/geppetto/pkg/chunking"
+	"github.com/wesen/geppetto/pkg/steps"
+	"github.com/wesen/geppetto/pkg/steps/openai"
+	"github.com/wesen/glazed/pkg/cli"
+	glazedcmds "github.com/wesen/glazed/pkg/cmds"
+	"github.com/wesen/glazed/pkg/formatters"
+	"reflect"
+	"strings"
+)
+
+const defaultMultiConcurrency = 4
+
+// multiInputElements converts the value of a multi_input parameter to the list of elements
+// to iterate over. Lists (stringList, intList, JSON or YAML arrays from objectFromFile) are used
+// as is, strings (for example stringFromFile, which can read stdin) are parsed as a JSON array
+// if possible, and split into non-empty lines otherwise.
+func multiInputElements(v interface{}) ([]interface{}, error) {
+	switch v_ := v.(type) {
+	case nil:
+		return []interface{}{}, nil
+	case []interface{}:
+		return v_, nil
+	case string:
+		var elements []interface{}
+		if err := json.Unmarshal([]byte(v_), &elements); err == nil {
+			return elements, nil
+		}
+		ret := []interface{}{}
+		for _, line := range strings.Split(v_, "\n") {
+			if strings.TrimSpace(line) != "" {
+				ret = append(ret, line)
+			}
+		}
+		return ret, nil
+	}
+
+	value := reflect.ValueOf(v)
+	if value.Kind() != reflect.Slice && value.Kind() != reflect.Array {
+		return nil, errors.Errorf("multi_input parameter of type %T is not a list", v)
+	}
+	ret := make([]interface{}, 0, value.Len())
+	for i := 0; i < value.Len(); i++ {
+		ret = append(ret, value.Index(i).Interface())
+	}
+	return ret, nil
+}
+
+// chunkElements splits the documents of a multi_input parameter into chunks, each chunk being an element
+// with the fields chunk (its index in the document), title, text, start, end, tokens, and source for files.
+func chunkElements(ctx context.Context, v interface{}, settings *chunking.Settings) ([]interface{}, error) {
+	documents := []interface{}{v}
+	switch v.(type) {
+	case string, *File:
+	default:
+		var err error
+		documents, err = multiInputElements(v)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ret := []interface{}{}
+	for _, document := range documents {
+		content, source := "", ""
+		switch d := document.(type) {
+		case string:
+			content = d
+		case *File:
+			content, source = d.Content, d.Path
+		default:
+			return nil, errors.Errorf("could not chunk multi_input element of type %T", document)
+		}
+
+		chunker, err := chunking.NewChunker(settings, source)
+		if err != nil {
+			return nil, err
+		}
+		s := steps.NewChunkStep(chunker)
+		go func() {
+			_ = s.Run(ctx, content)
+		}()
+		result := <-s.GetOutput()
+		chunks, err := result.Value()
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not chunk %s", source)
+		}
+
+		for _, chunk := range chunks {
+			element := map[string]interface{}{
+				"chunk":  chunk.Index,
+				"title":  chunk.Title,
+				"text":   chunk.Text,
+				"start":  chunk.Start,
+				"end":    chunk.End,
+				"tokens": chunk.Tokens,
+			}
+			if source != "" {
+				element["source"] = source
+			}
+			ret = append(ret, element)
+		}
+	}
+	return ret, nil
+}
+
+// multiInputTemplateData returns the parameters used to render the prompt for element.
+// The element is available under the name of the multi_input parameter, and if it is an object,
+// its fields are also available directly.
+func multiInputTemplateData(
+	parameters map[string]interface{},
+	name string,
+	element interface{},
+) map[string]interface{} {
+	ret := map[string]interface{}{}
+	for k, v := range parameters {
+		ret[k] = v
+	}
+	if m, ok := element.(map[string]interface{}); ok {
+		for k, v := range m {
+			ret[k] = v
+		}
+	}
+	ret[name] = element
+	return ret
+}
+
+// multiInputRow puts the element and the response side by side, with the error of the completion
+// of the element if it failed.
+func multiInputRow(name string, idx int, element interface{}, response string, err error) map[string]interface{} {
+	row := map[string]interface{}{
+		"index": idx,
+	}
+	switch e := element.(type) {
+	case map[string]interface{}:
+		for k, v := range e {
+			row[k] = v
+		}
+	case *File:
+		row[name] = e.Path
+	default:
+		row[name] = element
+	}
+	row["response"] = response
+	row["error"] = ""
+	if err != nil {
+		row["error"] = err.Error()
+	}
+	return row
+}
+
+// runMulti renders the prompt for each element of the multi_input parameter, runs the completions
+// concurrently, and outputs the element and the response of each completion as a row.
+// The responses of all the elements are output even if some of them failed, and the failures
+// are then returned as a *steps.MapError.
+//
+// If gp is nil, only the responses are printed, separated by the choices separator.
+func (g *GeppettoCommand) runMulti(
+	ctx context.Context,
+	parameters map[string]interface{},
+	gp *cli.GlazeProcessor,
+	of formatters.OutputFormatter,
+) error {
+	factory, ok := g.Factories["completion-step"].(*openai.CompletionStepFactory)
+	if !ok {
+		return errors.Errorf("No completion-step factory defined")
+	}
+
+	name := g.Step.MultiInput
+	var elements []interface{}
+	var err error
+	if g.Step.Chunk != nil {
+		elements, err = chunkElements(ctx, parameters[name], g.Step.Chunk)
+	} else {
+		elements, err = multiInputElements(parameters[name])
+	}
+	if err != nil {
+		return err
+	}
+
+	prompts := make([]string, 0, len(elements))
+	for i, element := range elements {
+		prompt, err := g.recordTemplate(ctx, "prompt", g.Prompt, multiInputTemplateData(parameters, name, element))
+		if err != nil {
+			return errors.Wrapf(err, "could not render prompt for element %d", i)
+		}
+		prompts = append(prompts, prompt)
+	}
+
+	printPrompt, ok := parameters["print-prompt"]
+	if ok && printPrompt.(bool) {
+		for i, prompt := range prompts {
+			fmt.Printf("--- %d ---\n%s\n", i, prompt)
+		}
+		return nil
+	}
+
+	printDyno, ok := parameters["print-dyno"]
+	if ok && printDyno.(bool) {
+		return errors.Errorf("--print-dyno is not supported for multi commands")
+	}
+
+	concurrency := g.Step.Concurrency
+	if c, ok := parameters["concurrency"].(int); ok && c > 0 {
+		concurrency = c
+	}
+	if concurrency <= 0 {
+		concurrency = defaultMultiConcurrency
+	}
+
+	s := openai.NewMultiCompletionStep(factory.NewStepSettings(), concurrency)
+	go func() {
+		_ = s.Run(ctx, prompts)
+	}()
+
+	result := <-s.GetOutput()
+	responses, err := result.Value()
+	mapError, ok := err.(*steps.MapError)
+	if err != nil && !ok {
+		return err
+	}
+	elementErrors := map[int]error{}
+	if mapError != nil {
+		elementErrors = mapError.Errors
+	}
+
+	if gp == nil {
+		separator, _ := parameters["choices-separator"].(string)
+		for i, response := range responses {
+			if i > 0 {
+				fmt.Print(separator)
+			}
+			fmt.Printf("%s", response)
+		}
+	} else {
+		rows := []map[string]interface{}{}
+		for i, response := range responses {
+			rows = append(rows, multiInputRow(name, i, elements[i], response, elementErrors[i]))
+		}
+		err = outputGlazedRows(rows, gp, of)
+		if err != nil {
+			return err
+		}
+	}
+
+	if mapError != nil {
+		return mapError
+	}
+	return nil
+}
+
+// validateMultiInput checks that the multi_input of the command is a declared flag or argument.
+func validateMultiInput(scd *GeppettoCommandDescription) error {
+	if scd.Step.MultiInput == "" {
+		return errors.Errorf("multi step without multi_input")
+	}
+	if scd.SystemPrompt != "" || len(scd.Messages) > 0 {
+		return errors.Errorf("multi_input is not supported by chat commands")
+	}
+	if scd.Edit != nil {
+		return errors.Errorf("multi_input is not supported by edit commands")
+	}
+	if scd.Step.Chunk != nil {
+		if err := scd.Step.Chunk.Validate(); err != nil {
+			return errors.Wrap(err, "invalid chunk settings")
+		}
+	}
+	for _, p := range append(append([]*glazedcmds.Parameter{}, scd.Flags...), scd.Arguments...) {
+		if p.Name == scd.Step.MultiInput {
+			return nil
+		}
+	}
+	return errors.Errorf("multi_input %s is not a flag or argument", scd.Step.MultiInput)
+}
@@ -0,0 +1,139 @@
+package cmds
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wesen/geppetto/pkg/backends"
+	"github.com/wesen/geppetto/pkg/chunking"
+	"github.com/wesen/geppetto/pkg/steps"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMultiInputElements(t *testing.T) {
+	elements, err := multiInputElements([]string{"a", "b"})
+	require.Nil(t, err)
+	assert.Equal(t, []interface{}{"a", "b"}, elements)
+
+	elements, err = multiInputElements([]int{1, 2})
+	require.Nil(t, err)
+	assert.Equal(t, []interface{}{1, 2}, elements)
+
+	elements, err = multiInputElements(`["a", {"b": 1}]`)
+	require.Nil(t, err)
+	assert.Equal(t, []interface{}{"a", map[string]interface{}{"b": float64(1)}}, elements)
+
+	elements, err = multiInputElements("first line\n\nsecond line\n")
+	require.Nil(t, err)
+	assert.Equal(t, []interface{}{"first line", "second line"}, elements)
+
+	_, err = multiInputElements(map[string]interface{}{"a": 1})
+	assert.Error(t, err)
+}
+
+func TestMultiInputTemplateData(t *testing.T) {
+	parameters := map[string]interface{}{"questions": []string{"why?"}}
+
+	data := multiInputTemplateData(parameters, "article", map[string]interface{}{"heading": "Intro"})
+	assert.Equal(t, "Intro", data["heading"])
+	assert.Equal(t, map[string]interface{}{"heading": "Intro"}, data["article"])
+	assert.Equal(t, []string{"why?"}, data["questions"])
+
+	row := multiInputRow("article", 2, "some line", "response", nil)
+	assert.Equal(t, map[string]interface{}{"index": 2, "article": "some line", "response": "response", "error": ""}, row)
+
+	row = multiInputRow("article", 2, "some line", "", errors.New("failed"))
+	assert.Equal(t, "failed", row["error"])
+}
+
+func TestLoadMultiInput(t *testing.T) {
+	loader := &GeppettoCommandLoader{}
+	header := "name: multi\nshort: Multi\nflags:\n  - name: items\n    type: stringList\nstep:\n  type: multi\n  multi_input: items\n"
+
+	_, err := loader.LoadCommandFromYAML(strings.NewReader(header + "prompt: say {{ .items }}\n"))
+	require.Nil(t, err)
+
+	invalid := []string{
+		// chat commands run a single conversation
+		"system: You are a bot\n",
+		"messages:\n  - role: user\n    content: hello\n",
+	}
+	for _, s := range invalid {
+		_, err = loader.LoadCommandFromYAML(strings.NewReader(header + s))
+		assert.Error(t, err, s)
+	}
+}
+
+func TestRunMultiReportsFailedElements(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(home, ".config"))
+	t.Setenv("XDG_DATA_HOME", filepath.Join(home, ".local", "share"))
+
+	backend := backends.NewFakeBackend()
+	backend.AddPromptResponse("say a", &backends.FakeResponse{Text: "a"})
+	backend.AddPromptResponse("say b", &backends.FakeResponse{
+		Error: &backends.APIError{StatusCode: 400, Message: "invalid prompt"},
+	})
+	server := backends.NewFakeOpenAIServer(backend)
+	defer server.Close()
+
+	loader := &GeppettoCommandLoader{}
+	commands, err := loader.LoadCommandFromYAML(strings.NewReader(`
+name: multi
+short: Multi
+flags:
+  - name: items
+    type: stringList
+factories:
+  openai:
+    client:
+      api_key: test
+      base_url: ` + server.URL + `
+    completion:
+      engine: fake-model
+step:
+  type: multi
+  multi_input: items
+prompt: "say {{ .items }}"
+`))
+	require.Nil(t, err)
+	command := commands[0].(*GeppettoCommand)
+
+	err = command.Run(map[string]interface{}{
+		"items": []string{"a", "b"},
+	})
+	require.Error(t, err)
+	mapError, ok := err.(*steps.MapError)
+	require.True(t, ok)
+	require.Len(t, mapError.Errors, 1)
+	assert.Contains(t, mapError.Errors[1].Error(), "invalid prompt")
+	assert.Len(t, backend.Requests(), 2)
+}
+
+func TestChunkElements(t *testing.T) {
+	settings := &chunking.Settings{Strategy: chunking.StrategyHeading, Level: 1}
+
+	elements, err := chunkElements(context.Background(), "intro\n# One\nfirst\n", settings)
+	require.Nil(t, err)
+	require.Len(t, elements, 2)
+	assert.Equal(t, "One", elements[1].(map[string]interface{})["title"])
+	assert.Equal(t, "# One\nfirst", elements[1].(map[string]interface{})["text"])
+	assert.Equal(t, 1, elements[1].(map[string]interface{})["chunk"])
+
+	files := []*File{
+		{Path: "a.md", Content: "# A\na"},
+		{Path: "b.md", Content: "# B1\nb\n# B2\nb"},
+	}
+	elements, err = chunkElements(context.Background(), files, settings)
+	require.Nil(t, err)
+	require.Len(t, elements, 3)
+	assert.Equal(t, "b.md", elements[2].(map[string]interface{})["source"])
+	assert.Equal(t, "B2", elements[2].(map[string]interface{})["title"])
+
+	_, err = chunkElements(context.Background(), []int{1}, settings)
+	assert.Error(t, err)
+}
@@ -0,0 +1,65 @@
+package cmds
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/wesen/geppetto/pkg/steps"
+	"github.com/wesen/glazed/pkg/cli"
+	"github.com/wesen/glazed/pkg/formatters"
+)
+
+// outputRows converts a parsed output to rows: lists become one row per element,
+// and values that are not objects are put in a value column.
+func outputRows(v interface{}) []map[string]interface{} {
+	elements, ok := v.([]interface{})
+	if !ok {
+		elements = []interface{}{v}
+	}
+
+	ret := []map[string]interface{}{}
+	for _, e := range elements {
+		if row, ok := e.(map[string]interface{}); ok {
+			ret = append(ret, row)
+		} else {
+			ret = append(ret, map[string]interface{}{"value": e})
+		}
+	}
+	return ret
+}
+
+// runOutputStep runs s and outputs the parsed result. Text is printed as is, and data is
+// output as rows through glazed, or printed as JSON if gp is nil.
+func runOutputStep[A any](
+	ctx context.Context,
+	s *steps.OutputStep[A],
+	a A,
+	gp *cli.GlazeProcessor,
+	of formatters.OutputFormatter,
+) error {
+	go func() {
+		_ = s.Run(ctx, a)
+	}()
+
+	result := <-s.GetOutput()
+	v, err := result.Value()
+	if err != nil {
+		return err
+	}
+
+	if text, ok := v.(string); ok {
+		fmt.Printf("%s", text)
+		return nil
+	}
+
+	if gp == nil {
+		b, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+		return nil
+	}
+
+	return outputGlazedRows(outputRows(v), gp, of)
+}
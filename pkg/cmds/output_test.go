@@ -0,0 +1,48 @@
+package cmds
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+)
+
+func TestOutputRows(t *testing.T) {
+	assert.Equal(t,
+		[]map[string]interface{}{{"name": "a"}, {"value": "b"}},
+		outputRows([]interface{}{map[string]interface{}{"name": "a"}, "b"}))
+	assert.Equal(t,
+		[]map[string]interface{}{{"name": "a"}},
+		outputRows(map[string]interface{}{"name": "a"}))
+	assert.Equal(t,
+		[]map[string]interface{}{{"value": 1}},
+		outputRows(1))
+}
+
+func TestLoadOutput(t *testing.T) {
+	loader := &GeppettoCommandLoader{}
+	commands, err := loader.LoadCommandFromYAML(strings.NewReader(`
+name: extract
+short: Extract
+prompt: hello
+output:
+  parsers:
+    - type: markers
+      begin: ---BEGIN YAML---
+    - type: yaml
+`))
+	require.Nil(t, err)
+	command := commands[0].(*GeppettoCommand)
+	assert.NotNil(t, command.outputProcessor)
+	assert.True(t, command.hasGlazedOutput())
+
+	_, err = loader.LoadCommandFromYAML(strings.NewReader(`
+name: extract
+short: Extract
+prompt: hello
+output:
+  parsers:
+    - type: xml
+`))
+	assert.Error(t, err)
+}
@@ -0,0 +1,56 @@
+package cmds
+
+import (
+	"context"
+	"github.com/rs/zerolog/log"
+	"github.com/wesen/geppetto/pkg/recorder"
+	"github.com/wesen/geppetto/pkg/usage"
+)
+
+// startRecording starts recording the run in the default runs directory, if the record parameter is set.
+// Runs that only print the prompt are not recorded. Recording is best effort: if the run can't
+// be recorded, the error is logged and nil is returned.
+func (g *GeppettoCommand) startRecording(parameters map[string]interface{}) *recorder.Recorder {
+	record, _ := parameters["record"].(bool)
+	printPrompt, _ := parameters["print-prompt"].(bool)
+	printDyno, _ := parameters["print-dyno"].(bool)
+	if !record || printPrompt || printDyno {
+		return nil
+	}
+
+	directory, err := recorder.DefaultDirectory()
+	if err != nil {
+		log.Warn().Err(err).Msg("could not record the run")
+		return nil
+	}
+	rec, err := recorder.NewStore(directory).Create(g.description.Name, g.parameterColumns(parameters))
+	if err != nil {
+		log.Warn().Err(err).Msg("could not record the run")
+		return nil
+	}
+	log.Debug().Str("run", rec.RunID()).Msg("recording run")
+	return rec
+}
+
+// finishRecording records the end of the run, with the usage collected by tracker.
+func finishRecording(rec *recorder.Recorder, err error, tracker *usage.Tracker) {
+	finishErr := rec.Finish(err, tracker)
+	if finishErr != nil {
+		log.Warn().Err(finishErr).Str("run", rec.RunID()).Msg("could not record the end of the run")
+	}
+}
+
+// recordTemplate renders tmpl like renderTemplate, and records the rendering as a template step.
+func (g *GeppettoCommand) recordTemplate(
+	ctx context.Context,
+	name string,
+	tmpl string,
+	parameters map[string]interface{},
+) (string, error) {
+	_, rec := recorder.StartStep(ctx, "template", parameters)
+	rec.SetName(name)
+	rec.SetMetadata("template", tmpl)
+	ret, err := g.renderTemplate(name, tmpl, parameters)
+	rec.Finish(ret, err)
+	return ret, err
+}
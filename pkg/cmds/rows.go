@@ -0,0 +1,228 @@
+package cmds
+
+import (
+	"context"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/wesen/geppetto/pkg/steps/openai"
+	"github.com/wesen/geppetto/pkg/usage"
+	"github.com/wesen/glazed/pkg/cli"
+	glazedcmds "github.com/wesen/glazed/pkg/cmds"
+	"github.com/wesen/glazed/pkg/formatters"
+	"time"
+)
+
+// addGlazedFlags adds the glazed output flags to cmd, unless one of them is already declared
+// by the command. It returns false if the flags were not added.
+func addGlazedFlags(cmd *cobra.Command) bool {
+	flags := &cobra.Command{}
+	cli.AddFlags(flags, cli.NewFlagsDefaults())
+
+	conflict := ""
+	flags.Flags().VisitAll(func(f *pflag.Flag) {
+		if cmd.Flags().Lookup(f.Name) != nil {
+			conflict = f.Name
+		}
+	})
+	if conflict != "" {
+		log.Debug().Str("command", cmd.Name()).Str("flag", conflict).Msg("flag conflicts with glazed, disabling glazed output")
+		return false
+	}
+
+	cmd.Flags().AddFlagSet(flags.Flags())
+	return true
+}
+
+// parameterColumns returns the values of the flags and arguments of the command,
+// with files replaced by their paths.
+func (g *GeppettoCommand) parameterColumns(parameters map[string]interface{}) map[string]interface{} {
+	ret := map[string]interface{}{}
+	for _, p := range append(append([]*glazedcmds.Parameter{}, g.description.Flags...), g.description.Arguments...) {
+		v, ok := parameters[p.Name]
+		if !ok {
+			continue
+		}
+		switch v_ := v.(type) {
+		case *File:
+			v = v_.Path
+		case []*File:
+			paths := []string{}
+			for _, f := range v_ {
+				paths = append(paths, f.Path)
+			}
+			v = paths
+		}
+		ret[p.Name] = v
+	}
+	return ret
+}
+
+// engineName returns the engine used by a step, which falls back to the default engine of the client.
+func engineName(engine *string, clientSettings *openai.ClientSettings) string {
+	if engine != nil {
+		return *engine
+	}
+	if clientSettings.DefaultEngine != nil {
+		return *clientSettings.DefaultEngine
+	}
+	return ""
+}
+
+// engine returns the engine of the completion, chat or edit step of the command,
+// or an empty string if it has none or the engine is not configured.
+func (g *GeppettoCommand) engine() string {
+	switch f := g.Factories["completion-step"].(type) {
+	case *openai.CompletionStepFactory:
+		if f.StepSettings != nil && f.ClientSettings != nil {
+			return engineName(f.StepSettings.Engine, f.ClientSettings)
+		}
+	}
+	switch f := g.Factories["chat-completion-step"].(type) {
+	case *openai.ChatCompletionStepFactory:
+		if f.StepSettings != nil && f.ClientSettings != nil {
+			return engineName(f.StepSettings.Engine, f.ClientSettings)
+		}
+	}
+	switch f := g.Factories["edit-step"].(type) {
+	case *openai.EditStepFactory:
+		if f.StepSettings != nil && f.ClientSettings != nil {
+			return engineName(f.StepSettings.Engine, f.ClientSettings)
+		}
+	}
+	return ""
+}
+
+// addUsageColumns adds the tokens and cost of all the requests recorded by tracker to row.
+func addUsageColumns(row map[string]interface{}, tracker *usage.Tracker) {
+	total := &usage.Total{}
+	for _, t := range tracker.Totals() {
+		total.Add(t)
+	}
+	row["prompt_tokens"] = total.PromptTokens
+	row["completion_tokens"] = total.CompletionTokens
+	row["total_tokens"] = total.TotalTokens()
+	if total.UnknownPrice {
+		row["cost"] = ""
+	} else {
+		row["cost"] = total.Cost
+	}
+}
+
+func outputGlazedRows(rows []map[string]interface{}, gp *cli.GlazeProcessor, of formatters.OutputFormatter) error {
+	for _, row := range rows {
+		err := gp.ProcessInputObject(row)
+		if err != nil {
+			return err
+		}
+	}
+
+	s, err := of.Output()
+	if err != nil {
+		return err
+	}
+	fmt.Print(s)
+	return nil
+}
+
+// runCompletionRows runs the completion without streaming, and outputs a row per choice.
+func (g *GeppettoCommand) runCompletionRows(
+	ctx context.Context,
+	factory *openai.CompletionStepFactory,
+	parameters map[string]interface{},
+	prompt string,
+	gp *cli.GlazeProcessor,
+	of formatters.OutputFormatter,
+) error {
+	settings := factory.NewStepSettings()
+	settings.Stream = false
+	s := openai.NewCompletionChoicesStep(settings)
+
+	start := time.Now()
+	go func() {
+		_ = s.Run(ctx, prompt)
+	}()
+	result := <-s.GetOutput()
+	latency := time.Since(start)
+	choices, err := result.Value()
+	if err != nil {
+		return err
+	}
+
+	engine := engineName(settings.Engine, settings.ClientSettings)
+
+	rows := []map[string]interface{}{}
+	for _, choice := range choices {
+		row := g.parameterColumns(parameters)
+		row["index"] = choice.Index
+		row["prompt"] = prompt
+		row["response"] = choice.Text
+		row["engine"] = engine
+		row["finish_reason"] = choice.FinishReason
+		row["latency_ms"] = latency.Milliseconds()
+		addUsageColumns(row, settings.ClientSettings.UsageTracker)
+		rows = append(rows, row)
+	}
+
+	return outputGlazedRows(rows, gp, of)
+}
+
+// runChatRows runs the chat completion without streaming, and outputs the answer as a row.
+// The prompt column contains the rendered messages.
+func (g *GeppettoCommand) runChatRows(
+	ctx context.Context,
+	factory *openai.ChatCompletionStepFactory,
+	parameters map[string]interface{},
+	messages []openai.ChatMessage,
+	gp *cli.GlazeProcessor,
+	of formatters.OutputFormatter,
+) error {
+	settings := factory.NewStepSettings()
+	settings.Stream = false
+	s := openai.NewChatCompletionStep(settings)
+
+	start := time.Now()
+	go func() {
+		_ = s.Run(ctx, messages)
+	}()
+	result := <-s.GetOutput()
+	latency := time.Since(start)
+	response, err := result.Value()
+	if err != nil {
+		return err
+	}
+
+	engine := engineName(settings.Engine, settings.ClientSettings)
+
+	prompt := ""
+	for _, message := range messages {
+		prompt += fmt.Sprintf("%s: %s\n", message.Role, message.Content)
+	}
+
+	row := g.parameterColumns(parameters)
+	row["prompt"] = prompt
+	row["response"] = response
+	row["engine"] = engine
+	row["finish_reason"] = s.FinishReason()
+	row["latency_ms"] = latency.Milliseconds()
+	addUsageColumns(row, settings.ClientSettings.UsageTracker)
+
+	return outputGlazedRows([]map[string]interface{}{row}, gp, of)
+}
+
+// chainRows returns a row per output of the chain.
+func (g *GeppettoCommand) chainRows(
+	parameters map[string]interface{},
+	ids []string,
+	outputs map[string]string,
+) []map[string]interface{} {
+	rows := []map[string]interface{}{}
+	for _, id := range ids {
+		row := g.parameterColumns(parameters)
+		row["id"] = id
+		row["response"] = outputs[id]
+		rows = append(rows, row)
+	}
+	return rows
+}
@@ -0,0 +1,45 @@
+package cmds
+
+import (
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+)
+
+func TestAddGlazedFlags(t *testing.T) {
+	cmd := &cobra.Command{Use: "test"}
+	assert.True(t, addGlazedFlags(cmd))
+	assert.NotNil(t, cmd.Flags().Lookup("output"))
+
+	// a command declaring a flag used by glazed keeps printing text
+	cmd = &cobra.Command{Use: "test"}
+	cmd.Flags().String("fields", "", "Fields to summarize")
+	assert.False(t, addGlazedFlags(cmd))
+	assert.Nil(t, cmd.Flags().Lookup("output"))
+}
+
+func TestParameterColumns(t *testing.T) {
+	loader := &GeppettoCommandLoader{}
+	commands, err := loader.LoadCommandFromYAML(strings.NewReader(`
+name: columns
+short: Columns
+flags:
+  - name: language
+    type: string
+arguments:
+  - name: input_file
+    type: file
+prompt: hello
+`))
+	require.Nil(t, err)
+	command := commands[0].(*GeppettoCommand)
+
+	columns := command.parameterColumns(map[string]interface{}{
+		"language":     "go",
+		"input_file":   &File{Path: "main.go", Content: "package main"},
+		"print-prompt": false,
+	})
+	assert.Equal(t, map[string]interface{}{"language": "go", "input_file": "main.go"}, columns)
+}
@@ -0,0 +1,149 @@
+package cmds
+
+import (
+	"github.com/pkg/errors"
+	"github.com/wesen/geppetto/pkg/helpers"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// TemplatesDirectory is the directory next to a command (or at the root of a repository)
+// containing the partials available to the prompts.
+const TemplatesDirectory = "templates"
+
+// LoadPartials parses all the .tmpl files below dir as templates named by their path relative
+// to dir, for example {{ template "sql/schema.tmpl" . }}. The templates they define with
+// {{ define }} are available as well. If base is not nil, the partials are added to a clone of it.
+//
+// A missing dir is not an error.
+func LoadPartials(f fs.FS, dir string, base *template.Template) (*template.Template, error) {
+	var ret *template.Template
+	if base != nil {
+		var err error
+		ret, err = base.Clone()
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		ret = template.New("").Funcs(helpers.TemplateFuncs)
+	}
+
+	if _, err := fs.Stat(f, dir); err != nil {
+		return ret, nil
+	}
+
+	err := fs.WalkDir(f, dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(p, ".tmpl") {
+			return nil
+		}
+		s, err := fs.ReadFile(f, p)
+		if err != nil {
+			return err
+		}
+		name := strings.TrimPrefix(strings.TrimPrefix(p, dir), "/")
+		_, err = ret.New(name).Parse(string(s))
+		if err != nil {
+			return errors.Wrapf(err, "could not parse partial %s", p)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+// LoadTemplates reads the prompt files of the command relative to dir, and loads the partials in
+// dir/templates on top of the shared partials (which can be nil).
+func (g *GeppettoCommand) LoadTemplates(f fs.FS, dir string, shared *template.Template) error {
+	if g.PromptFile != "" {
+		s, err := fs.ReadFile(f, path.Join(dir, g.PromptFile))
+		if err != nil {
+			return errors.Wrapf(err, "could not read prompt_file of command %s", g.description.Name)
+		}
+		g.Prompt = string(s)
+		g.PromptFile = ""
+	}
+
+	for name, step := range g.Steps {
+		if step.PromptFile == "" {
+			continue
+		}
+		s, err := fs.ReadFile(f, path.Join(dir, step.PromptFile))
+		if err != nil {
+			return errors.Wrapf(err, "could not read prompt_file of step %s", name)
+		}
+		step.Prompt = string(s)
+		step.PromptFile = ""
+	}
+
+	partials, err := LoadPartials(f, path.Join(dir, TemplatesDirectory), shared)
+	if err != nil {
+		return err
+	}
+	g.templates = partials
+
+	return nil
+}
+
+// LoadCommandTemplates calls LoadTemplates on commands loaded by glazed from the directory root,
+// with f giving access to the files of root. The commands are located using the source glazed
+// stores in their description, and the partials in root/templates are shared by all the commands.
+func LoadCommandTemplates(f fs.FS, root string, commands []*GeppettoCommand) error {
+	shared, err := LoadPartials(f, TemplatesDirectory, nil)
+	if err != nil {
+		return err
+	}
+
+	for _, command := range commands {
+		source := command.Description().Source
+		source = strings.TrimPrefix(source, "embed:")
+		source = strings.TrimPrefix(source, "file:")
+		rel, err := filepath.Rel(root, source)
+		if err != nil {
+			return err
+		}
+		err = command.LoadTemplates(f, path.Dir(filepath.ToSlash(rel)), shared)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// renderTemplate renders tmpl with parameters, making the partials of the command available.
+// truncateTokens counts the tokens with the encoding of the engine of the command.
+func (g *GeppettoCommand) renderTemplate(name string, tmpl string, parameters map[string]interface{}) (string, error) {
+	t := template.New(name).Funcs(helpers.TemplateFuncs)
+	if g.templates != nil {
+		var err error
+		t, err = g.templates.Clone()
+		if err != nil {
+			return "", err
+		}
+		t = t.New(name)
+	}
+	if engine := g.engine(); engine != "" {
+		t = t.Funcs(template.FuncMap{"truncateTokens": helpers.TruncateTokensForModel(engine)})
+	}
+	t, err := t.Parse(tmpl)
+	if err != nil {
+		return "", err
+	}
+
+	var buf strings.Builder
+	err = t.Execute(&buf, parameters)
+	if err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
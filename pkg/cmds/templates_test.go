@@ -0,0 +1,89 @@
+package cmds
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestLoadCommandTemplates(t *testing.T) {
+	f := fstest.MapFS{
+		"templates/signature.tmpl":            {Data: []byte("-- {{ .name }}")},
+		"code/templates/header.tmpl":          {Data: []byte(`{{ define "greeting" }}Hello{{ end }}`)},
+		"code/templates/sql/schema.tmpl":      {Data: []byte("CREATE TABLE {{ .table }}")},
+		"code/prompts/explain.tmpl":           {Data: []byte(`{{ template "greeting" }}, explain {{ template "sql/schema.tmpl" . }}`)},
+		"code/templates/ignored-not-tmpl.txt": {Data: []byte("{{ broken")},
+	}
+
+	loader := &GeppettoCommandLoader{}
+	commands, err := loader.LoadCommandFromYAML(strings.NewReader(`
+name: explain
+short: Explain a schema
+prompt_file: prompts/explain.tmpl
+factories:
+  openai:
+    client:
+      api_key: test
+`))
+	require.Nil(t, err)
+	command := commands[0].(*GeppettoCommand)
+	command.Description().Source = "file:/repository/code/explain.yaml"
+
+	other, err := loader.LoadCommandFromYAML(strings.NewReader(`
+name: sign
+short: Sign
+prompt: '{{ template "signature.tmpl" . }}'
+`))
+	require.Nil(t, err)
+	otherCommand := other[0].(*GeppettoCommand)
+	otherCommand.Description().Source = "file:/repository/sign.yaml"
+
+	err = LoadCommandTemplates(f, "/repository", []*GeppettoCommand{command, otherCommand})
+	require.Nil(t, err)
+
+	prompt, err := command.renderTemplate("prompt", command.Prompt, map[string]interface{}{"table": "users"})
+	require.Nil(t, err)
+	assert.Equal(t, "Hello, explain CREATE TABLE users", prompt)
+
+	prompt, err = otherCommand.renderTemplate("prompt", otherCommand.Prompt, map[string]interface{}{"name": "manuel"})
+	require.Nil(t, err)
+	assert.Equal(t, "-- manuel", prompt)
+}
+
+func TestPromptAndPromptFile(t *testing.T) {
+	loader := &GeppettoCommandLoader{}
+	_, err := loader.LoadCommandFromYAML(strings.NewReader(`
+name: both
+short: Both
+prompt: hello
+prompt_file: hello.tmpl
+`))
+	assert.Error(t, err)
+}
+
+func TestRenderTemplateTruncateTokens(t *testing.T) {
+	t.Setenv("GEPPETTO_TOKENIZERS_DIR", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+
+	loader := &GeppettoCommandLoader{}
+	commands, err := loader.LoadCommandFromYAML(strings.NewReader(`
+name: truncate
+short: Truncate
+prompt: '{{ .text | truncateTokens 4 }}'
+factories:
+  openai:
+    client:
+      api_key: test
+    completion:
+      engine: gpt-4
+`))
+	require.Nil(t, err)
+	command := commands[0].(*GeppettoCommand)
+	assert.Equal(t, "gpt-4", command.engine())
+
+	prompt, err := command.renderTemplate("prompt", command.Prompt, map[string]interface{}{"text": "the tokenization"})
+	require.Nil(t, err)
+	assert.Equal(t, "the", prompt)
+}
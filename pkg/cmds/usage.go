@@ -0,0 +1,84 @@
+package cmds
+
+import (
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"github.com/wesen/geppetto/pkg/usage"
+	"io"
+	"time"
+)
+
+// reportUsage adds the usage of the run to the daily totals, and prints both if printUsage is set.
+// Failing to persist the daily totals is logged but doesn't fail the command.
+func reportUsage(w io.Writer, tracker *usage.Tracker, printUsage bool) error {
+	totals := tracker.Totals()
+	if len(totals) == 0 {
+		return nil
+	}
+
+	var dailyTotals []*usage.Total
+	path, err := usage.DefaultDailyTotalsPath()
+	if err == nil {
+		dailyTotals, err = usage.AddToDailyTotals(path, time.Now().Format("2006-01-02"), totals)
+	}
+	if err != nil {
+		log.Warn().Err(err).Msg("could not update the daily usage totals")
+	}
+
+	if !printUsage {
+		return nil
+	}
+
+	_, err = fmt.Fprintln(w)
+	if err != nil {
+		return err
+	}
+	err = printTotals(w, "This run", totals)
+	if err != nil {
+		return err
+	}
+	if dailyTotals != nil {
+		err = printTotals(w, "Today", dailyTotals)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func printTotals(w io.Writer, title string, totals []*usage.Total) error {
+	_, err := fmt.Fprintf(w, "%s:\n", title)
+	if err != nil {
+		return err
+	}
+
+	sum := &usage.Total{}
+	for _, total := range totals {
+		sum.Add(total)
+		_, err = fmt.Fprintf(w, "  %s: %s\n", total.Model, formatTotal(total))
+		if err != nil {
+			return err
+		}
+	}
+	if len(totals) > 1 {
+		_, err = fmt.Fprintf(w, "  total: %s\n", formatTotal(sum))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func formatTotal(total *usage.Total) string {
+	ret := fmt.Sprintf("%d requests, %d prompt + %d completion = %d tokens",
+		total.Requests, total.PromptTokens, total.CompletionTokens, total.TotalTokens())
+	if total.Estimated {
+		ret += " (estimated)"
+	}
+	if total.UnknownPrice {
+		ret += fmt.Sprintf(", $%.4f (unknown price for some models)", total.Cost)
+	} else {
+		ret += fmt.Sprintf(", $%.4f", total.Cost)
+	}
+	return ret
+}
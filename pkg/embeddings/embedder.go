@@ -0,0 +1,80 @@
+package embeddings
+
+import (
+	"context"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"github.com/wesen/geppetto/pkg/backends"
+	"github.com/wesen/geppetto/pkg/usage"
+)
+
+const (
+	DefaultModel     = "text-embedding-ada-002"
+	DefaultBatchSize = 100
+)
+
+// Embedder computes the embeddings of texts, sending them to the backend in batches.
+type Embedder struct {
+	Backend backends.Backend
+	Model   string
+	// BatchSize is the maximum number of texts per request, DefaultBatchSize if 0
+	BatchSize int
+	User      string
+	// UsageTracker collects the tokens used by the requests, if not nil
+	UsageTracker *usage.Tracker
+}
+
+// Embed returns the vectors of the texts, in the same order.
+func (e *Embedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	batchSize := e.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+
+	ret := make([][]float32, 0, len(texts))
+	for start := 0; start < len(texts); start += batchSize {
+		end := start + batchSize
+		if end > len(texts) {
+			end = len(texts)
+		}
+		log.Debug().
+			Str("model", e.Model).
+			Int("start", start).
+			Int("end", end).
+			Int("total", len(texts)).
+			Msg("sending embeddings request")
+
+		resp, err := e.Backend.Embed(ctx, &backends.EmbeddingsRequest{
+			Model: e.Model,
+			Input: texts[start:end],
+			User:  e.User,
+		})
+		if err != nil {
+			return nil, err
+		}
+		e.UsageTracker.Add(usage.Usage{
+			Model:        e.Model,
+			PromptTokens: resp.Usage.PromptTokens,
+		})
+
+		vectors := make([][]float32, end-start)
+		for _, data := range resp.Data {
+			if data.Index < 0 || data.Index >= len(vectors) {
+				return nil, fmt.Errorf("embedding index %d out of range", data.Index)
+			}
+			vector := make([]float32, len(data.Embedding))
+			for j, v := range data.Embedding {
+				vector[j] = float32(v)
+			}
+			vectors[data.Index] = vector
+		}
+		for j, vector := range vectors {
+			if vector == nil {
+				return nil, fmt.Errorf("no embedding returned for text %d", start+j)
+			}
+		}
+		ret = append(ret, vectors...)
+	}
+
+	return ret, nil
+}
@@ -0,0 +1,132 @@
+package embeddings
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wesen/geppetto/pkg/backends"
+	"github.com/wesen/geppetto/pkg/usage"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// batchRecordingBackend records the inputs of each embeddings request.
+type batchRecordingBackend struct {
+	*backends.FakeBackend
+	batches [][]string
+}
+
+func (b *batchRecordingBackend) Embed(ctx context.Context, request *backends.EmbeddingsRequest) (*backends.EmbeddingsResponse, error) {
+	b.batches = append(b.batches, request.Input)
+	return b.FakeBackend.Embed(ctx, request)
+}
+
+func TestIndexSaveAndSearch(t *testing.T) {
+	directory := filepath.Join(t.TempDir(), "index")
+	index, err := Open(directory)
+	require.Nil(t, err)
+	assert.Empty(t, index.Chunks)
+
+	chunks := []*Chunk{
+		{Source: "a.md", Index: 0, Text: "apples", SourceHash: "1"},
+		{Source: "a.md", Index: 1, Text: "pears", SourceHash: "1"},
+		{Source: "b.md", Index: 0, Text: "carrots", SourceHash: "2"},
+	}
+	vectors := [][]float32{{1, 0, 0}, {0.8, 0.6, 0}, {0, 0, 1}}
+	require.Nil(t, index.Add("model", chunks, vectors))
+	assert.NotNil(t, index.Add("other-model", chunks[:1], vectors[:1]))
+	assert.NotNil(t, index.Add("model", chunks[:1], [][]float32{{1, 0}}))
+	require.Nil(t, index.Save())
+
+	index, err = Open(directory)
+	require.Nil(t, err)
+	assert.Equal(t, "model", index.Metadata.Model)
+	assert.Equal(t, 3, index.Metadata.Dimensions)
+	assert.Equal(t, 3, index.Metadata.Count)
+	assert.Equal(t, vectors, index.Vectors)
+	assert.Equal(t, "pears", index.Chunks[1].Text)
+
+	results, err := index.Search([]float32{2, 0, 0}, 2)
+	require.Nil(t, err)
+	require.Len(t, results, 2)
+	assert.Equal(t, "apples", results[0].Chunk.Text)
+	assert.InDelta(t, 1.0, results[0].Score, 1e-6)
+	assert.Equal(t, "pears", results[1].Chunk.Text)
+	assert.InDelta(t, 0.8, results[1].Score, 1e-6)
+
+	_, err = index.Search([]float32{1, 0}, 2)
+	assert.NotNil(t, err)
+
+	hash, ok := index.SourceHash("b.md")
+	assert.True(t, ok)
+	assert.Equal(t, "2", hash)
+	assert.Equal(t, 2, index.RemoveSource("a.md"))
+	assert.Len(t, index.Vectors, 1)
+	_, ok = index.SourceHash("a.md")
+	assert.False(t, ok)
+
+	// a vectors file that doesn't match the metadata is detected
+	require.Nil(t, os.WriteFile(filepath.Join(directory, "vectors.f32"), []byte{0, 0, 0, 0}, 0644))
+	_, err = Open(directory)
+	assert.NotNil(t, err)
+}
+
+func TestIndexChecksums(t *testing.T) {
+	directory := t.TempDir()
+	index, err := Open(directory)
+	require.Nil(t, err)
+	require.Nil(t, index.Add("model", []*Chunk{{Source: "a.md", Text: "apples"}}, [][]float32{{1, 0}}))
+	require.Nil(t, index.Save())
+
+	index, err = Open(directory)
+	require.Nil(t, err)
+	assert.Len(t, index.Metadata.Checksums, 2)
+
+	// a vectors file of the right size, from another save, is detected
+	vectorsPath := filepath.Join(directory, "vectors.f32")
+	vectors, err := os.ReadFile(vectorsPath)
+	require.Nil(t, err)
+	otherVectors := append([]byte{}, vectors...)
+	otherVectors[0]++
+	require.Nil(t, os.WriteFile(vectorsPath, otherVectors, 0644))
+	_, err = Open(directory)
+	assert.ErrorContains(t, err, "vectors.f32")
+
+	// indexes without checksums are still opened
+	require.Nil(t, os.WriteFile(vectorsPath, vectors, 0644))
+	index.Metadata.Checksums = nil
+	b, err := json.Marshal(index.Metadata)
+	require.Nil(t, err)
+	require.Nil(t, os.WriteFile(filepath.Join(directory, "index.json"), b, 0644))
+	_, err = Open(directory)
+	require.Nil(t, err)
+}
+
+func TestEmbedderBatches(t *testing.T) {
+	backend := &batchRecordingBackend{FakeBackend: backends.NewFakeBackend()}
+	tracker := usage.NewTracker()
+	embedder := &Embedder{
+		Backend:      backend,
+		Model:        "text-embedding-ada-002",
+		BatchSize:    2,
+		UsageTracker: tracker,
+	}
+
+	texts := []string{"one", "two words", "three", "four", "five"}
+	vectors, err := embedder.Embed(context.Background(), texts)
+	require.Nil(t, err)
+	require.Len(t, vectors, 5)
+	assert.Equal(t, [][]string{{"one", "two words"}, {"three", "four"}, {"five"}}, backend.batches)
+	assert.Len(t, vectors[0], 16)
+
+	// the vectors are in the order of the texts
+	single, err := embedder.Embed(context.Background(), []string{"four"})
+	require.Nil(t, err)
+	assert.Equal(t, single[0], vectors[3])
+
+	totals := tracker.Totals()
+	require.Len(t, totals, 1)
+	assert.Equal(t, 7, totals[0].PromptTokens)
+}
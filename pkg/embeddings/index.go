@@ -0,0 +1,352 @@
+package embeddings
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/wesen/geppetto/pkg/helpers"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Chunk is a part of a source document, embedded as a single vector.
+type Chunk struct {
+	Source string `json:"source"`
+	// Index is the position of the chunk in the source
+	Index int `json:"index"`
+	// Title is the heading or the function the chunk belongs to, see chunking.Chunk
+	Title string `json:"title,omitempty"`
+	// Start and End are the byte offsets of the chunk in the source
+	Start int    `json:"start"`
+	End   int    `json:"end"`
+	Text  string `json:"text"`
+	// SourceHash is the hash of the content of the source when it was indexed
+	SourceHash string `json:"source_hash"`
+}
+
+// Metadata describes the vectors of an index.
+type Metadata struct {
+	Model      string    `json:"model"`
+	Dimensions int       `json:"dimensions"`
+	Count      int       `json:"count"`
+	Updated    time.Time `json:"updated"`
+	// Checksums maps chunks.jsonl and vectors.f32 to the sha256 of the content written by Save,
+	// to detect files that don't belong to the same save
+	Checksums map[string]string `json:"checksums,omitempty"`
+}
+
+// Index stores the chunks of documents and their embeddings in a directory:
+//
+//   - index.json contains the Metadata
+//   - chunks.jsonl contains a Chunk per line
+//   - vectors.f32 contains the vectors of the chunks, in the same order, as little-endian float32
+//
+// The files are renamed into place one after the other, so a save can be interrupted between two
+// renames. The checksums of the data files are stored in index.json, and checked by Open.
+//
+// The whole index is loaded in memory, and searched exhaustively.
+type Index struct {
+	Directory string
+	Metadata  Metadata
+	Chunks    []*Chunk
+	Vectors   [][]float32
+}
+
+// DefaultDirectory returns the directory of the index called name, in $XDG_DATA_HOME/pinocchio/embeddings.
+func DefaultDirectory(name string) (string, error) {
+	return helpers.DataDirectory("embeddings", name)
+}
+
+// HashSource returns the hash of the content of a source, to detect the sources that changed since they were indexed.
+func HashSource(content string) string {
+	h := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(h[:])
+}
+
+// Open loads the index in directory. The index is empty if the directory doesn't exist.
+func Open(directory string) (*Index, error) {
+	ret := &Index{
+		Directory: directory,
+	}
+
+	b, err := os.ReadFile(filepath.Join(directory, "index.json"))
+	if os.IsNotExist(err) {
+		return ret, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(b, &ret.Metadata)
+	if err != nil {
+		return nil, fmt.Errorf("invalid index %s: %w", directory, err)
+	}
+
+	// indexes saved before the checksums were added have none
+	for name, expected := range ret.Metadata.Checksums {
+		checksum, err := fileChecksum(filepath.Join(directory, name))
+		if err != nil {
+			return nil, err
+		}
+		if checksum != expected {
+			return nil, fmt.Errorf("index %s is inconsistent (%s doesn't match index.json), it has to be rebuilt",
+				directory, name)
+		}
+	}
+
+	ret.Chunks, err = readChunks(filepath.Join(directory, "chunks.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+	ret.Vectors, err = readVectors(filepath.Join(directory, "vectors.f32"), ret.Metadata.Dimensions)
+	if err != nil {
+		return nil, err
+	}
+	if len(ret.Chunks) != ret.Metadata.Count || len(ret.Vectors) != ret.Metadata.Count {
+		return nil, fmt.Errorf("index %s is inconsistent (%d chunks, %d vectors, expected %d), it has to be rebuilt",
+			directory, len(ret.Chunks), len(ret.Vectors), ret.Metadata.Count)
+	}
+
+	return ret, nil
+}
+
+func readChunks(path string) ([]*Chunk, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	ret := []*Chunk{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		chunk := &Chunk{}
+		err = json.Unmarshal(scanner.Bytes(), chunk)
+		if err != nil {
+			return nil, fmt.Errorf("invalid chunk in %s: %w", path, err)
+		}
+		ret = append(ret, chunk)
+	}
+	return ret, scanner.Err()
+}
+
+func readVectors(path string, dimensions int) ([][]float32, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if dimensions == 0 {
+		return [][]float32{}, nil
+	}
+	if len(b)%(dimensions*4) != 0 {
+		return nil, fmt.Errorf("invalid size of %s for %d dimensions", path, dimensions)
+	}
+
+	ret := make([][]float32, 0, len(b)/(dimensions*4))
+	r := bytes.NewReader(b)
+	for r.Len() > 0 {
+		vector := make([]float32, dimensions)
+		err = binary.Read(r, binary.LittleEndian, vector)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, vector)
+	}
+	return ret, nil
+}
+
+// Save writes the index to its directory. Each file is written to a temporary file first,
+// and index.json is written last, with the checksums of the other files.
+func (i *Index) Save() error {
+	i.Metadata.Count = len(i.Chunks)
+	i.Metadata.Updated = time.Now()
+	i.Metadata.Checksums = map[string]string{}
+
+	err := os.MkdirAll(i.Directory, 0755)
+	if err != nil {
+		return err
+	}
+
+	i.Metadata.Checksums["vectors.f32"], err = writeFile(filepath.Join(i.Directory, "vectors.f32"), func(w io.Writer) error {
+		for _, vector := range i.Vectors {
+			if err := binary.Write(w, binary.LittleEndian, vector); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	i.Metadata.Checksums["chunks.jsonl"], err = writeFile(filepath.Join(i.Directory, "chunks.jsonl"), func(w io.Writer) error {
+		encoder := json.NewEncoder(w)
+		for _, chunk := range i.Chunks {
+			if err := encoder.Encode(chunk); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = writeFile(filepath.Join(i.Directory, "index.json"), func(w io.Writer) error {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(i.Metadata)
+	})
+	return err
+}
+
+// writeFile writes path with write through a temporary file, so that readers never see a partial file.
+// It returns the checksum of the content.
+func writeFile(path string, write func(w io.Writer) error) (string, error) {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	w := bufio.NewWriter(f)
+	err = write(io.MultiWriter(w, h))
+	if err == nil {
+		err = w.Flush()
+	}
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return "", err
+	}
+	err = os.Rename(f.Name(), path)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// fileChecksum returns the checksum of the content of path, as returned by writeFile.
+func fileChecksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// SourceHash returns the hash of the source when it was indexed, and false if it is not indexed.
+func (i *Index) SourceHash(source string) (string, bool) {
+	for _, chunk := range i.Chunks {
+		if chunk.Source == source {
+			return chunk.SourceHash, true
+		}
+	}
+	return "", false
+}
+
+// RemoveSource removes the chunks of source from the index, and returns how many were removed.
+func (i *Index) RemoveSource(source string) int {
+	chunks := []*Chunk{}
+	vectors := [][]float32{}
+	for j, chunk := range i.Chunks {
+		if chunk.Source == source {
+			continue
+		}
+		chunks = append(chunks, chunk)
+		vectors = append(vectors, i.Vectors[j])
+	}
+	removed := len(i.Chunks) - len(chunks)
+	i.Chunks = chunks
+	i.Vectors = vectors
+	return removed
+}
+
+// Add adds the chunks and their vectors to the index, which has to use model.
+func (i *Index) Add(model string, chunks []*Chunk, vectors [][]float32) error {
+	if len(chunks) != len(vectors) {
+		return fmt.Errorf("%d chunks but %d vectors", len(chunks), len(vectors))
+	}
+	if len(chunks) == 0 {
+		return nil
+	}
+
+	if len(i.Chunks) == 0 {
+		i.Metadata.Model = model
+		i.Metadata.Dimensions = len(vectors[0])
+	}
+	if i.Metadata.Model != model {
+		return fmt.Errorf("the index uses the model %s, not %s", i.Metadata.Model, model)
+	}
+	for _, vector := range vectors {
+		if len(vector) != i.Metadata.Dimensions {
+			return fmt.Errorf("vector of %d dimensions in an index of %d dimensions", len(vector), i.Metadata.Dimensions)
+		}
+	}
+
+	i.Chunks = append(i.Chunks, chunks...)
+	i.Vectors = append(i.Vectors, vectors...)
+	return nil
+}
+
+// Result is a chunk matching a search, with its cosine similarity to the query.
+type Result struct {
+	Chunk *Chunk
+	Score float64
+}
+
+// Search returns the topK chunks most similar to the query vector, most similar first.
+func (i *Index) Search(query []float32, topK int) ([]*Result, error) {
+	if len(i.Chunks) > 0 && len(query) != i.Metadata.Dimensions {
+		return nil, fmt.Errorf("query of %d dimensions in an index of %d dimensions", len(query), i.Metadata.Dimensions)
+	}
+
+	ret := make([]*Result, 0, len(i.Chunks))
+	for j, chunk := range i.Chunks {
+		ret = append(ret, &Result{
+			Chunk: chunk,
+			Score: CosineSimilarity(query, i.Vectors[j]),
+		})
+	}
+	sort.SliceStable(ret, func(a, b int) bool {
+		return ret[a].Score > ret[b].Score
+	})
+	if topK > 0 && len(ret) > topK {
+		ret = ret[:topK]
+	}
+	return ret, nil
+}
+
+// CosineSimilarity returns the cosine of the angle between a and b, 0 if one of them is null.
+func CosineSimilarity(a []float32, b []float32) float64 {
+	dot, normA, normB := 0.0, 0.0, 0.0
+	for j := range a {
+		dot += float64(a[j]) * float64(b[j])
+		normA += float64(a[j]) * float64(a[j])
+		normB += float64(b[j]) * float64(b[j])
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(normA) * math.Sqrt(normB))
+}
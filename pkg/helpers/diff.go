@@ -0,0 +1,33 @@
+package helpers
+
+import (
+	"github.com/pmezard/go-difflib/difflib"
+	"path"
+	"strings"
+)
+
+// UnifiedDiff returns the unified diff from before to after, with 3 lines of context.
+// The file headers are a/path and b/path, like git diff. The diff is empty if the texts are equal.
+func UnifiedDiff(path_ string, before string, after string) (string, error) {
+	return difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        splitLines(before),
+		B:        splitLines(after),
+		FromFile: path.Join("a", path_),
+		ToFile:   path.Join("b", path_),
+		Context:  3,
+	})
+}
+
+// splitLines splits s into lines ending with a newline. Unlike difflib.SplitLines,
+// a final newline doesn't add an empty line.
+func splitLines(s string) []string {
+	if s == "" {
+		return []string{}
+	}
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		return lines[:len(lines)-1]
+	}
+	lines[len(lines)-1] += "\n"
+	return lines
+}
@@ -0,0 +1,28 @@
+package helpers
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	diff, err := UnifiedDiff("/tmp/hello.txt", "one\nhelo\nthree\n", "one\nhello\nthree\n")
+	require.Nil(t, err)
+	assert.Equal(t, `--- a/tmp/hello.txt
++++ b/tmp/hello.txt
+@@ -1,3 +1,3 @@
+ one
+-helo
++hello
+ three
+`, diff)
+
+	diff, err = UnifiedDiff("hello.txt", "helo", "hello")
+	require.Nil(t, err)
+	assert.Equal(t, "--- a/hello.txt\n+++ b/hello.txt\n@@ -1 +1 @@\n-helo\n+hello\n", diff)
+
+	diff, err = UnifiedDiff("hello.txt", "same\n", "same\n")
+	require.Nil(t, err)
+	assert.Equal(t, "", diff)
+}
@@ -0,0 +1,75 @@
+package helpers
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// DataDirectory returns the directory elem in $XDG_DATA_HOME/pinocchio, where $XDG_DATA_HOME
+// defaults to ~/.local/share.
+func DataDirectory(elem ...string) (string, error) {
+	dataHome := os.Getenv("XDG_DATA_HOME")
+	if dataHome == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		dataHome = filepath.Join(home, ".local", "share")
+	}
+	return filepath.Join(append([]string{dataHome, "pinocchio"}, elem...)...), nil
+}
+
+// WriteFileAtomic writes data to a temporary file in the directory of path, and renames it to path,
+// so that readers never see a partially written file.
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Chmod(perm)
+	}
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// staleLockAge is the age after which a lock file is considered left over by a crashed process.
+const staleLockAge = 30 * time.Second
+
+// LockFile takes an exclusive lock on path by creating path.lock, waiting up to timeout
+// if another process holds it. The returned function releases the lock.
+func LockFile(path string, timeout time.Duration) (func(), error) {
+	lockPath := path + ".lock"
+	deadline := time.Now().Add(timeout)
+	for {
+		f, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			_ = f.Close()
+			return func() {
+				_ = os.Remove(lockPath)
+			}, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+
+		if info, err := os.Stat(lockPath); err == nil && time.Since(info.ModTime()) > staleLockAge {
+			_ = os.Remove(lockPath)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("could not lock %s, remove %s if no other process is using it", path, lockPath)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
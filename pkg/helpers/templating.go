@@ -0,0 +1,232 @@
+package helpers
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/wesen/geppetto/pkg/tokenizer"
+	"gopkg.in/yaml.v3"
+	"os"
+	"reflect"
+	"strings"
+	"text/template"
+	"unicode"
+	"unicode/utf8"
+)
+
+// TemplateFuncs are the functions available to prompt templates.
+//
+// The string and list helpers follow the names and argument order of sprig, so that the
+// value can be piped as the last argument: {{ .name | trim | indent 2 }}.
+// The others help with building prompts, for example {{ .code | codeBlock "go" }}
+// or {{ readFile "notes.md" | truncateTokens 500 }}.
+//
+// truncateTokens counts the tokens with the encoding of DefaultTokenizerModel, or of the model
+// given as optional argument: {{ .notes | truncateTokens 500 "gpt-4" }}. Commands replace
+// the default with the model they use, see TruncateTokensForModel.
+var TemplateFuncs = template.FuncMap{
+	"trim":       strings.TrimSpace,
+	"trimAll":    func(cutset, s string) string { return strings.Trim(s, cutset) },
+	"trimPrefix": func(prefix, s string) string { return strings.TrimPrefix(s, prefix) },
+	"trimSuffix": func(suffix, s string) string { return strings.TrimSuffix(s, suffix) },
+	"upper":      strings.ToUpper,
+	"lower":      strings.ToLower,
+	"title":      title,
+	"repeat":     func(count int, s string) string { return strings.Repeat(s, count) },
+	"replace":    func(old, new, s string) string { return strings.ReplaceAll(s, old, new) },
+	"contains":   func(substr, s string) bool { return strings.Contains(s, substr) },
+	"hasPrefix":  func(prefix, s string) bool { return strings.HasPrefix(s, prefix) },
+	"hasSuffix":  func(suffix, s string) bool { return strings.HasSuffix(s, suffix) },
+	"indent":     indent,
+	"nindent":    func(spaces int, s string) string { return "\n" + indent(spaces, s) },
+	"quote":      func(s string) string { return fmt.Sprintf("%q", s) },
+	"squote":     func(s string) string { return "'" + s + "'" },
+
+	"list":      func(v ...interface{}) []interface{} { return v },
+	"join":      join,
+	"splitList": func(sep, s string) []string { return strings.Split(s, sep) },
+	"lines":     lines,
+	"first":     first,
+	"last":      last,
+	"default":   defaultValue,
+	"empty":     isEmpty,
+
+	"readFile":       readFile,
+	"codeBlock":      codeBlock,
+	"truncateTokens": TruncateTokensForModel(DefaultTokenizerModel),
+	"toYAML":         toYAML,
+	"toJSON":         toJSON,
+	"numberedList":   numberedList,
+	"bulletList":     bulletList,
+}
+
+// title upper-cases the first letter of each word.
+func title(s string) string {
+	words := strings.Fields(s)
+	for i, word := range words {
+		r, size := utf8.DecodeRuneInString(word)
+		words[i] = string(unicode.ToUpper(r)) + word[size:]
+	}
+	return strings.Join(words, " ")
+}
+
+// indent indents all the lines of s by spaces.
+func indent(spaces int, s string) string {
+	pad := strings.Repeat(" ", spaces)
+	return pad + strings.ReplaceAll(s, "\n", "\n"+pad)
+}
+
+// toStrings converts a list (or a single value) to a list of strings.
+func toStrings(v interface{}) []string {
+	if v == nil {
+		return []string{}
+	}
+	if s, ok := v.([]string); ok {
+		return s
+	}
+	value := reflect.ValueOf(v)
+	if value.Kind() != reflect.Slice && value.Kind() != reflect.Array {
+		return []string{fmt.Sprint(v)}
+	}
+	ret := make([]string, 0, value.Len())
+	for i := 0; i < value.Len(); i++ {
+		ret = append(ret, fmt.Sprint(value.Index(i).Interface()))
+	}
+	return ret
+}
+
+func join(sep string, v interface{}) string {
+	return strings.Join(toStrings(v), sep)
+}
+
+// lines splits s into its non-empty lines.
+func lines(s string) []string {
+	ret := []string{}
+	for _, line := range strings.Split(s, "\n") {
+		if strings.TrimSpace(line) != "" {
+			ret = append(ret, line)
+		}
+	}
+	return ret
+}
+
+func first(v interface{}) interface{} {
+	value := reflect.ValueOf(v)
+	if (value.Kind() != reflect.Slice && value.Kind() != reflect.Array) || value.Len() == 0 {
+		return nil
+	}
+	return value.Index(0).Interface()
+}
+
+func last(v interface{}) interface{} {
+	value := reflect.ValueOf(v)
+	if (value.Kind() != reflect.Slice && value.Kind() != reflect.Array) || value.Len() == 0 {
+		return nil
+	}
+	return value.Index(value.Len() - 1).Interface()
+}
+
+// isEmpty returns true for nil, zero values and empty lists, maps and strings.
+func isEmpty(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+	value := reflect.ValueOf(v)
+	switch value.Kind() {
+	case reflect.Slice, reflect.Array, reflect.Map, reflect.String:
+		return value.Len() == 0
+	default:
+		return value.IsZero()
+	}
+}
+
+func defaultValue(d interface{}, v ...interface{}) interface{} {
+	if len(v) == 0 || isEmpty(v[0]) {
+		return d
+	}
+	return v[0]
+}
+
+func readFile(path string) (string, error) {
+	s, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return string(s), nil
+}
+
+// codeBlock wraps s in a markdown code block. The fence is made longer than any run
+// of backticks in s, so that code containing code blocks doesn't end it early.
+func codeBlock(lang string, s string) string {
+	longest := 0
+	current := 0
+	for _, c := range s {
+		if c == '`' {
+			current++
+			if current > longest {
+				longest = current
+			}
+		} else {
+			current = 0
+		}
+	}
+	fenceLength := 3
+	if longest >= fenceLength {
+		fenceLength = longest + 1
+	}
+	fence := strings.Repeat("`", fenceLength)
+	return fmt.Sprintf("%s%s\n%s\n%s", fence, lang, strings.TrimSuffix(s, "\n"), fence)
+}
+
+// DefaultTokenizerModel is the model whose encoding is used by truncateTokens in TemplateFuncs.
+const DefaultTokenizerModel = "text-davinci-003"
+
+// TruncateTokensForModel returns the truncateTokens template function, which keeps the start
+// of s that fits in maxTokens tokens. The tokens are counted with the encoding of defaultModel,
+// unless a model is passed before s.
+func TruncateTokensForModel(defaultModel string) func(maxTokens int, args ...string) (string, error) {
+	return func(maxTokens int, args ...string) (string, error) {
+		model := defaultModel
+		switch len(args) {
+		case 1:
+		case 2:
+			model = args[0]
+		default:
+			return "", fmt.Errorf("truncateTokens expects the maximum number of tokens, an optional model and a string")
+		}
+		return tokenizer.ForModel(model).TrimEnd(args[len(args)-1], maxTokens), nil
+	}
+}
+
+func toYAML(v interface{}) (string, error) {
+	s, err := yaml.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(string(s), "\n"), nil
+}
+
+func toJSON(v interface{}) (string, error) {
+	s, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(s), nil
+}
+
+// numberedList renders the elements of v as a list numbered from 1, one element per line.
+func numberedList(v interface{}) string {
+	ret := []string{}
+	for i, s := range toStrings(v) {
+		ret = append(ret, fmt.Sprintf("%d. %s", i+1, s))
+	}
+	return strings.Join(ret, "\n")
+}
+
+// bulletList renders the elements of v as a markdown bullet list, one element per line.
+func bulletList(v interface{}) string {
+	ret := []string{}
+	for _, s := range toStrings(v) {
+		ret = append(ret, "- "+s)
+	}
+	return strings.Join(ret, "\n")
+}
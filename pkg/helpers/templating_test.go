@@ -0,0 +1,79 @@
+package helpers
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"text/template"
+)
+
+func renderTestTemplate(t *testing.T, tmpl string, data interface{}) string {
+	parsed, err := template.New("test").Funcs(TemplateFuncs).Parse(tmpl)
+	require.Nil(t, err)
+	buf := &strings.Builder{}
+	require.Nil(t, parsed.Execute(buf, data))
+	return buf.String()
+}
+
+func TestStringFuncs(t *testing.T) {
+	data := map[string]interface{}{"name": "  hello world \n"}
+	assert.Equal(t, "HELLO WORLD", renderTestTemplate(t, `{{ .name | trim | upper }}`, data))
+	assert.Equal(t, "Hello World", renderTestTemplate(t, `{{ .name | trim | title }}`, data))
+	assert.Equal(t, "Élan Über Ça", renderTestTemplate(t, `{{ "élan über ça" | title }}`, nil))
+	assert.Equal(t, "hello there", renderTestTemplate(t, `{{ .name | trim | replace "world" "there" }}`, data))
+	assert.Equal(t, "  a\n  b", renderTestTemplate(t, `{{ "a\nb" | indent 2 }}`, nil))
+	assert.Equal(t, "x:\n  a", renderTestTemplate(t, `x:{{ "a" | nindent 2 }}`, nil))
+	assert.Equal(t, "fallback", renderTestTemplate(t, `{{ .missing | default "fallback" }}`, data))
+}
+
+func TestListFuncs(t *testing.T) {
+	data := map[string]interface{}{"items": []interface{}{"a", "b", 3}}
+	assert.Equal(t, "a, b, 3", renderTestTemplate(t, `{{ .items | join ", " }}`, data))
+	assert.Equal(t, "1. a\n2. b\n3. 3", renderTestTemplate(t, `{{ .items | numberedList }}`, data))
+	assert.Equal(t, "- a\n- b\n- 3", renderTestTemplate(t, `{{ .items | bulletList }}`, data))
+	assert.Equal(t, "- x\n- y", renderTestTemplate(t, `{{ "x\n\ny\n" | lines | bulletList }}`, nil))
+	assert.Equal(t, "a 3", renderTestTemplate(t, `{{ first .items }} {{ last .items }}`, data))
+}
+
+func TestCodeBlock(t *testing.T) {
+	assert.Equal(t, "```go\nfmt.Println()\n```",
+		renderTestTemplate(t, `{{ "fmt.Println()\n" | codeBlock "go" }}`, nil))
+
+	// fences inside the code are escaped by using a longer fence
+	code := "Example:\n```sh\nls\n```"
+	assert.Equal(t, "````markdown\n"+code+"\n````",
+		renderTestTemplate(t, `{{ .code | codeBlock "markdown" }}`, map[string]interface{}{"code": code}))
+}
+
+func TestSerializationFuncs(t *testing.T) {
+	data := map[string]interface{}{"v": map[string]interface{}{"a": 1, "b": []string{"x"}}}
+	assert.Equal(t, "a: 1\nb:\n    - x", renderTestTemplate(t, `{{ toYAML .v }}`, data))
+	assert.Equal(t, "{\n  \"a\": 1,\n  \"b\": [\n    \"x\"\n  ]\n}", renderTestTemplate(t, `{{ toJSON .v }}`, data))
+}
+
+func TestReadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notes.md")
+	require.Nil(t, os.WriteFile(path, []byte("some notes"), 0644))
+	assert.Equal(t, "some notes", renderTestTemplate(t, `{{ readFile .path }}`, map[string]interface{}{"path": path}))
+
+	parsed, err := template.New("test").Funcs(TemplateFuncs).Parse(`{{ readFile "does-not-exist" }}`)
+	require.Nil(t, err)
+	assert.Error(t, parsed.Execute(&strings.Builder{}, nil))
+}
+
+func TestTruncateTokens(t *testing.T) {
+	t.Setenv("GEPPETTO_TOKENIZERS_DIR", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+
+	// the approximate tokenizer counts " tokenization" as 4 tokens
+	assert.Equal(t, "the", renderTestTemplate(t, `{{ "the tokenization" | truncateTokens 4 }}`, nil))
+	assert.Equal(t, "the tokenization", renderTestTemplate(t, `{{ "the tokenization" | truncateTokens 10 }}`, nil))
+	assert.Equal(t, "the", renderTestTemplate(t, `{{ "the tokenization" | truncateTokens 4 "gpt-4" }}`, nil))
+
+	parsed, err := template.New("test").Funcs(TemplateFuncs).Parse(`{{ "the tokenization" | truncateTokens 4 "gpt-4" "extra" }}`)
+	require.Nil(t, err)
+	assert.Error(t, parsed.Execute(&strings.Builder{}, nil))
+}
@@ -0,0 +1,90 @@
+package models
+
+import (
+	_ "embed"
+	"encoding/json"
+	"sync"
+)
+
+// ModelsJSONString is the embedded description of the OpenAI models and their families.
+//
+//go:embed models.json
+var ModelsJSONString string
+
+type Completion struct {
+	Name                   string `json:"name"`
+	Family                 string `json:"family"`
+	Description            string `json:"description"`
+	MaxTokens              int    `json:"max_tokens"`
+	TrainingDataCutoffDate string `json:"training_data_cutoff_date"`
+}
+
+type Family struct {
+	Name             string  `json:"name"`
+	Description      string  `json:"description"`
+	PricePer1kTokens float64 `json:"price_per_1k_tokens"`
+	// CompletionPricePer1kTokens is the price of the completion tokens, if it differs from PricePer1kTokens
+	CompletionPricePer1kTokens float64  `json:"completion_price_per_1k_tokens,omitempty"`
+	GoodAt                     []string `json:"good_at"`
+	KeyPoints                  []string `json:"key_points"`
+	Subtitle                   string   `json:"subtitle"`
+	Short                      string   `json:"short"`
+}
+
+type ModelsJSON struct {
+	Completion []Completion `json:"completion"`
+	Families   []Family     `json:"families"`
+}
+
+var (
+	loadOnce   sync.Once
+	loaded     *ModelsJSON
+	loadingErr error
+)
+
+// Load parses the embedded models.json the first time it is called. The returned value is
+// shared by all the callers, and must not be modified.
+func Load() (*ModelsJSON, error) {
+	loadOnce.Do(func() {
+		ret := &ModelsJSON{}
+		loadingErr = json.Unmarshal([]byte(ModelsJSONString), ret)
+		if loadingErr == nil {
+			loaded = ret
+		}
+	})
+	return loaded, loadingErr
+}
+
+// GetCompletion returns the completion model with the given name, or nil if it is unknown.
+func (m *ModelsJSON) GetCompletion(name string) *Completion {
+	for i := range m.Completion {
+		if m.Completion[i].Name == name {
+			return &m.Completion[i]
+		}
+	}
+	return nil
+}
+
+// GetFamily returns the model family with the given name, or nil if it is unknown.
+func (m *ModelsJSON) GetFamily(name string) *Family {
+	for i := range m.Families {
+		if m.Families[i].Name == name {
+			return &m.Families[i]
+		}
+	}
+	return nil
+}
+
+// ContextWindow returns the maximum number of tokens (prompt and completion) of the model,
+// and false if the model is not in models.json.
+func ContextWindow(model string) (int, bool) {
+	models, err := Load()
+	if err != nil {
+		return 0, false
+	}
+	completion := models.GetCompletion(model)
+	if completion == nil {
+		return 0, false
+	}
+	return completion.MaxTokens, true
+}
@@ -0,0 +1,298 @@
+package recorder
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"github.com/wesen/geppetto/pkg/usage"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	RunStatusRunning = "running"
+	RunStatusSuccess = "success"
+	RunStatusError   = "error"
+)
+
+// Run is a recorded command run, along with the steps it executed.
+type Run struct {
+	ID         string                 `json:"id"`
+	Command    string                 `json:"command"`
+	Parameters map[string]interface{} `json:"parameters,omitempty"`
+	Start      time.Time              `json:"start"`
+	End        *time.Time             `json:"end,omitempty"`
+	DurationMs int64                  `json:"duration_ms,omitempty"`
+	// Status is running until the end of the run has been recorded, so a run that
+	// crashed stays running.
+	Status           string  `json:"status"`
+	Error            string  `json:"error,omitempty"`
+	PromptTokens     int     `json:"prompt_tokens,omitempty"`
+	CompletionTokens int     `json:"completion_tokens,omitempty"`
+	Cost             float64 `json:"cost,omitempty"`
+	// ReplayOf is the ID of the run replayed by this run, from the step FromStep
+	ReplayOf string `json:"replay_of,omitempty"`
+	FromStep int    `json:"from_step,omitempty"`
+	// Steps are ordered by ID, which is the order in which they started
+	Steps []*Step `json:"-"`
+}
+
+// Step is a recorded step. Steps run by another step (for example the completions of a map step)
+// have its ID as ParentID, top-level steps have a ParentID of 0.
+type Step struct {
+	ID         int        `json:"id"`
+	ParentID   int        `json:"parent_id,omitempty"`
+	Type       string     `json:"type"`
+	Name       string     `json:"name,omitempty"`
+	Start      time.Time  `json:"start"`
+	End        *time.Time `json:"end,omitempty"`
+	DurationMs int64      `json:"duration_ms"`
+	// Input and Output are stored as JSON, so they are decoded to maps, lists and scalars when loaded
+	Input  interface{} `json:"input,omitempty"`
+	Output interface{} `json:"output,omitempty"`
+	Error  string      `json:"error,omitempty"`
+	// Metadata contains the settings of the step, for example the template or the completion settings
+	Metadata map[string]interface{} `json:"metadata,omitempty"`
+	// Metrics contains the measurements done by the step, for example the number of tokens
+	Metrics map[string]interface{} `json:"metrics,omitempty"`
+}
+
+// Children returns the steps whose parent is the step with the given ID, in ID order.
+func (r *Run) Children(id int) []*Step {
+	ret := []*Step{}
+	for _, step := range r.Steps {
+		if step.ParentID == id {
+			ret = append(ret, step)
+		}
+	}
+	return ret
+}
+
+// GetStep returns the step with the given ID, or nil.
+func (r *Run) GetStep(id int) *Step {
+	for _, step := range r.Steps {
+		if step.ID == id {
+			return step
+		}
+	}
+	return nil
+}
+
+const (
+	recordTypeRun  = "run"
+	recordTypeStep = "step"
+	recordTypeEnd  = "end"
+)
+
+// record is a line of the JSONL file of a run. The file starts with a run record,
+// followed by a step record per finished step, and ends with an end record.
+type record struct {
+	Type string `json:"type"`
+	Run  *Run   `json:"run,omitempty"`
+	Step *Step  `json:"step,omitempty"`
+}
+
+// Recorder writes the steps of a run as they finish. A nil Recorder records nothing,
+// so that steps don't have to check whether recording is enabled.
+type Recorder struct {
+	mutex  sync.Mutex
+	run    *Run
+	w      io.WriteCloser
+	nextID int
+}
+
+func NewRecorder(run *Run, w io.WriteCloser) (*Recorder, error) {
+	run.Status = RunStatusRunning
+	ret := &Recorder{run: run, w: w, nextID: 1}
+	err := ret.write(&record{Type: recordTypeRun, Run: run})
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// RunID returns the ID of the recorded run.
+func (r *Recorder) RunID() string {
+	if r == nil {
+		return ""
+	}
+	return r.run.ID
+}
+
+func (r *Recorder) write(rec *record) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		if rec.Step == nil {
+			return err
+		}
+		// inputs and outputs can contain values that can't be marshalled, keep their string representation
+		step := *rec.Step
+		step.Input = fmt.Sprintf("%v", step.Input)
+		step.Output = fmt.Sprintf("%v", step.Output)
+		b, err = json.Marshal(&record{Type: rec.Type, Step: &step})
+		if err != nil {
+			return err
+		}
+	}
+	_, err = r.w.Write(append(b, '\n'))
+	return err
+}
+
+func (r *Recorder) startStep(parentID int, type_ string, input interface{}) *StepRecorder {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	id := r.nextID
+	r.nextID++
+	return &StepRecorder{
+		recorder: r,
+		step: &Step{
+			ID:       id,
+			ParentID: parentID,
+			Type:     type_,
+			Start:    time.Now(),
+			Input:    input,
+		},
+	}
+}
+
+func (r *Recorder) finishStep(step *Step) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	err := r.write(&record{Type: recordTypeStep, Step: step})
+	if err != nil {
+		log.Warn().Err(err).Str("run", r.run.ID).Int("step", step.ID).Msg("could not record step")
+	}
+}
+
+// Finish records the end of the run with the usage collected by tracker, which can be nil,
+// and closes the file of the run.
+func (r *Recorder) Finish(err error, tracker *usage.Tracker) error {
+	if r == nil {
+		return nil
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	end := time.Now()
+	run := *r.run
+	run.End = &end
+	run.DurationMs = end.Sub(run.Start).Milliseconds()
+	run.Status = RunStatusSuccess
+	if err != nil {
+		run.Status = RunStatusError
+		run.Error = err.Error()
+	}
+	for _, total := range tracker.Totals() {
+		run.PromptTokens += total.PromptTokens
+		run.CompletionTokens += total.CompletionTokens
+		run.Cost += total.Cost
+	}
+
+	writeErr := r.write(&record{Type: recordTypeEnd, Run: &run})
+	closeErr := r.w.Close()
+	if writeErr != nil {
+		return writeErr
+	}
+	return closeErr
+}
+
+// StepRecorder records a single step. Like Recorder, a nil StepRecorder records nothing.
+type StepRecorder struct {
+	recorder *Recorder
+	step     *Step
+}
+
+// ID returns the ID of the step in the run, or 0 if the step is not recorded.
+func (s *StepRecorder) ID() int {
+	if s == nil {
+		return 0
+	}
+	return s.step.ID
+}
+
+// SetName names the step, for example with the ID of a chain entry.
+func (s *StepRecorder) SetName(name string) {
+	if s == nil {
+		return
+	}
+	s.step.Name = name
+}
+
+func (s *StepRecorder) SetMetadata(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	if s.step.Metadata == nil {
+		s.step.Metadata = map[string]interface{}{}
+	}
+	s.step.Metadata[key] = value
+}
+
+// AddMetric adds value to the metric, so that steps doing several requests record their total.
+func (s *StepRecorder) AddMetric(key string, value float64) {
+	if s == nil {
+		return
+	}
+	s.recorder.mutex.Lock()
+	defer s.recorder.mutex.Unlock()
+	if s.step.Metrics == nil {
+		s.step.Metrics = map[string]interface{}{}
+	}
+	current, _ := s.step.Metrics[key].(float64)
+	s.step.Metrics[key] = current + value
+}
+
+// Finish records the output or the error of the step.
+func (s *StepRecorder) Finish(output interface{}, err error) {
+	if s == nil {
+		return
+	}
+	end := time.Now()
+	s.step.End = &end
+	s.step.DurationMs = end.Sub(s.step.Start).Milliseconds()
+	if err != nil {
+		s.step.Error = err.Error()
+	} else {
+		s.step.Output = output
+	}
+	s.recorder.finishStep(s.step)
+}
+
+type contextKey int
+
+const (
+	recorderKey contextKey = iota
+	stepKey
+)
+
+// WithRecorder returns a context in which the steps are recorded by r.
+func WithRecorder(ctx context.Context, r *Recorder) context.Context {
+	return context.WithValue(ctx, recorderKey, r)
+}
+
+// FromContext returns the recorder of the context, or nil.
+func FromContext(ctx context.Context) *Recorder {
+	r, _ := ctx.Value(recorderKey).(*Recorder)
+	return r
+}
+
+// CurrentStep returns the recorder of the step running in ctx, or nil.
+func CurrentStep(ctx context.Context) *StepRecorder {
+	s, _ := ctx.Value(stepKey).(*StepRecorder)
+	return s
+}
+
+// StartStep starts recording a step, as a child of the step running in ctx. The returned
+// context has to be passed to the steps run by the new step, to build the step tree.
+//
+// If ctx has no recorder, ctx is returned along with a nil StepRecorder.
+func StartStep(ctx context.Context, type_ string, input interface{}) (context.Context, *StepRecorder) {
+	r := FromContext(ctx)
+	if r == nil {
+		return ctx, nil
+	}
+	s := r.startStep(CurrentStep(ctx).ID(), type_, input)
+	return context.WithValue(ctx, stepKey, s), s
+}
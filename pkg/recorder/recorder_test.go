@@ -0,0 +1,141 @@
+package recorder
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wesen/geppetto/pkg/usage"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRecordRun(t *testing.T) {
+	store := NewStore(t.TempDir())
+
+	rec, err := store.Create("hello", map[string]interface{}{"name": "world"})
+	require.Nil(t, err)
+	ctx := WithRecorder(context.Background(), rec)
+
+	ctx2, parent := StartStep(ctx, "pipe", "world")
+	_, template := StartStep(ctx2, "template", map[string]interface{}{"name": "world"})
+	template.SetMetadata("template", "Say hello to {{ .name }}")
+	template.Finish("Say hello to world", nil)
+
+	ctx3, completion := StartStep(ctx2, "completion", "Say hello to world")
+	CurrentStep(ctx3).AddMetric("prompt_tokens", 10)
+	CurrentStep(ctx3).AddMetric("prompt_tokens", 5)
+	completion.Finish(nil, errors.New("rate limited"))
+	parent.Finish(nil, errors.New("rate limited"))
+
+	tracker := usage.NewTracker()
+	tracker.Add(usage.Usage{Model: "local", PromptTokens: 15})
+	require.Nil(t, rec.Finish(errors.New("rate limited"), tracker))
+
+	run, err := store.Load(rec.RunID()[:len("20060102-150405")+2])
+	require.Nil(t, err)
+	assert.Equal(t, "hello", run.Command)
+	assert.Equal(t, RunStatusError, run.Status)
+	assert.Equal(t, "rate limited", run.Error)
+	assert.Equal(t, 15, run.PromptTokens)
+	assert.Equal(t, map[string]interface{}{"name": "world"}, run.Parameters)
+
+	require.Len(t, run.Steps, 3)
+	roots := run.Children(0)
+	require.Len(t, roots, 1)
+	assert.Equal(t, "pipe", roots[0].Type)
+
+	children := run.Children(roots[0].ID)
+	require.Len(t, children, 2)
+	assert.Equal(t, "template", children[0].Type)
+	assert.Equal(t, "Say hello to world", children[0].Output)
+	assert.Equal(t, "Say hello to {{ .name }}", children[0].Metadata["template"])
+	assert.Equal(t, "completion", children[1].Type)
+	assert.Equal(t, "rate limited", children[1].Error)
+	assert.Equal(t, float64(15), children[1].Metrics["prompt_tokens"])
+}
+
+func TestNoRecorder(t *testing.T) {
+	ctx, rec := StartStep(context.Background(), "template", "input")
+	assert.Nil(t, rec)
+	assert.Nil(t, CurrentStep(ctx))
+
+	// a nil recorder ignores everything
+	rec.SetName("foo")
+	rec.AddMetric("tokens", 1)
+	rec.Finish("output", nil)
+}
+
+func TestLoadInterruptedRun(t *testing.T) {
+	store := NewStore(t.TempDir())
+
+	rec, err := store.Create("hello", nil)
+	require.Nil(t, err)
+	ctx := WithRecorder(context.Background(), rec)
+	_, step := StartStep(ctx, "completion", "prompt")
+	step.Finish("output", nil)
+
+	// simulate a run killed while writing a step
+	f, err := os.OpenFile(store.path(rec.RunID()), os.O_APPEND|os.O_WRONLY, 0644)
+	require.Nil(t, err)
+	_, err = f.WriteString(`{"type":"step","step":{"id":2,`)
+	require.Nil(t, err)
+	require.Nil(t, f.Close())
+
+	runs, err := store.List()
+	require.Nil(t, err)
+	require.Len(t, runs, 1)
+	assert.Equal(t, RunStatusRunning, runs[0].Status)
+	assert.Len(t, runs[0].Steps, 1)
+
+	_, err = store.Load("nope")
+	assert.Error(t, err)
+}
+
+func TestRunFilePermissions(t *testing.T) {
+	store := NewStore(filepath.Join(t.TempDir(), "runs"))
+
+	rec, err := store.Create("hello", nil)
+	require.Nil(t, err)
+	require.Nil(t, rec.Finish(nil, nil))
+
+	info, err := os.Stat(store.Directory)
+	require.Nil(t, err)
+	assert.Equal(t, os.FileMode(0700), info.Mode().Perm())
+	info, err = os.Stat(store.path(rec.RunID()))
+	require.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+}
+
+func TestPrune(t *testing.T) {
+	store := NewStore(t.TempDir())
+
+	old := []string{"20200101-120000-aaaaaa", "20200102-120000-bbbbbb", "20200103-120000-cccccc"}
+	for _, id := range old {
+		require.Nil(t, os.WriteFile(store.path(id), []byte{}, 0600))
+	}
+	rec, err := store.Create("hello", nil)
+	require.Nil(t, err)
+	require.Nil(t, rec.Finish(nil, nil))
+
+	removed, err := store.Prune(24*time.Hour, 0, true)
+	require.Nil(t, err)
+	assert.Equal(t, old, removed)
+	ids, err := store.ids()
+	require.Nil(t, err)
+	assert.Len(t, ids, 4)
+
+	// the most recent runs are kept, even if they are old
+	removed, err = store.Prune(24*time.Hour, 3, false)
+	require.Nil(t, err)
+	assert.Equal(t, old[:1], removed)
+
+	removed, err = store.Prune(0, 1, false)
+	require.Nil(t, err)
+	assert.Equal(t, old[1:], removed)
+	ids, err = store.ids()
+	require.Nil(t, err)
+	assert.Equal(t, []string{rec.RunID()}, ids)
+}
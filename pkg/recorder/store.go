@@ -0,0 +1,255 @@
+package recorder
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/wesen/geppetto/pkg/helpers"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Store keeps each run in a JSONL file named after its ID in Directory.
+type Store struct {
+	Directory string
+}
+
+func NewStore(directory string) *Store {
+	return &Store{Directory: directory}
+}
+
+// DefaultDirectory returns $XDG_DATA_HOME/pinocchio/runs, which defaults to ~/.local/share/pinocchio/runs.
+func DefaultDirectory() (string, error) {
+	return helpers.DataDirectory("runs")
+}
+
+const runIDTimeFormat = "20060102-150405"
+
+// newRunID returns an ID that sorts by start time, with a random suffix to tell apart
+// the runs started in the same second.
+func newRunID(start time.Time) (string, error) {
+	b := make([]byte, 3)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s-%s", start.Format(runIDTimeFormat), hex.EncodeToString(b)), nil
+}
+
+// runIDStart returns the start time encoded in a run ID, in local time.
+func runIDStart(id string) (time.Time, bool) {
+	if len(id) < len(runIDTimeFormat) {
+		return time.Time{}, false
+	}
+	start, err := time.ParseInLocation(runIDTimeFormat, id[:len(runIDTimeFormat)], time.Local)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return start, true
+}
+
+func (s *Store) path(id string) string {
+	return filepath.Join(s.Directory, id+".jsonl")
+}
+
+// Create starts recording a new run of command.
+func (s *Store) Create(command string, parameters map[string]interface{}) (*Recorder, error) {
+	return s.create(&Run{
+		Command:    command,
+		Parameters: parameters,
+	})
+}
+
+// CreateReplay starts recording a replay of run, from the step fromStep.
+func (s *Store) CreateReplay(run *Run, fromStep int) (*Recorder, error) {
+	return s.create(&Run{
+		Command:    run.Command,
+		Parameters: run.Parameters,
+		ReplayOf:   run.ID,
+		FromStep:   fromStep,
+	})
+}
+
+// create writes the run to a file only readable by the user, since the prompts and outputs
+// can contain private data.
+func (s *Store) create(run *Run) (*Recorder, error) {
+	err := os.MkdirAll(s.Directory, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	run.Start = time.Now()
+	run.ID, err = newRunID(run.Start)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(s.path(run.ID), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := NewRecorder(run, f)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// Load reads the run with the given ID. A unique prefix of the ID is enough.
+func (s *Store) Load(id string) (*Run, error) {
+	path := s.path(id)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		ids, err := s.ids()
+		if err != nil {
+			return nil, err
+		}
+		matches := []string{}
+		for _, id_ := range ids {
+			if strings.HasPrefix(id_, id) {
+				matches = append(matches, id_)
+			}
+		}
+		switch len(matches) {
+		case 0:
+			return nil, fmt.Errorf("no run %s", id)
+		case 1:
+			path = s.path(matches[0])
+		default:
+			return nil, fmt.Errorf("run ID %s is ambiguous: %s", id, strings.Join(matches, ", "))
+		}
+	}
+	return LoadRun(path)
+}
+
+// List returns all the runs, most recent first.
+func (s *Store) List() ([]*Run, error) {
+	ids, err := s.ids()
+	if err != nil {
+		return nil, err
+	}
+
+	ret := []*Run{}
+	for i := len(ids) - 1; i >= 0; i-- {
+		run, err := LoadRun(s.path(ids[i]))
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, run)
+	}
+	return ret, nil
+}
+
+// Prune removes the runs started more than olderThan ago, always keeping the keep most recent runs.
+// An olderThan of 0 removes all the runs but the keep most recent ones. It returns the IDs of the
+// removed runs, which are only listed and not removed if dryRun is true.
+func (s *Store) Prune(olderThan time.Duration, keep int, dryRun bool) ([]string, error) {
+	ids, err := s.ids()
+	if err != nil {
+		return nil, err
+	}
+
+	ret := []string{}
+	cutoff := time.Now().Add(-olderThan)
+	for i, id := range ids {
+		if len(ids)-i <= keep {
+			break
+		}
+		if olderThan > 0 {
+			start, ok := runIDStart(id)
+			if !ok || !start.Before(cutoff) {
+				continue
+			}
+		}
+		if !dryRun {
+			err = os.Remove(s.path(id))
+			if err != nil {
+				return ret, err
+			}
+		}
+		ret = append(ret, id)
+	}
+	return ret, nil
+}
+
+// ids returns the IDs of the stored runs, sorted by start time.
+func (s *Store) ids() ([]string, error) {
+	entries, err := os.ReadDir(s.Directory)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{}, nil
+		}
+		return nil, err
+	}
+	ret := []string{}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".jsonl") {
+			continue
+		}
+		ret = append(ret, strings.TrimSuffix(entry.Name(), ".jsonl"))
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+// LoadRun reads the JSONL file of a run. A truncated last line, left by a run that
+// was killed while writing, is ignored.
+func LoadRun(path string) (*Run, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	var run *Run
+	steps := []*Step{}
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		rec := &record{}
+		err = json.Unmarshal(scanner.Bytes(), rec)
+		if err != nil {
+			if lineNumber > 1 {
+				break
+			}
+			return nil, fmt.Errorf("could not parse %s: %w", path, err)
+		}
+
+		switch rec.Type {
+		case recordTypeRun, recordTypeEnd:
+			if rec.Run == nil {
+				return nil, fmt.Errorf("could not parse %s: line %d has no run", path, lineNumber)
+			}
+			run = rec.Run
+		case recordTypeStep:
+			if rec.Step != nil {
+				steps = append(steps, rec.Step)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if run == nil {
+		return nil, fmt.Errorf("could not parse %s: no run record", path)
+	}
+
+	sortSteps(steps)
+	run.Steps = steps
+	return run, nil
+}
+
+func sortSteps(steps []*Step) {
+	sort.Slice(steps, func(i, j int) bool {
+		return steps[i].ID < steps[j].ID
+	})
+}
@@ -0,0 +1,352 @@
+package replay
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/wesen/geppetto/pkg/backends"
+	"github.com/wesen/geppetto/pkg/recorder"
+	"github.com/wesen/geppetto/pkg/steps"
+	"github.com/wesen/geppetto/pkg/steps/openai"
+	"reflect"
+)
+
+// Settings configures the replay of a recorded run.
+type Settings struct {
+	// FromStep is the ID of the first completion to send again. The completions started before
+	// it are not sent again and their recorded output is reused, unless their input changed.
+	FromStep int
+	// Engine and Temperature override the recorded settings of the completions that are sent again
+	Engine      *string
+	Temperature *float32
+	// ClientSettings are used to send the completions, with the recorded backend and base URL
+	ClientSettings *openai.ClientSettings
+}
+
+// Replayer runs the steps of a recorded run again, with their recorded input and settings.
+//
+// Steps that contain other steps (pipe, chain, map, ...) are replayed by replaying their children.
+// The data flowing between the steps is not recorded, so when the output of a step changes,
+// the recorded output is replaced by the new one in the inputs of all the following steps.
+type Replayer struct {
+	run      *recorder.Run
+	settings Settings
+	// changes maps the recorded outputs that changed to their new value
+	changes map[string]string
+}
+
+func NewReplayer(run *recorder.Run, settings Settings) (*Replayer, error) {
+	if settings.FromStep != 0 && run.GetStep(settings.FromStep) == nil {
+		return nil, fmt.Errorf("run %s has no step %d", run.ID, settings.FromStep)
+	}
+	if len(run.Steps) == 0 {
+		return nil, fmt.Errorf("run %s has no recorded steps", run.ID)
+	}
+	return &Replayer{
+		run:      run,
+		settings: settings,
+		changes:  map[string]string{},
+	}, nil
+}
+
+// Replay replays the top-level steps of the run in order, and returns the output of the last one,
+// which is the result of the command.
+func (r *Replayer) Replay(ctx context.Context) (interface{}, error) {
+	var ret interface{}
+	for _, step := range r.run.Children(0) {
+		var err error
+		ret, err = r.replayStep(ctx, step)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+func (r *Replayer) replayStep(ctx context.Context, step *recorder.Step) (interface{}, error) {
+	input := r.substitute(step.Input)
+	inputChanged := !reflect.DeepEqual(input, step.Input)
+
+	var output interface{}
+	var err error
+	children := r.run.Children(step.ID)
+	if len(children) == 0 {
+		output, err = r.replayLeaf(ctx, step, input, inputChanged)
+	} else {
+		output, err = r.replayContainer(ctx, step, input, children)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("step %d (%s): %w", step.ID, step.Type, err)
+	}
+
+	recorded, ok := step.Output.(string)
+	if s, ok_ := output.(string); ok && ok_ && recorded != "" && s != recorded {
+		r.changes[recorded] = s
+	}
+	return output, nil
+}
+
+// substitute replaces the recorded outputs that changed in v, which is a value decoded from JSON.
+func (r *Replayer) substitute(v interface{}) interface{} {
+	switch v_ := v.(type) {
+	case string:
+		if s, ok := r.changes[v_]; ok {
+			return s
+		}
+		return v_
+	case []interface{}:
+		ret := make([]interface{}, 0, len(v_))
+		for _, e := range v_ {
+			ret = append(ret, r.substitute(e))
+		}
+		return ret
+	case map[string]interface{}:
+		ret := map[string]interface{}{}
+		for k, e := range v_ {
+			ret[k] = r.substitute(e)
+		}
+		return ret
+	default:
+		return v
+	}
+}
+
+func isCompletion(type_ string) bool {
+	return type_ == "completion" || type_ == "completion-choices" || type_ == "chat" || type_ == "edit"
+}
+
+// replayLeaf runs a step again if its input changed, if it failed, or if it is a completion
+// started after the replay point. Otherwise, the recorded output is reused.
+func (r *Replayer) replayLeaf(
+	ctx context.Context,
+	step *recorder.Step,
+	input interface{},
+	inputChanged bool,
+) (interface{}, error) {
+	rerun := inputChanged || step.Error != "" || (isCompletion(step.Type) && step.ID >= r.settings.FromStep)
+	if !rerun {
+		_, rec := recorder.StartStep(ctx, step.Type, input)
+		rec.SetName(step.Name)
+		for key, value := range step.Metadata {
+			rec.SetMetadata(key, value)
+		}
+		rec.SetMetadata("reused_step", step.ID)
+		rec.Finish(step.Output, nil)
+		return step.Output, nil
+	}
+
+	switch step.Type {
+	case "template":
+		template, _ := step.Metadata["template"].(string)
+		return runStep[interface{}, string](ctx, steps.NewTemplateStep[interface{}](template), input)
+
+	case "completion", "completion-choices":
+		settings := &openai.CompletionStepSettings{}
+		err := decode(step.Metadata["settings"], settings)
+		if err != nil {
+			return nil, err
+		}
+		settings.ClientSettings = r.clientSettings(step)
+		if r.settings.Engine != nil {
+			settings.Engine = r.settings.Engine
+		}
+		if r.settings.Temperature != nil {
+			settings.Temperature = r.settings.Temperature
+		}
+		// nobody consumes the streamed chunks
+		settings.Stream = false
+
+		prompt, ok := input.(string)
+		if !ok {
+			return nil, fmt.Errorf("recorded prompt is not a string")
+		}
+		if step.Type == "completion" {
+			return runStep[string, string](ctx, openai.NewCompletionStep(settings), prompt)
+		}
+		choices, err := runStep[string, []backends.CompletionChoice](ctx, openai.NewCompletionChoicesStep(settings), prompt)
+		if err != nil {
+			return nil, err
+		}
+		return normalize(choices)
+
+	case "chat":
+		settings := &openai.ChatCompletionStepSettings{}
+		err := decode(step.Metadata["settings"], settings)
+		if err != nil {
+			return nil, err
+		}
+		settings.ClientSettings = r.clientSettings(step)
+		if r.settings.Engine != nil {
+			settings.Engine = r.settings.Engine
+		}
+		if r.settings.Temperature != nil {
+			settings.Temperature = r.settings.Temperature
+		}
+		settings.Stream = false
+
+		messages := []openai.ChatMessage{}
+		err = decode(input, &messages)
+		if err != nil {
+			return nil, err
+		}
+		return runStep[[]openai.ChatMessage, string](ctx, openai.NewChatCompletionStep(settings), messages)
+
+	case "edit":
+		settings := &openai.EditStepSettings{}
+		err := decode(step.Metadata["settings"], settings)
+		if err != nil {
+			return nil, err
+		}
+		settings.ClientSettings = r.clientSettings(step)
+		if r.settings.Engine != nil {
+			settings.Engine = r.settings.Engine
+		}
+		if r.settings.Temperature != nil {
+			settings.Temperature = r.settings.Temperature
+		}
+
+		editInput := openai.EditInput{}
+		err = decode(input, &editInput)
+		if err != nil {
+			return nil, err
+		}
+		choices, err := runStep[openai.EditInput, []backends.EditChoice](ctx, openai.NewEditStep(settings), editInput)
+		if err != nil {
+			return nil, err
+		}
+		return normalize(choices)
+
+	default:
+		return nil, fmt.Errorf("%s steps can't be replayed", step.Type)
+	}
+}
+
+// replayContainer replays the children of step. Retry and output steps only replay their last
+// attempt, the output of the other containers is their recorded output with the changes applied.
+func (r *Replayer) replayContainer(
+	ctx context.Context,
+	step *recorder.Step,
+	input interface{},
+	children []*recorder.Step,
+) (interface{}, error) {
+	ctx, rec := recorder.StartStep(ctx, step.Type, input)
+	rec.SetName(step.Name)
+
+	if step.Type == "retry" || step.Type == "output" {
+		children = children[len(children)-1:]
+	}
+
+	outputs := []interface{}{}
+	for _, child := range children {
+		output, err := r.replayStep(ctx, child)
+		if err != nil {
+			rec.Finish(nil, err)
+			return nil, err
+		}
+		outputs = append(outputs, output)
+	}
+	last := outputs[len(outputs)-1]
+
+	var ret interface{}
+	var err error
+	switch {
+	case step.Type == "output":
+		ret, err = r.processOutput(step, last)
+	case step.Type == "chain":
+		ret, err = r.chainOutput(step, children, outputs)
+	case step.Error == "":
+		ret = r.substitute(step.Output)
+	case step.Type == "map":
+		ret = outputs
+	default:
+		ret = last
+	}
+	rec.Finish(ret, err)
+	return ret, err
+}
+
+// processOutput parses and validates the text returned by the last attempt of an output step.
+// Invalid outputs are not corrected, since the attempts are not replayed.
+func (r *Replayer) processOutput(step *recorder.Step, output interface{}) (interface{}, error) {
+	text, ok := output.(string)
+	if !ok {
+		return nil, fmt.Errorf("output step received a %T", output)
+	}
+	d := &steps.OutputDescription{}
+	err := decode(step.Metadata["output"], d)
+	if err != nil {
+		return nil, err
+	}
+	processor, err := steps.NewOutputProcessor(d)
+	if err != nil {
+		return nil, err
+	}
+	v, err := processor.Process(text)
+	if err != nil {
+		return nil, err
+	}
+	return normalize(v)
+}
+
+// chainOutput returns the outputs of the entries listed in the outputs of the chain.
+func (r *Replayer) chainOutput(step *recorder.Step, entries []*recorder.Step, outputs []interface{}) (interface{}, error) {
+	ids := []string{}
+	err := decode(step.Metadata["outputs"], &ids)
+	if err != nil {
+		return nil, err
+	}
+	ret := map[string]interface{}{}
+	for _, id := range ids {
+		for i, entry := range entries {
+			if entry.Name == id {
+				ret[id] = outputs[i]
+			}
+		}
+	}
+	return ret, nil
+}
+
+// clientSettings returns the settings used to send a completion, with the recorded backend and base URL.
+func (r *Replayer) clientSettings(step *recorder.Step) *openai.ClientSettings {
+	ret := openai.NewClientSettings()
+	if r.settings.ClientSettings != nil {
+		ret = r.settings.ClientSettings.Clone()
+	}
+	if backend, ok := step.Metadata["backend"].(string); ok {
+		ret.Backend = backend
+	}
+	if baseURL, ok := step.Metadata["base_url"].(string); ok {
+		ret.BaseURL = &baseURL
+	}
+	return ret
+}
+
+// runStep runs s with a and waits for its result.
+func runStep[A, B any](ctx context.Context, s steps.Step[A, B], a A) (B, error) {
+	go func() {
+		_ = s.Run(ctx, a)
+	}()
+	result, ok := <-s.GetOutput()
+	if !ok {
+		var zero B
+		return zero, fmt.Errorf("step closed output channel")
+	}
+	return result.Value()
+}
+
+// decode converts a value decoded from JSON into v.
+func decode(value interface{}, v interface{}) error {
+	b, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// normalize converts v to the maps, lists and scalars it is recorded as, so that it can be
+// compared with the recorded values.
+func normalize(v interface{}) (interface{}, error) {
+	var ret interface{}
+	err := decode(v, &ret)
+	return ret, err
+}
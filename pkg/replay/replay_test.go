@@ -0,0 +1,114 @@
+package replay
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wesen/geppetto/pkg/backends"
+	"github.com/wesen/geppetto/pkg/recorder"
+	"github.com/wesen/geppetto/pkg/steps"
+	"github.com/wesen/geppetto/pkg/steps/openai"
+	"testing"
+)
+
+// recordChain records a chain that greets someone, and translates the greeting.
+func recordChain(t *testing.T, store *recorder.Store, clientSettings *openai.ClientSettings) *recorder.Run {
+	engine := "fake-model"
+	factory := steps.StepFactoryFunc[string, string](func() (steps.Step[string, string], error) {
+		return openai.NewCompletionStep(&openai.CompletionStepSettings{
+			ClientSettings: clientSettings.Clone(),
+			Engine:         &engine,
+		}), nil
+	})
+	s, err := steps.NewChainStep(map[string]*steps.ChainStepDescription{
+		"greet":     {Prompt: "Say hello to {{ .name }}"},
+		"translate": {Prompt: "Translate: {{ .greeting }}"},
+	}, &steps.ChainDescription{
+		Pipe: []*steps.ChainEntry{
+			{Step: "greet"},
+			{Step: "translate", Inputs: map[string]string{"greeting": "steps.greet.output"}},
+		},
+	}, factory)
+	require.Nil(t, err)
+
+	rec, err := store.Create("greet", map[string]interface{}{"name": "world"})
+	require.Nil(t, err)
+	ctx := recorder.WithRecorder(context.Background(), rec)
+	go func() {
+		_ = s.Run(ctx, map[string]interface{}{"name": "world"})
+	}()
+	result := <-s.GetOutput()
+	_, err = result.Value()
+	require.Nil(t, err)
+	require.Nil(t, rec.Finish(nil, nil))
+
+	run, err := store.Load(rec.RunID())
+	require.Nil(t, err)
+	return run
+}
+
+func findStep(run *recorder.Run, type_ string, input string) *recorder.Step {
+	for _, step := range run.Steps {
+		if step.Type == type_ && step.Input == input {
+			return step
+		}
+	}
+	return nil
+}
+
+func TestReplay(t *testing.T) {
+	backend := backends.NewFakeBackend()
+	backend.AddPromptResponse("Say hello to world", &backends.FakeResponse{Text: "Hello world"})
+	backend.AddPromptResponse("Translate: Hello world", &backends.FakeResponse{Text: "Bonjour monde"})
+	server := backends.NewFakeOpenAIServer(backend)
+	t.Cleanup(server.Close)
+	apiKey := "test"
+	clientSettings := &openai.ClientSettings{APIKey: &apiKey, BaseURL: &server.URL}
+
+	store := recorder.NewStore(t.TempDir())
+	run := recordChain(t, store, clientSettings)
+	require.Len(t, backend.Requests(), 2)
+
+	translate := findStep(run, "completion", "Translate: Hello world")
+	require.NotNil(t, translate)
+
+	// replaying from the translation only sends the translation again
+	temperature := float32(0.2)
+	r, err := NewReplayer(run, Settings{
+		FromStep:       translate.ID,
+		Temperature:    &temperature,
+		ClientSettings: clientSettings,
+	})
+	require.Nil(t, err)
+	output, err := r.Replay(context.Background())
+	require.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{"translate": "Bonjour monde"}, output)
+
+	requests := backend.Requests()
+	require.Len(t, requests, 3)
+	assert.Equal(t, "Translate: Hello world", requests[2].Prompt)
+	require.NotNil(t, requests[2].Temperature)
+	assert.Equal(t, temperature, *requests[2].Temperature)
+
+	// when the greeting changes, the translation is rendered and sent again with the new greeting
+	backend.AddPromptResponse("Say hello to world", &backends.FakeResponse{Text: "Hi world"})
+	backend.AddPromptResponse("Translate: Hi world", &backends.FakeResponse{Text: "Salut monde"})
+
+	rec, err := store.CreateReplay(run, 0)
+	require.Nil(t, err)
+	r, err = NewReplayer(run, Settings{ClientSettings: clientSettings})
+	require.Nil(t, err)
+	output, err = r.Replay(recorder.WithRecorder(context.Background(), rec))
+	require.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{"translate": "Salut monde"}, output)
+	require.Nil(t, rec.Finish(nil, nil))
+
+	replayed, err := store.Load(rec.RunID())
+	require.Nil(t, err)
+	assert.Equal(t, run.ID, replayed.ReplayOf)
+	assert.NotNil(t, findStep(replayed, "completion", "Translate: Hi world"))
+	assert.Len(t, replayed.Steps, len(run.Steps))
+
+	_, err = NewReplayer(run, Settings{FromStep: 100})
+	assert.Error(t, err)
+}
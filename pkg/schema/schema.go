@@ -0,0 +1,231 @@
+package schema
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Validate checks v against a JSON Schema, given as decoded JSON or YAML.
+//
+// Only the validation keywords commonly used to describe LLM outputs are supported:
+// type, enum, const, properties, required, additionalProperties, items,
+// minItems, maxItems, minLength, maxLength, pattern, minimum and maximum.
+// Other keywords are ignored.
+func Validate(schema map[string]interface{}, v interface{}) error {
+	return validate("$", schema, normalize(v))
+}
+
+// normalize converts the values decoded from YAML or JSON (or built by hand) to
+// map[string]interface{}, []interface{} and float64 for numbers.
+func normalize(v interface{}) interface{} {
+	switch v_ := v.(type) {
+	case nil, string, bool, float64:
+		return v
+	case map[string]interface{}:
+		ret := map[string]interface{}{}
+		for k, e := range v_ {
+			ret[k] = normalize(e)
+		}
+		return ret
+	case []interface{}:
+		ret := make([]interface{}, len(v_))
+		for i, e := range v_ {
+			ret[i] = normalize(e)
+		}
+		return ret
+	}
+
+	value := reflect.ValueOf(v)
+	switch value.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(value.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(value.Uint())
+	case reflect.Float32:
+		return value.Float()
+	case reflect.Slice, reflect.Array:
+		ret := make([]interface{}, value.Len())
+		for i := 0; i < value.Len(); i++ {
+			ret[i] = normalize(value.Index(i).Interface())
+		}
+		return ret
+	case reflect.Map:
+		ret := map[string]interface{}{}
+		for _, k := range value.MapKeys() {
+			ret[fmt.Sprint(k.Interface())] = normalize(value.MapIndex(k).Interface())
+		}
+		return ret
+	}
+	return v
+}
+
+func typeName(v interface{}) string {
+	switch v_ := v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case float64:
+		if v_ == float64(int64(v_)) {
+			return "integer"
+		}
+		return "number"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+func hasType(v interface{}, t string) bool {
+	actual := typeName(v)
+	return actual == t || (t == "number" && actual == "integer")
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	f, ok := normalize(v).(float64)
+	return f, ok
+}
+
+func validate(path string, schema map[string]interface{}, v interface{}) error {
+	if t, ok := schema["type"]; ok {
+		types := []string{}
+		switch t_ := t.(type) {
+		case string:
+			types = append(types, t_)
+		case []interface{}:
+			for _, e := range t_ {
+				types = append(types, fmt.Sprint(e))
+			}
+		}
+		found := false
+		for _, t_ := range types {
+			if hasType(v, t_) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: expected %s, got %s", path, strings.Join(types, " or "), typeName(v))
+		}
+	}
+
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, e := range enum {
+			if reflect.DeepEqual(normalize(e), v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: %v is not one of %v", path, v, enum)
+		}
+	}
+	if c, ok := schema["const"]; ok && !reflect.DeepEqual(normalize(c), v) {
+		return fmt.Errorf("%s: expected %v, got %v", path, c, v)
+	}
+
+	switch v_ := v.(type) {
+	case string:
+		return validateString(path, schema, v_)
+	case float64:
+		return validateNumber(path, schema, v_)
+	case []interface{}:
+		return validateArray(path, schema, v_)
+	case map[string]interface{}:
+		return validateObject(path, schema, v_)
+	}
+	return nil
+}
+
+func validateString(path string, schema map[string]interface{}, s string) error {
+	length := len([]rune(s))
+	if min, ok := toFloat(schema["minLength"]); ok && float64(length) < min {
+		return fmt.Errorf("%s: expected at least %v characters, got %d", path, min, length)
+	}
+	if max, ok := toFloat(schema["maxLength"]); ok && float64(length) > max {
+		return fmt.Errorf("%s: expected at most %v characters, got %d", path, max, length)
+	}
+	if pattern, ok := schema["pattern"].(string); ok {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("%s: invalid pattern %s: %w", path, pattern, err)
+		}
+		if !re.MatchString(s) {
+			return fmt.Errorf("%s: %q does not match %s", path, s, pattern)
+		}
+	}
+	return nil
+}
+
+func validateNumber(path string, schema map[string]interface{}, f float64) error {
+	if min, ok := toFloat(schema["minimum"]); ok && f < min {
+		return fmt.Errorf("%s: %v is less than the minimum %v", path, f, min)
+	}
+	if max, ok := toFloat(schema["maximum"]); ok && f > max {
+		return fmt.Errorf("%s: %v is greater than the maximum %v", path, f, max)
+	}
+	return nil
+}
+
+func validateArray(path string, schema map[string]interface{}, a []interface{}) error {
+	if min, ok := toFloat(schema["minItems"]); ok && float64(len(a)) < min {
+		return fmt.Errorf("%s: expected at least %v items, got %d", path, min, len(a))
+	}
+	if max, ok := toFloat(schema["maxItems"]); ok && float64(len(a)) > max {
+		return fmt.Errorf("%s: expected at most %v items, got %d", path, max, len(a))
+	}
+	if items, ok := schema["items"].(map[string]interface{}); ok {
+		for i, e := range a {
+			if err := validate(fmt.Sprintf("%s[%d]", path, i), items, e); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func validateObject(path string, schema map[string]interface{}, o map[string]interface{}) error {
+	if required, ok := schema["required"].([]interface{}); ok {
+		for _, name := range required {
+			if _, ok := o[fmt.Sprint(name)]; !ok {
+				return fmt.Errorf("%s: missing required property %v", path, name)
+			}
+		}
+	}
+
+	properties, _ := schema["properties"].(map[string]interface{})
+	keys := make([]string, 0, len(o))
+	for k := range o {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		p := path + "." + k
+		if property, ok := properties[k].(map[string]interface{}); ok {
+			if err := validate(p, property, o[k]); err != nil {
+				return err
+			}
+			continue
+		}
+		switch additional := schema["additionalProperties"].(type) {
+		case bool:
+			if !additional {
+				return fmt.Errorf("%s: unexpected property", p)
+			}
+		case map[string]interface{}:
+			if err := validate(p, additional, o[k]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package schema
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+	"testing"
+)
+
+const peopleSchema = `
+type: array
+minItems: 1
+items:
+  type: object
+  required: [name, age]
+  additionalProperties: false
+  properties:
+    name:
+      type: string
+      minLength: 1
+    age:
+      type: integer
+      minimum: 0
+    role:
+      enum: [admin, user]
+`
+
+func loadSchema(t *testing.T, s string) map[string]interface{} {
+	ret := map[string]interface{}{}
+	require.Nil(t, yaml.Unmarshal([]byte(s), &ret))
+	return ret
+}
+
+func TestValidate(t *testing.T) {
+	schema := loadSchema(t, peopleSchema)
+
+	valid := []interface{}{
+		map[string]interface{}{"name": "manuel", "age": 40, "role": "admin"},
+		map[string]interface{}{"name": "bob", "age": float64(3)},
+	}
+	assert.Nil(t, Validate(schema, valid))
+
+	tests := map[string]interface{}{
+		"$: expected array, got object":                    map[string]interface{}{},
+		"$: expected at least 1 items, got 0":              []interface{}{},
+		"$[0]: missing required property age":              []interface{}{map[string]interface{}{"name": "a"}},
+		"$[0].age: expected integer, got number":           []interface{}{map[string]interface{}{"name": "a", "age": 1.5}},
+		"$[0].age: -1 is less than the minimum 0":          []interface{}{map[string]interface{}{"name": "a", "age": -1}},
+		"$[0].name: expected at least 1 characters, got 0": []interface{}{map[string]interface{}{"name": "", "age": 1}},
+		"$[0].role: guest is not one of [admin user]":      []interface{}{map[string]interface{}{"name": "a", "age": 1, "role": "guest"}},
+		"$[0].email: unexpected property":                  []interface{}{map[string]interface{}{"name": "a", "age": 1, "email": "a@b"}},
+	}
+	for expected, v := range tests {
+		err := Validate(schema, v)
+		if assert.Error(t, err, expected) {
+			assert.Equal(t, expected, err.Error())
+		}
+	}
+}
+
+func TestValidateTypeList(t *testing.T) {
+	schema := loadSchema(t, `
+type: [string, "null"]
+pattern: "^[a-z]+$"
+`)
+	assert.Nil(t, Validate(schema, nil))
+	assert.Nil(t, Validate(schema, "abc"))
+	assert.Error(t, Validate(schema, "ABC"))
+	assert.Error(t, Validate(schema, 1))
+}
@@ -0,0 +1,370 @@
+package steps
+
+import (
+	"context"
+	"fmt"
+	"github.com/wesen/geppetto/pkg/helpers"
+	"github.com/wesen/geppetto/pkg/recorder"
+	"golang.org/x/sync/errgroup"
+	"gopkg.in/errgo.v2/fmt/errors"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+const (
+	ChainStepTypeCompletion = "completion"
+	ChainStepTypeTemplate   = "template"
+)
+
+const (
+	ReferenceArguments = "arguments"
+	ReferenceFlags     = "flags"
+	ReferenceSteps     = "steps"
+)
+
+// Reference points to a value available to the entries of a chain: a command
+// argument (arguments.<name>), a command flag (flags.<name>) or the output of
+// another entry (steps.<id>.output).
+type Reference struct {
+	Type string
+	Name string
+}
+
+func ParseReference(s string) (*Reference, error) {
+	parts := strings.Split(s, ".")
+	switch {
+	case len(parts) == 2 && (parts[0] == ReferenceArguments || parts[0] == ReferenceFlags) && parts[1] != "":
+		return &Reference{Type: parts[0], Name: parts[1]}, nil
+	case len(parts) == 3 && parts[0] == ReferenceSteps && parts[1] != "" && parts[2] == "output":
+		return &Reference{Type: ReferenceSteps, Name: parts[1]}, nil
+	default:
+		return nil, errors.Newf("invalid reference %s, expected arguments.<name>, flags.<name> or steps.<id>.output", s)
+	}
+}
+
+func (r *Reference) String() string {
+	if r.Type == ReferenceSteps {
+		return fmt.Sprintf("steps.%s.output", r.Name)
+	}
+	return fmt.Sprintf("%s.%s", r.Type, r.Name)
+}
+
+type chainNode struct {
+	id       string
+	stepType string
+	prompt   string
+	inputs   map[string]*Reference
+	// dependencies are the IDs of the entries whose output is used as input
+	dependencies []string
+}
+
+type ChainStepState int
+
+const (
+	ChainStepNotStarted ChainStepState = iota
+	ChainStepRunning
+	ChainStepFinished
+	ChainStepClosed
+)
+
+// ChainStep runs the entries of a chain in dependency order, and outputs the outputs
+// of the selected entries, indexed by ID.
+//
+// The prompt of each entry is rendered right before it runs, with the parameters passed to
+// Run and the inputs of the entry. Completion entries then send the prompt to a step created
+// by the completion factory, which shouldn't stream since nobody consumes the deltas.
+type ChainStep struct {
+	nodes             []*chainNode
+	outputs           []string
+	completionFactory StepFactory[string, string]
+	// baseTemplate contains the partials available to the prompts
+	baseTemplate *template.Template
+	output       chan helpers.Result[map[string]string]
+	state        ChainStepState
+}
+
+// NewChainStep validates the chain description, and sorts its entries by dependencies.
+// completionFactory can be nil to only validate the chain or render its prompts.
+func NewChainStep(
+	stepDescriptions map[string]*ChainStepDescription,
+	description *ChainDescription,
+	completionFactory StepFactory[string, string],
+) (*ChainStep, error) {
+	if description == nil || len(description.Pipe) == 0 {
+		return nil, errors.Newf("chain has no entries")
+	}
+
+	nodes := map[string]*chainNode{}
+	ids := []string{}
+	for _, entry := range description.Pipe {
+		stepDescription, ok := stepDescriptions[entry.Step]
+		if !ok {
+			return nil, errors.Newf("chain references unknown step %s", entry.Step)
+		}
+		id := entry.ID
+		if id == "" {
+			id = entry.Step
+		}
+		if _, ok := nodes[id]; ok {
+			return nil, errors.Newf("duplicate chain entry %s", id)
+		}
+
+		stepType := stepDescription.Type
+		switch stepType {
+		case "":
+			stepType = ChainStepTypeCompletion
+		case ChainStepTypeCompletion, ChainStepTypeTemplate:
+		default:
+			return nil, errors.Newf("step %s has unknown type %s", entry.Step, stepType)
+		}
+
+		_, err := template.New(id).Funcs(helpers.TemplateFuncs).Parse(stepDescription.Prompt)
+		if err != nil {
+			return nil, errors.Notef(err, nil, "could not parse prompt of step %s", entry.Step)
+		}
+
+		node := &chainNode{
+			id:       id,
+			stepType: stepType,
+			prompt:   stepDescription.Prompt,
+			inputs:   map[string]*Reference{},
+		}
+		for name, s := range entry.Inputs {
+			ref, err := ParseReference(s)
+			if err != nil {
+				return nil, errors.Notef(err, nil, "input %s of chain entry %s", name, id)
+			}
+			node.inputs[name] = ref
+			if ref.Type == ReferenceSteps {
+				node.dependencies = append(node.dependencies, ref.Name)
+			}
+		}
+
+		nodes[id] = node
+		ids = append(ids, id)
+	}
+
+	for _, id := range ids {
+		for _, dep := range nodes[id].dependencies {
+			if _, ok := nodes[dep]; !ok {
+				return nil, errors.Newf("chain entry %s references unknown entry %s", id, dep)
+			}
+		}
+	}
+
+	sorted, err := sortChainNodes(nodes, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	outputs := description.Outputs
+	if len(outputs) == 0 {
+		outputs = []string{ids[len(ids)-1]}
+	}
+	for _, output := range outputs {
+		if _, ok := nodes[output]; !ok {
+			return nil, errors.Newf("chain output references unknown entry %s", output)
+		}
+	}
+
+	return &ChainStep{
+		nodes:             sorted,
+		outputs:           outputs,
+		completionFactory: completionFactory,
+		output:            make(chan helpers.Result[map[string]string]),
+		state:             ChainStepNotStarted,
+	}, nil
+}
+
+// sortChainNodes sorts the nodes topologically, keeping the order of the chain description
+// for independent entries.
+func sortChainNodes(nodes map[string]*chainNode, ids []string) ([]*chainNode, error) {
+	ret := []*chainNode{}
+	visited := map[string]bool{}
+	visiting := map[string]bool{}
+
+	var visit func(id string) error
+	visit = func(id string) error {
+		if visited[id] {
+			return nil
+		}
+		if visiting[id] {
+			return errors.Newf("chain has a cycle through entry %s", id)
+		}
+		visiting[id] = true
+		for _, dep := range nodes[id].dependencies {
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		visiting[id] = false
+		visited[id] = true
+		ret = append(ret, nodes[id])
+		return nil
+	}
+
+	for _, id := range ids {
+		if err := visit(id); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+// SetBaseTemplate makes the templates defined in base (for example partials) available to the prompts.
+func (c *ChainStep) SetBaseTemplate(base *template.Template) {
+	c.baseTemplate = base
+}
+
+// Outputs returns the IDs of the entries whose output is returned by the chain.
+func (c *ChainStep) Outputs() []string {
+	return c.outputs
+}
+
+func (n *chainNode) templateData(parameters map[string]interface{}, outputs map[string]string) map[string]interface{} {
+	ret := map[string]interface{}{}
+	for k, v := range parameters {
+		ret[k] = v
+	}
+	for name, ref := range n.inputs {
+		if ref.Type == ReferenceSteps {
+			ret[name] = outputs[ref.Name]
+		} else {
+			ret[name] = parameters[ref.Name]
+		}
+	}
+	return ret
+}
+
+func (c *ChainStep) newNodeFactory(node *chainNode) StepFactory[map[string]interface{}, string] {
+	return StepFactoryFunc[map[string]interface{}, string](func() (Step[map[string]interface{}, string], error) {
+		templateStep := NewTemplateStepWithBase[map[string]interface{}](c.baseTemplate, node.prompt)
+		if node.stepType == ChainStepTypeTemplate {
+			return templateStep, nil
+		}
+
+		if c.completionFactory == nil {
+			return nil, errors.Newf("no completion factory to run chain entry %s", node.id)
+		}
+		completionStep, err := c.completionFactory.NewStep()
+		if err != nil {
+			return nil, err
+		}
+		return NewPipeStep[map[string]interface{}, string, string](templateStep, completionStep), nil
+	})
+}
+
+func (c *ChainStep) Run(ctx context.Context, parameters map[string]interface{}) error {
+	if c.state != ChainStepNotStarted {
+		return errors.Newf("step already started")
+	}
+	c.state = ChainStepRunning
+
+	defer func() {
+		c.state = ChainStepClosed
+		close(c.output)
+	}()
+
+	mutex := sync.Mutex{}
+	outputs := map[string]string{}
+	done := map[string]chan struct{}{}
+	for _, node := range c.nodes {
+		done[node.id] = make(chan struct{})
+	}
+
+	ctx, rec := recorder.StartStep(ctx, "chain", parameters)
+	rec.SetMetadata("outputs", c.outputs)
+
+	eg, ctx2 := errgroup.WithContext(ctx)
+	for _, node_ := range c.nodes {
+		node := node_
+		eg.Go(func() error {
+			for _, dep := range node.dependencies {
+				select {
+				case <-done[dep]:
+				case <-ctx2.Done():
+					return ctx2.Err()
+				}
+			}
+
+			mutex.Lock()
+			data := node.templateData(parameters, outputs)
+			mutex.Unlock()
+
+			ctx3, nodeRec := recorder.StartStep(ctx2, "chain-entry", data)
+			nodeRec.SetName(node.id)
+			nodeRec.SetMetadata("type", node.stepType)
+			output, err := runStep(ctx3, c.newNodeFactory(node), data)
+			nodeRec.Finish(output, err)
+			if err != nil {
+				return errors.Notef(err, nil, "chain entry %s", node.id)
+			}
+
+			mutex.Lock()
+			outputs[node.id] = output
+			mutex.Unlock()
+			close(done[node.id])
+			return nil
+		})
+	}
+
+	err := eg.Wait()
+	c.state = ChainStepFinished
+	if err != nil {
+		rec.Finish(nil, err)
+		c.output <- helpers.NewErrorResult[map[string]string](err)
+		return nil
+	}
+
+	ret := map[string]string{}
+	for _, id := range c.outputs {
+		ret[id] = outputs[id]
+	}
+	rec.Finish(ret, nil)
+	c.output <- helpers.NewValueResult(ret)
+
+	return nil
+}
+
+// RenderedPrompt is the prompt of a chain entry rendered by RenderPrompts.
+type RenderedPrompt struct {
+	ID     string
+	Prompt string
+}
+
+// RenderPrompts renders the prompts of all the entries without running them, in execution order.
+// The outputs of other entries are replaced by their reference, for example {{ steps.foo.output }}.
+func (c *ChainStep) RenderPrompts(parameters map[string]interface{}) ([]*RenderedPrompt, error) {
+	placeholders := map[string]string{}
+	for _, node := range c.nodes {
+		placeholders[node.id] = fmt.Sprintf("{{ %s }}", (&Reference{Type: ReferenceSteps, Name: node.id}).String())
+	}
+
+	ret := []*RenderedPrompt{}
+	for _, node := range c.nodes {
+		tmpl, err := NewTemplateStepWithBase[map[string]interface{}](c.baseTemplate, node.prompt).parse()
+		if err != nil {
+			return nil, err
+		}
+		buf := &strings.Builder{}
+		err = tmpl.Execute(buf, node.templateData(parameters, placeholders))
+		if err != nil {
+			return nil, errors.Notef(err, nil, "chain entry %s", node.id)
+		}
+		ret = append(ret, &RenderedPrompt{ID: node.id, Prompt: buf.String()})
+	}
+	return ret, nil
+}
+
+func (c *ChainStep) GetOutput() <-chan helpers.Result[map[string]string] {
+	return c.output
+}
+
+func (c *ChainStep) GetState() interface{} {
+	return c.state
+}
+
+func (c *ChainStep) IsFinished() bool {
+	return c.state == ChainStepFinished
+}
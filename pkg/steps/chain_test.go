@@ -0,0 +1,121 @@
+package steps
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// upperCaseFactory creates completion steps that return their prompt in upper case,
+// and records the prompts they received.
+type upperCaseFactory struct {
+	mutex   sync.Mutex
+	prompts []string
+}
+
+func (u *upperCaseFactory) NewStep() (Step[string, string], error) {
+	return NewSimpleStep(func(prompt string) string {
+		u.mutex.Lock()
+		defer u.mutex.Unlock()
+		u.prompts = append(u.prompts, prompt)
+		return strings.ToUpper(prompt)
+	}), nil
+}
+
+func runChainStep(t *testing.T, c *ChainStep, parameters map[string]interface{}) (map[string]string, error) {
+	go func() {
+		require.Nil(t, c.Run(context.Background(), parameters))
+	}()
+	v, ok := <-c.GetOutput()
+	require.True(t, ok)
+	return v.Value()
+}
+
+var testChainSteps = map[string]*ChainStepDescription{
+	"greet":   {Prompt: "hello {{ .name }}"},
+	"shout":   {Prompt: "{{ .greeting }}!"},
+	"combine": {Type: ChainStepTypeTemplate, Prompt: "{{ .a }} / {{ .b }}"},
+}
+
+func TestChainStepWiring(t *testing.T) {
+	factory := &upperCaseFactory{}
+	c, err := NewChainStep(testChainSteps, &ChainDescription{
+		Pipe: []*ChainEntry{
+			{Step: "combine", Inputs: map[string]string{
+				"a": "steps.greet.output",
+				"b": "steps.shout.output",
+			}},
+			{Step: "greet", Inputs: map[string]string{"name": "arguments.person"}},
+			{Step: "shout", Inputs: map[string]string{"greeting": "steps.greet.output"}},
+		},
+		Outputs: []string{"combine", "greet"},
+	}, factory)
+	require.Nil(t, err)
+
+	outputs, err := runChainStep(t, c, map[string]interface{}{"person": "manuel"})
+	require.Nil(t, err)
+	assert.Equal(t, map[string]string{
+		"greet":   "HELLO MANUEL",
+		"combine": "HELLO MANUEL / HELLO MANUEL!",
+	}, outputs)
+	assert.Equal(t, []string{"hello manuel", "HELLO MANUEL!"}, factory.prompts)
+	assert.Equal(t, []string{"combine", "greet"}, c.Outputs())
+}
+
+func TestChainStepDefaultOutput(t *testing.T) {
+	c, err := NewChainStep(testChainSteps, &ChainDescription{
+		Pipe: []*ChainEntry{
+			{ID: "first", Step: "greet", Inputs: map[string]string{"name": "flags.name"}},
+			{ID: "second", Step: "greet", Inputs: map[string]string{"name": "steps.first.output"}},
+		},
+	}, &upperCaseFactory{})
+	require.Nil(t, err)
+
+	outputs, err := runChainStep(t, c, map[string]interface{}{"name": "bob"})
+	require.Nil(t, err)
+	assert.Equal(t, map[string]string{"second": "HELLO HELLO BOB"}, outputs)
+}
+
+func TestChainStepInvalid(t *testing.T) {
+	_, err := NewChainStep(testChainSteps, &ChainDescription{
+		Pipe: []*ChainEntry{
+			{ID: "a", Step: "shout", Inputs: map[string]string{"greeting": "steps.b.output"}},
+			{ID: "b", Step: "shout", Inputs: map[string]string{"greeting": "steps.a.output"}},
+		},
+	}, nil)
+	assert.ErrorContains(t, err, "cycle")
+
+	_, err = NewChainStep(testChainSteps, &ChainDescription{
+		Pipe: []*ChainEntry{{Step: "unknown"}},
+	}, nil)
+	assert.ErrorContains(t, err, "unknown step")
+
+	_, err = NewChainStep(testChainSteps, &ChainDescription{
+		Pipe: []*ChainEntry{{Step: "greet", Inputs: map[string]string{"name": "steps.greet"}}},
+	}, nil)
+	assert.ErrorContains(t, err, "invalid reference")
+
+	_, err = NewChainStep(testChainSteps, &ChainDescription{
+		Pipe: []*ChainEntry{{Step: "shout", Inputs: map[string]string{"greeting": "steps.greet.output"}}},
+	}, nil)
+	assert.ErrorContains(t, err, "unknown entry greet")
+}
+
+func TestChainStepRenderPrompts(t *testing.T) {
+	c, err := NewChainStep(testChainSteps, &ChainDescription{
+		Pipe: []*ChainEntry{
+			{Step: "shout", Inputs: map[string]string{"greeting": "steps.greet.output"}},
+			{Step: "greet", Inputs: map[string]string{"name": "arguments.person"}},
+		},
+	}, nil)
+	require.Nil(t, err)
+
+	prompts, err := c.RenderPrompts(map[string]interface{}{"person": "manuel"})
+	require.Nil(t, err)
+	require.Len(t, prompts, 2)
+	assert.Equal(t, &RenderedPrompt{ID: "greet", Prompt: "hello manuel"}, prompts[0])
+	assert.Equal(t, &RenderedPrompt{ID: "shout", Prompt: "{{ steps.greet.output }}!"}, prompts[1])
+}
@@ -0,0 +1,66 @@
+package steps
+
+import (
+	"context"
+	"github.com/wesen/geppetto/pkg/chunking"
+	"github.com/wesen/geppetto/pkg/helpers"
+	"github.com/wesen/geppetto/pkg/recorder"
+	"gopkg.in/errgo.v2/fmt/errors"
+)
+
+type ChunkStepState int
+
+const (
+	ChunkStepNotStarted ChunkStepState = iota
+	ChunkStepRunning
+	ChunkStepFinished
+	ChunkStepClosed
+)
+
+// ChunkStep splits a document into chunks, for example to run a prompt per chunk with a MapStep.
+type ChunkStep struct {
+	chunker chunking.Chunker
+	output  chan helpers.Result[[]*chunking.Chunk]
+	state   ChunkStepState
+}
+
+func NewChunkStep(chunker chunking.Chunker) *ChunkStep {
+	return &ChunkStep{
+		chunker: chunker,
+		output:  make(chan helpers.Result[[]*chunking.Chunk]),
+		state:   ChunkStepNotStarted,
+	}
+}
+
+func (c *ChunkStep) Run(ctx context.Context, content string) error {
+	if c.state != ChunkStepNotStarted {
+		return errors.Newf("step already started")
+	}
+	c.state = ChunkStepRunning
+	defer func() {
+		c.state = ChunkStepClosed
+		close(c.output)
+	}()
+
+	_, rec := recorder.StartStep(ctx, "chunk", content)
+	chunks, err := c.chunker.Chunk(content)
+	rec.SetMetadata("chunks", len(chunks))
+	rec.Finish(chunks, err)
+
+	c.state = ChunkStepFinished
+	c.output <- helpers.NewResult(chunks, err)
+
+	return nil
+}
+
+func (c *ChunkStep) GetOutput() <-chan helpers.Result[[]*chunking.Chunk] {
+	return c.output
+}
+
+func (c *ChunkStep) GetState() interface{} {
+	return c.state
+}
+
+func (c *ChunkStep) IsFinished() bool {
+	return c.state == ChunkStepFinished
+}
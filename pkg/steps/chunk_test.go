@@ -0,0 +1,29 @@
+package steps
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wesen/geppetto/pkg/chunking"
+	"github.com/wesen/geppetto/pkg/tokenizer"
+	"testing"
+)
+
+func TestChunkStep(t *testing.T) {
+	s := NewChunkStep(&chunking.HeadingChunker{
+		Level:     1,
+		Tokenizer: tokenizer.NewApproximateTokenizer(tokenizer.EncodingCL100kBase),
+	})
+	require.Equal(t, ChunkStepNotStarted, s.GetState())
+
+	go func() {
+		require.Nil(t, s.Run(context.Background(), "# One\nfirst\n# Two\nsecond\n"))
+	}()
+	v, ok := <-s.GetOutput()
+	require.True(t, ok)
+	chunks, err := v.Value()
+	require.Nil(t, err)
+	require.Len(t, chunks, 2)
+	assert.Equal(t, "Two", chunks[1].Title)
+	assert.Equal(t, "# Two\nsecond", chunks[1].Text)
+}
@@ -0,0 +1,251 @@
+package steps
+
+import (
+	"context"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"github.com/wesen/geppetto/pkg/helpers"
+	"github.com/wesen/geppetto/pkg/recorder"
+	"gopkg.in/errgo.v2/fmt/errors"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MapErrorPolicy determines what a MapStep does when the step for one of the input elements fails.
+type MapErrorPolicy int
+
+const (
+	// MapFailFast cancels the remaining elements as soon as one fails, and returns that error.
+	MapFailFast MapErrorPolicy = iota
+	// MapCollectErrors runs all the elements, and returns the outputs along with a *MapError
+	// listing the elements that failed. The outputs of the failed elements are left at their zero value.
+	MapCollectErrors
+	// MapSubstituteDefault runs all the elements, and uses MapStepSettings.Default as output
+	// for the elements that failed.
+	MapSubstituteDefault
+)
+
+type MapStepSettings[B any] struct {
+	// Concurrency is the maximum number of steps running at the same time. 0 means no limit.
+	Concurrency int
+	ErrorPolicy MapErrorPolicy
+	// Default is used as output for failed elements when using MapSubstituteDefault
+	Default B
+}
+
+// MapError is returned by a MapStep using MapCollectErrors, and contains the error for each failed element.
+type MapError struct {
+	Errors map[int]error
+}
+
+func (m *MapError) Error() string {
+	idxs := make([]int, 0, len(m.Errors))
+	for idx := range m.Errors {
+		idxs = append(idxs, idx)
+	}
+	sort.Ints(idxs)
+
+	msgs := make([]string, 0, len(idxs))
+	for _, idx := range idxs {
+		msgs = append(msgs, fmt.Sprintf("element %d: %s", idx, m.Errors[idx]))
+	}
+	return fmt.Sprintf("%d elements failed: %s", len(idxs), strings.Join(msgs, ", "))
+}
+
+type MapStepState int
+
+const (
+	MapStepNotStarted MapStepState = iota
+	MapStepRunning
+	MapStepFinished
+	MapStepClosed
+)
+
+// MapStep creates a step for each element of its input using a StepFactory, runs them
+// concurrently and outputs their results in the same order as the input.
+type MapStep[A, B any] struct {
+	factory  StepFactory[A, B]
+	settings MapStepSettings[B]
+	output   chan helpers.Result[[]B]
+	state    MapStepState
+}
+
+func NewMapStep[A, B any](factory StepFactory[A, B], settings MapStepSettings[B]) *MapStep[A, B] {
+	return &MapStep[A, B]{
+		factory:  factory,
+		settings: settings,
+		output:   make(chan helpers.Result[[]B]),
+		state:    MapStepNotStarted,
+	}
+}
+
+func (m *MapStep[A, B]) Run(ctx context.Context, as []A) error {
+	if m.state != MapStepNotStarted {
+		return errors.Newf("step already started")
+	}
+	m.state = MapStepRunning
+
+	defer func() {
+		m.state = MapStepClosed
+		close(m.output)
+	}()
+
+	ctx, rec := recorder.StartStep(ctx, "map", as)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make([]B, len(as))
+	errs := make([]error, len(as))
+
+	var sem chan struct{}
+	if m.settings.Concurrency > 0 {
+		sem = make(chan struct{}, m.settings.Concurrency)
+	}
+
+	wg := sync.WaitGroup{}
+	for i, a := range as {
+		if sem != nil {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				errs[i] = ctx.Err()
+				continue
+			}
+		}
+
+		wg.Add(1)
+		go func(i int, a A) {
+			defer func() {
+				if sem != nil {
+					<-sem
+				}
+				wg.Done()
+			}()
+
+			results[i], errs[i] = runStep(ctx, m.factory, a)
+			if errs[i] != nil && m.settings.ErrorPolicy == MapFailFast {
+				cancel()
+			}
+		}(i, a)
+	}
+	wg.Wait()
+
+	result := m.collect(results, errs)
+	rec.Finish(result.Value())
+	m.state = MapStepFinished
+	m.output <- result
+
+	return nil
+}
+
+func (m *MapStep[A, B]) collect(results []B, errs []error) helpers.Result[[]B] {
+	mapError := &MapError{Errors: map[int]error{}}
+	for i, err := range errs {
+		if err != nil {
+			mapError.Errors[i] = err
+		}
+	}
+
+	if len(mapError.Errors) == 0 {
+		return helpers.NewValueResult(results)
+	}
+
+	switch m.settings.ErrorPolicy {
+	case MapFailFast:
+		// report the error that caused the cancellation, not the cancellation errors of the other elements
+		var first error
+		for _, err := range errs {
+			if err == nil {
+				continue
+			}
+			if err != context.Canceled {
+				return helpers.NewErrorResult[[]B](err)
+			}
+			if first == nil {
+				first = err
+			}
+		}
+		return helpers.NewErrorResult[[]B](first)
+
+	case MapSubstituteDefault:
+		for i, err := range mapError.Errors {
+			log.Warn().Err(err).Int("element", i).Msg("map step element failed, using default value")
+			results[i] = m.settings.Default
+		}
+		return helpers.NewValueResult(results)
+
+	default:
+		return helpers.NewResult[[]B](results, mapError)
+	}
+}
+
+func (m *MapStep[A, B]) GetOutput() <-chan helpers.Result[[]B] {
+	return m.output
+}
+
+func (m *MapStep[A, B]) GetState() interface{} {
+	return m.state
+}
+
+func (m *MapStep[A, B]) IsFinished() bool {
+	return m.state == MapStepFinished
+}
+
+// runStep creates a new step with factory, runs it with a and waits for its result.
+//
+// If ctx is cancelled before the step sends its result, the output of the step is drained
+// until Run returns, so that a step blocked on sending its result can finish.
+func runStep[A, B any](ctx context.Context, factory StepFactory[A, B], a A) (B, error) {
+	var zero B
+
+	if ctx.Err() != nil {
+		return zero, ctx.Err()
+	}
+
+	step, err := factory.NewStep()
+	if err != nil {
+		return zero, err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- step.Run(ctx, a)
+	}()
+
+	select {
+	case result, ok := <-step.GetOutput():
+		err = <-done
+		if err != nil {
+			return zero, err
+		}
+		if !ok {
+			return zero, errors.Newf("step closed output channel")
+		}
+		return result.Value()
+
+	case err = <-done:
+		if err != nil {
+			return zero, err
+		}
+		// the step returned, its output is either closed or buffered
+		result, ok := <-step.GetOutput()
+		if !ok {
+			return zero, errors.Newf("step closed output channel")
+		}
+		return result.Value()
+
+	case <-ctx.Done():
+		output := step.GetOutput()
+		for {
+			select {
+			case _, ok := <-output:
+				if !ok {
+					output = nil
+				}
+			case <-done:
+				return zero, ctx.Err()
+			}
+		}
+	}
+}
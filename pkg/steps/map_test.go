@@ -0,0 +1,140 @@
+package steps
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wesen/geppetto/pkg/helpers"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func runMapStep[A, B any](t *testing.T, s *MapStep[A, B], as []A) ([]B, error) {
+	go func() {
+		require.Nil(t, s.Run(context.Background(), as))
+	}()
+	v, ok := <-s.GetOutput()
+	require.True(t, ok)
+	return v.Value()
+}
+
+func TestMapStepPreservesOrder(t *testing.T) {
+	factory := StepFactoryFunc[int, string](func() (Step[int, string], error) {
+		return NewSimpleStep(func(a int) string {
+			// finish the later elements first
+			time.Sleep(time.Duration(10-a) * time.Millisecond)
+			return fmt.Sprintf("%d", a*2)
+		}), nil
+	})
+	s := NewMapStep[int, string](factory, MapStepSettings[string]{})
+
+	values, err := runMapStep(t, s, []int{1, 2, 3, 4, 5})
+	require.Nil(t, err)
+	assert.Equal(t, []string{"2", "4", "6", "8", "10"}, values)
+}
+
+func TestMapStepConcurrencyLimit(t *testing.T) {
+	var running, maxRunning int32
+	factory := StepFactoryFunc[int, int](func() (Step[int, int], error) {
+		return NewSimpleStep(func(a int) int {
+			n := atomic.AddInt32(&running, 1)
+			for {
+				m := atomic.LoadInt32(&maxRunning)
+				if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+					break
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+			atomic.AddInt32(&running, -1)
+			return a
+		}), nil
+	})
+	s := NewMapStep[int, int](factory, MapStepSettings[int]{Concurrency: 2})
+
+	values, err := runMapStep(t, s, []int{1, 2, 3, 4, 5, 6})
+	require.Nil(t, err)
+	assert.Equal(t, []int{1, 2, 3, 4, 5, 6}, values)
+	assert.LessOrEqual(t, maxRunning, int32(2))
+}
+
+func newFailingFactory(failOn int) StepFactory[int, int] {
+	return StepFactoryFunc[int, int](func() (Step[int, int], error) {
+		return NewSimpleResultStep(func(a int) helpers.Result[int] {
+			if a == failOn {
+				return helpers.NewErrorResult[int](fmt.Errorf("failed on %d", a))
+			}
+			return helpers.NewValueResult(a * 10)
+		}), nil
+	})
+}
+
+func TestMapStepFailFast(t *testing.T) {
+	s := NewMapStep[int, int](newFailingFactory(2), MapStepSettings[int]{
+		ErrorPolicy: MapFailFast,
+	})
+
+	_, err := runMapStep(t, s, []int{1, 2, 3})
+	require.NotNil(t, err)
+	assert.Equal(t, "failed on 2", err.Error())
+}
+
+func TestMapStepCollectErrors(t *testing.T) {
+	s := NewMapStep[int, int](newFailingFactory(2), MapStepSettings[int]{
+		ErrorPolicy: MapCollectErrors,
+	})
+
+	values, err := runMapStep(t, s, []int{1, 2, 3})
+	require.NotNil(t, err)
+	mapError, ok := err.(*MapError)
+	require.True(t, ok)
+	assert.Len(t, mapError.Errors, 1)
+	assert.Contains(t, mapError.Errors, 1)
+	assert.Equal(t, []int{10, 0, 30}, values)
+}
+
+func TestMapStepSubstituteDefault(t *testing.T) {
+	s := NewMapStep[int, int](newFailingFactory(2), MapStepSettings[int]{
+		ErrorPolicy: MapSubstituteDefault,
+		Default:     -1,
+	})
+
+	values, err := runMapStep(t, s, []int{1, 2, 3})
+	require.Nil(t, err)
+	assert.Equal(t, []int{10, -1, 30}, values)
+}
+
+func TestMapStepCancelMidFlight(t *testing.T) {
+	release := make(chan struct{})
+	var started int32
+	factory := StepFactoryFunc[int, int](func() (Step[int, int], error) {
+		// the steps ignore the context, and send their result after being cancelled
+		return NewSimpleStep(func(a int) int {
+			atomic.AddInt32(&started, 1)
+			<-release
+			return a
+		}), nil
+	})
+	s := NewMapStep[int, int](factory, MapStepSettings[int]{ErrorPolicy: MapFailFast})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		require.Nil(t, s.Run(ctx, []int{1, 2, 3, 4}))
+	}()
+
+	for atomic.LoadInt32(&started) < 4 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	close(release)
+
+	select {
+	case v := <-s.GetOutput():
+		_, err := v.Value()
+		assert.Equal(t, context.Canceled, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("map step blocked after its context was cancelled")
+	}
+}
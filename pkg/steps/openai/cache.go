@@ -0,0 +1,121 @@
+package openai
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/rs/zerolog/log"
+	"github.com/wesen/geppetto/pkg/backends"
+	"github.com/wesen/geppetto/pkg/cache"
+	"github.com/wesen/geppetto/pkg/recorder"
+)
+
+// cacheRequest is what identifies a completion in the cache. The cache key is its hash.
+type cacheRequest struct {
+	Backend  string                  `json:"backend"`
+	BaseURL  string                  `json:"base_url,omitempty"`
+	Engine   string                  `json:"engine"`
+	Prompt   string                  `json:"prompt"`
+	Settings *CompletionStepSettings `json:"settings"`
+}
+
+// completionCache caches the choices of a completion request, as configured by the client settings.
+// A nil completionCache caches nothing.
+type completionCache struct {
+	settings *cache.Settings
+	store    *cache.Store
+	key      string
+	request  *cacheRequest
+}
+
+// newCompletionCache returns the cache of the completion of prompt, or nil if the completion
+// is not cached. Completions with a non-zero temperature are only cached if the cache settings allow it,
+// the API defaults to a temperature of 1 when none is set.
+func newCompletionCache(
+	clientSettings *ClientSettings,
+	settings *CompletionStepSettings,
+	engine string,
+	prompt string,
+) *completionCache {
+	cs := clientSettings.Cache
+	if cs == nil || (!cs.CanRead() && !cs.CanWrite()) {
+		return nil
+	}
+	if !cs.NonZeroTemperature && (settings.Temperature == nil || *settings.Temperature != 0) {
+		return nil
+	}
+
+	store, err := cs.NewStore()
+	if err != nil {
+		log.Warn().Err(err).Msg("could not open the completion cache")
+		return nil
+	}
+
+	request := &cacheRequest{
+		Backend:  clientSettings.Backend,
+		Engine:   engine,
+		Prompt:   prompt,
+		Settings: settings.Clone(),
+	}
+	if request.Backend == "" {
+		request.Backend = BackendOpenAI
+	}
+	if clientSettings.BaseURL != nil {
+		request.BaseURL = *clientSettings.BaseURL
+	}
+	// streaming doesn't change the completion
+	request.Settings.Stream = false
+
+	key, err := cache.Key(request)
+	if err != nil {
+		log.Warn().Err(err).Msg("could not compute the cache key of the completion")
+		return nil
+	}
+
+	return &completionCache{
+		settings: cs,
+		store:    store,
+		key:      key,
+		request:  request,
+	}
+}
+
+// get returns the cached choices, and false if they are not cached or the cache is not read.
+func (c *completionCache) get(ctx context.Context) ([]backends.CompletionChoice, bool) {
+	if c == nil || !c.settings.CanRead() {
+		return nil, false
+	}
+	entry, err := c.store.Get(c.key, c.settings.TTL)
+	if err != nil {
+		log.Warn().Err(err).Str("key", c.key).Msg("could not read the completion cache")
+		return nil, false
+	}
+	if entry == nil {
+		return nil, false
+	}
+	choices := []backends.CompletionChoice{}
+	err = json.Unmarshal(entry.Value, &choices)
+	if err != nil {
+		log.Warn().Err(err).Str("key", c.key).Msg("could not parse the cached completion")
+		return nil, false
+	}
+
+	log.Debug().Str("key", c.key).Time("created", entry.Created).Msg("using cached completion")
+	rec := recorder.CurrentStep(ctx)
+	rec.SetMetadata("engine", c.request.Engine)
+	rec.SetMetadata("cache_key", c.key)
+	rec.SetMetadata("cached", true)
+	return choices, true
+}
+
+// put caches the choices, if the cache is written.
+func (c *completionCache) put(ctx context.Context, choices []backends.CompletionChoice) {
+	if c == nil || !c.settings.CanWrite() {
+		return
+	}
+	err := c.store.Put(c.key, c.request, choices)
+	if err != nil {
+		log.Warn().Err(err).Str("key", c.key).Msg("could not write the completion cache")
+		return
+	}
+	recorder.CurrentStep(ctx).SetMetadata("cache_key", c.key)
+}
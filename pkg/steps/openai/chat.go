@@ -0,0 +1,243 @@
+package openai
+
+import (
+	"context"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"github.com/wesen/geppetto/pkg/backends"
+	"github.com/wesen/geppetto/pkg/helpers"
+	"github.com/wesen/geppetto/pkg/recorder"
+	"github.com/wesen/geppetto/pkg/tokenizer"
+	"github.com/wesen/geppetto/pkg/usage"
+	"gopkg.in/errgo.v2/fmt/errors"
+	"sort"
+)
+
+const (
+	ChatMessageRoleSystem    = "system"
+	ChatMessageRoleUser      = "user"
+	ChatMessageRoleAssistant = "assistant"
+)
+
+type ChatMessage struct {
+	Role    string `json:"role" yaml:"role"`
+	Content string `json:"content" yaml:"content"`
+}
+
+// RepromptChat asks a chat model to correct its previous answer, see steps.OutputStep.
+func RepromptChat(messages []ChatMessage, output string, err error) []ChatMessage {
+	ret := append([]ChatMessage{}, messages...)
+	return append(ret,
+		ChatMessage{Role: ChatMessageRoleAssistant, Content: output},
+		ChatMessage{
+			Role:    ChatMessageRoleUser,
+			Content: fmt.Sprintf("Your answer is invalid: %s\nPlease answer again with a corrected output.", err),
+		},
+	)
+}
+
+// ChatCompletionStep sends a list of messages to the chat completion API, and returns the
+// content of the answer.
+type ChatCompletionStep struct {
+	output       chan helpers.Result[string]
+	deltas       chan *backends.ChatResponse
+	state        CompletionStepState
+	settings     *ChatCompletionStepSettings
+	finishReason string
+	choices      []string
+}
+
+func NewChatCompletionStep(settings *ChatCompletionStepSettings) *ChatCompletionStep {
+	return &ChatCompletionStep{
+		output:   make(chan helpers.Result[string]),
+		deltas:   make(chan *backends.ChatResponse),
+		settings: settings,
+		state:    CompletionStepNotStarted,
+	}
+}
+
+// Run sends the messages to the chat completion API. If the settings have Stream enabled,
+// each chunk returned by the API is forwarded on GetDeltaOutput() as it arrives.
+func (c *ChatCompletionStep) Run(ctx context.Context, messages []ChatMessage) error {
+	c.state = CompletionStepRunning
+
+	ctx, rec := recorder.StartStep(ctx, "chat", messages)
+	recordChatSettings(rec, c.settings)
+	completion, err := c.complete(ctx, messages)
+	if c.finishReason != "" {
+		rec.SetMetadata("finish_reason", c.finishReason)
+	}
+	rec.Finish(completion, err)
+	close(c.deltas)
+	c.state = CompletionStepFinished
+
+	defer func() {
+		c.state = CompletionStepClosed
+		close(c.output)
+	}()
+
+	c.output <- helpers.NewResult(completion, err)
+
+	return nil
+}
+
+func (c *ChatCompletionStep) complete(ctx context.Context, messages []ChatMessage) (string, error) {
+	clientSettings := c.settings.ClientSettings
+	if clientSettings == nil {
+		return "", ErrMissingClientSettings
+	}
+
+	backend, err := clientSettings.CreateBackend()
+	if err != nil {
+		return "", err
+	}
+
+	engine := ""
+	if c.settings.Engine != nil {
+		engine = *c.settings.Engine
+	} else if clientSettings.DefaultEngine != nil {
+		engine = *clientSettings.DefaultEngine
+	} else {
+		return "", errors.Newf("no engine specified")
+	}
+
+	evt := log.Debug()
+	evt = evt.Str("backend", clientSettings.Backend)
+	evt = evt.Str("engine", engine)
+	if c.settings.MaxResponseTokens != nil {
+		evt = evt.Int("max_response_tokens", *c.settings.MaxResponseTokens)
+	}
+	if c.settings.Temperature != nil {
+		evt = evt.Float32("temperature", *c.settings.Temperature)
+	}
+	if c.settings.TopP != nil {
+		evt = evt.Float32("top_p", *c.settings.TopP)
+	}
+	if c.settings.N != nil {
+		evt = evt.Int("n", *c.settings.N)
+	}
+	if c.settings.Stop != nil {
+		evt = evt.Strs("stop", c.settings.Stop)
+	}
+	evt = evt.Bool("stream", c.settings.Stream)
+	evt.Int("messages", len(messages))
+	evt.Msg("sending chat completion request")
+
+	request := &backends.ChatRequest{
+		Model:       engine,
+		Messages:    make([]backends.ChatMessage, 0, len(messages)),
+		MaxTokens:   c.settings.MaxResponseTokens,
+		Temperature: c.settings.Temperature,
+		TopP:        c.settings.TopP,
+		N:           c.settings.N,
+		Stop:        c.settings.Stop,
+	}
+	for _, message := range messages {
+		request.Messages = append(request.Messages, backends.ChatMessage(message))
+	}
+
+	if !c.settings.Stream {
+		resp, err := backend.Chat(ctx, request)
+		if err != nil {
+			return "", err
+		}
+		addUsage(ctx, clientSettings, usage.Usage{
+			Model:            engine,
+			PromptTokens:     resp.Usage.PromptTokens,
+			CompletionTokens: resp.Usage.CompletionTokens,
+		})
+		if len(resp.Choices) == 0 {
+			return "", errors.Newf("no choices returned from backend")
+		}
+		sort.Slice(resp.Choices, func(i, j int) bool {
+			return resp.Choices[i].Index < resp.Choices[j].Index
+		})
+		for _, choice := range resp.Choices {
+			c.choices = append(c.choices, choice.Message.Content)
+		}
+		c.finishReason = resp.Choices[0].FinishReason
+		return c.choices[0], nil
+	}
+
+	// the chunks of the different answers are interleaved when N > 1
+	answers := map[int]string{}
+	onData := func(resp *backends.ChatResponse) {
+		for _, choice := range resp.Choices {
+			answers[choice.Index] += choice.Message.Content
+			if choice.Index == 0 && choice.FinishReason != "" {
+				c.finishReason = choice.FinishReason
+			}
+		}
+		if len(resp.Choices) == 0 {
+			return
+		}
+
+		select {
+		case c.deltas <- resp:
+		case <-ctx.Done():
+		}
+	}
+
+	err = backend.ChatStream(ctx, request, onData)
+	if err != nil {
+		return "", err
+	}
+
+	indexes := make([]int, 0, len(answers))
+	for index := range answers {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+	allAnswers := ""
+	for _, index := range indexes {
+		c.choices = append(c.choices, answers[index])
+		allAnswers += answers[index]
+	}
+	completion := answers[0]
+
+	if shouldCountUsage(ctx, clientSettings) {
+		// the streaming API doesn't return the usage, so we count the tokens ourselves.
+		// Each message is wrapped in 3 tokens, and the reply is primed with 3 more.
+		prompt := ""
+		for _, message := range messages {
+			prompt += message.Content
+		}
+		t := tokenizer.ForModel(engine)
+		addUsage(ctx, clientSettings, usage.Usage{
+			Model:            engine,
+			PromptTokens:     t.Count(prompt) + 3*len(messages) + 3,
+			CompletionTokens: t.Count(allAnswers),
+			Estimated:        true,
+		})
+	}
+
+	return completion, nil
+}
+
+func (c *ChatCompletionStep) GetOutput() <-chan helpers.Result[string] {
+	return c.output
+}
+
+// GetDeltaOutput returns the chunks received from the API when streaming is enabled.
+func (c *ChatCompletionStep) GetDeltaOutput() <-chan *backends.ChatResponse {
+	return c.deltas
+}
+
+// Choices returns the content of all the N answers ordered by index, once the output has been received.
+// The output of the step is the first answer.
+func (c *ChatCompletionStep) Choices() []string {
+	return c.choices
+}
+
+// FinishReason returns why the model stopped answering (stop, length, ...), once the output has been received.
+func (c *ChatCompletionStep) FinishReason() string {
+	return c.finishReason
+}
+
+func (c *ChatCompletionStep) GetState() interface{} {
+	return c.state
+}
+
+func (c *ChatCompletionStep) IsFinished() bool {
+	return c.state == CompletionStepFinished
+}
@@ -0,0 +1,265 @@
+package openai
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/wesen/geppetto/pkg/steps"
+	"gopkg.in/yaml.v3"
+	"io"
+)
+
+const DefaultChatEngine = "gpt-3.5-turbo"
+
+type ChatCompletionStepSettings struct {
+	ClientSettings *ClientSettings `yaml:"client,omitempty" json:"-"`
+
+	Engine *string `yaml:"engine,omitempty" json:"engine,omitempty"`
+
+	MaxResponseTokens *int `yaml:"max_response_tokens,omitempty" json:"max_response_tokens,omitempty"`
+
+	// Sampling temperature to use
+	Temperature *float32 `yaml:"temperature,omitempty" json:"temperature,omitempty"`
+	// Alternative to temperature for nucleus sampling
+	TopP *float32 `yaml:"top_p,omitempty" json:"top_p,omitempty"`
+	// How many answers to generate for the messages
+	N *int `yaml:"n,omitempty" json:"n,omitempty"`
+	// Up to 4 sequences where the API will stop generating tokens. Response will not contain the stop sequence.
+	Stop []string `yaml:"stop,omitempty" json:"stop,omitempty"`
+
+	Stream bool `yaml:"stream,omitempty" json:"stream,omitempty"`
+}
+
+func (c *ChatCompletionStepSettings) Clone() *ChatCompletionStepSettings {
+	var clientSettings *ClientSettings = nil
+	if c.ClientSettings != nil {
+		clientSettings = c.ClientSettings.Clone()
+	}
+	return &ChatCompletionStepSettings{
+		ClientSettings:    clientSettings,
+		Engine:            c.Engine,
+		MaxResponseTokens: c.MaxResponseTokens,
+		Temperature:       c.Temperature,
+		TopP:              c.TopP,
+		N:                 c.N,
+		Stop:              c.Stop,
+		Stream:            c.Stream,
+	}
+}
+
+func NewChatCompletionStepSettings() *ChatCompletionStepSettings {
+	engine := DefaultChatEngine
+	return &ChatCompletionStepSettings{
+		Engine: &engine,
+	}
+}
+
+type ChatCompletionStepFactory struct {
+	ClientSettings *ClientSettings             `yaml:"client,omitempty"`
+	StepSettings   *ChatCompletionStepSettings `yaml:"chat,omitempty"`
+	flagsDefaults  *ChatCompletionStepFactoryFlagsDefaults
+	flagsPrefix    string
+}
+
+func NewChatCompletionStepFactory(
+	settings *ChatCompletionStepSettings,
+	clientSettings *ClientSettings,
+) *ChatCompletionStepFactory {
+	return &ChatCompletionStepFactory{
+		StepSettings:   settings,
+		ClientSettings: clientSettings,
+	}
+}
+
+func (ccsf *ChatCompletionStepFactory) NewStepSettings() *ChatCompletionStepSettings {
+	stepSettings := ccsf.StepSettings.Clone()
+	if stepSettings.ClientSettings == nil {
+		stepSettings.ClientSettings = ccsf.ClientSettings.Clone()
+	}
+	return stepSettings
+}
+
+func (ccsf *ChatCompletionStepFactory) NewStep() (steps.Step[[]ChatMessage, string], error) {
+	return NewChatCompletionStep(ccsf.NewStepSettings()), nil
+}
+
+type ChatCompletionStepFactoryFlagsDefaults struct {
+	Engine            *string
+	MaxResponseTokens *int
+	Temperature       *float32
+	TopP              *float32
+	N                 *int
+	Stop              *[]string
+	Stream            *bool
+}
+
+func (ccsf *ChatCompletionStepFactory) AddFlags(cmd *cobra.Command, prefix string, defaults interface{}) error {
+	ccsfDefaults, ok := defaults.(*ChatCompletionStepFactoryFlagsDefaults)
+	if !ok || ccsfDefaults == nil {
+		return fmt.Errorf("defaults are not of type *ChatCompletionStepFactoryFlagsDefaults")
+	}
+
+	ccsf.flagsDefaults = ccsfDefaults
+
+	defaultEngine := DefaultChatEngine
+	if ccsfDefaults.Engine != nil {
+		defaultEngine = *ccsfDefaults.Engine
+	}
+	cmd.PersistentFlags().String(prefix+"engine", defaultEngine, "OpenAI chat engine to use")
+
+	defaultMaxResponseTokens := 0
+	if ccsfDefaults.MaxResponseTokens != nil {
+		defaultMaxResponseTokens = *ccsfDefaults.MaxResponseTokens
+	}
+	cmd.PersistentFlags().Int(prefix+"max-response-tokens", defaultMaxResponseTokens, "Maximum number of tokens to return")
+
+	defaultTemperature := float32(0.7)
+	if ccsfDefaults.Temperature != nil {
+		defaultTemperature = *ccsfDefaults.Temperature
+	}
+	cmd.PersistentFlags().Float32(prefix+"temperature", defaultTemperature, "Sampling temperature to use")
+
+	defaultTopP := float32(0.0)
+	if ccsfDefaults.TopP != nil {
+		defaultTopP = *ccsfDefaults.TopP
+	}
+	cmd.PersistentFlags().Float32(prefix+"top-p", defaultTopP, "Alternative to temperature for nucleus sampling")
+
+	defaultN := 1
+	if ccsfDefaults.N != nil {
+		defaultN = *ccsfDefaults.N
+	}
+	cmd.PersistentFlags().Int(prefix+"n", defaultN, "How many answers to generate for the messages")
+
+	defaultStop := []string{}
+	if ccsfDefaults.Stop != nil {
+		defaultStop = *ccsfDefaults.Stop
+	}
+	cmd.PersistentFlags().StringSlice(prefix+"stop", defaultStop, "Up to 4 sequences where the API will stop generating tokens. Response will not contain the stop sequence.")
+
+	defaultStream := false
+	if ccsfDefaults.Stream != nil {
+		defaultStream = *ccsfDefaults.Stream
+	}
+	cmd.PersistentFlags().Bool(prefix+"stream", defaultStream, "Stream the response")
+
+	ccsf.flagsPrefix = prefix
+
+	return nil
+}
+
+func (ccsf *ChatCompletionStepFactory) UpdateFromCobra(cmd *cobra.Command) error {
+	prefix := ccsf.flagsPrefix
+	apiKey := viper.GetString(prefix + "api-key")
+	if apiKey != "" {
+		ccsf.ClientSettings.APIKey = &apiKey
+	}
+	err := ccsf.ClientSettings.UpdateRetryFromCobra(cmd)
+	if err != nil {
+		return err
+	}
+	err = ccsf.ClientSettings.UpdateLimiterFromCobra(cmd)
+	if err != nil {
+		return err
+	}
+
+	if cmd.Flags().Changed(prefix+"engine") || ccsf.flagsDefaults.Engine != nil {
+		engine := cmd.Flag(prefix + "engine").Value.String()
+		ccsf.StepSettings.Engine = &engine
+	}
+	if cmd.Flags().Changed(prefix+"max-response-tokens") || ccsf.flagsDefaults.MaxResponseTokens != nil {
+		maxResponseTokens, err := cmd.PersistentFlags().GetInt(prefix + "max-response-tokens")
+		if err != nil {
+			return err
+		}
+		ccsf.StepSettings.MaxResponseTokens = &maxResponseTokens
+	}
+	if cmd.Flags().Changed(prefix+"temperature") || ccsf.flagsDefaults.Temperature != nil {
+		temperature, err := cmd.PersistentFlags().GetFloat32(prefix + "temperature")
+		if err != nil {
+			return err
+		}
+		ccsf.StepSettings.Temperature = &temperature
+	}
+	if cmd.Flags().Changed(prefix+"top-p") || ccsf.flagsDefaults.TopP != nil {
+		topP, err := cmd.PersistentFlags().GetFloat32(prefix + "top-p")
+		if err != nil {
+			return err
+		}
+		ccsf.StepSettings.TopP = &topP
+	}
+	if cmd.Flags().Changed(prefix+"n") || ccsf.flagsDefaults.N != nil {
+		n, err := cmd.PersistentFlags().GetInt(prefix + "n")
+		if err != nil {
+			return err
+		}
+		ccsf.StepSettings.N = &n
+	}
+	if cmd.Flags().Changed(prefix+"stop") || ccsf.flagsDefaults.Stop != nil {
+		stop, err := cmd.PersistentFlags().GetStringSlice(prefix + "stop")
+		if err != nil {
+			return err
+		}
+		ccsf.StepSettings.Stop = stop
+	}
+	if cmd.Flags().Changed(prefix+"stream") || ccsf.flagsDefaults.Stream != nil {
+		stream, err := cmd.PersistentFlags().GetBool(prefix + "stream")
+		if err != nil {
+			return err
+		}
+		ccsf.StepSettings.Stream = stream
+	}
+
+	return nil
+}
+
+// chatFactoryConfigFileWrapper parses the chat factory out of a YAML file in the format:
+//
+//	factories:
+//	  openai-chat:
+//	    client:
+//	      timeout: 120
+//	    chat:
+//	      engine: gpt-3.5-turbo
+//	      temperature: 0.7
+//
+// The openai-compatible-chat key selects a server implementing the OpenAI REST API at client.base_url.
+type chatFactoryConfigFileWrapper struct {
+	Factories struct {
+		OpenAIChat           *ChatCompletionStepFactory `yaml:"openai-chat"`
+		OpenAICompatibleChat *ChatCompletionStepFactory `yaml:"openai-compatible-chat"`
+	} `yaml:"factories"`
+}
+
+func NewChatCompletionStepFactoryFromYAML(s io.Reader) (*ChatCompletionStepFactory, error) {
+	var settings chatFactoryConfigFileWrapper
+	if err := yaml.NewDecoder(s).Decode(&settings); err != nil {
+		return nil, err
+	}
+
+	factory := settings.Factories.OpenAIChat
+	backend := BackendOpenAI
+	if settings.Factories.OpenAICompatibleChat != nil {
+		if factory != nil {
+			return nil, fmt.Errorf("only one of the openai-chat and openai-compatible-chat factories can be declared")
+		}
+		factory = settings.Factories.OpenAICompatibleChat
+		backend = BackendOpenAICompatible
+	}
+
+	if factory == nil {
+		factory = NewChatCompletionStepFactory(NewChatCompletionStepSettings(), NewClientSettings())
+	}
+	if factory.StepSettings == nil {
+		factory.StepSettings = NewChatCompletionStepSettings()
+	}
+	if factory.ClientSettings == nil {
+		factory.ClientSettings = NewClientSettings()
+	}
+	factory.ClientSettings.Backend = backend
+
+	return NewChatCompletionStepFactory(
+		factory.StepSettings,
+		factory.ClientSettings,
+	), nil
+}
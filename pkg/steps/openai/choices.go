@@ -0,0 +1,111 @@
+package openai
+
+import (
+	"context"
+	"github.com/wesen/geppetto/pkg/backends"
+	"github.com/wesen/geppetto/pkg/helpers"
+	"github.com/wesen/geppetto/pkg/recorder"
+	"sort"
+)
+
+// completionChoices accumulates the choices of one or more (streamed) responses, keyed by choice index.
+type completionChoices struct {
+	choices map[int]*backends.CompletionChoice
+}
+
+func newCompletionChoices() *completionChoices {
+	return &completionChoices{
+		choices: map[int]*backends.CompletionChoice{},
+	}
+}
+
+func (c *completionChoices) addResponse(resp *backends.CompletionResponse) {
+	for _, choice := range resp.Choices {
+		current, ok := c.choices[choice.Index]
+		if !ok {
+			current = &backends.CompletionChoice{Index: choice.Index}
+			c.choices[choice.Index] = current
+		}
+		current.Text += choice.Text
+		if choice.FinishReason != "" {
+			current.FinishReason = choice.FinishReason
+		}
+
+		if choice.LogProbs != nil {
+			if current.LogProbs == nil {
+				current.LogProbs = &backends.LogProbs{}
+			}
+			current.LogProbs.Tokens = append(current.LogProbs.Tokens, choice.LogProbs.Tokens...)
+			current.LogProbs.TokenLogProbs = append(current.LogProbs.TokenLogProbs, choice.LogProbs.TokenLogProbs...)
+			current.LogProbs.TopLogProbs = append(current.LogProbs.TopLogProbs, choice.LogProbs.TopLogProbs...)
+			current.LogProbs.TextOffset = append(current.LogProbs.TextOffset, choice.LogProbs.TextOffset...)
+		}
+	}
+}
+
+func (c *completionChoices) toSlice() []backends.CompletionChoice {
+	ret := make([]backends.CompletionChoice, 0, len(c.choices))
+	for _, choice := range c.choices {
+		ret = append(ret, *choice)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Index < ret[j].Index
+	})
+	return ret
+}
+
+// CompletionChoicesStep sends a prompt to the completion API and returns all the N choices,
+// ordered by choice index.
+type CompletionChoicesStep struct {
+	output   chan helpers.Result[[]backends.CompletionChoice]
+	deltas   chan *backends.CompletionResponse
+	state    CompletionStepState
+	settings *CompletionStepSettings
+}
+
+func NewCompletionChoicesStep(settings *CompletionStepSettings) *CompletionChoicesStep {
+	return &CompletionChoicesStep{
+		output:   make(chan helpers.Result[[]backends.CompletionChoice]),
+		deltas:   make(chan *backends.CompletionResponse),
+		settings: settings,
+		state:    CompletionStepNotStarted,
+	}
+}
+
+func (c *CompletionChoicesStep) Run(ctx context.Context, prompt string) error {
+	c.state = CompletionStepRunning
+
+	ctx, rec := recorder.StartStep(ctx, "completion-choices", prompt)
+	recordCompletionSettings(rec, c.settings)
+	choices, err := complete(ctx, c.settings, prompt, c.deltas)
+	rec.Finish(choices, err)
+	close(c.deltas)
+	c.state = CompletionStepFinished
+
+	defer func() {
+		c.state = CompletionStepClosed
+		close(c.output)
+	}()
+
+	c.output <- helpers.NewResult(choices, err)
+
+	return nil
+}
+
+func (c *CompletionChoicesStep) GetOutput() <-chan helpers.Result[[]backends.CompletionChoice] {
+	return c.output
+}
+
+// GetDeltaOutput returns the chunks received from the API when streaming is enabled.
+// The chunks of the different choices are interleaved, use the choice index to tell them apart.
+func (c *CompletionChoicesStep) GetDeltaOutput() <-chan *backends.CompletionResponse {
+	return c.deltas
+}
+
+func (c *CompletionChoicesStep) GetState() interface{} {
+	return c.state
+}
+
+func (c *CompletionChoicesStep) IsFinished() bool {
+	return c.state == CompletionStepFinished
+}
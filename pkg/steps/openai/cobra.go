@@ -4,6 +4,8 @@ import (
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"github.com/wesen/geppetto/pkg/backends"
+	"github.com/wesen/geppetto/pkg/cache"
 	"time"
 )
 
@@ -51,6 +53,106 @@ func NewClientSettingsFromCobra(cmd *cobra.Command) (*ClientSettings, error) {
 	if defaultEngine != "" {
 		clientSettings.DefaultEngine = &defaultEngine
 	}
+	err = clientSettings.UpdateRetryFromCobra(cmd)
+	if err != nil {
+		return nil, err
+	}
+	err = clientSettings.UpdateLimiterFromCobra(cmd)
+	if err != nil {
+		return nil, err
+	}
+	err = clientSettings.UpdateCacheFromCobra(cmd)
+	if err != nil {
+		return nil, err
+	}
 
 	return clientSettings, nil
 }
+
+// UpdateRetryFromCobra enables retries if the max-retries flag was set on the command line.
+func (c *ClientSettings) UpdateRetryFromCobra(cmd *cobra.Command) error {
+	if cmd.Flags().Lookup("max-retries") == nil || !cmd.Flags().Changed("max-retries") {
+		return nil
+	}
+	maxRetries, err := cmd.Flags().GetInt("max-retries")
+	if err != nil {
+		return err
+	}
+	if c.Retry == nil {
+		c.Retry = backends.NewRetrySettings()
+	}
+	c.Retry.MaxRetries = maxRetries
+	return nil
+}
+
+// UpdateLimiterFromCobra replaces the Limiter if any of the rate limiting flags was set on the command line.
+func (c *ClientSettings) UpdateLimiterFromCobra(cmd *cobra.Command) error {
+	settings := backends.LimiterSettings{}
+	if c.RateLimit != nil {
+		settings = *c.RateLimit
+	}
+
+	changed := false
+	for flag, value := range map[string]*int{
+		"requests-per-minute": &settings.RequestsPerMinute,
+		"tokens-per-minute":   &settings.TokensPerMinute,
+		"max-in-flight":       &settings.MaxInFlight,
+	} {
+		if cmd.Flags().Lookup(flag) == nil || !cmd.Flags().Changed(flag) {
+			continue
+		}
+		v, err := cmd.Flags().GetInt(flag)
+		if err != nil {
+			return err
+		}
+		*value = v
+		changed = true
+	}
+
+	if changed {
+		c.RateLimit = &settings
+		c.Limiter = backends.NewLimiter(settings)
+	}
+	return nil
+}
+
+// UpdateCacheFromCobra updates the cache settings with the cache flags that were set on the command line.
+func (c *ClientSettings) UpdateCacheFromCobra(cmd *cobra.Command) error {
+	changed := func(flag string) bool {
+		return cmd.Flags().Lookup(flag) != nil && cmd.Flags().Changed(flag)
+	}
+	if !changed("cache") && !changed("cache-ttl") && !changed("cache-non-zero-temperature") {
+		return nil
+	}
+
+	settings := &cache.Settings{}
+	if c.Cache != nil {
+		settings = c.Cache.Clone()
+	}
+	if changed("cache") {
+		s, err := cmd.Flags().GetString("cache")
+		if err != nil {
+			return err
+		}
+		settings.Mode, err = cache.ParseMode(s)
+		if err != nil {
+			return err
+		}
+	}
+	if changed("cache-ttl") {
+		ttl, err := cmd.Flags().GetDuration("cache-ttl")
+		if err != nil {
+			return err
+		}
+		settings.TTL = ttl
+	}
+	if changed("cache-non-zero-temperature") {
+		nonZeroTemperature, err := cmd.Flags().GetBool("cache-non-zero-temperature")
+		if err != nil {
+			return err
+		}
+		settings.NonZeroTemperature = nonZeroTemperature
+	}
+	c.Cache = settings
+	return nil
+}
@@ -0,0 +1,135 @@
+package openai
+
+import (
+	"context"
+	"github.com/rs/zerolog/log"
+	"github.com/wesen/geppetto/pkg/backends"
+	"github.com/wesen/geppetto/pkg/helpers"
+	"github.com/wesen/geppetto/pkg/recorder"
+	"github.com/wesen/geppetto/pkg/usage"
+	"gopkg.in/errgo.v2/fmt/errors"
+	"sort"
+)
+
+// EditInput is the text to edit, and the instruction telling the model how to edit it.
+type EditInput struct {
+	Input       string `json:"input"`
+	Instruction string `json:"instruction"`
+}
+
+type EditStepState int
+
+const (
+	EditStepNotStarted EditStepState = iota
+	EditStepRunning
+	EditStepFinished
+	EditStepClosed
+)
+
+// EditStep sends a text and an instruction to the edits API, and returns the N edited texts,
+// ordered by choice index.
+type EditStep struct {
+	output   chan helpers.Result[[]backends.EditChoice]
+	state    EditStepState
+	settings *EditStepSettings
+}
+
+func NewEditStep(settings *EditStepSettings) *EditStep {
+	return &EditStep{
+		output:   make(chan helpers.Result[[]backends.EditChoice]),
+		settings: settings,
+		state:    EditStepNotStarted,
+	}
+}
+
+func (e *EditStep) Run(ctx context.Context, input EditInput) error {
+	e.state = EditStepRunning
+
+	ctx, rec := recorder.StartStep(ctx, "edit", input)
+	recordEditSettings(rec, e.settings)
+	choices, err := e.edit(ctx, input)
+	rec.Finish(choices, err)
+	e.state = EditStepFinished
+
+	defer func() {
+		e.state = EditStepClosed
+		close(e.output)
+	}()
+
+	e.output <- helpers.NewResult(choices, err)
+
+	return nil
+}
+
+func (e *EditStep) edit(ctx context.Context, input EditInput) ([]backends.EditChoice, error) {
+	clientSettings := e.settings.ClientSettings
+	if clientSettings == nil {
+		return nil, ErrMissingClientSettings
+	}
+
+	backend, err := clientSettings.CreateBackend()
+	if err != nil {
+		return nil, err
+	}
+
+	engine := ""
+	if e.settings.Engine != nil {
+		engine = *e.settings.Engine
+	} else if clientSettings.DefaultEngine != nil {
+		engine = *clientSettings.DefaultEngine
+	} else {
+		return nil, errors.Newf("no engine specified")
+	}
+
+	evt := log.Debug().
+		Str("backend", clientSettings.Backend).
+		Str("engine", engine)
+	if e.settings.Temperature != nil {
+		evt = evt.Float32("temperature", *e.settings.Temperature)
+	}
+	if e.settings.TopP != nil {
+		evt = evt.Float32("top_p", *e.settings.TopP)
+	}
+	if e.settings.N != nil {
+		evt = evt.Int("n", *e.settings.N)
+	}
+	evt.Str("instruction", input.Instruction).Msg("sending edit request")
+
+	resp, err := backend.Edit(ctx, &backends.EditRequest{
+		Model:       engine,
+		Input:       input.Input,
+		Instruction: input.Instruction,
+		Temperature: e.settings.Temperature,
+		TopP:        e.settings.TopP,
+		N:           e.settings.N,
+	})
+	if err != nil {
+		return nil, err
+	}
+	addUsage(ctx, clientSettings, usage.Usage{
+		Model:            engine,
+		PromptTokens:     resp.Usage.PromptTokens,
+		CompletionTokens: resp.Usage.CompletionTokens,
+	})
+
+	if len(resp.Choices) == 0 {
+		return nil, errors.Newf("no choices returned from backend")
+	}
+	choices := resp.Choices
+	sort.Slice(choices, func(i, j int) bool {
+		return choices[i].Index < choices[j].Index
+	})
+	return choices, nil
+}
+
+func (e *EditStep) GetOutput() <-chan helpers.Result[[]backends.EditChoice] {
+	return e.output
+}
+
+func (e *EditStep) GetState() interface{} {
+	return e.state
+}
+
+func (e *EditStep) IsFinished() bool {
+	return e.state == EditStepFinished
+}
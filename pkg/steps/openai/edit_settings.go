@@ -0,0 +1,215 @@
+package openai
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/wesen/geppetto/pkg/backends"
+	"github.com/wesen/geppetto/pkg/steps"
+	"gopkg.in/yaml.v3"
+	"io"
+)
+
+const DefaultEditEngine = "text-davinci-edit-001"
+
+type EditStepSettings struct {
+	ClientSettings *ClientSettings `yaml:"client,omitempty" json:"-"`
+
+	Engine *string `yaml:"engine,omitempty" json:"engine,omitempty"`
+
+	// Sampling temperature to use
+	Temperature *float32 `yaml:"temperature,omitempty" json:"temperature,omitempty"`
+	// Alternative to temperature for nucleus sampling
+	TopP *float32 `yaml:"top_p,omitempty" json:"top_p,omitempty"`
+	// How many edits to create for the input
+	N *int `yaml:"n,omitempty" json:"n,omitempty"`
+}
+
+func (e *EditStepSettings) Clone() *EditStepSettings {
+	var clientSettings *ClientSettings = nil
+	if e.ClientSettings != nil {
+		clientSettings = e.ClientSettings.Clone()
+	}
+	return &EditStepSettings{
+		ClientSettings: clientSettings,
+		Engine:         e.Engine,
+		Temperature:    e.Temperature,
+		TopP:           e.TopP,
+		N:              e.N,
+	}
+}
+
+func NewEditStepSettings() *EditStepSettings {
+	engine := DefaultEditEngine
+	return &EditStepSettings{
+		Engine: &engine,
+	}
+}
+
+type EditStepFactory struct {
+	ClientSettings *ClientSettings   `yaml:"client,omitempty"`
+	StepSettings   *EditStepSettings `yaml:"edit,omitempty"`
+	flagsDefaults  *EditStepFactoryFlagsDefaults
+	flagsPrefix    string
+}
+
+func NewEditStepFactory(
+	settings *EditStepSettings,
+	clientSettings *ClientSettings,
+) *EditStepFactory {
+	return &EditStepFactory{
+		StepSettings:   settings,
+		ClientSettings: clientSettings,
+	}
+}
+
+func (esf *EditStepFactory) NewStepSettings() *EditStepSettings {
+	stepSettings := esf.StepSettings.Clone()
+	if stepSettings.ClientSettings == nil {
+		stepSettings.ClientSettings = esf.ClientSettings.Clone()
+	}
+	return stepSettings
+}
+
+func (esf *EditStepFactory) NewStep() (steps.Step[EditInput, []backends.EditChoice], error) {
+	return NewEditStep(esf.NewStepSettings()), nil
+}
+
+type EditStepFactoryFlagsDefaults struct {
+	Engine      *string
+	Temperature *float32
+	TopP        *float32
+	N           *int
+}
+
+func (esf *EditStepFactory) AddFlags(cmd *cobra.Command, prefix string, defaults interface{}) error {
+	esfDefaults, ok := defaults.(*EditStepFactoryFlagsDefaults)
+	if !ok || esfDefaults == nil {
+		return fmt.Errorf("defaults are not of type *EditStepFactoryFlagsDefaults")
+	}
+
+	esf.flagsDefaults = esfDefaults
+
+	defaultEngine := DefaultEditEngine
+	if esfDefaults.Engine != nil {
+		defaultEngine = *esfDefaults.Engine
+	}
+	cmd.PersistentFlags().String(prefix+"engine", defaultEngine, "OpenAI edit engine to use")
+
+	defaultTemperature := float32(0.7)
+	if esfDefaults.Temperature != nil {
+		defaultTemperature = *esfDefaults.Temperature
+	}
+	cmd.PersistentFlags().Float32(prefix+"temperature", defaultTemperature, "Sampling temperature to use")
+
+	defaultTopP := float32(0.0)
+	if esfDefaults.TopP != nil {
+		defaultTopP = *esfDefaults.TopP
+	}
+	cmd.PersistentFlags().Float32(prefix+"top-p", defaultTopP, "Alternative to temperature for nucleus sampling")
+
+	defaultN := 1
+	if esfDefaults.N != nil {
+		defaultN = *esfDefaults.N
+	}
+	cmd.PersistentFlags().Int(prefix+"n", defaultN, "How many edits to create for the input")
+
+	esf.flagsPrefix = prefix
+
+	return nil
+}
+
+func (esf *EditStepFactory) UpdateFromCobra(cmd *cobra.Command) error {
+	prefix := esf.flagsPrefix
+	apiKey := viper.GetString(prefix + "api-key")
+	if apiKey != "" {
+		esf.ClientSettings.APIKey = &apiKey
+	}
+	err := esf.ClientSettings.UpdateRetryFromCobra(cmd)
+	if err != nil {
+		return err
+	}
+	err = esf.ClientSettings.UpdateLimiterFromCobra(cmd)
+	if err != nil {
+		return err
+	}
+
+	if cmd.Flags().Changed(prefix+"engine") || esf.flagsDefaults.Engine != nil {
+		engine := cmd.Flag(prefix + "engine").Value.String()
+		esf.StepSettings.Engine = &engine
+	}
+	if cmd.Flags().Changed(prefix+"temperature") || esf.flagsDefaults.Temperature != nil {
+		temperature, err := cmd.PersistentFlags().GetFloat32(prefix + "temperature")
+		if err != nil {
+			return err
+		}
+		esf.StepSettings.Temperature = &temperature
+	}
+	if cmd.Flags().Changed(prefix+"top-p") || esf.flagsDefaults.TopP != nil {
+		topP, err := cmd.PersistentFlags().GetFloat32(prefix + "top-p")
+		if err != nil {
+			return err
+		}
+		esf.StepSettings.TopP = &topP
+	}
+	if cmd.Flags().Changed(prefix+"n") || esf.flagsDefaults.N != nil {
+		n, err := cmd.PersistentFlags().GetInt(prefix + "n")
+		if err != nil {
+			return err
+		}
+		esf.StepSettings.N = &n
+	}
+
+	return nil
+}
+
+// editFactoryConfigFileWrapper parses the edit factory out of a YAML file in the format:
+//
+//	factories:
+//	  openai:
+//	    client:
+//	      timeout: 120
+//	    edit:
+//	      engine: text-davinci-edit-001
+//	      temperature: 0
+//
+// The openai-compatible key selects a server implementing the OpenAI REST API at client.base_url.
+type editFactoryConfigFileWrapper struct {
+	Factories struct {
+		OpenAI           *EditStepFactory `yaml:"openai"`
+		OpenAICompatible *EditStepFactory `yaml:"openai-compatible"`
+	} `yaml:"factories"`
+}
+
+func NewEditStepFactoryFromYAML(s io.Reader) (*EditStepFactory, error) {
+	var settings editFactoryConfigFileWrapper
+	if err := yaml.NewDecoder(s).Decode(&settings); err != nil {
+		return nil, err
+	}
+
+	factory := settings.Factories.OpenAI
+	backend := BackendOpenAI
+	if settings.Factories.OpenAICompatible != nil {
+		if factory != nil {
+			return nil, fmt.Errorf("only one of the openai and openai-compatible factories can be declared")
+		}
+		factory = settings.Factories.OpenAICompatible
+		backend = BackendOpenAICompatible
+	}
+
+	if factory == nil {
+		factory = NewEditStepFactory(NewEditStepSettings(), NewClientSettings())
+	}
+	if factory.StepSettings == nil {
+		factory.StepSettings = NewEditStepSettings()
+	}
+	if factory.ClientSettings == nil {
+		factory.ClientSettings = NewClientSettings()
+	}
+	factory.ClientSettings.Backend = backend
+
+	return NewEditStepFactory(
+		factory.StepSettings,
+		factory.ClientSettings,
+	), nil
+}
@@ -0,0 +1,41 @@
+package openai
+
+import (
+	"github.com/rs/zerolog/log"
+	"github.com/wesen/geppetto/pkg/tokenizer"
+	"gopkg.in/errgo.v2/fmt/errors"
+)
+
+// encodeLogitBias converts the biases of token strings to the biases of token ids sent to the API,
+// using the encoding of engine. A string that is split into several tokens biases all of them.
+//
+// The ids have to be exact, so the vocabulary of the encoding is required, see tokenizer.GetEncoding.
+func encodeLogitBias(engine string, logitBias map[string]float32) (map[int]float32, error) {
+	if len(logitBias) == 0 {
+		return nil, nil
+	}
+
+	encoding := tokenizer.EncodingForModel(engine)
+	bpe, err := tokenizer.GetEncoding(encoding)
+	if err != nil {
+		return nil, errors.Newf("logit_bias needs the vocabulary of the %s encoding: %v", encoding, err)
+	}
+
+	ret := map[int]float32{}
+	for s, bias := range logitBias {
+		tokens := bpe.Encode(s)
+		if len(tokens) == 0 {
+			return nil, errors.Newf("logit_bias: %q has no tokens", s)
+		}
+		if len(tokens) > 1 {
+			log.Debug().
+				Str("text", s).
+				Ints("tokens", tokens).
+				Msg("logit_bias text is split into several tokens, biasing all of them")
+		}
+		for _, token := range tokens {
+			ret[token] = bias
+		}
+	}
+	return ret, nil
+}
@@ -2,10 +2,14 @@ package openai
 
 import (
 	"context"
-	"github.com/PullRequestInc/go-gpt3"
 	"github.com/rs/zerolog/log"
+	"github.com/wesen/geppetto/pkg/backends"
 	"github.com/wesen/geppetto/pkg/helpers"
-	"golang.org/x/sync/errgroup"
+	"github.com/wesen/geppetto/pkg/models"
+	"github.com/wesen/geppetto/pkg/recorder"
+	"github.com/wesen/geppetto/pkg/steps"
+	"github.com/wesen/geppetto/pkg/tokenizer"
+	"github.com/wesen/geppetto/pkg/usage"
 	"gopkg.in/errgo.v2/fmt/errors"
 )
 
@@ -24,6 +28,7 @@ var ErrMissingClientAPIKey = errors.Newf("missing client settings api key")
 
 type CompletionStep struct {
 	output   chan helpers.Result[string]
+	deltas   chan *backends.CompletionResponse
 	state    CompletionStepState
 	settings *CompletionStepSettings
 }
@@ -31,198 +36,318 @@ type CompletionStep struct {
 func NewCompletionStep(settings *CompletionStepSettings) *CompletionStep {
 	return &CompletionStep{
 		output:   make(chan helpers.Result[string]),
+		deltas:   make(chan *backends.CompletionResponse),
 		settings: settings,
 		state:    CompletionStepNotStarted,
 	}
 }
 
+// Run sends the prompt to the completion API. If the settings have Stream enabled,
+// each chunk returned by the API is forwarded on GetDeltaOutput() as it arrives.
 func (o *CompletionStep) Run(ctx context.Context, prompt string) error {
 	o.state = CompletionStepRunning
 
+	ctx, rec := recorder.StartStep(ctx, "completion", prompt)
+	recordCompletionSettings(rec, o.settings)
+	completion, err := o.complete(ctx, prompt)
+	rec.Finish(completion, err)
+	close(o.deltas)
+	o.state = CompletionStepFinished
+
 	defer func() {
 		o.state = CompletionStepClosed
 		close(o.output)
 	}()
 
-	clientSettings := o.settings.ClientSettings
-	if clientSettings == nil {
-		o.output <- helpers.NewErrorResult[string](ErrMissingClientSettings)
-		return nil
+	o.output <- helpers.NewResult(completion, err)
+
+	return nil
+}
+
+func (o *CompletionStep) complete(ctx context.Context, prompt string) (string, error) {
+	if o.settings.N != nil && *o.settings.N != 1 {
+		return "", errors.Newf("N > 1 is not supported by CompletionStep, use CompletionChoicesStep")
 	}
 
-	if clientSettings.APIKey == nil {
-		o.output <- helpers.NewErrorResult[string](ErrMissingClientAPIKey)
-		return nil
+	choices, err := complete(ctx, o.settings, prompt, o.deltas)
+	if err != nil {
+		return "", err
+	}
+	if len(choices) == 0 {
+		return "", errors.Newf("no choices returned from backend")
 	}
 
-	client, err := clientSettings.CreateClient()
+	return choices[0].Text, nil
+}
+
+// complete sends a single prompt to the completion backend and returns all the choices, ordered by index.
+//
+// If the settings have Stream enabled, the chunks are forwarded to deltas as they arrive,
+// otherwise the non-streaming endpoint is used. If the client settings configure a cache,
+// the choices are looked up in it first, and the new choices are added to it.
+func complete(
+	ctx context.Context,
+	settings *CompletionStepSettings,
+	prompt string,
+	deltas chan<- *backends.CompletionResponse,
+) ([]backends.CompletionChoice, error) {
+	clientSettings := settings.ClientSettings
+	if clientSettings == nil {
+		return nil, ErrMissingClientSettings
+	}
+
+	backend, err := clientSettings.CreateBackend()
 	if err != nil {
-		o.output <- helpers.NewErrorResult[string](err)
-		return nil
+		return nil, err
 	}
 
 	engine := ""
-	if o.settings.Engine != nil {
-		engine = *o.settings.Engine
+	if settings.Engine != nil {
+		engine = *settings.Engine
 	} else if clientSettings.DefaultEngine != nil {
 		engine = *clientSettings.DefaultEngine
 	} else {
-		o.output <- helpers.NewErrorResult[string](errors.Newf("no engine specified"))
-		return nil
+		return nil, errors.Newf("no engine specified")
 	}
 
-	prompts := []string{prompt}
+	prompt, err = checkContextWindow(engine, prompt, settings)
+	if err != nil {
+		return nil, err
+	}
 
 	evt := log.Debug()
+	evt = evt.Str("backend", clientSettings.Backend)
 	evt = evt.Str("engine", engine)
-	if o.settings.MaxResponseTokens != nil {
-		evt = evt.Int("max_response_tokens", *o.settings.MaxResponseTokens)
+	if settings.MaxResponseTokens != nil {
+		evt = evt.Int("max_response_tokens", *settings.MaxResponseTokens)
+	}
+	if settings.Temperature != nil {
+		evt = evt.Float32("temperature", *settings.Temperature)
+	}
+	if settings.TopP != nil {
+		evt = evt.Float32("top_p", *settings.TopP)
+	}
+	if settings.N != nil {
+		evt = evt.Int("n", *settings.N)
+	}
+	if settings.LogProbs != nil {
+		evt = evt.Int("log_probs", *settings.LogProbs)
 	}
-	if o.settings.Temperature != nil {
-		evt = evt.Float32("temperature", *o.settings.Temperature)
+	if settings.Stop != nil {
+		evt = evt.Strs("stop", settings.Stop)
 	}
-	if o.settings.TopP != nil {
-		evt = evt.Float32("top_p", *o.settings.TopP)
+	if settings.Suffix != "" {
+		evt = evt.Str("suffix", settings.Suffix)
 	}
-	if o.settings.N != nil {
-		evt = evt.Int("n", *o.settings.N)
+	if settings.PresencePenalty != nil {
+		evt = evt.Float32("presence_penalty", *settings.PresencePenalty)
 	}
-	if o.settings.LogProbs != nil {
-		evt = evt.Int("log_probs", *o.settings.LogProbs)
+	if settings.FrequencyPenalty != nil {
+		evt = evt.Float32("frequency_penalty", *settings.FrequencyPenalty)
 	}
-	if o.settings.Stop != nil {
-		evt = evt.Strs("stop", o.settings.Stop)
+	if settings.BestOf != nil {
+		evt = evt.Int("best_of", *settings.BestOf)
 	}
-	evt.Strs("prompts", prompts)
+	if settings.Echo {
+		evt = evt.Bool("echo", settings.Echo)
+	}
+	evt = evt.Bool("stream", settings.Stream)
+	evt.Str("prompt", prompt)
 	evt.Msg("sending completion request")
 
-	// TODO(manuel, 2023-01-28) - handle multiple values
-	if o.settings.N != nil && *o.settings.N != 1 {
-		o.output <- helpers.NewErrorResult[string](errors.Newf("N > 1 is not supported yet"))
-		return nil
+	request, err := NewCompletionRequest(settings, engine, prompt)
+	if err != nil {
+		return nil, err
 	}
 
-	completion := ""
-
-	onData := func(resp *gpt3.CompletionResponse) {
-		data := resp.Choices[0].Text
-		//fmt.Println("object: %v, choices: %v\n", resp.Object, resp.Choices)
-		// TODO(manuel, 2023-02-02) Add stream mode
-		// See https://github.com/wesen/geppetto/issues/10
-		//
-		//fmt.Print(string(data))
-		completion += string(data)
+	c := newCompletionCache(clientSettings, settings, engine, prompt)
+	if cached, ok := c.get(ctx); ok {
+		if settings.Stream {
+			select {
+			case deltas <- &backends.CompletionResponse{Model: engine, Choices: cached}:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		return cached, nil
 	}
 
-	// TODO(manuel, 2023-01-27) This is where we would emit progress status and do some logging
-	err = client.CompletionStreamWithEngine(ctx, engine, gpt3.CompletionRequest{
-		Prompt:      prompts,
-		MaxTokens:   o.settings.MaxResponseTokens,
-		Temperature: o.settings.Temperature,
-		TopP:        o.settings.TopP,
-		N:           o.settings.N,
-		LogProbs:    o.settings.LogProbs,
-		Echo:        false,
-		Stop:        o.settings.Stop,
-	}, onData)
-	o.state = CompletionStepFinished
-
-	if err != nil {
-		o.output <- helpers.NewErrorResult[string](err)
-		return nil
+	if !settings.Stream {
+		resp, err := backend.Complete(ctx, request)
+		if err != nil {
+			return nil, err
+		}
+		addUsage(ctx, clientSettings, usage.Usage{
+			Model:            engine,
+			PromptTokens:     resp.Usage.PromptTokens,
+			CompletionTokens: resp.Usage.CompletionTokens,
+		})
+		choices := newCompletionChoices()
+		choices.addResponse(resp)
+		ret := choices.toSlice()
+		c.put(ctx, ret)
+		return ret, nil
 	}
 
-	// TODO(manuel, 2023-02-04) Handle multiple outputs
-	// See https://github.com/wesen/geppetto/issues/23
+	choices := newCompletionChoices()
+	onData := func(resp *backends.CompletionResponse) {
+		choices.addResponse(resp)
 
-	//if len(completion.Choices) == 0 {
-	//	o.output <- helpers.NewErrorResult[string](errors.Newf("no choices returned from OpenAI"))
-	//	return
-	//}
-
-	o.output <- helpers.NewValueResult(completion)
+		select {
+		case deltas <- resp:
+		case <-ctx.Done():
+		}
+	}
 
-	return nil
-}
+	// TODO(manuel, 2023-01-27) This is where we would emit progress status and do some logging
+	err = backend.CompleteStream(ctx, request, onData)
+	if err != nil {
+		return nil, err
+	}
 
-func (o *CompletionStep) GetOutput() <-chan helpers.Result[string] {
-	return o.output
-}
+	ret := choices.toSlice()
+	if shouldCountUsage(ctx, clientSettings) {
+		// the streaming API doesn't return the usage, so we count the tokens ourselves
+		t := tokenizer.ForModel(engine)
+		completionTokens := 0
+		for _, choice := range ret {
+			completionTokens += t.Count(choice.Text)
+		}
+		addUsage(ctx, clientSettings, usage.Usage{
+			Model:            engine,
+			PromptTokens:     t.Count(prompt),
+			CompletionTokens: completionTokens,
+			Estimated:        true,
+		})
+	}
+	c.put(ctx, ret)
 
-func (o *CompletionStep) GetState() interface{} {
-	return o.state
+	return ret, nil
 }
 
-func (o *CompletionStep) IsFinished() bool {
-	return o.state == CompletionStepFinished
-}
+const (
+	ContextOverflowError    = "error"
+	ContextOverflowTruncate = "truncate"
+	ContextOverflowIgnore   = "ignore"
+)
 
-// TODO(manuel, 2023-02-04) This could be generic, and take a factory
+// defaultMaxResponseTokens is the value used by the OpenAI API when max_tokens is not set
+const defaultMaxResponseTokens = 16
+
+// NewCompletionRequest creates the backend request sending prompt to engine with the settings.
+// The token strings of the logit bias are converted to token ids with the encoding of engine.
+func NewCompletionRequest(
+	settings *CompletionStepSettings,
+	engine string,
+	prompt string,
+) (*backends.CompletionRequest, error) {
+	logitBias, err := encodeLogitBias(engine, settings.LogitBias)
+	if err != nil {
+		return nil, err
+	}
 
-// MultiCompletionStep runs multiple completion steps in parallel
-type MultiCompletionStep struct {
-	output   chan helpers.Result[[]string]
-	state    CompletionStepState
-	settings *CompletionStepSettings
+	return &backends.CompletionRequest{
+		Model:            engine,
+		Prompt:           prompt,
+		MaxTokens:        settings.MaxResponseTokens,
+		Temperature:      settings.Temperature,
+		TopP:             settings.TopP,
+		N:                settings.N,
+		LogProbs:         settings.LogProbs,
+		Stop:             settings.Stop,
+		Suffix:           settings.Suffix,
+		PresencePenalty:  settings.PresencePenalty,
+		FrequencyPenalty: settings.FrequencyPenalty,
+		BestOf:           settings.BestOf,
+		LogitBias:        logitBias,
+		Echo:             settings.Echo,
+		User:             settings.User,
+	}, nil
 }
 
-func NewMultiCompletionStep(settings *CompletionStepSettings) *MultiCompletionStep {
-	return &MultiCompletionStep{
-		output:   make(chan helpers.Result[[]string]),
-		settings: settings,
-		state:    CompletionStepNotStarted,
+// checkContextWindow verifies that the prompt and the response fit in the context window
+// of the engine, as listed in models.json. Unknown engines are not checked.
+//
+// If settings.OnContextOverflow is truncate, the start of the prompt is removed to make it fit.
+func checkContextWindow(engine string, prompt string, settings *CompletionStepSettings) (string, error) {
+	if settings.OnContextOverflow == ContextOverflowIgnore {
+		return prompt, nil
+	}
+	contextWindow, ok := models.ContextWindow(engine)
+	if !ok {
+		return prompt, nil
 	}
-}
 
-func (mc *MultiCompletionStep) Run(ctx context.Context, prompts []string) error {
-	completionSteps := make([]*CompletionStep, len(prompts))
-	chans := make([]<-chan helpers.Result[string], len(prompts))
-	for i := range prompts {
-		completionSteps[i] = NewCompletionStep(mc.settings)
-		chans[i] = completionSteps[i].GetOutput()
+	maxResponseTokens := defaultMaxResponseTokens
+	if settings.MaxResponseTokens != nil {
+		maxResponseTokens = *settings.MaxResponseTokens
 	}
 
-	ctx, cancel := context.WithCancel(ctx)
-	defer cancel()
-	eg, ctx2 := errgroup.WithContext(ctx)
+	t := tokenizer.ForModel(engine)
+	// the suffix is part of the prompt, but only the text before the completion can be truncated
+	suffixTokens := 0
+	if settings.Suffix != "" {
+		suffixTokens = t.Count(settings.Suffix)
+	}
+	promptTokens := t.Count(prompt) + suffixTokens
+	if promptTokens+maxResponseTokens <= contextWindow {
+		return prompt, nil
+	}
 
-	results := []string{}
-	eg.Go(func() error {
-		mergeChannel := helpers.MergeChannels(chans...)
-		for {
-			select {
-			case <-ctx2.Done():
-				return ctx2.Err()
-			case result := <-mergeChannel:
-				v, err := result.Value()
-				// if we have an error, just store the "" string
-				if err != nil {
-					v = ""
-				}
-				results = append(results, v)
-			}
+	switch settings.OnContextOverflow {
+	case "", ContextOverflowError:
+		return "", errors.Newf(
+			"prompt (%d tokens) and max response tokens (%d) exceed the context window of %s (%d tokens)",
+			promptTokens, maxResponseTokens, engine, contextWindow)
+	case ContextOverflowTruncate:
+		if maxResponseTokens+suffixTokens >= contextWindow {
+			return "", errors.Newf("max response tokens (%d) and suffix (%d tokens) exceed the context window of %s (%d tokens)",
+				maxResponseTokens, suffixTokens, engine, contextWindow)
 		}
-	})
-
-	for i, prompt := range prompts {
-		j := i
-		prompt_ := prompt
-		eg.Go(func() error {
-			return completionSteps[j].Run(ctx2, prompt_)
-		})
+		log.Warn().
+			Int("prompt_tokens", promptTokens).
+			Int("max_response_tokens", maxResponseTokens).
+			Int("context_window", contextWindow).
+			Str("tokenizer", t.Name()).
+			Msg("truncating the start of the prompt to fit in the context window")
+		return t.TrimStart(prompt, contextWindow-maxResponseTokens-suffixTokens), nil
+	default:
+		return "", errors.Newf("unknown on_context_overflow value %s", settings.OnContextOverflow)
 	}
+}
+
+func (o *CompletionStep) GetOutput() <-chan helpers.Result[string] {
+	return o.output
+}
 
-	return eg.Wait()
+// GetDeltaOutput returns the chunks received from the API when streaming is enabled.
+func (o *CompletionStep) GetDeltaOutput() <-chan *backends.CompletionResponse {
+	return o.deltas
 }
 
-func (mc *MultiCompletionStep) GetOutput() <-chan helpers.Result[[]string] {
-	return mc.output
+func (o *CompletionStep) GetState() interface{} {
+	return o.state
 }
 
-func (mc *MultiCompletionStep) GetState() interface{} {
-	return mc.state
+func (o *CompletionStep) IsFinished() bool {
+	return o.state == CompletionStepFinished
 }
 
-func (mc *MultiCompletionStep) IsFinished() bool {
-	return mc.state == CompletionStepFinished
+// NewMultiCompletionStep runs a completion for each of the input prompts in parallel, and returns
+// the completions in the same order as the prompts. If some completions fail, they are left empty
+// and a *steps.MapError listing their errors is returned along with the completions.
+//
+// Streaming is disabled for the individual completions, since nobody would consume the chunks.
+func NewMultiCompletionStep(settings *CompletionStepSettings, concurrency int) *steps.MapStep[string, string] {
+	settings = settings.Clone()
+	settings.Stream = false
+
+	factory := steps.StepFactoryFunc[string, string](func() (steps.Step[string, string], error) {
+		return NewCompletionStep(settings.Clone()), nil
+	})
+
+	return steps.NewMapStep[string, string](factory, steps.MapStepSettings[string]{
+		Concurrency: concurrency,
+		ErrorPolicy: steps.MapCollectErrors,
+	})
 }
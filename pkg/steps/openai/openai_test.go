@@ -0,0 +1,498 @@
+package openai
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wesen/geppetto/pkg/backends"
+	"github.com/wesen/geppetto/pkg/cache"
+	"github.com/wesen/geppetto/pkg/steps"
+	"github.com/wesen/geppetto/pkg/usage"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newFakeClientSettings(t *testing.T, backend *backends.FakeBackend) *ClientSettings {
+	server := backends.NewFakeOpenAIServer(backend)
+	t.Cleanup(server.Close)
+
+	apiKey := "test"
+	return &ClientSettings{
+		APIKey:  &apiKey,
+		BaseURL: &server.URL,
+	}
+}
+
+func TestCompletionStepFakeServer(t *testing.T) {
+	backend := backends.NewFakeBackend()
+	backend.AddPromptResponse("Say hello", &backends.FakeResponse{Text: " Hello world"})
+
+	engine := "fake-model"
+	for _, stream := range []bool{false, true} {
+		s := NewCompletionStep(&CompletionStepSettings{
+			ClientSettings: newFakeClientSettings(t, backend),
+			Engine:         &engine,
+			Stream:         stream,
+		})
+
+		go func() {
+			require.Nil(t, s.Run(context.Background(), "Say hello"))
+		}()
+
+		deltas := ""
+		for delta := range s.GetDeltaOutput() {
+			deltas += delta.Choices[0].Text
+		}
+
+		v, ok := <-s.GetOutput()
+		require.True(t, ok)
+		value, err := v.Value()
+		require.Nil(t, err)
+		assert.Equal(t, " Hello world", value)
+		if stream {
+			assert.Equal(t, " Hello world", deltas)
+		} else {
+			assert.Equal(t, "", deltas)
+		}
+	}
+}
+
+func TestCompletionStepFakeServerError(t *testing.T) {
+	backend := backends.NewFakeBackend()
+	backend.AddSequenceResponses(&backends.FakeResponse{Error: &backends.APIError{
+		StatusCode: 429,
+		Type:       "rate_limit_exceeded",
+		Message:    "Rate limit reached",
+	}})
+
+	engine := "fake-model"
+	s := NewCompletionStep(&CompletionStepSettings{
+		ClientSettings: newFakeClientSettings(t, backend),
+		Engine:         &engine,
+	})
+	go func() {
+		require.Nil(t, s.Run(context.Background(), "Say hello"))
+	}()
+
+	v := <-s.GetOutput()
+	_, err := v.Value()
+	apiError, ok := err.(*backends.APIError)
+	require.True(t, ok)
+	assert.Equal(t, 429, apiError.StatusCode)
+}
+
+// the chunks are forwarded as they arrive, and the delta channel is closed before the final result
+var _ steps.StreamingStep[string, string, *backends.CompletionResponse] = &CompletionStep{}
+
+func TestCompletionStepStreamingDeltas(t *testing.T) {
+	backend := backends.NewFakeBackend()
+	backend.AddPromptResponse("Count", &backends.FakeResponse{Text: " one two three"})
+
+	engine := "fake-model"
+	s := NewCompletionStep(&CompletionStepSettings{
+		ClientSettings: newFakeClientSettings(t, backend),
+		Engine:         &engine,
+		Stream:         true,
+	})
+	go func() {
+		require.Nil(t, s.Run(context.Background(), "Count"))
+	}()
+
+	deltas := []string{}
+	finishReason := ""
+	for delta := range s.GetDeltaOutput() {
+		require.Len(t, delta.Choices, 1)
+		if delta.Choices[0].Text != "" {
+			deltas = append(deltas, delta.Choices[0].Text)
+		}
+		if delta.Choices[0].FinishReason != "" {
+			finishReason = delta.Choices[0].FinishReason
+		}
+	}
+	assert.Equal(t, []string{" one", " two", " three"}, deltas)
+	assert.Equal(t, "stop", finishReason)
+
+	v := <-s.GetOutput()
+	value, err := v.Value()
+	require.Nil(t, err)
+	assert.Equal(t, " one two three", value)
+
+	_, ok := <-s.GetOutput()
+	assert.False(t, ok)
+
+	requests := backend.Requests()
+	require.Len(t, requests, 1)
+	assert.Equal(t, "Count", requests[0].Prompt)
+}
+
+func TestCompletionStepStreamingCancel(t *testing.T) {
+	backend := backends.NewFakeBackend()
+	backend.AddPromptResponse("Count", &backends.FakeResponse{Text: " one two three four five six"})
+
+	engine := "fake-model"
+	s := NewCompletionStep(&CompletionStepSettings{
+		ClientSettings: newFakeClientSettings(t, backend),
+		Engine:         &engine,
+		Stream:         true,
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		require.Nil(t, s.Run(ctx, "Count"))
+	}()
+
+	// the consumer stops reading the deltas after the first one, the step must not block on them
+	_, ok := <-s.GetDeltaOutput()
+	require.True(t, ok)
+	cancel()
+
+	select {
+	case <-s.GetOutput():
+	case <-time.After(5 * time.Second):
+		t.Fatal("the step blocked after its context was cancelled")
+	}
+	_, ok = <-s.GetDeltaOutput()
+	assert.False(t, ok)
+}
+
+func TestCompletionStepStreamingRejectsN(t *testing.T) {
+	backend := backends.NewFakeBackend()
+	backend.Default = &backends.FakeResponse{Text: " ok"}
+
+	engine := "fake-model"
+	n := 2
+	s := NewCompletionStep(&CompletionStepSettings{
+		ClientSettings: newFakeClientSettings(t, backend),
+		Engine:         &engine,
+		Stream:         true,
+		N:              &n,
+	})
+	go func() {
+		require.Nil(t, s.Run(context.Background(), "Say ok"))
+	}()
+
+	for range s.GetDeltaOutput() {
+	}
+	v := <-s.GetOutput()
+	_, err := v.Value()
+	assert.NotNil(t, err)
+	assert.Empty(t, backend.Requests())
+}
+
+func TestChatCompletionStepFakeServer(t *testing.T) {
+	backend := backends.NewFakeBackend()
+	backend.AddPromptResponse("system: You are a poet.\nuser: Write about cats.", &backends.FakeResponse{
+		Text: "Cats sleep all day.",
+	})
+
+	for _, stream := range []bool{false, true} {
+		settings := NewChatCompletionStepSettings()
+		settings.ClientSettings = newFakeClientSettings(t, backend)
+		settings.Stream = stream
+		s := NewChatCompletionStep(settings)
+
+		go func() {
+			require.Nil(t, s.Run(context.Background(), []ChatMessage{
+				{Role: ChatMessageRoleSystem, Content: "You are a poet."},
+				{Role: ChatMessageRoleUser, Content: "Write about cats."},
+			}))
+		}()
+
+		deltas := []string{}
+		for delta := range s.GetDeltaOutput() {
+			deltas = append(deltas, delta.Choices[0].Message.Content)
+		}
+
+		v := <-s.GetOutput()
+		value, err := v.Value()
+		require.Nil(t, err)
+		assert.Equal(t, "Cats sleep all day.", value)
+		if stream {
+			assert.Equal(t, "Cats sleep all day.", strings.Join(deltas, ""))
+		}
+	}
+}
+
+func TestChatCompletionStepN(t *testing.T) {
+	backend := backends.NewFakeBackend()
+	backend.Default = &backends.FakeResponse{Text: "Cats sleep all day."}
+
+	factory, err := NewChatCompletionStepFactoryFromYAML(strings.NewReader(`
+factories:
+  openai-chat:
+    chat:
+      engine: fake-model
+      n: 2
+`))
+	require.Nil(t, err)
+	require.NotNil(t, factory.StepSettings.N)
+	assert.Equal(t, 2, *factory.StepSettings.N)
+
+	for _, stream := range []bool{false, true} {
+		settings := factory.NewStepSettings()
+		settings.ClientSettings = newFakeClientSettings(t, backend)
+		settings.Stream = stream
+		s := NewChatCompletionStep(settings)
+
+		go func() {
+			require.Nil(t, s.Run(context.Background(), []ChatMessage{
+				{Role: ChatMessageRoleUser, Content: "Write about cats."},
+			}))
+		}()
+
+		indexes := map[int]bool{}
+		for delta := range s.GetDeltaOutput() {
+			for _, choice := range delta.Choices {
+				indexes[choice.Index] = true
+			}
+		}
+
+		v := <-s.GetOutput()
+		value, err := v.Value()
+		require.Nil(t, err)
+		assert.Equal(t, "Cats sleep all day.", value)
+		assert.Equal(t, []string{"Cats sleep all day.", "Cats sleep all day."}, s.Choices())
+		assert.Equal(t, "stop", s.FinishReason())
+		if stream {
+			assert.Equal(t, map[int]bool{0: true, 1: true}, indexes)
+		}
+	}
+}
+
+func TestClientSettingsShareLimiter(t *testing.T) {
+	factory, err := NewCompletionStepFactoryFromYAML(strings.NewReader(`
+factories:
+  openai:
+    client:
+      api_key: test
+      rate_limit:
+        requests_per_minute: 60
+        max_in_flight: 2
+`))
+	require.Nil(t, err)
+	require.NotNil(t, factory.ClientSettings.Limiter)
+	assert.Equal(t, 2, factory.ClientSettings.Limiter.Settings().MaxInFlight)
+
+	s1 := factory.NewStepSettings()
+	s2 := factory.NewStepSettings()
+	assert.Same(t, s1.ClientSettings.Limiter, s2.ClientSettings.Limiter)
+	assert.Same(t, factory.ClientSettings.Limiter, s1.ClientSettings.Limiter)
+}
+
+func TestCompletionStepContextOverflow(t *testing.T) {
+	t.Setenv("GEPPETTO_TOKENIZERS_DIR", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+
+	backend := backends.NewFakeBackend()
+	backend.Default = &backends.FakeResponse{Text: " ok"}
+
+	engine := "text-davinci-003"
+	maxResponseTokens := 100
+	// 5000 words of 4 bytes, which are about 5000 tokens
+	prompt := strings.Repeat(" cat", 5000)
+
+	s := NewCompletionStep(&CompletionStepSettings{
+		ClientSettings:    newFakeClientSettings(t, backend),
+		Engine:            &engine,
+		MaxResponseTokens: &maxResponseTokens,
+	})
+	go func() {
+		require.Nil(t, s.Run(context.Background(), prompt))
+	}()
+	v := <-s.GetOutput()
+	_, err := v.Value()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "context window")
+	assert.Len(t, backend.Requests(), 0)
+
+	s = NewCompletionStep(&CompletionStepSettings{
+		ClientSettings:    newFakeClientSettings(t, backend),
+		Engine:            &engine,
+		MaxResponseTokens: &maxResponseTokens,
+		OnContextOverflow: ContextOverflowTruncate,
+	})
+	go func() {
+		require.Nil(t, s.Run(context.Background(), prompt))
+	}()
+	v = <-s.GetOutput()
+	value, err := v.Value()
+	require.Nil(t, err)
+	assert.Equal(t, " ok", value)
+
+	requests := backend.Requests()
+	require.Len(t, requests, 1)
+	assert.Equal(t, strings.Repeat(" cat", 4000-100), requests[0].Prompt)
+}
+
+func TestCompletionStepParameters(t *testing.T) {
+	// a vocabulary with a token per byte, so that the token of a byte is its value
+	dir := t.TempDir()
+	lines := []string{}
+	for b := 0; b < 256; b++ {
+		lines = append(lines, fmt.Sprintf("%s %d", base64.StdEncoding.EncodeToString([]byte{byte(b)}), b))
+	}
+	require.Nil(t, os.WriteFile(filepath.Join(dir, "r50k_base.tiktoken"), []byte(strings.Join(lines, "\n")), 0644))
+	t.Setenv("GEPPETTO_TOKENIZERS_DIR", dir)
+
+	backend := backends.NewFakeBackend()
+	backend.AddPromptResponse("func add(a, b int) int {\n", &backends.FakeResponse{Text: "\treturn a + b"})
+
+	engine := "text-curie-001"
+	penalty := float32(0.5)
+	bestOf := 2
+	s := NewCompletionStep(&CompletionStepSettings{
+		ClientSettings:   newFakeClientSettings(t, backend),
+		Engine:           &engine,
+		Suffix:           "\n}\n",
+		PresencePenalty:  &penalty,
+		FrequencyPenalty: &penalty,
+		BestOf:           &bestOf,
+		LogitBias:        map[string]float32{"a": 10, " no": -100},
+		Echo:             true,
+		User:             "user-1",
+	})
+	go func() {
+		require.Nil(t, s.Run(context.Background(), "func add(a, b int) int {\n"))
+	}()
+	value, err := (<-s.GetOutput()).Value()
+	require.Nil(t, err)
+	assert.Equal(t, "\treturn a + b", value)
+
+	requests := backend.Requests()
+	require.Len(t, requests, 1)
+	assert.Equal(t, "\n}\n", requests[0].Suffix)
+	assert.Equal(t, &penalty, requests[0].PresencePenalty)
+	assert.Equal(t, &penalty, requests[0].FrequencyPenalty)
+	assert.Equal(t, &bestOf, requests[0].BestOf)
+	assert.Equal(t, map[int]float32{'a': 10, ' ': -100, 'n': -100, 'o': -100}, requests[0].LogitBias)
+	assert.True(t, requests[0].Echo)
+	assert.Equal(t, "user-1", requests[0].User)
+}
+
+func TestCompletionStepUsage(t *testing.T) {
+	t.Setenv("GEPPETTO_TOKENIZERS_DIR", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+
+	backend := backends.NewFakeBackend()
+	backend.Default = &backends.FakeResponse{Text: " Hello world"}
+
+	engine := "text-davinci-003"
+	for _, stream := range []bool{false, true} {
+		settings := newFakeClientSettings(t, backend)
+		settings.UsageTracker = usage.NewTracker()
+		s := NewCompletionStep(&CompletionStepSettings{
+			ClientSettings: settings,
+			Engine:         &engine,
+			Stream:         stream,
+		})
+		go func() {
+			require.Nil(t, s.Run(context.Background(), "Say hello"))
+		}()
+		for range s.GetDeltaOutput() {
+		}
+		_, err := (<-s.GetOutput()).Value()
+		require.Nil(t, err)
+
+		usages := settings.UsageTracker.Usages()
+		require.Len(t, usages, 1)
+		assert.Equal(t, engine, usages[0].Model)
+		assert.Equal(t, stream, usages[0].Estimated)
+		assert.Greater(t, usages[0].PromptTokens, 0)
+		assert.Greater(t, usages[0].CompletionTokens, 0)
+	}
+}
+
+func TestCompletionStepCache(t *testing.T) {
+	backend := backends.NewFakeBackend()
+	backend.Default = &backends.FakeResponse{Text: " Hello world"}
+	clientSettings := newFakeClientSettings(t, backend)
+	clientSettings.Cache = &cache.Settings{
+		Mode:      cache.ModeReadWrite,
+		Directory: t.TempDir(),
+	}
+
+	engine := "fake-model"
+	zero := float32(0)
+	hot := float32(0.7)
+	complete := func(mode cache.Mode, temperature *float32, stream bool) string {
+		settings := clientSettings.Clone()
+		settings.Cache.Mode = mode
+		s := NewCompletionStep(&CompletionStepSettings{
+			ClientSettings: settings,
+			Engine:         &engine,
+			Temperature:    temperature,
+			Stream:         stream,
+		})
+		go func() {
+			require.Nil(t, s.Run(context.Background(), "Say hello"))
+		}()
+		for range s.GetDeltaOutput() {
+		}
+		value, err := (<-s.GetOutput()).Value()
+		require.Nil(t, err)
+		return value
+	}
+
+	// read-only doesn't cache the new completions
+	assert.Equal(t, " Hello world", complete(cache.ModeReadOnly, &zero, false))
+	require.Len(t, backend.Requests(), 1)
+
+	assert.Equal(t, " Hello world", complete(cache.ModeReadWrite, &zero, false))
+	require.Len(t, backend.Requests(), 2)
+	backend.Default = &backends.FakeResponse{Text: " Hi"}
+	// streaming doesn't change the cache key
+	assert.Equal(t, " Hello world", complete(cache.ModeReadWrite, &zero, true))
+	assert.Equal(t, " Hello world", complete(cache.ModeReadOnly, &zero, false))
+	require.Len(t, backend.Requests(), 2)
+
+	// refresh sends the request again, and caches the new completion
+	assert.Equal(t, " Hi", complete(cache.ModeRefresh, &zero, false))
+	assert.Equal(t, " Hi", complete(cache.ModeReadWrite, &zero, false))
+	require.Len(t, backend.Requests(), 3)
+
+	// completions with a non-zero temperature are only cached when enabled
+	assert.Equal(t, " Hi", complete(cache.ModeReadWrite, &hot, false))
+	assert.Equal(t, " Hi", complete(cache.ModeReadWrite, &hot, false))
+	require.Len(t, backend.Requests(), 5)
+	clientSettings.Cache.NonZeroTemperature = true
+	assert.Equal(t, " Hi", complete(cache.ModeReadWrite, &hot, false))
+	assert.Equal(t, " Hi", complete(cache.ModeReadWrite, &hot, false))
+	require.Len(t, backend.Requests(), 6)
+
+	// the off mode ignores the cache
+	assert.Equal(t, " Hi", complete(cache.ModeOff, &zero, false))
+	require.Len(t, backend.Requests(), 7)
+}
+
+func TestEditStepFakeServer(t *testing.T) {
+	backend := backends.NewFakeBackend()
+	backend.AddPromptResponse(backends.FakeEditPrompt("Fix the typo", "helo"), &backends.FakeResponse{Text: "hello"})
+
+	clientSettings := newFakeClientSettings(t, backend)
+	clientSettings.UsageTracker = usage.NewTracker()
+	engine := "fake-edit-model"
+	n := 2
+	s := NewEditStep(&EditStepSettings{
+		ClientSettings: clientSettings,
+		Engine:         &engine,
+		N:              &n,
+	})
+	go func() {
+		require.Nil(t, s.Run(context.Background(), EditInput{Input: "helo", Instruction: "Fix the typo"}))
+	}()
+	choices, err := (<-s.GetOutput()).Value()
+	require.Nil(t, err)
+	require.Len(t, choices, 2)
+	assert.Equal(t, "hello", choices[0].Text)
+	assert.Equal(t, 1, choices[1].Index)
+
+	requests := backend.Requests()
+	require.Len(t, requests, 1)
+	assert.Equal(t, "fake-edit-model", requests[0].Model)
+	assert.Len(t, clientSettings.UsageTracker.Usages(), 1)
+}
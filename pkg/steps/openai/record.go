@@ -0,0 +1,66 @@
+package openai
+
+import (
+	"context"
+	"github.com/wesen/geppetto/pkg/recorder"
+	"github.com/wesen/geppetto/pkg/usage"
+)
+
+// recordClientSettings records the client settings needed to retrace a request.
+// The API key and organization are left out.
+func recordClientSettings(rec *recorder.StepRecorder, c *ClientSettings) {
+	if c == nil {
+		return
+	}
+	backend := c.Backend
+	if backend == "" {
+		backend = BackendOpenAI
+	}
+	rec.SetMetadata("backend", backend)
+	if c.BaseURL != nil {
+		rec.SetMetadata("base_url", *c.BaseURL)
+	}
+}
+
+// recordCompletionSettings records the settings of a completion step. The client settings
+// are not marshalled to JSON, see recordClientSettings.
+func recordCompletionSettings(rec *recorder.StepRecorder, settings *CompletionStepSettings) {
+	rec.SetMetadata("settings", settings)
+	recordClientSettings(rec, settings.ClientSettings)
+}
+
+func recordChatSettings(rec *recorder.StepRecorder, settings *ChatCompletionStepSettings) {
+	rec.SetMetadata("settings", settings)
+	recordClientSettings(rec, settings.ClientSettings)
+}
+
+func recordEditSettings(rec *recorder.StepRecorder, settings *EditStepSettings) {
+	rec.SetMetadata("settings", settings)
+	recordClientSettings(rec, settings.ClientSettings)
+}
+
+// shouldCountUsage returns true if the usage of a request has to be computed, because it is
+// tracked or recorded. Counting the tokens of a streamed response is not free.
+func shouldCountUsage(ctx context.Context, clientSettings *ClientSettings) bool {
+	return clientSettings.UsageTracker != nil || recorder.CurrentStep(ctx) != nil
+}
+
+// addUsage adds the usage of a request to the usage tracker, and to the metrics of the step running in ctx.
+func addUsage(ctx context.Context, clientSettings *ClientSettings, u usage.Usage) {
+	clientSettings.UsageTracker.Add(u)
+
+	rec := recorder.CurrentStep(ctx)
+	if rec == nil {
+		return
+	}
+	rec.SetMetadata("engine", u.Model)
+	rec.AddMetric("requests", 1)
+	rec.AddMetric("prompt_tokens", float64(u.PromptTokens))
+	rec.AddMetric("completion_tokens", float64(u.CompletionTokens))
+	if cost, ok := u.Cost(); ok {
+		rec.AddMetric("cost", cost)
+	}
+	if u.Estimated {
+		rec.SetMetadata("estimated_usage", true)
+	}
+}
@@ -6,23 +6,49 @@ import (
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"github.com/wesen/geppetto/pkg/backends"
+	"github.com/wesen/geppetto/pkg/cache"
 	"github.com/wesen/geppetto/pkg/steps"
+	"github.com/wesen/geppetto/pkg/usage"
 	"gopkg.in/yaml.v3"
 	"io"
 	"net/http"
+	"os"
+	"strconv"
 	"time"
 )
 
 var ErrMissingYAMLAPIKey = &yaml.TypeError{Errors: []string{"missing api key"}}
 
+const (
+	// BackendOpenAI uses the go-gpt3 client to talk to the OpenAI API, and its REST API for completions
+	BackendOpenAI = "openai"
+	// BackendOpenAICompatible talks to any server implementing the OpenAI REST API,
+	// for example a llama.cpp server or vLLM
+	BackendOpenAICompatible = "openai-compatible"
+)
+
 type ClientSettings struct {
-	APIKey        *string        `yaml:"api_key,omitempty"`
-	Timeout       *time.Duration `yaml:"timeout,omitempty"`
+	// Backend is set from the key of the factory in the YAML file, and selects the backends.Backend to use
+	Backend string  `yaml:"-"`
+	APIKey  *string `yaml:"api_key,omitempty"`
+	// Timeout is parsed from an int number of seconds by UnmarshalYAML
+	Timeout       *time.Duration `yaml:"-"`
 	Organization  *string        `yaml:"organization,omitempty"`
 	DefaultEngine *string        `yaml:"default_engine,omitempty"`
 	UserAgent     *string        `yaml:"user_agent,omitempty"`
 	BaseURL       *string        `yaml:"base_url,omitempty"`
-	HTTPClient    *http.Client   `yaml:"omitempty"`
+	HTTPClient    *http.Client   `yaml:"-"`
+	// Retry configures the retries of failed requests, no retries are done if nil
+	Retry *backends.RetrySettings `yaml:"retry,omitempty"`
+	// RateLimit configures the Limiter shared by all the steps using these settings
+	RateLimit *backends.LimiterSettings `yaml:"rate_limit,omitempty"`
+	// Limiter is created from RateLimit, and shared by the clones of the settings
+	Limiter *backends.Limiter `yaml:"-"`
+	// UsageTracker collects the token usage of the requests, and is shared by the clones of the settings
+	UsageTracker *usage.Tracker `yaml:"-"`
+	// Cache configures the on-disk cache of the completions, they are not cached if nil
+	Cache *cache.Settings `yaml:"cache,omitempty"`
 }
 
 // UnmarshalYAML overrides YAML parsing to convert time.duration from int
@@ -30,7 +56,7 @@ func (c *ClientSettings) UnmarshalYAML(value *yaml.Node) error {
 	type Alias ClientSettings
 	aux := &struct {
 		Timeout *int `yaml:"timeout,omitempty"`
-		*Alias
+		*Alias  `yaml:",inline"`
 	}{
 		Alias: (*Alias)(c),
 	}
@@ -41,9 +67,28 @@ func (c *ClientSettings) UnmarshalYAML(value *yaml.Node) error {
 		t := time.Duration(*aux.Timeout) * time.Second
 		c.Timeout = &t
 	}
+	if c.RateLimit != nil {
+		c.Limiter = backends.NewLimiter(*c.RateLimit)
+	}
 	return nil
 }
 
+// MarshalYAML writes the timeout as an int number of seconds, the way UnmarshalYAML reads it
+func (c ClientSettings) MarshalYAML() (interface{}, error) {
+	type Alias ClientSettings
+	aux := &struct {
+		Timeout *int `yaml:"timeout,omitempty"`
+		*Alias  `yaml:",inline"`
+	}{
+		Alias: (*Alias)(&c),
+	}
+	if c.Timeout != nil {
+		t := int(*c.Timeout / time.Second)
+		aux.Timeout = &t
+	}
+	return aux, nil
+}
+
 func (c *ClientSettings) IsValid() error {
 	if c.APIKey == nil {
 		return ErrMissingYAMLAPIKey
@@ -52,7 +97,16 @@ func (c *ClientSettings) IsValid() error {
 }
 
 func (c *ClientSettings) Clone() *ClientSettings {
+	var retry *backends.RetrySettings
+	if c.Retry != nil {
+		retry = c.Retry.Clone()
+	}
+	var cacheSettings *cache.Settings
+	if c.Cache != nil {
+		cacheSettings = c.Cache.Clone()
+	}
 	return &ClientSettings{
+		Backend:       c.Backend,
 		APIKey:        c.APIKey,
 		Timeout:       c.Timeout,
 		Organization:  c.Organization,
@@ -60,14 +114,16 @@ func (c *ClientSettings) Clone() *ClientSettings {
 		UserAgent:     c.UserAgent,
 		BaseURL:       c.BaseURL,
 		HTTPClient:    c.HTTPClient,
+		Retry:         retry,
+		RateLimit:     c.RateLimit,
+		Limiter:       c.Limiter,
+		UsageTracker:  c.UsageTracker,
+		Cache:         cacheSettings,
 	}
 }
 
 func (c *ClientSettings) ToOptions() []gpt3.ClientOption {
 	ret := make([]gpt3.ClientOption, 0)
-	if c.Timeout != nil {
-		ret = append(ret, gpt3.WithTimeout(*c.Timeout))
-	}
 	if c.Organization != nil {
 		ret = append(ret, gpt3.WithOrg(*c.Organization))
 	}
@@ -80,9 +136,12 @@ func (c *ClientSettings) ToOptions() []gpt3.ClientOption {
 	if c.BaseURL != nil {
 		ret = append(ret, gpt3.WithBaseURL(*c.BaseURL))
 	}
-	if c.HTTPClient != nil {
-		ret = append(ret, gpt3.WithHTTPClient(c.HTTPClient))
+	// the transport of the client records the Retry-After header of the errors, see backends.RetryAfterTransport
+	timeout := 60 * time.Second
+	if c.Timeout != nil {
+		timeout = *c.Timeout
 	}
+	ret = append(ret, gpt3.WithHTTPClient(backends.NewOpenAIHTTPClient(c.HTTPClient, timeout)))
 	return ret
 }
 
@@ -112,25 +171,103 @@ func (c *ClientSettings) CreateClient() (gpt3.Client, error) {
 	return gpt3.NewClient(*c.APIKey, options...), nil
 }
 
+// CreateBackend creates the backends.Backend selected by the Backend setting,
+// sending the requests through the shared Limiter and retrying failed requests if Retry is set.
+func (c *ClientSettings) CreateBackend() (backends.Backend, error) {
+	var backend backends.Backend
+	switch c.Backend {
+	case "", BackendOpenAI:
+		if c.APIKey == nil {
+			return nil, ErrMissingClientAPIKey
+		}
+		client, err := c.CreateClient()
+		if err != nil {
+			return nil, err
+		}
+		backend, err = backends.NewOpenAIBackend(client, c.CreateHTTPBackend())
+		if err != nil {
+			return nil, err
+		}
+
+	case BackendOpenAICompatible:
+		backend = c.CreateHTTPBackend()
+
+	default:
+		return nil, fmt.Errorf("unknown backend %s", c.Backend)
+	}
+
+	if c.Limiter != nil {
+		backend = backends.NewLimitedBackend(backend, c.Limiter)
+	}
+	if c.Retry != nil {
+		backend = backends.NewRetryBackend(backend, c.Retry)
+	}
+	return backend, nil
+}
+
+// CreateHTTPBackend creates a backend talking to an OpenAI-compatible REST API, independently
+// of the Backend setting. It is used for the endpoints that go-gpt3 doesn't support.
+func (c *ClientSettings) CreateHTTPBackend() *backends.HTTPBackend {
+	settings := backends.HTTPBackendSettings{
+		HTTPClient: c.HTTPClient,
+	}
+	if c.BaseURL != nil {
+		settings.BaseURL = *c.BaseURL
+	}
+	if c.APIKey != nil {
+		settings.APIKey = *c.APIKey
+	}
+	if c.Organization != nil {
+		settings.Organization = *c.Organization
+	}
+	if c.UserAgent != nil {
+		settings.UserAgent = *c.UserAgent
+	}
+	if c.Timeout != nil {
+		settings.Timeout = *c.Timeout
+	}
+	return backends.NewHTTPBackend(settings)
+}
+
 type CompletionStepSettings struct {
-	ClientSettings *ClientSettings `yaml:"client,omitempty"`
+	ClientSettings *ClientSettings `yaml:"client,omitempty" json:"-"`
 
-	Engine *string `yaml:"engine,omitempty"`
+	Engine *string `yaml:"engine,omitempty" json:"engine,omitempty"`
 
-	MaxResponseTokens *int `yaml:"max_response_tokens,omitempty"`
+	MaxResponseTokens *int `yaml:"max_response_tokens,omitempty" json:"max_response_tokens,omitempty"`
 
 	// Sampling temperature to use
-	Temperature *float32 `yaml:"temperature,omitempty"`
+	Temperature *float32 `yaml:"temperature,omitempty" json:"temperature,omitempty"`
 	// Alternative to temperature for nucleus sampling
-	TopP *float32 `yaml:"top_p,omitempty"`
+	TopP *float32 `yaml:"top_p,omitempty" json:"top_p,omitempty"`
 	// How many choice to create for each prompt
-	N *int `yaml:"n"`
+	N *int `yaml:"n" json:"n,omitempty"`
 	// Include the probabilities of most likely tokens
-	LogProbs *int `yaml:"logprobs"`
+	LogProbs *int `yaml:"logprobs" json:"logprobs,omitempty"`
 	// Up to 4 sequences where the API will stop generating tokens. Response will not contain the stop sequence.
-	Stop []string `yaml:"stop,omitempty"`
-
-	Stream bool `yaml:"stream,omitempty"`
+	Stop []string `yaml:"stop,omitempty" json:"stop,omitempty"`
+
+	Stream bool `yaml:"stream,omitempty" json:"stream,omitempty"`
+
+	// Suffix is the text that comes after the completion, to insert text instead of appending it
+	Suffix string `yaml:"suffix,omitempty" json:"suffix,omitempty"`
+	// Penalize the tokens that already appear in the text, from -2.0 to 2.0
+	PresencePenalty *float32 `yaml:"presence_penalty,omitempty" json:"presence_penalty,omitempty"`
+	// Penalize the tokens by how often they already appear in the text, from -2.0 to 2.0
+	FrequencyPenalty *float32 `yaml:"frequency_penalty,omitempty" json:"frequency_penalty,omitempty"`
+	// Generate BestOf completions server-side and return the N best ones
+	BestOf *int `yaml:"best_of,omitempty" json:"best_of,omitempty"`
+	// LogitBias maps token strings to a bias from -100 (ban) to 100 (exclusive selection).
+	// The strings are tokenized with the encoding of the engine, see encodeLogitBias.
+	LogitBias map[string]float32 `yaml:"logit_bias,omitempty" json:"logit_bias,omitempty"`
+	// Echo back the prompt in addition to the completion
+	Echo bool `yaml:"echo,omitempty" json:"echo,omitempty"`
+	// User identifies the end-user to the API, to monitor abuse
+	User string `yaml:"user,omitempty" json:"user,omitempty"`
+
+	// OnContextOverflow is what to do when the prompt and MaxResponseTokens don't fit
+	// in the context window of the engine: error (the default), truncate or ignore.
+	OnContextOverflow string `yaml:"on_context_overflow,omitempty" json:"on_context_overflow,omitempty"`
 }
 
 func (c *CompletionStepSettings) Clone() *CompletionStepSettings {
@@ -148,6 +285,14 @@ func (c *CompletionStepSettings) Clone() *CompletionStepSettings {
 		LogProbs:          c.LogProbs,
 		Stop:              c.Stop,
 		Stream:            c.Stream,
+		Suffix:            c.Suffix,
+		PresencePenalty:   c.PresencePenalty,
+		FrequencyPenalty:  c.FrequencyPenalty,
+		BestOf:            c.BestOf,
+		LogitBias:         c.LogitBias,
+		Echo:              c.Echo,
+		User:              c.User,
+		OnContextOverflow: c.OnContextOverflow,
 	}
 }
 
@@ -168,13 +313,23 @@ func NewCompletionStepFactory(
 	}
 }
 
-func (csf *CompletionStepFactory) NewStep() (steps.Step[string, string], error) {
+// NewStepSettings returns a copy of the settings used for new steps, sharing the rate limiter
+// and usage tracker of the factory.
+func (csf *CompletionStepFactory) NewStepSettings() *CompletionStepSettings {
 	stepSettings := csf.StepSettings.Clone()
 	if stepSettings.ClientSettings == nil {
 		stepSettings.ClientSettings = csf.ClientSettings.Clone()
 	}
+	return stepSettings
+}
 
-	return NewCompletionStep(stepSettings), nil
+func (csf *CompletionStepFactory) NewStep() (steps.Step[string, string], error) {
+	return NewCompletionStep(csf.NewStepSettings()), nil
+}
+
+// NewChoicesStep creates a step that returns all the N choices of the completion, not just the first.
+func (csf *CompletionStepFactory) NewChoicesStep() (steps.Step[string, []backends.CompletionChoice], error) {
+	return NewCompletionChoicesStep(csf.NewStepSettings()), nil
 }
 
 type CompletionStepFactoryFlagsDefaults struct {
@@ -186,6 +341,13 @@ type CompletionStepFactoryFlagsDefaults struct {
 	LogProbs          *int
 	Stop              *[]string
 	Stream            *bool
+	Suffix            *string
+	PresencePenalty   *float32
+	FrequencyPenalty  *float32
+	BestOf            *int
+	LogitBias         *map[string]float32
+	Echo              *bool
+	OnContextOverflow *string
 }
 
 func (csf *CompletionStepFactory) AddFlags(cmd *cobra.Command, prefix string, defaults interface{}) error {
@@ -244,6 +406,52 @@ func (csf *CompletionStepFactory) AddFlags(cmd *cobra.Command, prefix string, de
 	}
 	cmd.PersistentFlags().Bool(prefix+"stream", defaultStream, "Stream the response")
 
+	defaultSuffix := ""
+	if csfDefaults.Suffix != nil {
+		defaultSuffix = *csfDefaults.Suffix
+	}
+	cmd.PersistentFlags().String(prefix+"suffix", defaultSuffix, "Text that comes after the completion, to insert text instead of appending it")
+	cmd.PersistentFlags().String(prefix+"suffix-file", "", "Read the suffix from a file, to fill the gap between the prompt and the file")
+
+	defaultPresencePenalty := float32(0.0)
+	if csfDefaults.PresencePenalty != nil {
+		defaultPresencePenalty = *csfDefaults.PresencePenalty
+	}
+	cmd.PersistentFlags().Float32(prefix+"presence-penalty", defaultPresencePenalty, "Penalize the tokens that already appear in the text, from -2.0 to 2.0")
+
+	defaultFrequencyPenalty := float32(0.0)
+	if csfDefaults.FrequencyPenalty != nil {
+		defaultFrequencyPenalty = *csfDefaults.FrequencyPenalty
+	}
+	cmd.PersistentFlags().Float32(prefix+"frequency-penalty", defaultFrequencyPenalty, "Penalize the tokens by how often they already appear in the text, from -2.0 to 2.0")
+
+	defaultBestOf := 0
+	if csfDefaults.BestOf != nil {
+		defaultBestOf = *csfDefaults.BestOf
+	}
+	cmd.PersistentFlags().Int(prefix+"best-of", defaultBestOf, "Generate this many completions server-side and return the n best ones")
+
+	defaultLogitBias := map[string]string{}
+	if csfDefaults.LogitBias != nil {
+		for token, bias := range *csfDefaults.LogitBias {
+			defaultLogitBias[token] = strconv.FormatFloat(float64(bias), 'f', -1, 32)
+		}
+	}
+	cmd.PersistentFlags().StringToString(prefix+"logit-bias", defaultLogitBias, "Bias of token strings, from -100 (ban) to 100, for example ' yes=10,no=-100'")
+
+	defaultEcho := false
+	if csfDefaults.Echo != nil {
+		defaultEcho = *csfDefaults.Echo
+	}
+	cmd.PersistentFlags().Bool(prefix+"echo", defaultEcho, "Echo back the prompt in addition to the completion")
+
+	defaultOnContextOverflow := ContextOverflowError
+	if csfDefaults.OnContextOverflow != nil {
+		defaultOnContextOverflow = *csfDefaults.OnContextOverflow
+	}
+	cmd.PersistentFlags().String(prefix+"on-context-overflow", defaultOnContextOverflow,
+		"What to do when the prompt doesn't fit in the context window of the engine (error, truncate, ignore)")
+
 	csf.flagsPrefix = prefix
 
 	return nil
@@ -255,6 +463,18 @@ func (csf *CompletionStepFactory) UpdateFromCobra(cmd *cobra.Command) error {
 	if apiKey != "" {
 		csf.ClientSettings.APIKey = &apiKey
 	}
+	err := csf.ClientSettings.UpdateRetryFromCobra(cmd)
+	if err != nil {
+		return err
+	}
+	err = csf.ClientSettings.UpdateLimiterFromCobra(cmd)
+	if err != nil {
+		return err
+	}
+	err = csf.ClientSettings.UpdateCacheFromCobra(cmd)
+	if err != nil {
+		return err
+	}
 
 	if cmd.Flags().Changed(prefix+"engine") || csf.flagsDefaults.Engine != nil {
 		engine := cmd.Flag(prefix + "engine").Value.String()
@@ -282,7 +502,7 @@ func (csf *CompletionStepFactory) UpdateFromCobra(cmd *cobra.Command) error {
 		csf.StepSettings.TopP = &topP
 	}
 
-	if cmd.Flags().Changed(prefix+"n") || csf.flagsDefaults.Temperature != nil {
+	if cmd.Flags().Changed(prefix+"n") || csf.flagsDefaults.N != nil {
 		n, err := cmd.PersistentFlags().GetInt(prefix + "n")
 		if err != nil {
 			return err
@@ -304,6 +524,92 @@ func (csf *CompletionStepFactory) UpdateFromCobra(cmd *cobra.Command) error {
 		}
 		csf.StepSettings.Stop = stop
 	}
+	if cmd.Flags().Changed(prefix+"stream") || csf.flagsDefaults.Stream != nil {
+		stream, err := cmd.PersistentFlags().GetBool(prefix + "stream")
+		if err != nil {
+			return err
+		}
+		csf.StepSettings.Stream = stream
+	}
+	if cmd.Flags().Changed(prefix+"suffix") || csf.flagsDefaults.Suffix != nil {
+		suffix, err := cmd.PersistentFlags().GetString(prefix + "suffix")
+		if err != nil {
+			return err
+		}
+		csf.StepSettings.Suffix = suffix
+	}
+	if cmd.Flags().Changed(prefix + "suffix-file") {
+		if cmd.Flags().Changed(prefix + "suffix") {
+			return fmt.Errorf("only one of --%ssuffix and --%ssuffix-file can be set", prefix, prefix)
+		}
+		suffixFile, err := cmd.PersistentFlags().GetString(prefix + "suffix-file")
+		if err != nil {
+			return err
+		}
+		suffix, err := os.ReadFile(suffixFile)
+		if err != nil {
+			return err
+		}
+		csf.StepSettings.Suffix = string(suffix)
+	}
+	if cmd.Flags().Changed(prefix+"presence-penalty") || csf.flagsDefaults.PresencePenalty != nil {
+		presencePenalty, err := cmd.PersistentFlags().GetFloat32(prefix + "presence-penalty")
+		if err != nil {
+			return err
+		}
+		csf.StepSettings.PresencePenalty = &presencePenalty
+	}
+	if cmd.Flags().Changed(prefix+"frequency-penalty") || csf.flagsDefaults.FrequencyPenalty != nil {
+		frequencyPenalty, err := cmd.PersistentFlags().GetFloat32(prefix + "frequency-penalty")
+		if err != nil {
+			return err
+		}
+		csf.StepSettings.FrequencyPenalty = &frequencyPenalty
+	}
+	if cmd.Flags().Changed(prefix+"best-of") || csf.flagsDefaults.BestOf != nil {
+		bestOf, err := cmd.PersistentFlags().GetInt(prefix + "best-of")
+		if err != nil {
+			return err
+		}
+		csf.StepSettings.BestOf = &bestOf
+	}
+	if cmd.Flags().Changed(prefix+"logit-bias") || csf.flagsDefaults.LogitBias != nil {
+		biases, err := cmd.PersistentFlags().GetStringToString(prefix + "logit-bias")
+		if err != nil {
+			return err
+		}
+		logitBias := map[string]float32{}
+		for token, s := range biases {
+			bias, err := strconv.ParseFloat(s, 32)
+			if err != nil {
+				return fmt.Errorf("invalid logit bias %s for %q", s, token)
+			}
+			logitBias[token] = float32(bias)
+		}
+		csf.StepSettings.LogitBias = logitBias
+	}
+	if cmd.Flags().Changed(prefix+"echo") || csf.flagsDefaults.Echo != nil {
+		echo, err := cmd.PersistentFlags().GetBool(prefix + "echo")
+		if err != nil {
+			return err
+		}
+		csf.StepSettings.Echo = echo
+	}
+	// user is a client flag, shared by all the factories of the command
+	if cmd.Flags().Lookup("user") != nil && cmd.Flags().Changed("user") {
+		user, err := cmd.Flags().GetString("user")
+		if err != nil {
+			return err
+		}
+		csf.StepSettings.User = user
+	}
+	if cmd.Flags().Changed(prefix+"on-context-overflow") || csf.flagsDefaults.OnContextOverflow != nil {
+		onContextOverflow, err := cmd.PersistentFlags().GetString(prefix + "on-context-overflow")
+		if err != nil {
+			return err
+		}
+		csf.StepSettings.OnContextOverflow = onContextOverflow
+	}
 
 	return nil
 }
@@ -320,10 +626,14 @@ func (csf *CompletionStepFactory) UpdateFromCobra(cmd *cobra.Command) error {
 //			      max_total_tokens: 100
 //		       ...
 //
+// The key of the factory selects the backend: openai uses the OpenAI API, openai-compatible
+// uses a server implementing the OpenAI REST API at client.base_url.
+//
 // TODO(manuel, 2023-01-27) Maybe look into better YAML handling using UnmarshalYAML overloading
 type factoryConfigFileWrapper struct {
 	Factories struct {
-		OpenAI *CompletionStepFactory `yaml:"openai"`
+		OpenAI           *CompletionStepFactory `yaml:"openai"`
+		OpenAICompatible *CompletionStepFactory `yaml:"openai-compatible"`
 	} `yaml:"factories"`
 }
 
@@ -333,13 +643,30 @@ func NewCompletionStepFactoryFromYAML(s io.Reader) (*CompletionStepFactory, erro
 		return nil, err
 	}
 
-	if settings.Factories.OpenAI == nil {
-		settings.Factories.OpenAI = NewCompletionStepFactory(NewCompletionStepSettings(), NewClientSettings())
+	factory := settings.Factories.OpenAI
+	backend := BackendOpenAI
+	if settings.Factories.OpenAICompatible != nil {
+		if factory != nil {
+			return nil, fmt.Errorf("only one of the openai and openai-compatible factories can be declared")
+		}
+		factory = settings.Factories.OpenAICompatible
+		backend = BackendOpenAICompatible
+	}
+
+	if factory == nil {
+		factory = NewCompletionStepFactory(NewCompletionStepSettings(), NewClientSettings())
+	}
+	if factory.StepSettings == nil {
+		factory.StepSettings = NewCompletionStepSettings()
+	}
+	if factory.ClientSettings == nil {
+		factory.ClientSettings = NewClientSettings()
 	}
+	factory.ClientSettings.Backend = backend
 
 	return NewCompletionStepFactory(
-		settings.Factories.OpenAI.StepSettings,
-		settings.Factories.OpenAI.ClientSettings,
+		factory.StepSettings,
+		factory.ClientSettings,
 	), nil
 }
 
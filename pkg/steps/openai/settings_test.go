@@ -0,0 +1,81 @@
+package openai
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wesen/geppetto/pkg/backends"
+	"gopkg.in/yaml.v3"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClientSettingsYAML(t *testing.T) {
+	factory, err := NewCompletionStepFactoryFromYAML(strings.NewReader(`
+factories:
+  openai-compatible:
+    client:
+      api_key: test-key
+      base_url: http://localhost:8080/v1
+      organization: org
+      timeout: 120
+    completion:
+      engine: local-model
+`))
+	require.Nil(t, err)
+
+	settings := factory.ClientSettings
+	assert.Equal(t, BackendOpenAICompatible, settings.Backend)
+	require.NotNil(t, settings.APIKey)
+	assert.Equal(t, "test-key", *settings.APIKey)
+	require.NotNil(t, settings.BaseURL)
+	assert.Equal(t, "http://localhost:8080/v1", *settings.BaseURL)
+	require.NotNil(t, settings.Organization)
+	assert.Equal(t, "org", *settings.Organization)
+	require.NotNil(t, settings.Timeout)
+	assert.Equal(t, 120*time.Second, *settings.Timeout)
+
+	b, err := yaml.Marshal(settings)
+	require.Nil(t, err)
+	assert.Contains(t, string(b), "timeout: 120\n")
+
+	parsed := &ClientSettings{}
+	require.Nil(t, yaml.Unmarshal(b, parsed))
+	assert.Equal(t, settings.APIKey, parsed.APIKey)
+	assert.Equal(t, settings.BaseURL, parsed.BaseURL)
+	assert.Equal(t, settings.Organization, parsed.Organization)
+	assert.Equal(t, settings.Timeout, parsed.Timeout)
+	// the backend is selected by the key of the factory, not by the client settings
+	assert.Equal(t, "", parsed.Backend)
+}
+
+func TestClientSettingsRetryYAML(t *testing.T) {
+	factory, err := NewCompletionStepFactoryFromYAML(strings.NewReader(`
+factories:
+  openai:
+    client:
+      api_key: test
+      retry:
+        max_retries: 5
+        backoff_base: 500ms
+        respect_retry_after: false
+`))
+	require.Nil(t, err)
+
+	retry := factory.ClientSettings.Retry
+	require.NotNil(t, retry)
+	assert.Equal(t, 5, retry.MaxRetries)
+	assert.Equal(t, 500*time.Millisecond, retry.BackoffBase)
+	assert.False(t, retry.RespectRetryAfter)
+	// the keys that are not set keep their default value
+	assert.Equal(t, 30*time.Second, retry.BackoffCap)
+	assert.Contains(t, retry.RetryableStatusCodes, 429)
+
+	backend, err := factory.ClientSettings.CreateBackend()
+	require.Nil(t, err)
+	_, ok := backend.(*backends.RetryBackend)
+	assert.True(t, ok)
+
+	// the settings are copied by the steps
+	assert.Equal(t, 5, factory.NewStepSettings().ClientSettings.Retry.MaxRetries)
+}
@@ -0,0 +1,336 @@
+package steps
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"github.com/wesen/geppetto/pkg/helpers"
+	"github.com/wesen/geppetto/pkg/recorder"
+	"github.com/wesen/geppetto/pkg/schema"
+	"gopkg.in/errgo.v2/fmt/errors"
+	"gopkg.in/yaml.v3"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	OutputParserCodeBlock = "code-block"
+	OutputParserMarkers   = "markers"
+	OutputParserJSON      = "json"
+	OutputParserYAML      = "yaml"
+	OutputParserCSV       = "csv"
+	OutputParserRegex     = "regex"
+)
+
+// OutputParser extracts text or data from the text output of a step.
+type OutputParser func(s string) (interface{}, error)
+
+// NewOutputParser creates the parser described by d. The code-block and markers parsers
+// return a string, the others decoded data (maps, lists and scalars).
+func NewOutputParser(d *OutputParserDescription) (OutputParser, error) {
+	switch d.Type {
+	case OutputParserCodeBlock:
+		return func(s string) (interface{}, error) {
+			return extractCodeBlock(s, d.Language)
+		}, nil
+	case OutputParserMarkers:
+		if d.Begin == "" && d.End == "" {
+			return nil, errors.Newf("markers parser needs a begin or end marker")
+		}
+		return func(s string) (interface{}, error) {
+			return extractBetweenMarkers(s, d.Begin, d.End), nil
+		}, nil
+	case OutputParserJSON:
+		return parseJSON, nil
+	case OutputParserYAML:
+		return parseYAML, nil
+	case OutputParserCSV:
+		return parseCSV, nil
+	case OutputParserRegex:
+		re, err := regexp.Compile(d.Pattern)
+		if err != nil {
+			return nil, errors.Notef(err, nil, "invalid regex parser pattern")
+		}
+		return func(s string) (interface{}, error) {
+			return parseRegex(re, s)
+		}, nil
+	default:
+		return nil, errors.Newf("unknown output parser %s", d.Type)
+	}
+}
+
+func isTextParser(type_ string) bool {
+	return type_ == OutputParserCodeBlock || type_ == OutputParserMarkers
+}
+
+// extractCodeBlock returns the content of the first fenced code block in s, or of the first one
+// in language. An unclosed block extends to the end of s.
+func extractCodeBlock(s string, language string) (string, error) {
+	lines := strings.Split(s, "\n")
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimSpace(lines[i])
+		fenceLength := len(line) - len(strings.TrimLeft(line, "`"))
+		if fenceLength < 3 {
+			continue
+		}
+		info := strings.Fields(line[fenceLength:])
+		matches := language == "" || (len(info) > 0 && info[0] == language)
+
+		content := []string{}
+		for i++; i < len(lines); i++ {
+			closing := strings.TrimSpace(lines[i])
+			if len(closing) >= fenceLength && strings.Trim(closing, "`") == "" {
+				break
+			}
+			content = append(content, lines[i])
+		}
+		if matches {
+			return strings.Join(content, "\n"), nil
+		}
+	}
+
+	if language != "" {
+		return "", errors.Newf("no %s code block found", language)
+	}
+	return "", errors.Newf("no code block found")
+}
+
+// extractBetweenMarkers returns the text between begin and end, trimmed of surrounding newlines.
+func extractBetweenMarkers(s string, begin string, end string) string {
+	if begin != "" {
+		if idx := strings.Index(s, begin); idx != -1 {
+			s = s[idx+len(begin):]
+		}
+	}
+	if end != "" {
+		if idx := strings.Index(s, end); idx != -1 {
+			s = s[:idx]
+		}
+	}
+	return strings.Trim(s, "\r\n")
+}
+
+func parseJSON(s string) (interface{}, error) {
+	var ret interface{}
+	err := json.Unmarshal([]byte(strings.TrimSpace(s)), &ret)
+	if err != nil {
+		return nil, errors.Notef(err, nil, "invalid JSON")
+	}
+	return ret, nil
+}
+
+func parseYAML(s string) (interface{}, error) {
+	var ret interface{}
+	err := yaml.Unmarshal([]byte(s), &ret)
+	if err != nil {
+		return nil, errors.Notef(err, nil, "invalid YAML")
+	}
+	if ret == nil {
+		return nil, errors.Newf("empty YAML")
+	}
+	return ret, nil
+}
+
+// parseCSV returns the rows of s as a list of objects, using the first row as header.
+func parseCSV(s string) (interface{}, error) {
+	r := csv.NewReader(strings.NewReader(strings.TrimSpace(s)))
+	r.TrimLeadingSpace = true
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, errors.Notef(err, nil, "invalid CSV")
+	}
+	if len(records) == 0 {
+		return nil, errors.Newf("empty CSV")
+	}
+
+	header := records[0]
+	ret := []interface{}{}
+	for _, record := range records[1:] {
+		row := map[string]interface{}{}
+		for i, name := range header {
+			if i < len(record) {
+				row[name] = record[i]
+			}
+		}
+		ret = append(ret, row)
+	}
+	return ret, nil
+}
+
+// parseRegex returns an object per match of re, containing its groups by name, or by
+// number for unnamed groups. If re has no groups, the object contains the whole match.
+func parseRegex(re *regexp.Regexp, s string) (interface{}, error) {
+	matches := re.FindAllStringSubmatch(s, -1)
+	if len(matches) == 0 {
+		return nil, errors.Newf("no match for %s", re.String())
+	}
+
+	names := re.SubexpNames()
+	ret := []interface{}{}
+	for _, match := range matches {
+		row := map[string]interface{}{}
+		if len(match) == 1 {
+			row["match"] = match[0]
+		}
+		for i := 1; i < len(match); i++ {
+			name := names[i]
+			if name == "" {
+				name = strconv.Itoa(i)
+			}
+			row[name] = match[i]
+		}
+		ret = append(ret, row)
+	}
+	return ret, nil
+}
+
+// OutputProcessor runs the parsers of an OutputDescription in order, and validates the result.
+type OutputProcessor struct {
+	description *OutputDescription
+	parsers     []OutputParser
+	schema      map[string]interface{}
+}
+
+// NewOutputProcessor checks the description: only the last parser can return data,
+// since all the parsers expect text.
+func NewOutputProcessor(d *OutputDescription) (*OutputProcessor, error) {
+	ret := &OutputProcessor{description: d, schema: d.Schema}
+	for i, pd := range d.Parsers {
+		if i < len(d.Parsers)-1 && !isTextParser(pd.Type) {
+			return nil, errors.Newf("output parser %s has to be the last parser", pd.Type)
+		}
+		parser, err := NewOutputParser(pd)
+		if err != nil {
+			return nil, err
+		}
+		ret.parsers = append(ret.parsers, parser)
+	}
+	if d.Schema != nil && (len(d.Parsers) == 0 || isTextParser(d.Parsers[len(d.Parsers)-1].Type)) {
+		return nil, errors.Newf("output schema needs a json, yaml, csv or regex parser")
+	}
+	return ret, nil
+}
+
+// Process returns the parsed output. It is a string if the processor has only text parsers.
+func (p *OutputProcessor) Process(s string) (interface{}, error) {
+	var ret interface{} = s
+	for _, parser := range p.parsers {
+		var err error
+		ret, err = parser(ret.(string))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if p.schema != nil {
+		err := schema.Validate(p.schema, ret)
+		if err != nil {
+			return nil, errors.Notef(err, nil, "output doesn't match schema")
+		}
+	}
+	return ret, nil
+}
+
+// RepromptCompletion asks a completion model to correct its previous output.
+func RepromptCompletion(prompt string, output string, err error) string {
+	return fmt.Sprintf("%s%s\n\nThe output above is invalid: %s\nCorrected output:\n", prompt, output, err)
+}
+
+type OutputStepState int
+
+const (
+	OutputStepNotStarted OutputStepState = iota
+	OutputStepRunning
+	OutputStepFinished
+	OutputStepClosed
+)
+
+// OutputStep runs a step created by factory and processes its output. If the output can't
+// be parsed or validated, the input is updated by reprompt to explain the error to the model,
+// and a new step is run, up to maxRetries times.
+//
+// The steps created by the factory are not expected to stream, since their deltas are
+// not forwarded.
+type OutputStep[A any] struct {
+	factory    StepFactory[A, string]
+	processor  *OutputProcessor
+	maxRetries int
+	reprompt   func(a A, output string, err error) A
+	output     chan helpers.Result[interface{}]
+	state      OutputStepState
+}
+
+func NewOutputStep[A any](
+	factory StepFactory[A, string],
+	processor *OutputProcessor,
+	maxRetries int,
+	reprompt func(a A, output string, err error) A,
+) *OutputStep[A] {
+	return &OutputStep[A]{
+		factory:    factory,
+		processor:  processor,
+		maxRetries: maxRetries,
+		reprompt:   reprompt,
+		output:     make(chan helpers.Result[interface{}]),
+		state:      OutputStepNotStarted,
+	}
+}
+
+func (o *OutputStep[A]) Run(ctx context.Context, a A) error {
+	o.state = OutputStepRunning
+	defer func() {
+		o.state = OutputStepClosed
+		close(o.output)
+	}()
+
+	ctx, rec := recorder.StartStep(ctx, "output", a)
+	rec.SetMetadata("output", o.processor.description)
+
+	for retry := 0; ; retry++ {
+		rec.SetMetadata("attempts", retry+1)
+		s, err := runStep(ctx, o.factory, a)
+		if err != nil {
+			rec.Finish(nil, err)
+			o.state = OutputStepFinished
+			o.output <- helpers.NewErrorResult[interface{}](err)
+			return nil
+		}
+
+		v, err := o.processor.Process(s)
+		if err == nil {
+			rec.Finish(v, nil)
+			o.state = OutputStepFinished
+			o.output <- helpers.NewValueResult(v)
+			return nil
+		}
+
+		if retry >= o.maxRetries || o.reprompt == nil {
+			err = errors.Notef(err, nil, "invalid output after %d attempts", retry+1)
+			rec.Finish(nil, err)
+			o.state = OutputStepFinished
+			o.output <- helpers.NewErrorResult[interface{}](err)
+			return nil
+		}
+
+		log.Warn().
+			Int("attempt", retry+1).
+			Err(err).
+			Msg("invalid output, asking for a correction")
+		a = o.reprompt(a, s, err)
+	}
+}
+
+func (o *OutputStep[A]) GetOutput() <-chan helpers.Result[interface{}] {
+	return o.output
+}
+
+func (o *OutputStep[A]) GetState() interface{} {
+	return o.state
+}
+
+func (o *OutputStep[A]) IsFinished() bool {
+	return o.state == OutputStepFinished
+}
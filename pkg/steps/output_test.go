@@ -0,0 +1,127 @@
+package steps
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestExtractCodeBlock(t *testing.T) {
+	s := "Here you go:\n```sh\nls\n```\n\n````go\nfmt.Println(\"```\")\n````\nDone."
+
+	block, err := extractCodeBlock(s, "")
+	require.Nil(t, err)
+	assert.Equal(t, "ls", block)
+
+	block, err = extractCodeBlock(s, "go")
+	require.Nil(t, err)
+	assert.Equal(t, "fmt.Println(\"```\")", block)
+
+	_, err = extractCodeBlock(s, "python")
+	assert.Error(t, err)
+
+	// a stop sequence can cut the closing fence
+	block, err = extractCodeBlock("```json\n{}\n", "json")
+	require.Nil(t, err)
+	assert.Equal(t, "{}\n", block)
+}
+
+func TestExtractBetweenMarkers(t *testing.T) {
+	assert.Equal(t, "a: 1", extractBetweenMarkers("blah\n---BEGIN---\na: 1\n---END---\n", "---BEGIN---", "---END---"))
+	assert.Equal(t, "a: 1", extractBetweenMarkers("a: 1\n", "---BEGIN---", "---END---"))
+}
+
+func TestDataParsers(t *testing.T) {
+	v, err := parseCSV("name, age\nmanuel, 40\nbob, 3\n")
+	require.Nil(t, err)
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"name": "manuel", "age": "40"},
+		map[string]interface{}{"name": "bob", "age": "3"},
+	}, v)
+
+	v, err = parseRegex(regexp.MustCompile(`(?P<name>\w+)=(\d+)`), "a=1, b=2")
+	require.Nil(t, err)
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"name": "a", "2": "1"},
+		map[string]interface{}{"name": "b", "2": "2"},
+	}, v)
+
+	_, err = parseJSON("not json")
+	assert.Error(t, err)
+}
+
+func TestOutputProcessor(t *testing.T) {
+	p, err := NewOutputProcessor(&OutputDescription{
+		Parsers: []*OutputParserDescription{
+			{Type: OutputParserCodeBlock, Language: "yaml"},
+			{Type: OutputParserYAML},
+		},
+		Schema: map[string]interface{}{"type": "object", "required": []interface{}{"name"}},
+	})
+	require.Nil(t, err)
+
+	v, err := p.Process("Sure!\n```yaml\nname: foo\n```")
+	require.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{"name": "foo"}, v)
+
+	_, err = p.Process("```yaml\ntitle: foo\n```")
+	assert.Error(t, err)
+
+	_, err = NewOutputProcessor(&OutputDescription{
+		Parsers: []*OutputParserDescription{{Type: OutputParserJSON}, {Type: OutputParserMarkers, Begin: "---"}},
+	})
+	assert.Error(t, err)
+
+	_, err = NewOutputProcessor(&OutputDescription{
+		Parsers: []*OutputParserDescription{{Type: OutputParserMarkers, Begin: "---"}},
+		Schema:  map[string]interface{}{"type": "object"},
+	})
+	assert.Error(t, err)
+}
+
+// answersFactory creates steps that return the next answer, and records the prompts.
+type answersFactory struct {
+	answers []string
+	prompts []string
+}
+
+func (a *answersFactory) NewStep() (Step[string, string], error) {
+	return NewSimpleStep(func(prompt string) string {
+		a.prompts = append(a.prompts, prompt)
+		answer := a.answers[0]
+		a.answers = a.answers[1:]
+		return answer
+	}), nil
+}
+
+func runOutputStep(t *testing.T, s *OutputStep[string], prompt string) (interface{}, error) {
+	go func() {
+		require.Nil(t, s.Run(context.Background(), prompt))
+	}()
+	result, ok := <-s.GetOutput()
+	require.True(t, ok)
+	return result.Value()
+}
+
+func TestOutputStepReprompts(t *testing.T) {
+	p, err := NewOutputProcessor(&OutputDescription{
+		Parsers: []*OutputParserDescription{{Type: OutputParserJSON}},
+	})
+	require.Nil(t, err)
+
+	factory := &answersFactory{answers: []string{"oops", `{"a": 1}`}}
+	v, err := runOutputStep(t, NewOutputStep[string](factory, p, 1, RepromptCompletion), "Give me JSON: ")
+	require.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{"a": float64(1)}, v)
+
+	require.Len(t, factory.prompts, 2)
+	assert.True(t, strings.HasPrefix(factory.prompts[1], "Give me JSON: oops\n\nThe output above is invalid: invalid JSON"))
+
+	factory = &answersFactory{answers: []string{"oops", "still not json"}}
+	_, err = runOutputStep(t, NewOutputStep[string](factory, p, 1, RepromptCompletion), "Give me JSON: ")
+	assert.Error(t, err)
+	assert.Len(t, factory.prompts, 2)
+}
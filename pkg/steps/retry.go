@@ -0,0 +1,105 @@
+package steps
+
+import (
+	"context"
+	"github.com/rs/zerolog/log"
+	"github.com/wesen/geppetto/pkg/helpers"
+	"github.com/wesen/geppetto/pkg/recorder"
+	"time"
+)
+
+// RetryPolicy decides if and when a failed step is run again.
+// backends.RetrySettings implements it for API errors.
+type RetryPolicy interface {
+	// ShouldRetry returns the delay to wait before the retry with the given number (starting at 0),
+	// or false if err should not be retried.
+	ShouldRetry(retry int, err error) (time.Duration, bool)
+}
+
+type RetryStepState int
+
+const (
+	RetryStepNotStarted RetryStepState = iota
+	RetryStepRunning
+	RetryStepFinished
+	RetryStepClosed
+)
+
+// RetryStep runs a step created by a StepFactory, and creates and runs a new step with
+// the same input when it fails, as long as the RetryPolicy allows it.
+//
+// The steps created by the factory are not expected to stream, since their deltas are
+// not forwarded.
+type RetryStep[A, B any] struct {
+	factory StepFactory[A, B]
+	policy  RetryPolicy
+	output  chan helpers.Result[B]
+	state   RetryStepState
+}
+
+func NewRetryStep[A, B any](factory StepFactory[A, B], policy RetryPolicy) *RetryStep[A, B] {
+	return &RetryStep[A, B]{
+		factory: factory,
+		policy:  policy,
+		output:  make(chan helpers.Result[B]),
+		state:   RetryStepNotStarted,
+	}
+}
+
+func (r *RetryStep[A, B]) Run(ctx context.Context, a A) error {
+	r.state = RetryStepRunning
+	defer func() {
+		r.state = RetryStepClosed
+		close(r.output)
+	}()
+
+	ctx, rec := recorder.StartStep(ctx, "retry", a)
+
+	for retry := 0; ; retry++ {
+		rec.SetMetadata("attempts", retry+1)
+		b, err := runStep(ctx, r.factory, a)
+		if err == nil {
+			rec.Finish(b, nil)
+			r.state = RetryStepFinished
+			r.output <- helpers.NewValueResult(b)
+			return nil
+		}
+
+		delay, ok := r.policy.ShouldRetry(retry, err)
+		if !ok {
+			rec.Finish(nil, err)
+			r.state = RetryStepFinished
+			r.output <- helpers.NewErrorResult[B](err)
+			return nil
+		}
+
+		log.Warn().
+			Int("attempt", retry+1).
+			Dur("delay", delay).
+			Err(err).
+			Msg("step failed, retrying")
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			rec.Finish(nil, ctx.Err())
+			r.state = RetryStepFinished
+			r.output <- helpers.NewErrorResult[B](ctx.Err())
+			return nil
+		case <-timer.C:
+		}
+	}
+}
+
+func (r *RetryStep[A, B]) GetOutput() <-chan helpers.Result[B] {
+	return r.output
+}
+
+func (r *RetryStep[A, B]) GetState() interface{} {
+	return r.state
+}
+
+func (r *RetryStep[A, B]) IsFinished() bool {
+	return r.state == RetryStepFinished
+}
@@ -0,0 +1,62 @@
+package steps
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wesen/geppetto/pkg/helpers"
+	"gopkg.in/errgo.v2/fmt/errors"
+	"testing"
+	"time"
+)
+
+type testRetryPolicy struct {
+	maxRetries int
+}
+
+func (t *testRetryPolicy) ShouldRetry(retry int, err error) (time.Duration, bool) {
+	return time.Millisecond, retry < t.maxRetries
+}
+
+func newFailingStepFactory(failures int, calls *int) StepFactory[int, int] {
+	return StepFactoryFunc[int, int](func() (Step[int, int], error) {
+		return NewSimpleResultStep(func(a int) helpers.Result[int] {
+			*calls++
+			if *calls <= failures {
+				return helpers.NewErrorResult[int](errors.Newf("failure %d", *calls))
+			}
+			return helpers.NewValueResult(a * 2)
+		}), nil
+	})
+}
+
+func TestRetryStepSucceedsAfterFailures(t *testing.T) {
+	calls := 0
+	s := NewRetryStep(newFailingStepFactory(2, &calls), &testRetryPolicy{maxRetries: 3})
+
+	go func() {
+		require.Nil(t, s.Run(context.Background(), 21))
+	}()
+
+	v, ok := <-s.GetOutput()
+	require.True(t, ok)
+	value, err := v.Value()
+	require.Nil(t, err)
+	assert.Equal(t, 42, value)
+	assert.Equal(t, 3, calls)
+}
+
+func TestRetryStepGivesUp(t *testing.T) {
+	calls := 0
+	s := NewRetryStep(newFailingStepFactory(5, &calls), &testRetryPolicy{maxRetries: 2})
+
+	go func() {
+		require.Nil(t, s.Run(context.Background(), 21))
+	}()
+
+	v, ok := <-s.GetOutput()
+	require.True(t, ok)
+	_, err := v.Value()
+	assert.EqualError(t, err, "failure 3")
+	assert.Equal(t, 3, calls)
+}
@@ -1,5 +1,10 @@
 package steps
 
+import "github.com/wesen/geppetto/pkg/chunking"
+
+// StepTypeMulti renders and runs the prompt once per element of the MultiInput parameter
+const StepTypeMulti = "multi"
+
 type StepDescription struct {
 	Type string `yaml:"type"`
 
@@ -8,4 +13,64 @@ type StepDescription struct {
 	//
 	// MultiInput is just the name of the input parameter used to iterate over the prompt
 	MultiInput string `yaml:"multi_input,omitempty"`
+	// Concurrency is the number of elements of MultiInput processed at the same time
+	Concurrency int `yaml:"concurrency,omitempty"`
+	// Chunk splits the documents of MultiInput (strings or files) into chunks, and renders the
+	// prompt once per chunk instead of once per element
+	Chunk *chunking.Settings `yaml:"chunk,omitempty"`
+}
+
+// ChainStepDescription describes a step that can be used in a chain.
+//
+// The prompt is a go template, rendered when the step is executed, with the parameters
+// of the command and the inputs wired to the step by the chain.
+type ChainStepDescription struct {
+	// Type is either completion (the default) or template, which only renders the prompt
+	Type   string `yaml:"type,omitempty"`
+	Prompt string `yaml:"prompt"`
+	// PromptFile is loaded into Prompt by the command loader, relative to the command file
+	PromptFile string `yaml:"prompt_file,omitempty"`
+}
+
+// ChainEntry instantiates a step in a chain, and wires its inputs.
+type ChainEntry struct {
+	// ID is used to reference the output of the entry, and defaults to the name of the step
+	ID   string `yaml:"id,omitempty"`
+	Step string `yaml:"step"`
+	// Inputs maps the names used in the prompt template to references of the form
+	// arguments.<name>, flags.<name> or steps.<id>.output
+	Inputs map[string]string `yaml:"inputs,omitempty"`
+}
+
+// ChainDescription lists the steps of a chain. The entries are run as soon as the
+// steps they reference have finished, so independent entries run concurrently.
+type ChainDescription struct {
+	Pipe []*ChainEntry `yaml:"pipe"`
+	// Outputs are the IDs of the entries whose output is returned, by default the last entry
+	Outputs []string `yaml:"outputs,omitempty"`
+}
+
+// OutputParserDescription describes how to extract data from the text returned by a step.
+type OutputParserDescription struct {
+	// Type is one of code-block, markers, json, yaml, csv or regex
+	Type string `yaml:"type" json:"type,omitempty"`
+	// Language selects the code block to extract (code-block), by default the first one
+	Language string `yaml:"language,omitempty" json:"language,omitempty"`
+	// Begin and End delimit the extracted text (markers). A missing marker extends the text
+	// to the start or end of the output, which works well with stop sequences.
+	Begin string `yaml:"begin,omitempty" json:"begin,omitempty"`
+	End   string `yaml:"end,omitempty" json:"end,omitempty"`
+	// Pattern is the regular expression whose groups are extracted from every match (regex)
+	Pattern string `yaml:"pattern,omitempty" json:"pattern,omitempty"`
+}
+
+// OutputDescription post-processes the output of a command by running parsers in order,
+// and optionally validating the result against a JSON Schema.
+type OutputDescription struct {
+	Parsers []*OutputParserDescription `yaml:"parsers" json:"parsers,omitempty"`
+	// Schema is a JSON Schema (written in YAML) the parsed output has to match
+	Schema map[string]interface{} `yaml:"schema,omitempty" json:"schema,omitempty"`
+	// MaxRetries is the number of times the model is asked to correct an output that could
+	// not be parsed or validated.
+	MaxRetries int `yaml:"max_retries,omitempty" json:"max_retries,omitempty"`
 }
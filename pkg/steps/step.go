@@ -2,9 +2,10 @@ package steps
 
 import (
 	"context"
-	"fmt"
+	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
 	"github.com/wesen/geppetto/pkg/helpers"
+	"github.com/wesen/geppetto/pkg/recorder"
 	"golang.org/x/sync/errgroup"
 	"gopkg.in/errgo.v2/fmt/errors"
 )
@@ -18,6 +19,17 @@ type Step[A, B any] interface {
 	IsFinished() bool
 }
 
+// StreamingStep is a Step that also emits partial results (deltas) while it is running,
+// for example the individual chunks of a streamed completion.
+//
+// The delta channel is always closed before the final result is sent on GetOutput(),
+// so a consumer can range over GetDeltaOutput() and then read the final value.
+// If a step emits deltas, they have to be consumed, otherwise Run will block.
+type StreamingStep[A, B, D any] interface {
+	Step[A, B]
+	GetDeltaOutput() <-chan D
+}
+
 type GenericStepFactory interface {
 	AddFlags(cmd *cobra.Command, prefix string, defaults interface{}) error
 	UpdateFromCobra(cmd *cobra.Command) error
@@ -27,6 +39,13 @@ type StepFactory[A, B any] interface {
 	NewStep() (Step[A, B], error)
 }
 
+// StepFactoryFunc adapts a plain function to the StepFactory interface.
+type StepFactoryFunc[A, B any] func() (Step[A, B], error)
+
+func (f StepFactoryFunc[A, B]) NewStep() (Step[A, B], error) {
+	return f()
+}
+
 type SimpleStepState int
 
 const (
@@ -42,13 +61,15 @@ type SimpleStep[A, B any] struct {
 	state        SimpleStepState
 }
 
-func (s *SimpleStep[A, B]) Run(_ context.Context, a A) error {
+func (s *SimpleStep[A, B]) Run(ctx context.Context, a A) error {
 	if s.state != SimpleStepNotStarted {
 		return errors.Newf("step already started")
 	}
 	s.state = SimpleStepRunning
 
+	_, rec := recorder.StartStep(ctx, "simple", a)
 	v := s.stepFunction(a)
+	rec.Finish(v.Value())
 	s.state = SimpleStepFinished
 	s.output <- v
 	defer func() {
@@ -82,6 +103,16 @@ func NewSimpleStep[A any, B any](f func(A) B) Step[A, B] {
 	return s
 }
 
+// NewSimpleResultStep is like NewSimpleStep, but the function can return an error.
+func NewSimpleResultStep[A any, B any](f func(A) helpers.Result[B]) Step[A, B] {
+	s := &SimpleStep[A, B]{
+		stepFunction: f,
+		output:       make(chan helpers.Result[B]),
+		state:        SimpleStepNotStarted,
+	}
+	return s
+}
+
 type PipeStepState int
 
 const (
@@ -110,6 +141,7 @@ func (s *PipeStep[A, B, C]) Run(ctx context.Context, a A) error {
 
 	s.state = PipeStepRunningStep1
 
+	ctx, rec := recorder.StartStep(ctx, "pipe", a)
 	eg, ctx2 := errgroup.WithContext(ctx)
 
 	eg.Go(func() error {
@@ -122,27 +154,32 @@ func (s *PipeStep[A, B, C]) Run(ctx context.Context, a A) error {
 			s.state = PipeStepClosed
 			close(s.output)
 		}()
+		send := func(result helpers.Result[C]) {
+			rec.Finish(result.Value())
+			s.output <- result
+		}
+
 		v_, ok := <-s.step1.GetOutput()
 		if !ok {
 			s.state = PipeStepError
-			s.output <- helpers.NewErrorResult[C](errors.Newf("step 1 closed output channel"))
+			send(helpers.NewErrorResult[C](errors.Newf("step 1 closed output channel")))
 			return nil
 		}
 		v, err := v_.Value()
 		if err != nil {
 			s.state = PipeStepError
-			s.output <- helpers.NewErrorResult[C](err)
+			send(helpers.NewErrorResult[C](err))
 			return nil
 		}
 
 		if ctx.Err() != nil {
 			s.state = PipeStepError
-			s.output <- helpers.NewErrorResult[C](ctx.Err())
+			send(helpers.NewErrorResult[C](ctx.Err()))
 			return nil
 		}
 
 		s.state = PipeStepRunningStep2
-		fmt.Println("Starting step2")
+		log.Debug().Msg("starting step 2")
 
 		eg2, ctx3 := errgroup.WithContext(ctx2)
 		eg2.Go(func() error {
@@ -155,23 +192,23 @@ func (s *PipeStep[A, B, C]) Run(ctx context.Context, a A) error {
 			select {
 			case <-ctx3.Done():
 				s.state = PipeStepError
-				s.output <- helpers.NewErrorResult[C](ctx3.Err())
+				send(helpers.NewErrorResult[C](ctx3.Err()))
 				return nil
 			case v2_, ok := <-s.step2.GetOutput():
 				if !ok {
 					s.state = PipeStepError
-					s.output <- helpers.NewErrorResult[C](errors.Newf("step 2 closed output channel"))
+					send(helpers.NewErrorResult[C](errors.Newf("step 2 closed output channel")))
 					return nil
 				}
 				v2, err := v2_.Value()
 				if err != nil {
 					s.state = PipeStepError
-					s.output <- helpers.NewErrorResult[C](err)
+					send(helpers.NewErrorResult[C](err))
 					return nil
 				}
 
 				s.state = PipeStepFinished
-				s.output <- helpers.NewValueResult(v2)
+				send(helpers.NewValueResult(v2))
 			}
 
 			return nil
@@ -6,6 +6,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/wesen/geppetto/pkg/helpers"
+	"github.com/wesen/geppetto/pkg/recorder"
 	"testing"
 )
 
@@ -95,3 +96,50 @@ func TestPipeStepAsync(t *testing.T) {
 	require.Nil(t, err)
 	assert.Equal(t, "3", value)
 }
+
+func TestTemplateStepFuncs(t *testing.T) {
+	s := NewTemplateStep[map[string]interface{}](`{{ .items | numberedList }}`)
+
+	go func() {
+		require.Nil(t, s.Run(context.Background(), map[string]interface{}{
+			"items": []string{"a", "b"},
+		}))
+	}()
+
+	v, ok := <-s.GetOutput()
+	require.True(t, ok)
+	value, err := v.Value()
+	require.Nil(t, err)
+	assert.Equal(t, "1. a\n2. b", value)
+}
+
+func TestPipeStepRecordsSteps(t *testing.T) {
+	store := recorder.NewStore(t.TempDir())
+	rec, err := store.Create("test", nil)
+	require.Nil(t, err)
+	ctx := recorder.WithRecorder(context.Background(), rec)
+
+	s := NewPipeStep[int, int, string](
+		NewSimpleStep(func(a int) int { return a + 1 }),
+		NewSimpleStep(func(a int) string { return fmt.Sprintf("%d", a) }),
+	)
+	go func() {
+		require.Nil(t, s.Run(ctx, 1))
+	}()
+	_, ok := <-s.GetOutput()
+	require.True(t, ok)
+	require.Nil(t, rec.Finish(nil, nil))
+
+	run, err := store.Load(rec.RunID())
+	require.Nil(t, err)
+	require.Len(t, run.Steps, 3)
+	pipe := run.Children(0)
+	require.Len(t, pipe, 1)
+	assert.Equal(t, "pipe", pipe[0].Type)
+	assert.Equal(t, "2", pipe[0].Output)
+
+	children := run.Children(pipe[0].ID)
+	require.Len(t, children, 2)
+	assert.Equal(t, float64(1), children[0].Input)
+	assert.Equal(t, float64(2), children[1].Input)
+}
@@ -4,13 +4,16 @@ import (
 	"bytes"
 	"context"
 	"github.com/wesen/geppetto/pkg/helpers"
+	"github.com/wesen/geppetto/pkg/recorder"
 	"text/template"
 )
 
 type TemplateStep[A any] struct {
 	output   chan helpers.Result[string]
 	template string
-	state    TemplateStepState
+	// base contains the partials that can be used by template, and can be nil
+	base  *template.Template
+	state TemplateStepState
 }
 
 type TemplateStepState int
@@ -30,20 +33,44 @@ func NewTemplateStep[A any](template string) *TemplateStep[A] {
 	}
 }
 
-func (t *TemplateStep[A]) Run(ctx context.Context, a A) error {
-	tmpl, err := template.New("template").Parse(t.template)
+// NewTemplateStepWithBase creates a TemplateStep whose template can use the templates defined in base,
+// for example partials loaded from files. base is cloned and never executed.
+func NewTemplateStepWithBase[A any](base *template.Template, template string) *TemplateStep[A] {
+	return &TemplateStep[A]{
+		output:   make(chan helpers.Result[string]),
+		template: template,
+		base:     base,
+		state:    TemplateStepNotStarted,
+	}
+}
+
+func (t *TemplateStep[A]) parse() (*template.Template, error) {
+	if t.base == nil {
+		return template.New("template").Funcs(helpers.TemplateFuncs).Parse(t.template)
+	}
+	tmpl, err := t.base.Clone()
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return tmpl.Funcs(helpers.TemplateFuncs).New("template").Parse(t.template)
+}
 
+func (t *TemplateStep[A]) Run(ctx context.Context, a A) error {
 	t.state = TemplateStepRunning
 	defer func() {
 		t.state = TemplateStepClosed
 		close(t.output)
 	}()
 
+	_, rec := recorder.StartStep(ctx, "template", a)
+	rec.SetMetadata("template", t.template)
+
 	buf := &bytes.Buffer{}
-	err = tmpl.Execute(buf, a)
+	tmpl, err := t.parse()
+	if err == nil {
+		err = tmpl.Execute(buf, a)
+	}
+	rec.Finish(buf.String(), err)
 
 	t.state = TemplateStepFinished
 	t.output <- helpers.NewResult(buf.String(), err)
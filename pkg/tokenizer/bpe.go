@@ -0,0 +1,179 @@
+package tokenizer
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"github.com/dlclark/regexp2"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// BPE is a byte-level byte pair encoding tokenizer, compatible with the encodings used by OpenAI.
+type BPE struct {
+	name    string
+	ranks   map[string]int
+	decoder map[int]string
+	pattern *regexp2.Regexp
+}
+
+// NewBPE creates a tokenizer from the merge ranks of the byte sequences and the regular expression
+// used to split the text into words before merging. All single bytes need to have a rank.
+func NewBPE(name string, ranks map[string]int, pattern string) (*BPE, error) {
+	re, err := regexp2.Compile(pattern, regexp2.None)
+	if err != nil {
+		return nil, err
+	}
+
+	for b := 0; b < 256; b++ {
+		if _, ok := ranks[string([]byte{byte(b)})]; !ok {
+			return nil, fmt.Errorf("vocabulary %s has no token for byte %d", name, b)
+		}
+	}
+
+	decoder := make(map[int]string, len(ranks))
+	for token, rank := range ranks {
+		decoder[rank] = token
+	}
+
+	return &BPE{
+		name:    name,
+		ranks:   ranks,
+		decoder: decoder,
+		pattern: re,
+	}, nil
+}
+
+// LoadTiktokenRanks reads a vocabulary in the tiktoken format, one base64 encoded token
+// and its rank per line.
+func LoadTiktokenRanks(r io.Reader) (map[string]int, error) {
+	ret := map[string]int{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid vocabulary line %q", line)
+		}
+		token, err := base64.StdEncoding.DecodeString(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid vocabulary token %q: %w", fields[0], err)
+		}
+		rank, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid vocabulary rank %q: %w", fields[1], err)
+		}
+		ret[string(token)] = rank
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (b *BPE) Name() string {
+	return b.name
+}
+
+// splitWords splits text using the pattern of the encoding.
+func splitWords(re *regexp2.Regexp, text string) []string {
+	var ret []string
+	m, _ := re.FindStringMatch(text)
+	for m != nil {
+		ret = append(ret, m.String())
+		m, _ = re.FindNextMatch(m)
+	}
+	return ret
+}
+
+// encodeWord merges the bytes of word, always merging the pair with the lowest rank first.
+func (b *BPE) encodeWord(word string) []int {
+	if rank, ok := b.ranks[word]; ok {
+		return []int{rank}
+	}
+
+	parts := make([]string, 0, len(word))
+	for i := 0; i < len(word); i++ {
+		parts = append(parts, word[i:i+1])
+	}
+
+	for len(parts) > 1 {
+		minRank, minIdx := -1, -1
+		for i := 0; i < len(parts)-1; i++ {
+			rank, ok := b.ranks[parts[i]+parts[i+1]]
+			if ok && (minRank < 0 || rank < minRank) {
+				minRank, minIdx = rank, i
+			}
+		}
+		if minIdx < 0 {
+			break
+		}
+		parts[minIdx] = parts[minIdx] + parts[minIdx+1]
+		parts = append(parts[:minIdx+1], parts[minIdx+2:]...)
+	}
+
+	ret := make([]int, 0, len(parts))
+	for _, part := range parts {
+		ret = append(ret, b.ranks[part])
+	}
+	return ret
+}
+
+// Encode returns the tokens of text. Special tokens such as <|endoftext|> are encoded as normal text.
+func (b *BPE) Encode(text string) []int {
+	var ret []int
+	for _, word := range splitWords(b.pattern, text) {
+		ret = append(ret, b.encodeWord(word)...)
+	}
+	return ret
+}
+
+// Decode returns the text of tokens. Unknown tokens are skipped.
+func (b *BPE) Decode(tokens []int) string {
+	sb := strings.Builder{}
+	for _, token := range tokens {
+		sb.WriteString(b.decoder[token])
+	}
+	return sb.String()
+}
+
+func (b *BPE) Count(text string) int {
+	return len(b.Encode(text))
+}
+
+func (b *BPE) TrimStart(text string, maxTokens int) string {
+	tokens := b.Encode(text)
+	if len(tokens) <= maxTokens {
+		return text
+	}
+	if maxTokens <= 0 {
+		return ""
+	}
+	ret := b.Decode(tokens[len(tokens)-maxTokens:])
+	// don't start in the middle of a multi-byte character
+	for len(ret) > 0 && !utf8.RuneStart(ret[0]) {
+		ret = ret[1:]
+	}
+	return ret
+}
+
+func (b *BPE) TrimEnd(text string, maxTokens int) string {
+	tokens := b.Encode(text)
+	if len(tokens) <= maxTokens {
+		return text
+	}
+	if maxTokens <= 0 {
+		return ""
+	}
+	ret := b.Decode(tokens[:maxTokens])
+	// don't end in the middle of a multi-byte character
+	for len(ret) > 0 && !utf8.ValidString(ret) {
+		ret = ret[:len(ret)-1]
+	}
+	return ret
+}
@@ -0,0 +1,81 @@
+//go:build ignore
+
+// fetch_vocab downloads the tiktoken vocabularies into the vocab directory, from which they
+// are embedded into the binary. Vocabularies that are already present are not downloaded again.
+//
+// Run it with go generate ./pkg/tokenizer/
+package main
+
+import (
+	"fmt"
+	"github.com/wesen/geppetto/pkg/tokenizer"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+const vocabURL = "https://openaipublic.blob.core.windows.net/encodings/%s.tiktoken"
+
+func fetch(name string) error {
+	path := filepath.Join("vocab", name+".tiktoken")
+	if _, err := os.Stat(path); err == nil {
+		fmt.Printf("%s already exists\n", path)
+		return nil
+	}
+
+	url := fmt.Sprintf(vocabURL, name)
+	resp, err := http.Get(url)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("could not download %s: %s", url, resp.Status)
+	}
+
+	f, err := os.CreateTemp("vocab", name+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.Remove(f.Name())
+	}()
+	_, err = io.Copy(f, resp.Body)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err == nil {
+		// make sure the file is a complete vocabulary before embedding it
+		_, err = tokenizer.LoadTiktokenRanks(f)
+	}
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("invalid vocabulary %s: %w", url, err)
+	}
+
+	err = os.Rename(f.Name(), path)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("downloaded %s\n", path)
+	return nil
+}
+
+func main() {
+	for _, name := range []string{
+		tokenizer.EncodingR50kBase,
+		tokenizer.EncodingP50kBase,
+		tokenizer.EncodingCL100kBase,
+	} {
+		if err := fetch(name); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package tokenizer
+
+import (
+	"embed"
+	"fmt"
+	"github.com/dlclark/regexp2"
+	"github.com/rs/zerolog/log"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Tokenizer counts the tokens of a text the way a model does.
+type Tokenizer interface {
+	// Name returns the name of the encoding
+	Name() string
+	Count(text string) int
+	// TrimStart removes text from the start so that the rest fits in maxTokens tokens.
+	TrimStart(text string, maxTokens int) string
+	// TrimEnd removes text from the end so that the rest fits in maxTokens tokens.
+	TrimEnd(text string, maxTokens int) string
+}
+
+const (
+	EncodingR50kBase   = "r50k_base"
+	EncodingP50kBase   = "p50k_base"
+	EncodingCL100kBase = "cl100k_base"
+)
+
+const gpt2Pattern = `'s|'t|'re|'ve|'m|'ll|'d| ?\p{L}+| ?\p{N}+| ?[^\s\p{L}\p{N}]+|\s+(?!\S)|\s+`
+
+const cl100kPattern = `(?i:'s|'t|'re|'ve|'m|'ll|'d)|[^\r\n\p{L}\p{N}]?\p{L}+|\p{N}{1,3}| ?[^\s\p{L}\p{N}]+[\r\n]*|\s*[\r\n]+|\s+(?!\S)|\s+`
+
+var encodingPatterns = map[string]string{
+	EncodingR50kBase:   gpt2Pattern,
+	EncodingP50kBase:   gpt2Pattern,
+	EncodingCL100kBase: cl100kPattern,
+}
+
+var modelEncodings = map[string]string{
+	"gpt-4":                  EncodingCL100kBase,
+	"gpt-3.5-turbo":          EncodingCL100kBase,
+	"text-embedding-ada-002": EncodingCL100kBase,
+	"text-davinci-003":       EncodingP50kBase,
+	"text-davinci-002":       EncodingP50kBase,
+	"text-davinci-edit-001":  EncodingP50kBase,
+	"code-davinci-002":       EncodingP50kBase,
+	"code-davinci-001":       EncodingP50kBase,
+	"code-cushman-002":       EncodingP50kBase,
+	"code-cushman-001":       EncodingP50kBase,
+	"code-davinci-edit-001":  EncodingP50kBase,
+	"text-davinci-001":       EncodingR50kBase,
+	"text-curie-001":         EncodingR50kBase,
+	"text-babbage-001":       EncodingR50kBase,
+	"text-ada-001":           EncodingR50kBase,
+	"davinci":                EncodingR50kBase,
+	"curie":                  EncodingR50kBase,
+	"babbage":                EncodingR50kBase,
+	"ada":                    EncodingR50kBase,
+}
+
+// EncodingForModel returns the name of the encoding used by model, defaulting to cl100k_base
+// for unknown models (which includes the versioned gpt-3.5-turbo and gpt-4 models).
+func EncodingForModel(model string) string {
+	if encoding, ok := modelEncodings[model]; ok {
+		return encoding
+	}
+	return EncodingCL100kBase
+}
+
+// The vocabularies are downloaded into the vocab directory by go generate, see fetch_vocab.go.
+//
+//go:generate go run fetch_vocab.go
+//go:embed vocab
+var vocabFS embed.FS
+
+var encodingsMutex sync.Mutex
+var encodings = map[string]*BPE{}
+
+// vocabDirectories returns the directories searched for vocabulary files, after the embedded ones.
+func vocabDirectories() []string {
+	var ret []string
+	if dir := os.Getenv("GEPPETTO_TOKENIZERS_DIR"); dir != "" {
+		ret = append(ret, dir)
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		ret = append(ret, filepath.Join(home, ".pinocchio", "tokenizers"))
+	}
+	return ret
+}
+
+func openVocab(name string) (io.ReadCloser, error) {
+	fileName := name + ".tiktoken"
+	if f, err := vocabFS.Open("vocab/" + fileName); err == nil {
+		return f, nil
+	}
+	for _, dir := range vocabDirectories() {
+		if f, err := os.Open(filepath.Join(dir, fileName)); err == nil {
+			return f, nil
+		}
+	}
+	return nil, fmt.Errorf("no vocabulary found for encoding %s", name)
+}
+
+// GetEncoding returns the BPE tokenizer for the encoding, loading its vocabulary the first time.
+func GetEncoding(name string) (*BPE, error) {
+	encodingsMutex.Lock()
+	defer encodingsMutex.Unlock()
+
+	if bpe, ok := encodings[name]; ok {
+		return bpe, nil
+	}
+
+	pattern, ok := encodingPatterns[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown encoding %s", name)
+	}
+
+	f, err := openVocab(name)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	ranks, err := LoadTiktokenRanks(f)
+	if err != nil {
+		return nil, err
+	}
+	bpe, err := NewBPE(name, ranks, pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	encodings[name] = bpe
+	return bpe, nil
+}
+
+// ForEncoding returns the BPE tokenizer of the encoding if its vocabulary is available,
+// and an approximation otherwise.
+func ForEncoding(name string) Tokenizer {
+	bpe, err := GetEncoding(name)
+	if err != nil {
+		log.Debug().Err(err).Str("encoding", name).Msg("using approximate token counts")
+		return NewApproximateTokenizer(name)
+	}
+	return bpe
+}
+
+// ForModel returns the tokenizer of model, see ForEncoding.
+func ForModel(model string) Tokenizer {
+	return ForEncoding(EncodingForModel(model))
+}
+
+// ApproximateTokenizer estimates token counts without a vocabulary, by splitting the text
+// into words like the BPE encodings do, and counting one token per 4 bytes of each word.
+type ApproximateTokenizer struct {
+	name    string
+	pattern *regexp2.Regexp
+}
+
+func NewApproximateTokenizer(encoding string) *ApproximateTokenizer {
+	pattern, ok := encodingPatterns[encoding]
+	if !ok {
+		pattern = gpt2Pattern
+	}
+	return &ApproximateTokenizer{
+		name:    encoding + " (approximate)",
+		pattern: regexp2.MustCompile(pattern, regexp2.None),
+	}
+}
+
+func (a *ApproximateTokenizer) Name() string {
+	return a.name
+}
+
+func wordTokens(word string) int {
+	return (len(word) + 3) / 4
+}
+
+func (a *ApproximateTokenizer) Count(text string) int {
+	ret := 0
+	for _, word := range splitWords(a.pattern, text) {
+		ret += wordTokens(word)
+	}
+	return ret
+}
+
+func (a *ApproximateTokenizer) TrimStart(text string, maxTokens int) string {
+	words := splitWords(a.pattern, text)
+	count := 0
+	for i := len(words) - 1; i >= 0; i-- {
+		count += wordTokens(words[i])
+		if count > maxTokens {
+			return strings.Join(words[i+1:], "")
+		}
+	}
+	return text
+}
+
+func (a *ApproximateTokenizer) TrimEnd(text string, maxTokens int) string {
+	words := splitWords(a.pattern, text)
+	count := 0
+	for i, word := range words {
+		count += wordTokens(word)
+		if count > maxTokens {
+			return strings.Join(words[:i], "")
+		}
+	}
+	return text
+}
@@ -0,0 +1,143 @@
+package tokenizer
+
+import (
+	"encoding/base64"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestRanks() map[string]int {
+	ranks := map[string]int{}
+	for b := 0; b < 256; b++ {
+		ranks[string([]byte{byte(b)})] = b
+	}
+	ranks["th"] = 256
+	ranks["the"] = 257
+	ranks[" the"] = 258
+	ranks["at"] = 259
+	return ranks
+}
+
+func TestBPEEncode(t *testing.T) {
+	bpe, err := NewBPE("test", newTestRanks(), gpt2Pattern)
+	require.Nil(t, err)
+
+	assert.Equal(t, []int{257, 32, 99, 259}, bpe.Encode("the cat"))
+	assert.Equal(t, []int{256, 259, 258}, bpe.Encode("that the"))
+	assert.Equal(t, "that the", bpe.Decode(bpe.Encode("that the")))
+	assert.Equal(t, 3, bpe.Count("that the"))
+
+	text := "héllo wörld, the cat"
+	assert.Equal(t, text, bpe.Decode(bpe.Encode(text)))
+}
+
+func TestBPETrimStart(t *testing.T) {
+	bpe, err := NewBPE("test", newTestRanks(), gpt2Pattern)
+	require.Nil(t, err)
+
+	assert.Equal(t, "the cat", bpe.TrimStart("the cat", 10))
+	assert.Equal(t, " cat", bpe.TrimStart("the cat", 3))
+	assert.Equal(t, "", bpe.TrimStart("the cat", 0))
+}
+
+func TestBPETrimEnd(t *testing.T) {
+	bpe, err := NewBPE("test", newTestRanks(), gpt2Pattern)
+	require.Nil(t, err)
+
+	assert.Equal(t, "the cat", bpe.TrimEnd("the cat", 10))
+	assert.Equal(t, "the ", bpe.TrimEnd("the cat", 2))
+	assert.Equal(t, "", bpe.TrimEnd("the cat", 0))
+}
+
+func TestBPEMissingBytes(t *testing.T) {
+	_, err := NewBPE("test", map[string]int{"a": 0}, gpt2Pattern)
+	assert.Error(t, err)
+}
+
+func TestGetEncodingFromDirectory(t *testing.T) {
+	dir := t.TempDir()
+	lines := []string{}
+	for token, rank := range newTestRanks() {
+		lines = append(lines, fmt.Sprintf("%s %d", base64.StdEncoding.EncodeToString([]byte(token)), rank))
+	}
+	err := os.WriteFile(filepath.Join(dir, "p50k_base.tiktoken"), []byte(strings.Join(lines, "\n")), 0644)
+	require.Nil(t, err)
+	t.Setenv("GEPPETTO_TOKENIZERS_DIR", dir)
+
+	tokenizer := ForModel("text-davinci-003")
+	assert.Equal(t, "p50k_base", tokenizer.Name())
+	assert.Equal(t, 4, tokenizer.Count("the cat"))
+}
+
+func TestApproximateTokenizer(t *testing.T) {
+	t.Setenv("GEPPETTO_TOKENIZERS_DIR", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+
+	tokenizer := ForEncoding(EncodingR50kBase)
+	assert.Equal(t, "r50k_base (approximate)", tokenizer.Name())
+	// " tokenization" is 13 bytes long
+	assert.Equal(t, 1+4, tokenizer.Count("the tokenization"))
+	assert.Equal(t, " tokenization", tokenizer.TrimStart("the tokenization", 4))
+	assert.Equal(t, "the", tokenizer.TrimEnd("the tokenization", 4))
+}
+
+func TestEncodingForModel(t *testing.T) {
+	assert.Equal(t, EncodingP50kBase, EncodingForModel("text-davinci-003"))
+	assert.Equal(t, EncodingR50kBase, EncodingForModel("text-curie-001"))
+	assert.Equal(t, EncodingCL100kBase, EncodingForModel("gpt-3.5-turbo"))
+	assert.Equal(t, EncodingCL100kBase, EncodingForModel("some-local-model"))
+}
+
+// loadVocabulary loads the real vocabulary of the encoding, bypassing the cache of GetEncoding
+// that other tests fill with test vocabularies.
+func loadVocabulary(t *testing.T, name string) *BPE {
+	f, err := openVocab(name)
+	if err != nil {
+		t.Skipf("%s, run go generate ./pkg/tokenizer/ to download the vocabularies", err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	ranks, err := LoadTiktokenRanks(f)
+	require.Nil(t, err)
+	bpe, err := NewBPE(name, ranks, encodingPatterns[name])
+	require.Nil(t, err)
+	return bpe
+}
+
+// The expected tokens are the output of tiktoken for the same encodings.
+func TestTiktokenEncodings(t *testing.T) {
+	testCases := []struct {
+		encoding string
+		text     string
+		tokens   []int
+		count    int
+	}{
+		{encoding: EncodingR50kBase, text: "hello world", tokens: []int{31373, 995}},
+		{encoding: EncodingP50kBase, text: "hello world", tokens: []int{31373, 995}},
+		{encoding: EncodingCL100kBase, text: "hello world", tokens: []int{15339, 1917}},
+		{encoding: EncodingCL100kBase, text: "tiktoken is great!", tokens: []int{83, 1609, 5963, 374, 2294, 0}},
+		{encoding: EncodingR50kBase, text: "antidisestablishmentarianism", count: 5},
+		{encoding: EncodingP50kBase, text: "antidisestablishmentarianism", count: 5},
+		{encoding: EncodingCL100kBase, text: "antidisestablishmentarianism", count: 6},
+		{encoding: EncodingR50kBase, text: "2 + 2 = 4", count: 5},
+		{encoding: EncodingCL100kBase, text: "2 + 2 = 4", count: 7},
+	}
+
+	for _, tc := range testCases {
+		bpe := loadVocabulary(t, tc.encoding)
+		if tc.tokens != nil {
+			assert.Equal(t, tc.tokens, bpe.Encode(tc.text), "%s: %q", tc.encoding, tc.text)
+			assert.Equal(t, tc.text, bpe.Decode(tc.tokens))
+			assert.Equal(t, len(tc.tokens), bpe.Count(tc.text))
+		} else {
+			assert.Equal(t, tc.count, bpe.Count(tc.text), "%s: %q", tc.encoding, tc.text)
+		}
+	}
+}
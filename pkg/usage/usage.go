@@ -0,0 +1,231 @@
+package usage
+
+import (
+	"fmt"
+	"github.com/wesen/geppetto/pkg/helpers"
+	"github.com/wesen/geppetto/pkg/models"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Usage is the number of tokens used by a single request.
+type Usage struct {
+	Model            string
+	PromptTokens     int
+	CompletionTokens int
+	// Estimated is true when the API didn't return the usage (streaming) and the
+	// tokens were counted locally.
+	Estimated bool
+}
+
+func (u Usage) TotalTokens() int {
+	return u.PromptTokens + u.CompletionTokens
+}
+
+// Cost returns the price of the request in dollars, and false if the price of the model is unknown.
+func (u Usage) Cost() (float64, bool) {
+	family, ok := priceFamily(u.Model)
+	if !ok {
+		return 0, false
+	}
+	completionPrice := family.PricePer1kTokens
+	if family.CompletionPricePer1kTokens != 0 {
+		completionPrice = family.CompletionPricePer1kTokens
+	}
+	return (float64(u.PromptTokens)*family.PricePer1kTokens + float64(u.CompletionTokens)*completionPrice) / 1000, true
+}
+
+// PricePer1kTokens returns the price of the family of model from models.json.
+// Base models such as davinci are looked up as families directly.
+func PricePer1kTokens(model string) (float64, bool) {
+	family, ok := priceFamily(model)
+	if !ok {
+		return 0, false
+	}
+	return family.PricePer1kTokens, true
+}
+
+func priceFamily(model string) (*models.Family, bool) {
+	m, err := models.Load()
+	if err != nil {
+		return nil, false
+	}
+	familyName := model
+	if completion := m.GetCompletion(model); completion != nil {
+		familyName = completion.Family
+	}
+	family := m.GetFamily(familyName)
+	if family == nil {
+		return nil, false
+	}
+	return family, true
+}
+
+// Total aggregates the usage of a model over several requests.
+type Total struct {
+	Model            string  `yaml:"-"`
+	Requests         int     `yaml:"requests"`
+	PromptTokens     int     `yaml:"prompt_tokens"`
+	CompletionTokens int     `yaml:"completion_tokens"`
+	Cost             float64 `yaml:"cost"`
+	// Estimated is true if some of the token counts were estimated
+	Estimated bool `yaml:"estimated,omitempty"`
+	// UnknownPrice is true if the price of the model is unknown, and Cost is 0
+	UnknownPrice bool `yaml:"unknown_price,omitempty"`
+}
+
+func (t *Total) TotalTokens() int {
+	return t.PromptTokens + t.CompletionTokens
+}
+
+func (t *Total) Add(other *Total) {
+	t.Requests += other.Requests
+	t.PromptTokens += other.PromptTokens
+	t.CompletionTokens += other.CompletionTokens
+	t.Cost += other.Cost
+	t.Estimated = t.Estimated || other.Estimated
+	t.UnknownPrice = t.UnknownPrice || other.UnknownPrice
+}
+
+// Tracker collects the usage of all the requests done during a command run.
+// It is shared by the clones of the step settings, and a nil Tracker ignores all usage.
+type Tracker struct {
+	mutex  sync.Mutex
+	usages []Usage
+}
+
+func NewTracker() *Tracker {
+	return &Tracker{}
+}
+
+func (t *Tracker) Add(u Usage) {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.usages = append(t.usages, u)
+}
+
+func (t *Tracker) Usages() []Usage {
+	if t == nil {
+		return nil
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	ret := make([]Usage, len(t.usages))
+	copy(ret, t.usages)
+	return ret
+}
+
+// Totals returns the aggregated usage per model, sorted by model name.
+func (t *Tracker) Totals() []*Total {
+	totals := map[string]*Total{}
+	for _, u := range t.Usages() {
+		total, ok := totals[u.Model]
+		if !ok {
+			total = &Total{Model: u.Model}
+			totals[u.Model] = total
+		}
+		cost, known := u.Cost()
+		total.Add(&Total{
+			Requests:         1,
+			PromptTokens:     u.PromptTokens,
+			CompletionTokens: u.CompletionTokens,
+			Cost:             cost,
+			Estimated:        u.Estimated,
+			UnknownPrice:     !known,
+		})
+	}
+	return sortTotals(totals)
+}
+
+func sortTotals(totals map[string]*Total) []*Total {
+	ret := make([]*Total, 0, len(totals))
+	for model, total := range totals {
+		total.Model = model
+		ret = append(ret, total)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Model < ret[j].Model
+	})
+	return ret
+}
+
+// DefaultDailyTotalsPath returns $XDG_DATA_HOME/pinocchio/usage.yaml
+func DefaultDailyTotalsPath() (string, error) {
+	return helpers.DataDirectory("usage.yaml")
+}
+
+// dailyTotalsFile maps days (2006-01-02) to the totals per model
+type dailyTotalsFile map[string]map[string]*Total
+
+func loadDailyTotals(path string) (dailyTotalsFile, error) {
+	ret := dailyTotalsFile{}
+	s, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ret, nil
+		}
+		return nil, err
+	}
+	err = yaml.Unmarshal(s, &ret)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse %s: %w", path, err)
+	}
+	if ret == nil {
+		ret = dailyTotalsFile{}
+	}
+	return ret, nil
+}
+
+// AddToDailyTotals adds totals to the running totals of day stored in the file at path,
+// and returns the updated totals of that day.
+//
+// The file is locked while it is updated, and replaced atomically, so that concurrent runs
+// don't lose each other's usage.
+func AddToDailyTotals(path string, day string, totals []*Total) ([]*Total, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, err
+	}
+	unlock, err := helpers.LockFile(path, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	file, err := loadDailyTotals(path)
+	if err != nil {
+		return nil, err
+	}
+
+	dayTotals, ok := file[day]
+	if !ok || dayTotals == nil {
+		dayTotals = map[string]*Total{}
+		file[day] = dayTotals
+	}
+	for _, total := range totals {
+		dayTotal, ok := dayTotals[total.Model]
+		if !ok {
+			dayTotal = &Total{}
+			dayTotals[total.Model] = dayTotal
+		}
+		dayTotal.Add(total)
+	}
+
+	s, err := yaml.Marshal(file)
+	if err != nil {
+		return nil, err
+	}
+	err = helpers.WriteFileAtomic(path, s, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return sortTotals(dayTotals), nil
+}
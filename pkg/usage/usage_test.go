@@ -0,0 +1,113 @@
+package usage
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestUsageCost(t *testing.T) {
+	cost, ok := Usage{Model: "text-davinci-003", PromptTokens: 400, CompletionTokens: 100}.Cost()
+	require.True(t, ok)
+	assert.InDelta(t, 0.01, cost, 1e-9)
+
+	cost, ok = Usage{Model: "curie", PromptTokens: 1000}.Cost()
+	require.True(t, ok)
+	assert.InDelta(t, 0.002, cost, 1e-9)
+
+	cost, ok = Usage{Model: "gpt-3.5-turbo", PromptTokens: 500, CompletionTokens: 500}.Cost()
+	require.True(t, ok)
+	assert.InDelta(t, 0.002, cost, 1e-9)
+
+	// the completion tokens of gpt-4 are more expensive than the prompt tokens
+	cost, ok = Usage{Model: "gpt-4", PromptTokens: 1000, CompletionTokens: 1000}.Cost()
+	require.True(t, ok)
+	assert.InDelta(t, 0.09, cost, 1e-9)
+
+	_, ok = Usage{Model: "some-local-model", PromptTokens: 1000}.Cost()
+	assert.False(t, ok)
+}
+
+func TestTrackerTotals(t *testing.T) {
+	tracker := NewTracker()
+	tracker.Add(Usage{Model: "text-davinci-003", PromptTokens: 10, CompletionTokens: 20})
+	tracker.Add(Usage{Model: "text-davinci-003", PromptTokens: 5, CompletionTokens: 5, Estimated: true})
+	tracker.Add(Usage{Model: "local", PromptTokens: 1, CompletionTokens: 1})
+
+	totals := tracker.Totals()
+	require.Len(t, totals, 2)
+	assert.Equal(t, "local", totals[0].Model)
+	assert.True(t, totals[0].UnknownPrice)
+	assert.Equal(t, "text-davinci-003", totals[1].Model)
+	assert.Equal(t, 2, totals[1].Requests)
+	assert.Equal(t, 40, totals[1].TotalTokens())
+	assert.True(t, totals[1].Estimated)
+	assert.InDelta(t, 0.0008, totals[1].Cost, 1e-9)
+
+	var nilTracker *Tracker
+	nilTracker.Add(Usage{Model: "local"})
+	assert.Len(t, nilTracker.Totals(), 0)
+}
+
+func TestAddToDailyTotals(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.yaml")
+
+	totals, err := AddToDailyTotals(path, "2023-03-01", []*Total{
+		{Model: "text-davinci-003", Requests: 1, PromptTokens: 10, CompletionTokens: 10, Cost: 0.0004},
+	})
+	require.Nil(t, err)
+	require.Len(t, totals, 1)
+
+	totals, err = AddToDailyTotals(path, "2023-03-01", []*Total{
+		{Model: "text-davinci-003", Requests: 2, PromptTokens: 5, CompletionTokens: 5, Cost: 0.0002},
+		{Model: "curie", Requests: 1, PromptTokens: 1, CompletionTokens: 1, Cost: 0.000004},
+	})
+	require.Nil(t, err)
+	require.Len(t, totals, 2)
+	assert.Equal(t, "curie", totals[0].Model)
+	assert.Equal(t, 3, totals[1].Requests)
+	assert.Equal(t, 30, totals[1].TotalTokens())
+	assert.InDelta(t, 0.0006, totals[1].Cost, 1e-9)
+
+	totals, err = AddToDailyTotals(path, "2023-03-02", []*Total{
+		{Model: "curie", Requests: 1, PromptTokens: 1, CompletionTokens: 1},
+	})
+	require.Nil(t, err)
+	require.Len(t, totals, 1)
+	assert.Equal(t, 1, totals[0].Requests)
+}
+
+func TestAddToDailyTotalsConcurrently(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pinocchio", "usage.yaml")
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := AddToDailyTotals(path, "2023-03-01", []*Total{
+				{Model: "curie", Requests: 1, PromptTokens: 1},
+			})
+			assert.Nil(t, err)
+		}()
+	}
+	wg.Wait()
+
+	totals, err := AddToDailyTotals(path, "2023-03-01", nil)
+	require.Nil(t, err)
+	require.Len(t, totals, 1)
+	assert.Equal(t, 10, totals[0].Requests)
+
+	_, err = os.Stat(path + ".lock")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestDefaultDailyTotalsPath(t *testing.T) {
+	t.Setenv("XDG_DATA_HOME", "/data")
+	path, err := DefaultDailyTotalsPath()
+	require.Nil(t, err)
+	assert.Equal(t, "/data/pinocchio/usage.yaml", path)
+}